@@ -57,6 +57,10 @@ func Assemble(instr []Instr) ([]byte, error) {
 			leb128.WriteVarUint32(body, ins.Immediates[1].(uint32))
 		case ops.CurrentMemory, ops.GrowMemory:
 			leb128.WriteVarUint32(body, uint32(ins.Immediates[0].(uint8)))
+		case ops.WagonNativeExec:
+			var b [ops.WagonNativeExecImmediateSize]byte
+			binary.LittleEndian.PutUint32(b[:], ins.Immediates[0].(uint32))
+			body.Write(b[:])
 		}
 	}
 	return body.Bytes(), nil
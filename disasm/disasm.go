@@ -371,6 +371,18 @@ func NewDisassembly(fn wasm.Function, module *wasm.Module) (*Disassembly, error)
 
 // Disassemble disassembles a given function body into a set of instructions. It won't check operations for validity.
 func Disassemble(code []byte) ([]Instr, error) {
+	return disassemble(code, false)
+}
+
+// DisassemblePatched is like Disassemble, but also accepts wagon's internal
+// opcodes, such as the wagon.nativeExec instructions patched into function
+// bodies which have been compiled to native code. The immediate of a
+// wagon.nativeExec instruction is its 4-byte native block index.
+func DisassemblePatched(code []byte) ([]Instr, error) {
+	return disassemble(code, true)
+}
+
+func disassemble(code []byte, internal bool) ([]Instr, error) {
 	reader := bytes.NewReader(code)
 	var out []Instr
 	for {
@@ -382,6 +394,9 @@ func Disassemble(code []byte) ([]Instr, error) {
 		}
 
 		opStr, err := ops.New(op)
+		if err != nil && internal {
+			opStr, err = ops.NewInternal(op)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -466,6 +481,12 @@ func Disassemble(code []byte) ([]Instr, error) {
 			}
 			i := binary.LittleEndian.Uint64(b[:])
 			instr.Immediates = append(instr.Immediates, math.Float64frombits(i))
+		case ops.WagonNativeExec:
+			var b [ops.WagonNativeExecImmediateSize]byte
+			if _, err := io.ReadFull(reader, b[:]); err != nil {
+				return nil, err
+			}
+			instr.Immediates = append(instr.Immediates, binary.LittleEndian.Uint32(b[:]))
 		case ops.I32Load, ops.I64Load, ops.F32Load, ops.F64Load, ops.I32Load8s, ops.I32Load8u, ops.I32Load16s, ops.I32Load16u, ops.I64Load8s, ops.I64Load8u, ops.I64Load16s, ops.I64Load16u, ops.I64Load32s, ops.I64Load32u, ops.I32Store, ops.I64Store, ops.F32Store, ops.F64Store, ops.I32Store8, ops.I32Store16, ops.I64Store8, ops.I64Store16, ops.I64Store32:
 			// read memory_immediate
 			flags, err := leb128.ReadVarUint32(reader)
@@ -12,6 +12,7 @@ import (
 
 	"github.com/go-interpreter/wagon/disasm"
 	"github.com/go-interpreter/wagon/wasm"
+	ops "github.com/go-interpreter/wagon/wasm/operators"
 )
 
 func TestDisassemble(t *testing.T) {
@@ -43,3 +44,46 @@ func TestDisassemble(t *testing.T) {
 		}
 	}
 }
+
+func TestDisassemblePatched(t *testing.T) {
+	code := []byte{
+		ops.WagonNativeExec, 2, 1, 0, 0,
+		ops.Unreachable,
+		ops.GetLocal, 1,
+	}
+	if _, err := disasm.Disassemble(code); err == nil {
+		t.Fatal("Disassemble accepted an internal opcode")
+	}
+
+	instrs, err := disasm.DisassemblePatched(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instrs) != 3 {
+		t.Fatalf("got %d instructions, want 3: %v", len(instrs), instrs)
+	}
+	if got := instrs[0].Op.Code; got != ops.WagonNativeExec {
+		t.Fatalf("instrs[0].Op = %#x, want %#x", got, ops.WagonNativeExec)
+	}
+	if got := instrs[0].Immediates; len(got) != 1 || got[0] != uint32(0x102) {
+		t.Fatalf("instrs[0].Immediates = %v, want [258]", got)
+	}
+	if got := instrs[1].Op.Code; got != ops.Unreachable {
+		t.Fatalf("instrs[1].Op = %#x, want unreachable", got)
+	}
+	if got := instrs[2].Op.Code; got != ops.GetLocal || instrs[2].Immediates[0] != uint32(1) {
+		t.Fatalf("instrs[2] = %v, want get_local 1", instrs[2])
+	}
+
+	out, err := disasm.Assemble(instrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, code) {
+		t.Fatalf("Assemble = %x, want %x", out, code)
+	}
+
+	if _, err := disasm.DisassemblePatched(code[:3]); err == nil {
+		t.Fatal("DisassemblePatched accepted a truncated immediate")
+	}
+}
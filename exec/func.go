@@ -26,13 +26,25 @@ type compiledFunction struct {
 	returns        bool // whether the function returns a value
 
 	asm []asmBlock
+	// reasons for the outcome of native compilation, see ExplainNative.
+	nativeNotes []string
 }
 
 type asmBlock struct {
 	// Compiled unit in native machine code.
 	nativeUnit compile.NativeCodeUnit
 	// where in the instruction stream to resume after native execution.
-	resumePC uint
+	resumePC int64
+	// the number of values the block may push beyond the stack height
+	// at its entry.
+	stackGrowth int
+	// the sequence of bytecode the block was compiled from.
+	candidate compile.CompilationCandidate
+	// the machine code of nativeUnit, kept for (*VM).WriteNativeCache.
+	machineCode []byte
+	// the bytecode replaced by the call into nativeUnit, restored by
+	// (*VM).invalidateFunction.
+	original []byte
 }
 
 type goFunction struct {
@@ -81,7 +93,9 @@ func (fn goFunction) call(vm *VM, index int64) {
 			vm.pushFloat64(out.Float())
 		case reflect.Uint32, reflect.Uint64:
 			vm.pushUint64(out.Uint())
-		case reflect.Int32, reflect.Int64:
+		case reflect.Int32:
+			vm.pushInt32(int32(out.Int()))
+		case reflect.Int64:
 			vm.pushInt64(out.Int())
 		default:
 			panic(fmt.Sprintf("exec: return value %d invalid kind=%v", i, kind))
@@ -90,6 +104,10 @@ func (fn goFunction) call(vm *VM, index int64) {
 }
 
 func (compiled compiledFunction) call(vm *VM, index int64) {
+	if vm.nativeLazy != nil {
+		vm.compileOnFirstCall(index)
+		compiled = vm.funcs[index].(compiledFunction)
+	}
 	newStack := make([]uint64, 0, compiled.maxDepth)
 	locals := make([]uint64, compiled.totalLocalVars)
 
@@ -2,36 +2,92 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !appengine
+// +build !appengine,!js
 
 package compile
 
 import (
+	"sync"
 	"unsafe"
 
 	mmap "github.com/edsrzf/mmap-go"
 )
 
 const (
-	minAllocSize = 1024
+	// minAllocSize is the smallest mapping made for normal pages. Code is
+	// packed into each mapping until it is full, so a module's native
+	// blocks take few mappings.
+	minAllocSize = 64 << 10
 	// alignment - instruction caching works better on aligned boundaries.
 	allocationAlignment = 128 - 1
+	// hugePageSize is the size of the huge pages requested by
+	// SetHugePages, which is the smallest huge page size on amd64.
+	hugePageSize = 2 << 20
 )
 
 type mmapBlock struct {
 	mem       mmap.MMap
 	consumed  uint32
 	remaining uint32
+	// huge is true if mem is backed by huge pages.
+	huge bool
 }
 
-// MMapAllocator copies instructions into executable memory.
+// MMapAllocator copies instructions into executable memory. It is safe
+// for concurrent use.
 type MMapAllocator struct {
+	mu     sync.Mutex
 	last   *mmapBlock
 	blocks []*mmapBlock
+
+	hugePages bool
+	prefault  bool
+}
+
+// SetHugePages sets whether instructions are placed in huge pages, which
+// can reduce iTLB pressure when a lot of code is compiled. Huge pages are
+// shared by many allocations. Where huge pages are not supported or not
+// available, normal pages are used instead.
+func (a *MMapAllocator) SetHugePages(v bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hugePages = v
+}
+
+// SetPrefault sets whether executable pages are populated as they are
+// allocated, so the first invocation of the code they contain does not
+// stall on page faults.
+func (a *MMapAllocator) SetPrefault(v bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.prefault = v
+}
+
+// ConsumedBytes returns the number of bytes of executable memory taken up
+// by the code allocated so far, including the padding which aligns each
+// allocation. Unused space at the end of each mapping is not counted.
+func (a *MMapAllocator) ConsumedBytes() uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var n uint64
+	for _, block := range a.blocks {
+		n += uint64(block.consumed)
+	}
+	return n
+}
+
+// MappedRegions returns the number of memory mappings made so far. Many
+// allocations share each mapping.
+func (a *MMapAllocator) MappedRegions() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.blocks)
 }
 
 // Close frees all pages allocted by the allocator.
 func (a *MMapAllocator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	for _, block := range a.blocks {
 		if err := block.mem.Unmap(); err != nil {
 			return err
@@ -42,26 +98,62 @@ func (a *MMapAllocator) Close() error {
 
 // AllocateExec allocates a block of executable memory with the given code contained.
 func (a *MMapAllocator) AllocateExec(asm []byte) (NativeCodeUnit, error) {
-	// TODO: Use free pages where possible.
-	alloc := minAllocSize
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	consumed := uint32(len(asm)+allocationAlignment) & ^uint32(allocationAlignment)
-	if int(consumed) > alloc { // not big enough? make minAlloc + aligned len
-		alloc += int(consumed)
+	if a.hugePages {
+		if unit, ok := a.allocateHuge(asm, consumed); ok {
+			return unit, nil
+		}
 	}
-	m, err := mmap.MapRegion(nil, alloc, mmap.EXEC|mmap.RDWR, mmap.ANON, int64(0))
-	if err != nil {
-		return nil, err
+	if a.last == nil || a.last.huge || a.last.remaining < consumed {
+		alloc := minAllocSize
+		if int(consumed) > alloc { // not big enough? make minAlloc + aligned len
+			alloc += int(consumed)
+		}
+		m, err := mapExec(alloc, a.prefault)
+		if err != nil {
+			return nil, err
+		}
+		a.last = &mmapBlock{
+			mem:       m,
+			remaining: uint32(alloc),
+		}
+		a.blocks = append(a.blocks, a.last)
 	}
-	a.last = &mmapBlock{
-		mem:       m,
-		consumed:  consumed,
-		remaining: uint32(alloc) - consumed,
+	return a.carve(asm, consumed), nil
+}
+
+// carve copies asm into the next consumed bytes of the block last
+// allocated, which must have room for them. a.mu must be held.
+func (a *MMapAllocator) carve(asm []byte, consumed uint32) NativeCodeUnit {
+	code := a.last.mem[a.last.consumed:]
+	a.last.consumed += consumed
+	a.last.remaining -= consumed
+	copy(code, asm)
+	return &asmBlock{
+		mem:  unsafe.Pointer(&code),
+		size: len(asm),
 	}
-	a.blocks = append(a.blocks, a.last)
-	copy(m, asm)
+}
 
-	out := asmBlock{
-		mem: unsafe.Pointer(&m),
+// allocateHuge copies asm into the huge page block last allocated, or
+// into a new one if it does not fit. ok is false if no huge pages could
+// be mapped. a.mu must be held.
+func (a *MMapAllocator) allocateHuge(asm []byte, consumed uint32) (unit NativeCodeUnit, ok bool) {
+	if a.last == nil || !a.last.huge || a.last.remaining < consumed {
+		size := (int(consumed) + hugePageSize - 1) &^ (hugePageSize - 1)
+		m, err := mapHugePages(size, a.prefault)
+		if err != nil {
+			return nil, false
+		}
+		a.last = &mmapBlock{
+			mem:       m,
+			remaining: uint32(size),
+			huge:      true,
+		}
+		a.blocks = append(a.blocks, a.last)
 	}
-	return &out, nil
+	return a.carve(asm, consumed), true
 }
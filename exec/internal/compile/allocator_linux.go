@@ -0,0 +1,46 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !appengine,!js
+
+package compile
+
+import (
+	mmap "github.com/edsrzf/mmap-go"
+	"golang.org/x/sys/unix"
+)
+
+// execMapFlags returns the mmap flags for an executable mapping. With
+// prefault, MAP_POPULATE has the kernel populate the pages up front.
+func execMapFlags(prefault bool) int {
+	flags := unix.MAP_PRIVATE | unix.MAP_ANON
+	if prefault {
+		flags |= unix.MAP_POPULATE
+	}
+	return flags
+}
+
+// mapExec maps size bytes of anonymous executable memory.
+func mapExec(size int, prefault bool) (mmap.MMap, error) {
+	if !prefault {
+		return mmap.MapRegion(nil, size, mmap.EXEC|mmap.RDWR, mmap.ANON, int64(0))
+	}
+	m, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE|unix.PROT_EXEC, execMapFlags(prefault))
+	if err != nil {
+		return nil, err
+	}
+	return mmap.MMap(m), nil
+}
+
+// mapHugePages maps size bytes of executable memory backed by huge pages.
+// This fails unless huge pages have been reserved, see
+// Documentation/admin-guide/mm/hugetlbpage.rst in the Linux sources.
+func mapHugePages(size int, prefault bool) (mmap.MMap, error) {
+	m, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE|unix.PROT_EXEC, execMapFlags(prefault)|unix.MAP_HUGETLB)
+	if err != nil {
+		return nil, err
+	}
+	// MMap.Unmap releases the mapping with unix.Munmap.
+	return mmap.MMap(m), nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !appengine,!js
+
+package compile
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestExecMapFlagsPrefault(t *testing.T) {
+	if flags := execMapFlags(true); flags&unix.MAP_POPULATE == 0 {
+		t.Errorf("execMapFlags(true) = %#x, want MAP_POPULATE set", flags)
+	}
+	if flags := execMapFlags(false); flags&unix.MAP_POPULATE != 0 {
+		t.Errorf("execMapFlags(false) = %#x, want MAP_POPULATE clear", flags)
+	}
+}
+
+func TestMMapAllocatorPrefault(t *testing.T) {
+	a := &MMapAllocator{}
+	a.SetPrefault(true)
+	defer a.Close()
+
+	unit, err := a.AllocateExec([]byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := **(**[4]byte)(unit.(*asmBlock).mem); d != [4]byte{1, 2, 3, 4} {
+		t.Errorf("unit = %d, want [4]byte{1,2,3,4}", d)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !appengine,!js,!linux
+
+package compile
+
+import (
+	"errors"
+	"os"
+
+	mmap "github.com/edsrzf/mmap-go"
+)
+
+// mapExec maps size bytes of anonymous executable memory. With prefault,
+// each page is written to so it is populated before the code first runs.
+func mapExec(size int, prefault bool) (mmap.MMap, error) {
+	m, err := mmap.MapRegion(nil, size, mmap.EXEC|mmap.RDWR, mmap.ANON, int64(0))
+	if err != nil || !prefault {
+		return m, err
+	}
+	for i := 0; i < len(m); i += os.Getpagesize() {
+		m[i] = 0
+	}
+	return m, nil
+}
+
+// mapHugePages is only implemented on Linux.
+func mapHugePages(size int, prefault bool) (mmap.MMap, error) {
+	return nil, errors.New("huge pages are not supported on this platform")
+}
@@ -2,11 +2,18 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !appengine
+// +build !appengine,!js
 
 package compile
 
-import "testing"
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"unsafe"
+)
 
 func TestMMapAllocator(t *testing.T) {
 	a := &MMapAllocator{}
@@ -26,20 +33,207 @@ func TestMMapAllocator(t *testing.T) {
 		t.Errorf("a.last.remaining = %d, want %d", a.last.remaining, want)
 	}
 
-	// Test allocation of massive slice - should be 32k more & new block.
-	b := make([]byte, 36*1024)
+	// Test allocation of massive slice - too big for the space left, so
+	// should be a new block of minAllocSize more.
+	b := make([]byte, minAllocSize+1)
 	b[1] = 5
 	massiveAlloc, err := a.AllocateExec(b)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if d := **(**[2]byte)(massiveAlloc.(*asmBlock).mem); d != [2]byte{0, 5} {
-		t.Errorf("bigAlloc = %d, want [2]byte{31, 0}", d)
+		t.Errorf("bigAlloc = %d, want [2]byte{0, 5}", d)
 	}
-	if want := uint32(36 * 1024); a.last.consumed != want {
+	if want := uint32(minAllocSize + allocationAlignment + 1); a.last.consumed != want {
 		t.Errorf("a.last.consumed = %d, want %d", a.last.consumed, want)
 	}
 	if want := uint32(minAllocSize); a.last.remaining != want {
 		t.Errorf("a.last.remaining = %d, want %d", a.last.remaining, want)
 	}
+
+	// Test a small allocation is packed into the space left.
+	packedAlloc, err := a.AllocateExec([]byte{6, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := **(**[2]byte)(packedAlloc.(*asmBlock).mem); d != [2]byte{6, 7} {
+		t.Errorf("packedAlloc = %d, want [2]byte{6, 7}", d)
+	}
+	if want := uint32(minAllocSize + 2*(allocationAlignment+1)); a.last.consumed != want {
+		t.Errorf("a.last.consumed = %d, want %d", a.last.consumed, want)
+	}
+	if got, want := a.MappedRegions(), 2; got != want {
+		t.Errorf("MappedRegions() = %d, want %d", got, want)
+	}
+}
+
+func TestMMapAllocatorConsumedBytes(t *testing.T) {
+	a := &MMapAllocator{}
+	defer a.Close()
+	if got := a.ConsumedBytes(); got != 0 {
+		t.Errorf("ConsumedBytes() = %d before allocating, want 0", got)
+	}
+
+	var want uint64
+	for _, size := range []int{1, 128, 129, 36 * 1024} {
+		if _, err := a.AllocateExec(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		want += uint64(size+allocationAlignment) &^ allocationAlignment
+		if got := a.ConsumedBytes(); got != want {
+			t.Errorf("after allocating %d bytes: ConsumedBytes() = %d, want %d", size, got, want)
+		}
+	}
+}
+
+func TestMMapAllocatorRegion(t *testing.T) {
+	a := &MMapAllocator{}
+	defer a.Close()
+
+	// Allocations are packed, each at the next aligned offset of the
+	// mapping.
+	var offset uintptr
+	for _, size := range []int{1, 4, 129, 36 * 1024} {
+		unit, err := a.AllocateExec(make([]byte, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, n := unit.(NativeCodeRegion).Region()
+		if n != size {
+			t.Errorf("size %d: Region() size = %d, want %d", size, n, size)
+		}
+		if addr%(allocationAlignment+1) != 0 {
+			t.Errorf("size %d: Region() addr = %#x, want aligned to %d bytes", size, addr, allocationAlignment+1)
+		}
+		if want := uintptr(unsafe.Pointer(&a.last.mem[0])) + offset; addr != want {
+			t.Errorf("size %d: Region() addr = %#x, want %#x", size, addr, want)
+		}
+		offset += uintptr(size+allocationAlignment) &^ allocationAlignment
+	}
+	if base := uintptr(unsafe.Pointer(&a.last.mem[0])); base%uintptr(os.Getpagesize()) != 0 {
+		t.Errorf("mapping addr = %#x, want page aligned", base)
+	}
+}
+
+// BenchmarkMMapAllocatorSmall performs many small allocations, of the
+// size emitted for typical candidates. Besides the usual timings, it
+// reports the bytes lost to alignment and the bytes mapped per allocation,
+// to guide tuning of allocationAlignment & minAllocSize.
+func BenchmarkMMapAllocatorSmall(b *testing.B) {
+	const allocsPerOp = 2000
+	sizes := []int{24, 48, 70, 96, 130, 200}
+
+	b.ReportAllocs()
+	var used, aligned, mapped int
+	for n := 0; n < b.N; n++ {
+		a := &MMapAllocator{}
+		for i := 0; i < allocsPerOp; i++ {
+			size := sizes[i%len(sizes)]
+			if _, err := a.AllocateExec(make([]byte, size)); err != nil {
+				b.Fatal(err)
+			}
+			used += size
+		}
+		aligned += int(a.ConsumedBytes())
+		for _, block := range a.blocks {
+			mapped += len(block.mem)
+		}
+		if err := a.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	allocs := float64(b.N * allocsPerOp)
+	b.ReportMetric(float64(aligned-used)/allocs, "align-bytes/alloc")
+	b.ReportMetric(float64(mapped)/allocs, "mapped-bytes/alloc")
+}
+
+func TestMMapAllocatorHugePages(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	a := &MMapAllocator{}
+	a.SetHugePages(true)
+	defer a.Close()
+
+	first, err := a.AllocateExec([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.last.huge {
+		// Normal pages were used as a fallback.
+		t.Skip("no huge pages available")
+	}
+	second, err := a.AllocateExec([]byte{4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(a.blocks), 1; got != want {
+		t.Errorf("len(a.blocks) = %d, want %d", got, want)
+	}
+
+	firstAddr, _ := first.(NativeCodeRegion).Region()
+	secondAddr, _ := second.(NativeCodeRegion).Region()
+	if firstAddr%hugePageSize != 0 {
+		t.Errorf("first addr = %#x, want huge page aligned", firstAddr)
+	}
+	if got, want := secondAddr-firstAddr, uintptr(allocationAlignment+1); got != want {
+		t.Errorf("second addr - first addr = %d, want %d", got, want)
+	}
+	if d := **(**[2]byte)(second.(*asmBlock).mem); d != [2]byte{4, 5} {
+		t.Errorf("second = %d, want [2]byte{4,5}", d)
+	}
+}
+
+func TestMMapAllocatorConcurrent(t *testing.T) {
+	for _, huge := range []bool{false, true} {
+		a := &MMapAllocator{}
+		a.SetHugePages(huge)
+
+		const workers, allocs = 16, 32
+		units := make([][]NativeCodeUnit, workers)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < allocs; i++ {
+					unit, err := a.AllocateExec(concurrentAllocation(w, i))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					units[w] = append(units[w], unit)
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for w := range units {
+			for i, unit := range units[w] {
+				want := concurrentAllocation(w, i)
+				block := unit.(*asmBlock)
+				if block.size != len(want) {
+					t.Errorf("huge pages %v: worker %d allocation %d has size %d, want %d", huge, w, i, block.size, len(want))
+					continue
+				}
+				if got := (*(*[]byte)(block.mem))[:block.size]; !bytes.Equal(got, want) {
+					t.Errorf("huge pages %v: worker %d allocation %d does not contain the bytes requested", huge, w, i)
+				}
+			}
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// concurrentAllocation returns the code allocated by worker w for its
+// i'th allocation, with a length & contents unique to the pair.
+func concurrentAllocation(w, i int) []byte {
+	out := make([]byte, 1+w*61+i*7)
+	for j := range out {
+		out[j] = byte(w<<4 ^ i ^ j)
+	}
+	return out
 }
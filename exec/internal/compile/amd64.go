@@ -7,16 +7,101 @@ package compile
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
+	"math/bits"
+	"strings"
 
+	"github.com/go-interpreter/wagon/wasm"
 	ops "github.com/go-interpreter/wagon/wasm/operators"
 	asm "github.com/twitchyliquid64/golang-asm"
 	"github.com/twitchyliquid64/golang-asm/obj"
 	"github.com/twitchyliquid64/golang-asm/obj/x86"
+	"golang.org/x/sys/cpu"
 )
 
 // NativeCodeUnit represents compiled native code.
 type NativeCodeUnit interface {
-	Invoke(stack, locals *[]uint64)
+	// Invoke runs the native code. Bounds checks read the length of
+	// memory through its slice header when they execute, so linear
+	// memory may grow between invocations.
+	Invoke(stack, locals *[]uint64, memory *[]byte) NativeExit
+}
+
+// CountedCodeUnit is implemented by NativeCodeUnits which can report how
+// many times they were invoked, if they were built to count invocations
+// (see AMD64Backend.SetProfiling).
+type CountedCodeUnit interface {
+	Invocations() uint64
+}
+
+// NativeCodeRegion is implemented by NativeCodeUnits which can report
+// where their code resides in memory, for diagnostics.
+type NativeCodeRegion interface {
+	// Region returns the address of the first instruction, and the length
+	// of the code in bytes.
+	Region() (addr uintptr, size int)
+}
+
+// NativeExit describes why a NativeCodeUnit stopped executing.
+type NativeExit uint64
+
+// Valid NativeExit values.
+const (
+	// ExitNormal indicates the native code ran to completion, and
+	// execution should continue at the end of the compiled sequence.
+	ExitNormal NativeExit = iota
+	// ExitReturn indicates the native code executed a return, and the
+	// current function should return with the value on the top of the
+	// stack, if any.
+	ExitReturn
+	// TrapOutOfBoundsMemory indicates an access to linear memory was
+	// out of bounds.
+	TrapOutOfBoundsMemory
+	// TrapIntegerDivideByZero indicates an integer division had a
+	// divisor of zero.
+	TrapIntegerDivideByZero
+	// TrapStackOverflow indicates a push would have exceeded the capacity
+	// of the stack. It is only returned by code built with stack guards,
+	// see (*AMD64Backend).SetGuardStack.
+	TrapStackOverflow
+	// TrapLocalOutOfRange indicates an access to a local past the end of
+	// the locals. It is only returned by code built with locals guards,
+	// see (*AMD64Backend).SetGuardLocals.
+	TrapLocalOutOfRange
+	// TrapIntegerOverflow indicates a signed integer division overflowed,
+	// such as math.MinInt32 / -1.
+	TrapIntegerOverflow
+	// ExitGrowMemory indicates the native code reached a memory.grow,
+	// with the number of pages to grow by on the top of the stack. The
+	// VM grows linear memory, replacing the operand with the previous
+	// size in pages, before continuing at the end of the compiled
+	// sequence.
+	ExitGrowMemory
+	// TrapStackImbalance indicates the native code ran to its end with a
+	// stack length other than the one expected from the instructions it
+	// was built from. It is only returned by code built with stack balance
+	// checks, see (*AMD64Backend).SetStackBalance.
+	TrapStackImbalance
+)
+
+// exitBranch is set in NativeExit values which request a branch. The
+// remaining bits hold the bytecode address of the branch target.
+const exitBranch NativeExit = 1 << 63
+
+// BranchExit returns the NativeExit value indicating the native code
+// took a branch, and execution should continue at the bytecode address
+// target.
+func BranchExit(target int64) NativeExit {
+	return exitBranch | NativeExit(target)
+}
+
+// BranchTarget returns the bytecode address execution should continue at,
+// if e indicates a branch was taken.
+func (e NativeExit) BranchTarget() (int64, bool) {
+	if e&exitBranch == 0 {
+		return 0, false
+	}
+	return int64(e &^ exitBranch), true
 }
 
 // dirtyRegs hold booleans that are true when the register stores
@@ -24,92 +109,697 @@ type NativeCodeUnit interface {
 type dirtyRegs struct {
 	R12 bool
 	R13 bool
+
+	// held are the registers holding the values on the top of the wasm
+	// stack which have not been pushed to memory yet, topmost last.
+	held []int16
+
+	// exits are forward jumps to the postamble, which are
+	// pointed at the postamble once it is emitted.
+	exits []*obj.Prog
+}
+
+// Reserved registers, which hold their value for the whole of a
+// compiled sequence.
+const (
+	// regStackHeader points to the stack sliceHeader.
+	regStackHeader = x86.REG_R10
+	// regLocalsHeader points to the locals sliceHeader. The locals may be
+	// reallocated while the header stays in place, so the base of the
+	// locals is loaded from it on every access, see emitLocalsBase.
+	regLocalsHeader = x86.REG_R11
+	// regStackItem points to a stack item, while pushing or popping.
+	regStackItem = x86.REG_R12
+	// regStackLen caches the stack length.
+	regStackLen = x86.REG_R13
+	// regExitStatus holds the NativeExit value for exits via
+	// emitConditionalReturn.
+	regExitStatus = x86.REG_R15
+	// regMemoryHeader points to the linear memory sliceHeader.
+	regMemoryHeader = x86.REG_SI
+)
+
+// amd64Reserved are the registers with a fixed role in compiled code.
+var amd64Reserved = []int16{
+	regStackHeader,
+	regLocalsHeader,
+	regStackItem,
+	regStackLen,
+	regExitStatus,
+	regMemoryHeader,
+}
+
+// amd64Scratch are the registers emit helpers may clobber freely. RAX,
+// RBX & RCX also carry the arguments of a native call, until the
+// preamble moves them into their reserved registers.
+// R14 (the current goroutine as of Go's register ABI) and RBP (the
+// frame pointer) are deliberately in neither set, so that native code
+// can later call back into Go.
+var amd64Scratch = []int16{
+	x86.REG_AX,
+	x86.REG_BX,
+	x86.REG_CX,
+	x86.REG_DX,
+	x86.REG_R8,
+	x86.REG_R9,
+	x86.REG_X0,
+	x86.REG_X1,
+	x86.REG_X2,
+}
+
+// amd64HeldRegs are the scratch registers which hold intermediate values
+// between register-aware instructions, see holdReg. Those instructions
+// only clobber RAX, RBX, RCX & R9 besides, and everything else runs after
+// flushHeld.
+var amd64HeldRegs = []int16{
+	x86.REG_DX,
+	x86.REG_R8,
+}
+
+// Assembler describes the operations the backend requires to emit &
+// assemble instructions. Emission is routed through it so that the
+// instructions can be observed, as by Recorder; it is not a way to swap
+// out golang-asm, as instructions are still golang-asm programs
+// (obj.Prog). *golangasm.Builder implements this interface.
+type Assembler interface {
+	// NewProg returns a new, empty instruction.
+	NewProg() *obj.Prog
+	// AddInstruction appends an instruction to the program.
+	AddInstruction(p *obj.Prog)
+	// Assemble returns the machine code for the program.
+	Assemble() []byte
+}
+
+var _ Assembler = (*asm.Builder)(nil)
+
+func newGolangAsmAssembler() (Assembler, error) {
+	return asm.NewBuilder("amd64", 128)
+}
+
+// Recorder is an Assembler which records emitted instructions instead of
+// assembling them, allowing the output of a backend to be inspected
+// without executable memory.
+type Recorder struct {
+	builder *asm.Builder
+	// Progs are the recorded instructions, in the order they were added.
+	Progs []*obj.Prog
+}
+
+// NewRecorder returns a Recorder for the given architecture, as
+// understood by golang-asm.
+func NewRecorder(arch string) (*Recorder, error) {
+	builder, err := asm.NewBuilder(arch, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{builder: builder}, nil
+}
+
+// NewProg implements Assembler.
+func (r *Recorder) NewProg() *obj.Prog {
+	return r.builder.NewProg()
+}
+
+// AddInstruction implements Assembler.
+func (r *Recorder) AddInstruction(p *obj.Prog) {
+	r.Progs = append(r.Progs, p)
+}
+
+// Assemble implements Assembler. A Recorder does not assemble, so this
+// always returns nil.
+func (r *Recorder) Assemble() []byte {
+	return nil
 }
 
-// Details of the AMD64 backend:
-// Reserved registers (for now):
-//  - R10 - pointer to stack sliceHeader
-//  - R11 - pointer to locals sliceHeader
-//  - R12 - pointer for stack item
-//  - R13 - stack size
-// Scratch registers:
-//  - RAX, RBX, RCX, RDX, R8, R9, R15
-// Most emission instructions make few attempts to optimize in order
-// to keep things simple, however a planned second pass peephole-optimizer
-//  should make a big difference.
+// Instructions returns the recorded instructions in Go assembler syntax,
+// such as "MOVQ $1234, AX".
+func (r *Recorder) Instructions() []string {
+	out := make([]string, len(r.Progs))
+	for i, p := range r.Progs {
+		out[i] = strings.Replace(p.InstructionString(), "\t", " ", 1)
+	}
+	return out
+}
 
 // AMD64Backend is the native compiler backend for x86-64 architectures.
+//
+// Registers are assigned by amd64Reserved & amd64Scratch, which are the
+// only place the role of a register is decided. Emit helpers refer to
+// reserved registers by role, and may only clobber scratch registers.
+// Most emission makes few attempts to optimize in order to keep things
+// simple, though a planned second pass peephole-optimizer should make a
+// big difference.
 type AMD64Backend struct {
-	s *scanner
+	s            *scanner
+	guardStack   bool
+	guardLocals  bool
+	stackBalance bool
+	breakpoints  bool
+	profiling    bool
+	fusedMulAdd  bool
+	// noRegAlloc pushes every value to memory, rather than holding
+	// intermediate values in amd64HeldRegs. For comparison in tests.
+	noRegAlloc bool
+
+	// NewAssembler returns the assembler instructions are emitted into,
+	// usually one wrapping golang-asm to observe them. If nil, a
+	// golang-asm builder is used directly.
+	NewAssembler func() (Assembler, error)
+}
+
+// SetGuardStack sets whether every push to the stack is checked against
+// its capacity, exiting with TrapStackOverflow rather than writing past
+// the end of the stack. The VM grows the stack before entering native
+// code, so the checks only catch bugs in that logic; they are intended
+// for debugging.
+func (b *AMD64Backend) SetGuardStack(v bool) {
+	b.guardStack = v
+}
+
+// SetStackBalance sets whether code which runs to its end checks the
+// stack length against the length on entry plus the net stack effect of
+// the candidate's instructions, exiting with TrapStackImbalance if they
+// differ. Unlike SetGuardStack, this catches pushes & pops which do not
+// balance. The checks are intended for debugging wagon.
+func (b *AMD64Backend) SetStackBalance(v bool) {
+	b.stackBalance = v
+}
+
+// SetGuardLocals sets whether every access to a local is checked against
+// the length of the locals, exiting with TrapLocalOutOfRange rather than
+// reading or writing past their end. Validation rejects modules which
+// access locals out of range, so the checks only catch bugs in wagon;
+// they are intended for debugging.
+func (b *AMD64Backend) SetGuardLocals(v bool) {
+	b.guardLocals = v
+}
+
+// SetBreakpoints sets whether an INT3 breakpoint is emitted as the first
+// instruction of each native block, so a debugger stops on entry to the
+// block. Without a debugger attached, the breakpoint raises SIGTRAP and
+// crashes the process.
+func (b *AMD64Backend) SetBreakpoints(v bool) {
+	b.breakpoints = v
+}
+
+// SetProfiling sets whether each native block increments its invocation
+// counter on entry, which is read with CountedCodeUnit. The counter is
+// passed as the fourth argument of the block.
+func (b *AMD64Backend) SetProfiling(v bool) {
+	b.profiling = v
+}
+
+// SetFusedMulAdd sets whether an f64.mul immediately followed by an
+// f64.add of the product is emitted as a single VFMADD231SD, on CPUs which
+// support FMA3. The fused instruction rounds once rather than twice, so
+// its results may differ from the interpreter in the last bit.
+func (b *AMD64Backend) SetFusedMulAdd(v bool) {
+	b.fusedMulAdd = v
+}
+
+// CPUFeatures returns the optional CPU features which code emitted by the
+// backend may use on this machine: "sse4.1" for ROUNDSD, and "fma" for
+// VFMADD231SD. The code may fault on CPUs lacking any of them.
+func (b *AMD64Backend) CPUFeatures() []string {
+	var features []string
+	if hasSSE41 {
+		features = append(features, "sse4.1")
+	}
+	if hasFMA {
+		features = append(features, "fma")
+	}
+	return features
 }
 
 // Scanner returns a scanner that can be used for
 // emitting compilation candidates.
 func (b *AMD64Backend) Scanner() *scanner {
 	if b.s == nil {
+		supported := map[byte]bool{
+			ops.I64Const:    true,
+			ops.I32Const:    true,
+			ops.I64Add:      true,
+			ops.I64Sub:      true,
+			ops.I64And:      true,
+			ops.I64Or:       true,
+			ops.I64Mul:      true,
+			ops.I64DivU:     true,
+			ops.I64Shl:      true,
+			ops.I32WrapI64:  true,
+			ops.I32Add:      true,
+			ops.I32DivS:     true,
+			ops.I32DivU:     true,
+			ops.I32RemS:     true,
+			ops.I32RemU:     true,
+			ops.I32Mul:      true,
+			ops.I32Shl:      true,
+			ops.I32ShrS:     true,
+			ops.I32ShrU:     true,
+			ops.I32Rotl:     true,
+			ops.I32Rotr:     true,
+			ops.F32Add:      true,
+			ops.F64Add:      true,
+			ops.F32Mul:      true,
+			ops.F64Mul:      true,
+			ops.F32Abs:      true,
+			ops.F64Abs:      true,
+			ops.F32Copysign: true,
+			ops.F64Copysign: true,
+
+			ops.F32ConvertUI32: true,
+			ops.F32ConvertUI64: true,
+			ops.F64ConvertUI32: true,
+			ops.F64ConvertUI64: true,
+
+			ops.I32Load:  true,
+			ops.I64Load:  true,
+			ops.I32Store: true,
+			ops.I64Store: true,
+			ops.GetLocal: true,
+			ops.SetLocal: true,
+			ops.Select:   true,
+			ops.Drop:     true,
+			ops.Return:   true,
+			OpJmpNz:      true,
+
+			// Growing memory may move it, so it is left to the VM.
+			ops.GrowMemory: true,
+
+			// Reinterpret casts only change the type of a value.
+			ops.I32ReinterpretF32: true,
+			ops.I64ReinterpretF64: true,
+			ops.F32ReinterpretI32: true,
+			ops.F64ReinterpretI64: true,
+		}
+		for op := range comparisons {
+			supported[op] = true
+		}
+		if hasSSE41 {
+			for op := range roundingModes {
+				supported[op] = true
+			}
+		}
 		b.s = &scanner{
-			supportedOpcodes: map[byte]bool{
-				ops.I64Const: true,
-				ops.I64Add:   true,
-				ops.I64Sub:   true,
-				ops.I64And:   true,
-				ops.I64Or:    true,
-				ops.I64Mul:   true,
-				ops.GetLocal: true,
-			},
+			supportedOpcodes: supported,
+			gapOpcodes:       map[byte]bool{ops.Nop: true},
 		}
 	}
 	return b.s
 }
 
-// Build implements exec.instructionBuilder.
+// SupportedOpcodes returns the opcodes the backend can compile, in
+// ascending order.
+func (b *AMD64Backend) SupportedOpcodes() []byte {
+	return b.Scanner().SupportedOpcodes()
+}
+
+// Build implements exec.InstructionBuilder.
 func (b *AMD64Backend) Build(candidate CompilationCandidate, code []byte, meta *BytecodeMetadata) ([]byte, error) {
-	builder, err := asm.NewBuilder("amd64", 128)
+	newAssembler := b.NewAssembler
+	if newAssembler == nil {
+		newAssembler = newGolangAsmAssembler
+	}
+	builder, err := newAssembler()
 	if err != nil {
 		return nil, err
 	}
+	if err := b.emit(builder, candidate, code, meta); err != nil {
+		return nil, err
+	}
+	return builder.Assemble(), nil
+}
+
+// BuildInstructions compiles the specified bytecode like Build, returning
+// the emitted instructions in Go assembler syntax rather than machine
+// code.
+func (b *AMD64Backend) BuildInstructions(candidate CompilationCandidate, code []byte, meta *BytecodeMetadata) ([]string, error) {
+	r, err := NewRecorder("amd64")
+	if err != nil {
+		return nil, err
+	}
+	if err := b.emit(r, candidate, code, meta); err != nil {
+		return nil, err
+	}
+	return r.Instructions(), nil
+}
+
+// emit emits the native instructions for candidate into builder.
+func (b *AMD64Backend) emit(builder Assembler, candidate CompilationCandidate, code []byte, meta *BytecodeMetadata) error {
+	if err := CheckCandidate(candidate, meta); err != nil {
+		return err
+	}
 	var regs dirtyRegs
 	b.emitPreamble(builder, &regs)
+	folds := b.foldConstants(code, meta, candidate)
 
 	for i := candidate.StartInstruction; i <= candidate.EndInstruction; i++ {
-		//fmt.Printf("i=%d, meta=%+v, len=%d\n", i, meta.Instructions[i], len(code))
 		inst := meta.Instructions[i]
+		// Push values computed at compile time as a constant.
+		if f, ok := folds[i]; ok {
+			reg := b.holdTarget(&regs)
+			b.emitMoveConst(builder, reg, f.value)
+			b.holdReg(builder, &regs, reg)
+			i = f.end
+			continue
+		}
+		// Values are only held in registers between the instructions
+		// which use holdReg & popReg.
+		switch inst.Op {
+		case ops.I64Const, ops.I32Const, ops.GetLocal, ops.SetLocal, ops.I64Add, ops.I64Sub, ops.I64Mul, ops.I64Or, ops.I64And, ops.Nop, ops.Drop:
+		default:
+			b.flushHeld(builder, &regs)
+		}
+
 		switch inst.Op {
-		case ops.I64Const:
-			b.emitPushI64(builder, &regs, b.readIntImmediate(code, inst))
+		case ops.I64Const, ops.I32Const:
+			c, err := b.readIntImmediate(code, inst)
+			if err != nil {
+				return err
+			}
+			// Fuse a read-modify-write of a constant address.
+			if inst.Op == ops.I32Const && i+5 <= candidate.EndInstruction {
+				ok, err := b.emitConstAddrRMW(builder, &regs, code, meta.Instructions[i:i+6])
+				if err != nil {
+					return err
+				}
+				if ok {
+					i += 5
+					continue
+				}
+			}
+			// Fold constant addresses into the displacement of a
+			// following load.
+			if inst.Op == ops.I32Const && i < candidate.EndInstruction {
+				next := meta.Instructions[i+1]
+				if next.Op == ops.I32Load || next.Op == ops.I64Load {
+					offset, err := b.readIntImmediate(code, next)
+					if err != nil {
+						return err
+					}
+					b.flushHeld(builder, &regs)
+					if b.emitConstAddrLoad(builder, &regs, next.Op, c, offset) {
+						i++
+						continue
+					}
+				}
+			}
+			// Strength-reduce division by a constant.
+			if inst.Op == ops.I64Const && i < candidate.EndInstruction && meta.Instructions[i+1].Op == ops.I64DivU {
+				b.flushHeld(builder, &regs)
+				if b.emitConstDivU(builder, &regs, c) {
+					i++
+					continue
+				}
+			}
+			// Shift by an immediate, rather than through CL.
+			if inst.Op == ops.I64Const && i < candidate.EndInstruction && meta.Instructions[i+1].Op == ops.I64Shl {
+				b.flushHeld(builder, &regs)
+				b.emitConstShl(builder, &regs, c)
+				i++
+				continue
+			}
+			// Strength-reduce multiplication by a constant.
+			if inst.Op == ops.I64Const && i < candidate.EndInstruction && meta.Instructions[i+1].Op == ops.I64Mul {
+				b.flushHeld(builder, &regs)
+				b.emitConstMul(builder, &regs, c)
+				i++
+				continue
+			}
+			// Increment or decrement in place, such as a loop counter.
+			if inst.Op == ops.I64Const && c == 1 && i < candidate.EndInstruction {
+				if next := meta.Instructions[i+1].Op; next == ops.I64Add || next == ops.I64Sub {
+					b.emitIncDec(builder, &regs, next)
+					i++
+					continue
+				}
+			}
+			if inst.Op == ops.I64Const && c == 0 && i < candidate.EndInstruction {
+				// The absolute value of a local, selecting its negation
+				// if it is negative.
+				if i+7 <= candidate.EndInstruction {
+					ok, err := b.emitAbsLocal(builder, &regs, code, meta, meta.Instructions[i:i+8])
+					if err != nil {
+						return err
+					}
+					if ok {
+						i += 7
+						continue
+					}
+				}
+				// x - 0 is x, so there is nothing to do.
+				if meta.Instructions[i+1].Op == ops.I64Sub {
+					i++
+					continue
+				}
+				// 0 - local is the negation of the local.
+				if i+2 <= candidate.EndInstruction && meta.Instructions[i+1].Op == ops.GetLocal && meta.Instructions[i+2].Op == ops.I64Sub {
+					index, err := b.readIntImmediate(code, meta.Instructions[i+1])
+					if err != nil {
+						return err
+					}
+					if reg, mov := localRegister(meta.LocalType(index)); reg == x86.REG_AX {
+						reg = b.holdTarget(&regs)
+						b.emitWasmLocalsLoad(builder, &regs, reg, mov, index)
+						b.emitNeg(builder, reg)
+						b.holdReg(builder, &regs, reg)
+						i += 2
+						continue
+					}
+				}
+			}
+			reg := b.holdTarget(&regs)
+			b.emitMoveConst(builder, reg, c)
+			b.holdReg(builder, &regs, reg)
 		case ops.GetLocal:
-			b.emitWasmLocalsLoad(builder, &regs, x86.REG_AX, b.readIntImmediate(code, inst))
-			b.emitWasmStackPush(builder, &regs, x86.REG_AX)
+			index, err := b.readIntImmediate(code, inst)
+			if err != nil {
+				return err
+			}
+			reg, mov := localRegister(meta.LocalType(index))
+			if reg != x86.REG_AX {
+				b.flushHeld(builder, &regs)
+				b.emitWasmLocalsLoad(builder, &regs, reg, mov, index)
+				b.emitWasmStackPush(builder, &regs, reg)
+				continue
+			}
+			reg = b.holdTarget(&regs)
+			b.emitWasmLocalsLoad(builder, &regs, reg, mov, index)
+			// Add a constant to the local before pushing it, rather
+			// than pushing both and popping them again.
+			if i+2 <= candidate.EndInstruction &&
+				meta.Instructions[i+1].Op == ops.I64Const && meta.Instructions[i+2].Op == ops.I64Add {
+				c, err := b.readIntImmediate(code, meta.Instructions[i+1])
+				if err != nil {
+					return err
+				}
+				b.emitAddConst(builder, reg, c)
+				i += 2
+			}
+			b.holdReg(builder, &regs, reg)
+		case ops.SetLocal:
+			index, err := b.readIntImmediate(code, inst)
+			if err != nil {
+				return err
+			}
+			reg := b.popReg(builder, &regs, x86.REG_AX, 0)
+			b.emitWasmLocalsStore(builder, &regs, reg, index)
 		case ops.I64Add, ops.I64Sub, ops.I64Mul, ops.I64Or, ops.I64And:
 			if err := b.emitBinaryI64(builder, &regs, inst.Op); err != nil {
-				return nil, fmt.Errorf("emitBinaryI64: %v", err)
+				return fmt.Errorf("emitBinaryI64: %v", err)
+			}
+		case ops.I64DivU:
+			b.emitDivU(builder, &regs)
+		case ops.I32DivS, ops.I32DivU, ops.I32RemS, ops.I32RemU:
+			b.emitDivI32(builder, &regs, inst.Op)
+		case ops.I32WrapI64, ops.I32ReinterpretF32, ops.F32ReinterpretI32:
+			b.emitLow32(builder, &regs)
+		case ops.Nop:
+			// Joins candidates merged by the scanner.
+		case ops.Drop:
+			b.emitDrop(builder, &regs)
+		case ops.I64ReinterpretF64, ops.F64ReinterpretI64:
+			// Stack slots hold the bits of a value regardless of its
+			// type, so there is nothing to do.
+		case ops.I64Shl:
+			b.emitShl(builder, &regs)
+		case ops.I32Add, ops.I32Mul, ops.I32Shl, ops.I32ShrS, ops.I32ShrU, ops.I32Rotl, ops.I32Rotr:
+			if err := b.emitBinaryI32(builder, &regs, inst.Op); err != nil {
+				return fmt.Errorf("emitBinaryI32: %v", err)
+			}
+		case ops.F32Add, ops.F64Add, ops.F32Mul, ops.F64Mul:
+			if inst.Op == ops.F64Mul && b.fusedMulAdd && hasFMA && i < candidate.EndInstruction && meta.Instructions[i+1].Op == ops.F64Add {
+				i++
+				b.emitFusedMulAdd(builder, &regs)
+				continue
+			}
+			if err := b.emitBinaryFloat(builder, &regs, inst.Op); err != nil {
+				return fmt.Errorf("emitBinaryFloat: %v", err)
+			}
+		case ops.F32Abs, ops.F64Abs:
+			b.emitFloatAbs(builder, &regs, inst.Op)
+		case ops.F64Ceil, ops.F64Floor, ops.F64Trunc, ops.F64Nearest:
+			b.emitFloatRound(builder, &regs, inst.Op)
+		case ops.F32Copysign, ops.F64Copysign:
+			b.emitFloatCopysign(builder, &regs, inst.Op)
+		case ops.F32ConvertUI32, ops.F32ConvertUI64, ops.F64ConvertUI32, ops.F64ConvertUI64:
+			b.emitConvertUnsigned(builder, &regs, inst.Op)
+		case ops.I64Eq, ops.I64Ne, ops.I64LtS, ops.I64LtU, ops.I64GtS, ops.I64GtU, ops.I64LeS, ops.I64LeU, ops.I64GeS, ops.I64GeU,
+			ops.I32Eq, ops.I32Ne, ops.I32LtS, ops.I32LtU, ops.I32GtS, ops.I32GtU, ops.I32LeS, ops.I32LeU, ops.I32GeS, ops.I32GeU:
+			b.emitCompare(builder, &regs, inst.Op)
+			// Branch on the flags directly, rather than materializing
+			// the boolean for a following br_if.
+			if i < candidate.EndInstruction && meta.Instructions[i+1].Op == OpJmpNz {
+				i++
+				target := readBranchTarget(code, meta.Instructions[i])
+				b.emitConditionalReturn(builder, &regs, comparisons[inst.Op].jump, BranchExit(target))
+				continue
+			}
+			b.emitSetCondition(builder, &regs, inst.Op)
+		case ops.Select:
+			b.emitSelect(builder, &regs, b.selectOperandType(code, meta, candidate, i))
+		case OpJmpNz:
+			if err := b.emitBrIf(builder, &regs, readBranchTarget(code, inst)); err != nil {
+				return fmt.Errorf("emitBrIf: %v", err)
+			}
+		case ops.Return:
+			// The results are already on the top of the stack, where
+			// the VM expects them.
+			b.emitConditionalReturn(builder, &regs, obj.AJMP, ExitReturn)
+		case ops.GrowMemory:
+			// The operand is already on the top of the stack, where the
+			// VM expects it.
+			b.emitConditionalReturn(builder, &regs, obj.AJMP, ExitGrowMemory)
+		case ops.I32Load, ops.I64Load:
+			offset, err := b.readIntImmediate(code, inst)
+			if err != nil {
+				return err
+			}
+			if err := b.emitLoad(builder, &regs, inst.Op, offset); err != nil {
+				return fmt.Errorf("emitLoad: %v", err)
+			}
+		case ops.I32Store, ops.I64Store:
+			offset, err := b.readIntImmediate(code, inst)
+			if err != nil {
+				return err
+			}
+			if err := b.emitStore(builder, &regs, inst.Op, offset); err != nil {
+				return fmt.Errorf("emitStore: %v", err)
 			}
 		default:
-			return nil, fmt.Errorf("cannot handle inst[%d].Op 0x%x", i, inst.Op)
+			return fmt.Errorf("cannot handle inst[%d].Op 0x%x", i, inst.Op)
+		}
+	}
+	if b.stackBalance {
+		if delta, ok := b.stackDelta(code, meta, candidate); ok {
+			b.flushHeld(builder, &regs)
+			b.emitStackBalanceCheck(builder, &regs, delta)
 		}
 	}
 	b.emitPostamble(builder, &regs)
+	return nil
+}
+
+// stackDelta returns the net change in stack length from running the
+// instructions of candidate to its end, or false if it is not known.
+func (b *AMD64Backend) stackDelta(code []byte, meta *BytecodeMetadata, candidate CompilationCandidate) (int, bool) {
+	var delta int
+	for i := candidate.StartInstruction; i <= candidate.EndInstruction; i++ {
+		inst := meta.Instructions[i]
+		switch inst.Op {
+		case ops.SetLocal:
+			delta--
+			continue
+		case ops.Select:
+			delta -= 2
+			continue
+		case ops.Return, ops.GrowMemory:
+			// Both always exit, so the end is never reached.
+			return 0, false
+		}
+		effect, ok := b.instStackEffect(code, meta, inst)
+		if !ok {
+			return 0, false
+		}
+		delta += effect.pushes - effect.pops
+	}
+	return delta, true
+}
+
+// emitStackBalanceCheck emits a jump to the postamble, exiting with
+// TrapStackImbalance unless the stack length is delta more than it was
+// on entry. Values held in registers must have been flushed.
+func (b *AMD64Backend) emitStackBalanceCheck(builder Assembler, regs *dirtyRegs, delta int) {
+	// movq rbx, [r10+8] (the length on entry)
+	// leaq rbx, [rbx + delta]
+	// cmpq r13, rbx
+	// jne  <trap>
+	if !regs.R13 {
+		// Nothing was pushed or popped.
+		prog := builder.NewProg()
+		prog.As = x86.AMOVQ
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = regStackLen
+		prog.From.Type = obj.TYPE_MEM
+		prog.From.Reg = regStackHeader
+		prog.From.Offset = 8
+		builder.AddInstruction(prog)
+		regs.R13 = true
+	}
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_BX
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = regStackHeader
+	prog.From.Offset = 8
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.ALEAQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_BX
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = x86.REG_BX
+	prog.From.Offset = int64(delta)
+	builder.AddInstruction(prog)
 
-	out := builder.Assemble()
-	// cmd := exec.Command("ndisasm", "-b64", "-")
-	// cmd.Stdin = bytes.NewReader(out)
-	// cmd.Stdout = os.Stdout
-	// cmd.Run()
-	return out, nil
+	prog = builder.NewProg()
+	prog.As = x86.ACMPQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = regStackLen
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_BX
+	builder.AddInstruction(prog)
+	b.emitConditionalReturn(builder, regs, x86.AJNE, TrapStackImbalance)
 }
 
-func (b *AMD64Backend) readIntImmediate(code []byte, meta InstructionMetadata) uint64 {
-	if meta.Size == 5 {
-		return uint64(binary.LittleEndian.Uint32(code[meta.Start+1 : meta.Start+meta.Size]))
+// readIntImmediate decodes the integer immediate of an instruction.
+// Compile re-encodes the LEB128 immediates of the wasm binary format
+// as fixed-width little-endian values, so constants of any encoded
+// length (up to 10 bytes for an i64) occupy 4 or 8 bytes here.
+func (b *AMD64Backend) readIntImmediate(code []byte, meta InstructionMetadata) (uint64, error) {
+	switch meta.Size {
+	case 5:
+		return uint64(binary.LittleEndian.Uint32(code[meta.Start+1 : meta.Start+meta.Size])), nil
+	case 9:
+		return binary.LittleEndian.Uint64(code[meta.Start+1 : meta.Start+meta.Size]), nil
 	}
-	return binary.LittleEndian.Uint64(code[meta.Start+1 : meta.Start+meta.Size])
+	return 0, fmt.Errorf("unexpected immediate size %d for op 0x%x", meta.Size-1, meta.Op)
 }
 
-func (b *AMD64Backend) emitWasmLocalsLoad(builder *asm.Builder, regs *dirtyRegs, reg int16, index uint64) {
+// emitWasmLocalsLoad loads the local at index into reg with mov. RBX & RCX
+// are clobbered.
+//
+// Locals are never cached in registers: every get_local reads the locals
+// slice and every set_local writes it, so a candidate may use any number
+// of them, and the slice is always current when native code exits. Only
+// stack values are held in registers, and those spill to the stack slice
+// when amd64HeldRegs run out (see holdReg).
+func (b *AMD64Backend) emitWasmLocalsLoad(builder Assembler, regs *dirtyRegs, reg int16, mov obj.As, index uint64) {
 	// movq rbx, $(index)
 	// movq rcx, [r11]
 	// leaq rcx, [rcx + rbx*8]
-	// movq reg, rcx
+	// mov  reg, [rcx]
 	var offsetReg int16 = x86.REG_BX
 	prog := builder.NewProg()
 	prog.As = x86.AMOVQ
@@ -118,35 +808,114 @@ func (b *AMD64Backend) emitWasmLocalsLoad(builder *asm.Builder, regs *dirtyRegs,
 	prog.From.Type = obj.TYPE_CONST
 	prog.From.Offset = int64(index)
 	builder.AddInstruction(prog)
+	b.emitLocalsGuard(builder, regs, offsetReg)
+	b.emitLocalsBase(builder, x86.REG_CX)
 
 	prog = builder.NewProg()
-	prog.As = x86.AMOVQ
+	prog.As = x86.ALEAQ
 	prog.To.Type = obj.TYPE_REG
 	prog.To.Reg = x86.REG_CX
 	prog.From.Type = obj.TYPE_MEM
-	prog.From.Reg = x86.REG_R11
+	prog.From.Reg = x86.REG_CX
+	prog.From.Scale = 8
+	prog.From.Index = offsetReg
 	builder.AddInstruction(prog)
 
 	prog = builder.NewProg()
-	prog.As = x86.ALEAQ
-	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_CX
+	prog.As = mov
 	prog.From.Type = obj.TYPE_MEM
 	prog.From.Reg = x86.REG_CX
-	prog.From.Scale = 8
-	prog.From.Index = offsetReg
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = reg
 	builder.AddInstruction(prog)
+}
+
+// emitWasmLocalsStore stores the 64 bits of reg into the local at index.
+// Locals hold the bits of a value regardless of its type, like stack
+// slots. RBX & RCX are clobbered.
+func (b *AMD64Backend) emitWasmLocalsStore(builder Assembler, regs *dirtyRegs, reg int16, index uint64) {
+	// movq rbx, $(index)
+	// movq rcx, [r11]
+	// movq [rcx + rbx*8], reg
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_BX
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = int64(index)
+	builder.AddInstruction(prog)
+	b.emitLocalsGuard(builder, regs, x86.REG_BX)
+	b.emitLocalsBase(builder, x86.REG_CX)
 
 	prog = builder.NewProg()
 	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = reg
+	prog.To.Type = obj.TYPE_MEM
+	prog.To.Reg = x86.REG_CX
+	prog.To.Index = x86.REG_BX
+	prog.To.Scale = 8
+	builder.AddInstruction(prog)
+}
+
+// emitLocalsBase loads the base address of the locals into reg.
+//
+// The base is never cached in a register across instructions: anything
+// which can run between two accesses to locals and reallocate them, such
+// as a call back into the host, only has to leave the sliceHeader at
+// regLocalsHeader in place for the next access to see the new locals.
+// Nothing emitted today can reallocate the locals within a block.
+func (b *AMD64Backend) emitLocalsBase(builder Assembler, reg int16) {
+	// movq reg, [r11]
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = reg
 	prog.From.Type = obj.TYPE_MEM
-	prog.From.Reg = x86.REG_CX
+	prog.From.Reg = regLocalsHeader
+	builder.AddInstruction(prog)
+}
+
+// emitLocalsGuard exits with TrapLocalOutOfRange unless the local index
+// in reg is less than the length of the locals, if locals guards are
+// enabled.
+func (b *AMD64Backend) emitLocalsGuard(builder Assembler, regs *dirtyRegs, reg int16) {
+	if !b.guardLocals {
+		return
+	}
+	// cmpq [r11+8], reg
+	// jbe  <trap>
+	prog := builder.NewProg()
+	prog.As = x86.ACMPQ
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = regLocalsHeader
+	prog.From.Offset = 8
 	prog.To.Type = obj.TYPE_REG
 	prog.To.Reg = reg
 	builder.AddInstruction(prog)
+	b.emitConditionalReturn(builder, regs, x86.AJLS, TrapLocalOutOfRange)
+}
+
+// localRegister returns the register a local of type typ is loaded into,
+// and the instruction which loads it. Float locals go into XMM registers,
+// where float ops expect them. MOVSS zeroes the upper bits, so f32 values
+// are pushed with the upper half of their stack slot cleared. Likewise,
+// MOVL zero-extends i32 locals, so any bits left above them in the slot
+// never reach the stack.
+func localRegister(typ wasm.ValueType) (int16, obj.As) {
+	switch typ {
+	case wasm.ValueTypeI32:
+		return x86.REG_AX, x86.AMOVL
+	case wasm.ValueTypeF32:
+		return x86.REG_X0, x86.AMOVSS
+	case wasm.ValueTypeF64:
+		return x86.REG_X0, x86.AMOVSD
+	default:
+		return x86.REG_AX, x86.AMOVQ
+	}
 }
 
-func (b *AMD64Backend) emitWasmStackLoad(builder *asm.Builder, regs *dirtyRegs, reg int16) {
+func (b *AMD64Backend) emitWasmStackLoad(builder Assembler, regs *dirtyRegs, reg int16) {
 	// movq r13,     [r10+8] (optional)
 	// decq r13
 	// movq r12,     [r10] (optional)
@@ -158,9 +927,9 @@ func (b *AMD64Backend) emitWasmStackLoad(builder *asm.Builder, regs *dirtyRegs,
 		prog = builder.NewProg()
 		prog.As = x86.AMOVQ
 		prog.To.Type = obj.TYPE_REG
-		prog.To.Reg = x86.REG_R13
+		prog.To.Reg = regStackLen
 		prog.From.Type = obj.TYPE_MEM
-		prog.From.Reg = x86.REG_R10
+		prog.From.Reg = regStackHeader
 		prog.From.Offset = 8
 		builder.AddInstruction(prog)
 		regs.R13 = true
@@ -169,40 +938,41 @@ func (b *AMD64Backend) emitWasmStackLoad(builder *asm.Builder, regs *dirtyRegs,
 	prog = builder.NewProg()
 	prog.As = x86.ADECQ
 	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_R13
+	prog.To.Reg = regStackLen
 	builder.AddInstruction(prog)
 
 	if !regs.R12 {
 		prog = builder.NewProg()
 		prog.As = x86.AMOVQ
 		prog.To.Type = obj.TYPE_REG
-		prog.To.Reg = x86.REG_R12
+		prog.To.Reg = regStackItem
 		prog.From.Type = obj.TYPE_MEM
-		prog.From.Reg = x86.REG_R10
+		prog.From.Reg = regStackHeader
 		builder.AddInstruction(prog)
 	}
 
 	prog = builder.NewProg()
 	prog.As = x86.ALEAQ
 	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_R12
+	prog.To.Reg = regStackItem
 	prog.From.Type = obj.TYPE_MEM
-	prog.From.Reg = x86.REG_R12
+	prog.From.Reg = regStackItem
 	prog.From.Scale = 8
-	prog.From.Index = x86.REG_R13
+	prog.From.Index = regStackLen
 	builder.AddInstruction(prog)
 
 	prog = builder.NewProg()
 	prog.As = x86.AMOVQ
 	prog.From.Type = obj.TYPE_MEM
-	prog.From.Reg = x86.REG_R12
+	prog.From.Reg = regStackItem
 	prog.To.Type = obj.TYPE_REG
 	prog.To.Reg = reg
 	builder.AddInstruction(prog)
 }
 
-func (b *AMD64Backend) emitWasmStackPush(builder *asm.Builder, regs *dirtyRegs, reg int16) {
+func (b *AMD64Backend) emitWasmStackPush(builder Assembler, regs *dirtyRegs, reg int16) {
 	// movq r13,     [r10+8] (optional)
+	// <check r13 against [r10+16]> (if guarded)
 	// movq r12,     [r10] (optional)
 	// leaq r12,     [r12 + r13*8]
 	// movq [r12],   reg
@@ -213,38 +983,52 @@ func (b *AMD64Backend) emitWasmStackPush(builder *asm.Builder, regs *dirtyRegs,
 		prog = builder.NewProg()
 		prog.As = x86.AMOVQ
 		prog.To.Type = obj.TYPE_REG
-		prog.To.Reg = x86.REG_R13
+		prog.To.Reg = regStackLen
 		prog.From.Type = obj.TYPE_MEM
-		prog.From.Reg = x86.REG_R10
+		prog.From.Reg = regStackHeader
 		prog.From.Offset = 8
 		builder.AddInstruction(prog)
 		regs.R13 = true
 	}
 
+	if b.guardStack {
+		// cmpq r13, [r10+16]
+		// jae  <trap>
+		prog = builder.NewProg()
+		prog.As = x86.ACMPQ
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = regStackLen
+		prog.To.Type = obj.TYPE_MEM
+		prog.To.Reg = regStackHeader
+		prog.To.Offset = 16
+		builder.AddInstruction(prog)
+		b.emitConditionalReturn(builder, regs, x86.AJCC, TrapStackOverflow)
+	}
+
 	if !regs.R12 {
 		prog = builder.NewProg()
 		prog.As = x86.AMOVQ
 		prog.To.Type = obj.TYPE_REG
-		prog.To.Reg = x86.REG_R12
+		prog.To.Reg = regStackItem
 		prog.From.Type = obj.TYPE_MEM
-		prog.From.Reg = x86.REG_R10
+		prog.From.Reg = regStackHeader
 		builder.AddInstruction(prog)
 	}
 
 	prog = builder.NewProg()
 	prog.As = x86.ALEAQ
 	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_R12
+	prog.To.Reg = regStackItem
 	prog.From.Type = obj.TYPE_MEM
-	prog.From.Reg = x86.REG_R12
+	prog.From.Reg = regStackItem
 	prog.From.Scale = 8
-	prog.From.Index = x86.REG_R13
+	prog.From.Index = regStackLen
 	builder.AddInstruction(prog)
 
 	prog = builder.NewProg()
 	prog.As = x86.AMOVQ
 	prog.To.Type = obj.TYPE_MEM
-	prog.To.Reg = x86.REG_R12
+	prog.To.Reg = regStackItem
 	prog.From.Type = obj.TYPE_REG
 	prog.From.Reg = reg
 	builder.AddInstruction(prog)
@@ -252,88 +1036,1767 @@ func (b *AMD64Backend) emitWasmStackPush(builder *asm.Builder, regs *dirtyRegs,
 	prog = builder.NewProg()
 	prog.As = x86.AINCQ
 	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_R13
+	prog.To.Reg = regStackLen
 	builder.AddInstruction(prog)
 }
 
-func (b *AMD64Backend) emitBinaryI64(builder *asm.Builder, regs *dirtyRegs, op byte) error {
+// comparisons describes how each integer comparison is emitted: the
+// instruction comparing the operands, and the conditional jump & set
+// instructions for the condition which holds if the comparison is true.
+var comparisons = map[byte]struct{ cmp, jump, set obj.As }{
+	ops.I64Eq:  {x86.ACMPQ, x86.AJEQ, x86.ASETEQ},
+	ops.I64Ne:  {x86.ACMPQ, x86.AJNE, x86.ASETNE},
+	ops.I64LtS: {x86.ACMPQ, x86.AJLT, x86.ASETLT},
+	ops.I64LtU: {x86.ACMPQ, x86.AJCS, x86.ASETCS},
+	ops.I64GtS: {x86.ACMPQ, x86.AJGT, x86.ASETGT},
+	ops.I64GtU: {x86.ACMPQ, x86.AJHI, x86.ASETHI},
+	ops.I64LeS: {x86.ACMPQ, x86.AJLE, x86.ASETLE},
+	ops.I64LeU: {x86.ACMPQ, x86.AJLS, x86.ASETLS},
+	ops.I64GeS: {x86.ACMPQ, x86.AJGE, x86.ASETGE},
+	ops.I64GeU: {x86.ACMPQ, x86.AJCC, x86.ASETCC},
+	ops.I32Eq:  {x86.ACMPL, x86.AJEQ, x86.ASETEQ},
+	ops.I32Ne:  {x86.ACMPL, x86.AJNE, x86.ASETNE},
+	ops.I32LtS: {x86.ACMPL, x86.AJLT, x86.ASETLT},
+	ops.I32LtU: {x86.ACMPL, x86.AJCS, x86.ASETCS},
+	ops.I32GtS: {x86.ACMPL, x86.AJGT, x86.ASETGT},
+	ops.I32GtU: {x86.ACMPL, x86.AJHI, x86.ASETHI},
+	ops.I32LeS: {x86.ACMPL, x86.AJLE, x86.ASETLE},
+	ops.I32LeU: {x86.ACMPL, x86.AJLS, x86.ASETLS},
+	ops.I32GeS: {x86.ACMPL, x86.AJGE, x86.ASETGE},
+	ops.I32GeU: {x86.ACMPL, x86.AJCC, x86.ASETCC},
+}
+
+// readBranchTarget returns the target address of an OpJmpNz instruction.
+func readBranchTarget(code []byte, meta InstructionMetadata) int64 {
+	return int64(binary.LittleEndian.Uint64(code[meta.Start+1:]))
+}
+
+// emitCompare pops two operands from the stack, and compares them
+// according to the comparison op, leaving the result in the flags.
+func (b *AMD64Backend) emitCompare(builder Assembler, regs *dirtyRegs, op byte) {
 	b.emitWasmStackLoad(builder, regs, x86.REG_R9)
 	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
 
+	// cmp rax, r9
 	prog := builder.NewProg()
+	prog.As = comparisons[op].cmp
 	prog.From.Type = obj.TYPE_REG
-	prog.From.Reg = x86.REG_R9
-	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_AX
-	switch op {
-	case ops.I64Add:
-		prog.As = x86.AADDQ
-	case ops.I64Sub:
-		prog.As = x86.ASUBQ
-	case ops.I64And:
-		prog.As = x86.AANDQ
-	case ops.I64Or:
-		prog.As = x86.AORQ
-	case ops.I64Mul:
-		prog.As = x86.AMULQ
-		prog.From.Reg = x86.REG_R9
-		prog.To.Type = obj.TYPE_NONE
-	default:
-		return fmt.Errorf("cannot handle op: %x", op)
-	}
-	builder.AddInstruction(prog)
-
-	b.emitWasmStackPush(builder, regs, x86.REG_AX)
-	return nil
-}
-
-func (b *AMD64Backend) emitPushI64(builder *asm.Builder, regs *dirtyRegs, c uint64) {
-	prog := builder.NewProg()
-	prog.As = x86.AMOVQ
-	prog.From.Type = obj.TYPE_CONST
-	prog.From.Offset = int64(c)
+	prog.From.Reg = x86.REG_AX
 	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_AX
+	prog.To.Reg = x86.REG_R9
 	builder.AddInstruction(prog)
-	b.emitWasmStackPush(builder, regs, x86.REG_AX)
 }
 
-// emitPreamble loads the address of the stack slice & locals into
-// R10 and R11 respectively.
-func (b *AMD64Backend) emitPreamble(builder *asm.Builder, regs *dirtyRegs) {
+// emitSetCondition pushes the i32 result of the comparison op, from
+// the flags set by emitCompare.
+func (b *AMD64Backend) emitSetCondition(builder Assembler, regs *dirtyRegs, op byte) {
+	// setcc al
+	// movbqzx rax, al
 	prog := builder.NewProg()
-	prog.As = x86.AMOVQ
+	prog.As = comparisons[op].set
 	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_R10
-	prog.From.Type = obj.TYPE_MEM
-	prog.From.Reg = x86.REG_SP
-	prog.From.Offset = 8
+	prog.To.Reg = x86.REG_AL
 	builder.AddInstruction(prog)
 
 	prog = builder.NewProg()
-	prog.As = x86.AMOVQ
+	prog.As = x86.AMOVBQZX
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AL
 	prog.To.Type = obj.TYPE_REG
-	prog.To.Reg = x86.REG_R11
-	prog.From.Type = obj.TYPE_MEM
-	prog.From.Reg = x86.REG_SP
-	prog.From.Offset = 16
+	prog.To.Reg = x86.REG_AX
 	builder.AddInstruction(prog)
+
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
 }
 
-func (b *AMD64Backend) emitPostamble(builder *asm.Builder, regs *dirtyRegs) {
-	// movq [r10+8], r13
-	if regs.R13 {
+// emitDrop discards the value on the top of the stack. A held value is
+// never pushed, otherwise the stack length is decremented. The length is
+// loaded first if no instruction before has, such as when the drop begins
+// the candidate and discards a value pushed by the interpreter.
+func (b *AMD64Backend) emitDrop(builder Assembler, regs *dirtyRegs) {
+	if n := len(regs.held); n > 0 {
+		regs.held = regs.held[:n-1]
+		return
+	}
+	// movq r13, [r10+8] (optional)
+	// decq r13
+	if !regs.R13 {
 		prog := builder.NewProg()
 		prog.As = x86.AMOVQ
-		prog.From.Type = obj.TYPE_REG
-		prog.From.Reg = x86.REG_R13
-		prog.To.Type = obj.TYPE_MEM
-		prog.To.Reg = x86.REG_R10
-		prog.To.Offset = 8
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = regStackLen
+		prog.From.Type = obj.TYPE_MEM
+		prog.From.Reg = regStackHeader
+		prog.From.Offset = 8
 		builder.AddInstruction(prog)
+		regs.R13 = true
 	}
-
-	ret := builder.NewProg()
-	ret.As = obj.ARET
+	prog := builder.NewProg()
+	prog.As = x86.ADECQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = regStackLen
+	builder.AddInstruction(prog)
+}
+
+// emitSelect emits select, choosing the first of two operands of type typ
+// if the i32 condition on the top of the stack is not zero, else the
+// second. Integers are selected with CMOV, and floats with a conditional
+// move between XMM registers.
+func (b *AMD64Backend) emitSelect(builder Assembler, regs *dirtyRegs, typ wasm.ValueType) {
+	b.emitWasmStackLoad(builder, regs, x86.REG_CX)
+
+	prog := builder.NewProg()
+	prog.As = x86.ATESTL
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_CX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_CX
+
+	switch typ {
+	case wasm.ValueTypeF32, wasm.ValueTypeF64:
+		// testl   ecx, ecx
+		// jne     done
+		// movaps  xmm0, xmm1
+		// done:
+		b.emitWasmStackLoad(builder, regs, x86.REG_X1)
+		b.emitWasmStackLoad(builder, regs, x86.REG_X0)
+		builder.AddInstruction(prog)
+
+		jump := builder.NewProg()
+		jump.As = x86.AJNE
+		jump.To.Type = obj.TYPE_BRANCH
+		builder.AddInstruction(jump)
+
+		prog = builder.NewProg()
+		prog.As = x86.AMOVAPS
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_X1
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_X0
+		builder.AddInstruction(prog)
+
+		done := builder.NewProg()
+		done.As = obj.ANOP
+		builder.AddInstruction(done)
+		jump.Pcond = done
+
+		b.emitWasmStackPush(builder, regs, x86.REG_X0)
+	default:
+		// testl   ecx, ecx
+		// cmovqeq rax, r9
+		b.emitWasmStackLoad(builder, regs, x86.REG_R9)
+		b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+		builder.AddInstruction(prog)
+
+		prog = builder.NewProg()
+		prog.As = x86.ACMOVQEQ
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_R9
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_AX
+		builder.AddInstruction(prog)
+
+		b.emitWasmStackPush(builder, regs, x86.REG_AX)
+	}
+}
+
+// stackEffect describes how an instruction changes the stack.
+type stackEffect struct {
+	pops, pushes int
+	// typ is the type of the value pushed, if any.
+	typ wasm.ValueType
+}
+
+// instStackEffect returns the stack effect of inst, or false if it is
+// not an instruction the backend compiles.
+func (b *AMD64Backend) instStackEffect(code []byte, meta *BytecodeMetadata, inst InstructionMetadata) (stackEffect, bool) {
+	if _, ok := comparisons[inst.Op]; ok {
+		return stackEffect{2, 1, wasm.ValueTypeI32}, true
+	}
+	if _, ok := roundingModes[inst.Op]; ok {
+		return stackEffect{1, 1, wasm.ValueTypeF64}, true
+	}
+	switch inst.Op {
+	case ops.I64Const:
+		return stackEffect{0, 1, wasm.ValueTypeI64}, true
+	case ops.I32Const:
+		return stackEffect{0, 1, wasm.ValueTypeI32}, true
+	case ops.GetLocal:
+		index, err := b.readIntImmediate(code, inst)
+		if err != nil {
+			return stackEffect{}, false
+		}
+		return stackEffect{0, 1, meta.LocalType(index)}, true
+	case ops.I64Add, ops.I64Sub, ops.I64Mul, ops.I64DivU, ops.I64And, ops.I64Or, ops.I64Shl:
+		return stackEffect{2, 1, wasm.ValueTypeI64}, true
+	case ops.I32Add, ops.I32Mul, ops.I32Shl, ops.I32ShrS, ops.I32ShrU, ops.I32Rotl, ops.I32Rotr,
+		ops.I32DivS, ops.I32DivU, ops.I32RemS, ops.I32RemU:
+		return stackEffect{2, 1, wasm.ValueTypeI32}, true
+	case ops.I32WrapI64, ops.I32ReinterpretF32, ops.I32Load:
+		return stackEffect{1, 1, wasm.ValueTypeI32}, true
+	case ops.I64ReinterpretF64, ops.I64Load:
+		return stackEffect{1, 1, wasm.ValueTypeI64}, true
+	case ops.F32ReinterpretI32, ops.F32Abs, ops.F32ConvertUI32, ops.F32ConvertUI64:
+		return stackEffect{1, 1, wasm.ValueTypeF32}, true
+	case ops.F64ReinterpretI64, ops.F64Abs, ops.F64ConvertUI32, ops.F64ConvertUI64:
+		return stackEffect{1, 1, wasm.ValueTypeF64}, true
+	case ops.F32Add, ops.F32Mul, ops.F32Copysign:
+		return stackEffect{2, 1, wasm.ValueTypeF32}, true
+	case ops.F64Add, ops.F64Mul, ops.F64Copysign:
+		return stackEffect{2, 1, wasm.ValueTypeF64}, true
+	case ops.I32Store, ops.I64Store:
+		return stackEffect{2, 0, 0}, true
+	case OpJmpNz, ops.Drop:
+		return stackEffect{1, 0, 0}, true
+	case ops.Nop:
+		return stackEffect{}, true
+	}
+	return stackEffect{}, false
+}
+
+// selectOperandType infers the type of the operands of the select at
+// meta.Instructions[i], from the instruction in the candidate which
+// pushed its second operand. Stack slots hold the bits of a value
+// regardless of its type, so selecting in the wrong register file is
+// still correct. Where the type cannot be inferred, such as when the
+// operand was pushed before the candidate, it returns i64.
+func (b *AMD64Backend) selectOperandType(code []byte, meta *BytecodeMetadata, candidate CompilationCandidate, i int) wasm.ValueType {
+	// The number of values above the operand on the stack.
+	depth := 1
+	for j := i - 1; j >= candidate.StartInstruction; j-- {
+		effect, ok := b.instStackEffect(code, meta, meta.Instructions[j])
+		if !ok {
+			break
+		}
+		if depth < effect.pushes {
+			return effect.typ
+		}
+		depth += effect.pops - effect.pushes
+	}
+	return wasm.ValueTypeI64
+}
+
+// constValue is a value on the stack which is known at compile time, as
+// it was computed by the instructions start..end alone.
+type constValue struct {
+	known      bool
+	start, end int
+	value      uint64
+}
+
+// foldConstants propagates constants through the locals & i64 arithmetic
+// of the candidate. It returns the runs of instructions which only push a
+// value known at compile time, keyed by the index of their first
+// instruction. Locals are unknown at the beginning of the candidate, and
+// become known when set to a known value.
+func (b *AMD64Backend) foldConstants(code []byte, meta *BytecodeMetadata, candidate CompilationCandidate) map[int]constValue {
+	folds := map[int]constValue{}
+	locals := map[uint64]uint64{}
+	var stack []constValue
+	pop := func() constValue {
+		// Values pushed before the candidate are unknown.
+		if len(stack) == 0 {
+			return constValue{}
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v
+	}
+	push := func(v constValue) {
+		stack = append(stack, v)
+		if v.known && (v.start < v.end || meta.Instructions[v.start].Op == ops.GetLocal) {
+			folds[v.start] = v
+		}
+	}
+
+	for i := candidate.StartInstruction; i <= candidate.EndInstruction; i++ {
+		inst := meta.Instructions[i]
+		switch inst.Op {
+		case ops.I64Const, ops.I32Const:
+			c, err := b.readIntImmediate(code, inst)
+			if err != nil {
+				return nil
+			}
+			push(constValue{true, i, i, c})
+			continue
+		case ops.GetLocal, ops.SetLocal:
+			index, err := b.readIntImmediate(code, inst)
+			if err != nil {
+				return nil
+			}
+			if inst.Op == ops.SetLocal {
+				if v := pop(); v.known {
+					locals[index] = v.value
+				} else {
+					delete(locals, index)
+				}
+				continue
+			}
+			c, ok := locals[index]
+			push(constValue{ok, i, i, c})
+			continue
+		case ops.I64Add, ops.I64Sub, ops.I64Mul, ops.I64And, ops.I64Or, ops.I64Shl:
+			y, x := pop(), pop()
+			// Both operands must be computed by the instructions just
+			// before, so folding them skips no other instruction.
+			if !x.known || !y.known || y.end != i-1 || x.end != y.start-1 {
+				push(constValue{})
+				continue
+			}
+			v := constValue{known: true, start: x.start, end: i}
+			switch inst.Op {
+			case ops.I64Add:
+				v.value = x.value + y.value
+			case ops.I64Sub:
+				v.value = x.value - y.value
+			case ops.I64Mul:
+				v.value = x.value * y.value
+			case ops.I64And:
+				v.value = x.value & y.value
+			case ops.I64Or:
+				v.value = x.value | y.value
+			case ops.I64Shl:
+				v.value = x.value << (y.value & 63)
+			}
+			push(v)
+			continue
+		}
+
+		effect, ok := b.instStackEffect(code, meta, inst)
+		if !ok {
+			// Such as select: give up on the values on the stack, but
+			// not on the locals.
+			stack = stack[:0]
+			continue
+		}
+		for n := 0; n < effect.pops; n++ {
+			pop()
+		}
+		for n := 0; n < effect.pushes; n++ {
+			push(constValue{})
+		}
+	}
+	return folds
+}
+
+// emitBrIf pops an i32 from the stack, exiting to the bytecode address
+// target if it is not zero. Only branches which leave the rest of the
+// stack untouched are supported, see the scanner.
+func (b *AMD64Backend) emitBrIf(builder Assembler, regs *dirtyRegs, target int64) error {
+	if target < 0 {
+		return fmt.Errorf("invalid branch target: %d", target)
+	}
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+
+	// testl eax, eax
+	// jne   <exit>
+	prog := builder.NewProg()
+	prog.As = x86.ATESTL
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+	b.emitConditionalReturn(builder, regs, x86.AJNE, BranchExit(target))
+	return nil
+}
+
+// emitBinaryI64 emits a binary i64 op. Operands held in registers are
+// used in place, and the result is held for the next instruction.
+func (b *AMD64Backend) emitBinaryI64(builder Assembler, regs *dirtyRegs, op byte) error {
+	prog := builder.NewProg()
+	switch op {
+	case ops.I64Add:
+		prog.As = x86.AADDQ
+	case ops.I64Sub:
+		prog.As = x86.ASUBQ
+	case ops.I64And:
+		prog.As = x86.AANDQ
+	case ops.I64Or:
+		prog.As = x86.AORQ
+	case ops.I64Mul:
+		// Unlike MULQ, IMULQ leaves RDX alone. The low 64 bits of
+		// the product are the same.
+		prog.As = x86.AIMULQ
+	default:
+		return fmt.Errorf("cannot handle op: %x", op)
+	}
+	right := b.popReg(builder, regs, x86.REG_R9, 0)
+	left := b.popReg(builder, regs, x86.REG_AX, right)
+
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = right
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = left
+	builder.AddInstruction(prog)
+
+	b.holdReg(builder, regs, left)
+	return nil
+}
+
+// holdReg pushes the value in reg onto the wasm stack, keeping it in one
+// of amd64HeldRegs rather than writing it to memory. If all of them are
+// in use, the deepest held value is spilled to memory to make room.
+func (b *AMD64Backend) holdReg(builder Assembler, regs *dirtyRegs, reg int16) {
+	if b.noRegAlloc {
+		b.emitWasmStackPush(builder, regs, reg)
+		return
+	}
+	dst, ok := b.freeHeldReg(regs, 0)
+	if isHeldReg(reg) {
+		// Popped by popReg, so it is free.
+		dst, ok = reg, true
+	}
+	if !ok {
+		dst = regs.held[0]
+		b.emitWasmStackPush(builder, regs, dst)
+		regs.held = regs.held[1:]
+	}
+	if dst != reg {
+		prog := builder.NewProg()
+		prog.As = x86.AMOVQ
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = reg
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = dst
+		builder.AddInstruction(prog)
+	}
+	regs.held = append(regs.held, dst)
+}
+
+// holdTarget returns the register to load a value into for holdReg: a
+// free register of amd64HeldRegs, or RAX if there is none.
+func (b *AMD64Backend) holdTarget(regs *dirtyRegs) int16 {
+	if reg, ok := b.freeHeldReg(regs, 0); ok && !b.noRegAlloc {
+		return reg
+	}
+	return x86.REG_AX
+}
+
+// popReg pops the value on the top of the wasm stack, returning the
+// register holding it. Values which are not held are loaded from memory
+// into a free register of amd64HeldRegs other than except, or into
+// fallback if there is none.
+func (b *AMD64Backend) popReg(builder Assembler, regs *dirtyRegs, fallback, except int16) int16 {
+	if n := len(regs.held); n > 0 {
+		reg := regs.held[n-1]
+		regs.held = regs.held[:n-1]
+		return reg
+	}
+	reg := fallback
+	if free, ok := b.freeHeldReg(regs, except); ok && !b.noRegAlloc {
+		reg = free
+	}
+	b.emitWasmStackLoad(builder, regs, reg)
+	return reg
+}
+
+// flushHeld pushes the values held in registers to memory, deepest first,
+// so the stack in memory is complete.
+func (b *AMD64Backend) flushHeld(builder Assembler, regs *dirtyRegs) {
+	for _, reg := range regs.held {
+		b.emitWasmStackPush(builder, regs, reg)
+	}
+	regs.held = regs.held[:0]
+}
+
+// freeHeldReg returns a register of amd64HeldRegs which is neither held
+// nor except.
+func (b *AMD64Backend) freeHeldReg(regs *dirtyRegs, except int16) (int16, bool) {
+next:
+	for _, reg := range amd64HeldRegs {
+		if reg == except {
+			continue
+		}
+		for _, held := range regs.held {
+			if held == reg {
+				continue next
+			}
+		}
+		return reg, true
+	}
+	return 0, false
+}
+
+func isHeldReg(reg int16) bool {
+	for _, r := range amd64HeldRegs {
+		if r == reg {
+			return true
+		}
+	}
+	return false
+}
+
+// emitAddConst adds the constant c to reg. ADDQ sign-extends a 32-bit
+// immediate, so constants which don't fit in one are first moved into
+// R9. Adding 1 or -1 is an INCQ or DECQ.
+func (b *AMD64Backend) emitAddConst(builder Assembler, reg int16, c uint64) {
+	prog := builder.NewProg()
+	prog.As = x86.AADDQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = reg
+	switch c {
+	case 1:
+		prog.As = x86.AINCQ
+		builder.AddInstruction(prog)
+		return
+	case math.MaxUint64:
+		prog.As = x86.ADECQ
+		builder.AddInstruction(prog)
+		return
+	}
+	if v := int64(c); v >= math.MinInt32 && v <= math.MaxInt32 {
+		prog.From.Type = obj.TYPE_CONST
+		prog.From.Offset = v
+		builder.AddInstruction(prog)
+		return
+	}
+
+	mov := builder.NewProg()
+	mov.As = x86.AMOVQ
+	mov.From.Type = obj.TYPE_CONST
+	mov.From.Offset = int64(c)
+	mov.To.Type = obj.TYPE_REG
+	mov.To.Reg = x86.REG_R9
+	builder.AddInstruction(mov)
+
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_R9
+	builder.AddInstruction(prog)
+}
+
+// emitAbsLocal emits the absolute value of an i64 local, for the sequence
+// in insts:
+//   i64.const 0; get_local x; i64.sub; get_local x;
+//   get_local x; i64.const 0; i64.lt_s; select
+// which selects 0 - x if x is negative, and x otherwise. The result is
+// computed without branching, as (x ^ m) - m where m is the sign of x
+// spread across all 64 bits, and held for the next instruction. It
+// returns false, emitting nothing, if insts is not such a sequence.
+func (b *AMD64Backend) emitAbsLocal(builder Assembler, regs *dirtyRegs, code []byte, meta *BytecodeMetadata, insts []InstructionMetadata) (bool, error) {
+	want := []byte{ops.I64Const, ops.GetLocal, ops.I64Sub, ops.GetLocal, ops.GetLocal, ops.I64Const, ops.I64LtS, ops.Select}
+	for n, op := range want {
+		if insts[n].Op != op {
+			return false, nil
+		}
+	}
+	var imm [5]uint64 // 0, x, x, x, 0
+	for n, inst := range []InstructionMetadata{insts[0], insts[1], insts[3], insts[4], insts[5]} {
+		v, err := b.readIntImmediate(code, inst)
+		if err != nil {
+			return false, err
+		}
+		imm[n] = v
+	}
+	index := imm[1]
+	if imm[0] != 0 || imm[4] != 0 || imm[2] != index || imm[3] != index || meta.LocalType(index) != wasm.ValueTypeI64 {
+		return false, nil
+	}
+
+	// movq r9, reg
+	// sarq r9, $63
+	// xorq reg, r9
+	// subq reg, r9
+	reg := b.holdTarget(regs)
+	b.emitWasmLocalsLoad(builder, regs, reg, x86.AMOVQ, index)
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = reg
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_R9
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.ASARQ
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = 63
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_R9
+	builder.AddInstruction(prog)
+
+	for _, as := range []obj.As{x86.AXORQ, x86.ASUBQ} {
+		prog = builder.NewProg()
+		prog.As = as
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_R9
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = reg
+		builder.AddInstruction(prog)
+	}
+	b.holdReg(builder, regs, reg)
+	return true, nil
+}
+
+// emitIncDec adds 1 to the i64 on the top of the stack if op is
+// i64.add, or subtracts 1 if it is i64.sub. The result is held for the
+// next instruction.
+func (b *AMD64Backend) emitIncDec(builder Assembler, regs *dirtyRegs, op byte) {
+	reg := b.popReg(builder, regs, x86.REG_AX, 0)
+	prog := builder.NewProg()
+	prog.As = x86.AINCQ
+	if op == ops.I64Sub {
+		prog.As = x86.ADECQ
+	}
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = reg
+	builder.AddInstruction(prog)
+	b.holdReg(builder, regs, reg)
+}
+
+// emitNeg negates the i64 in reg.
+func (b *AMD64Backend) emitNeg(builder Assembler, reg int16) {
+	prog := builder.NewProg()
+	prog.As = x86.ANEGQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = reg
+	builder.AddInstruction(prog)
+}
+
+// emitLow32 truncates the top of the stack to its low 32 bits, for
+// i32.wrap_i64 and the 32-bit reinterpret casts. Writing a 32-bit
+// register zeroes the upper half, so MOVL to itself suffices.
+func (b *AMD64Backend) emitLow32(builder Assembler, regs *dirtyRegs) {
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+
+	prog := builder.NewProg()
+	prog.As = x86.AMOVL
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+}
+
+// emitDivU emits an unsigned 64-bit division with DIVQ, trapping if the
+// divisor is zero. DIVQ divides RDX:RAX, so RDX is cleared first.
+func (b *AMD64Backend) emitDivU(builder Assembler, regs *dirtyRegs) {
+	b.emitWasmStackLoad(builder, regs, x86.REG_R9)
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+
+	prog := builder.NewProg()
+	prog.As = x86.ATESTQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_R9
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_R9
+	builder.AddInstruction(prog)
+	b.emitConditionalReturn(builder, regs, x86.AJEQ, TrapIntegerDivideByZero)
+
+	prog = builder.NewProg()
+	prog.As = x86.AXORL
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_DX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_DX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.ADIVQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_R9
+	builder.AddInstruction(prog)
+
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+}
+
+// emitDivI32 pops a divisor & dividend from the stack, and pushes their
+// i32 quotient or remainder, depending on op. It exits with
+// TrapIntegerDivideByZero if the divisor is zero, and with
+// TrapIntegerOverflow for math.MinInt32 / -1. The remainder of
+// math.MinInt32 by -1 is zero, which IDIVL cannot compute as it faults.
+// Every path writes a 32-bit register, which clears the upper half of
+// the result.
+func (b *AMD64Backend) emitDivI32(builder Assembler, regs *dirtyRegs, op byte) {
+	b.emitWasmStackLoad(builder, regs, x86.REG_R9)
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+
+	// testl r9d, r9d
+	// je    <trap>
+	prog := builder.NewProg()
+	prog.As = x86.ATESTL
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_R9
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_R9
+	builder.AddInstruction(prog)
+	b.emitConditionalReturn(builder, regs, x86.AJEQ, TrapIntegerDivideByZero)
+
+	var done *obj.Prog
+	if op == ops.I32DivS || op == ops.I32RemS {
+		// cmpl  r9d, $-1
+		// jne   divide
+		// div_s:                       rem_s:
+		//   cmpl eax, $0x80000000        xorl eax, eax
+		//   je   <trap>
+		//   negl eax
+		// jmp   done
+		// divide:
+		// cdq
+		// idivl r9d
+		prog = builder.NewProg()
+		prog.As = x86.ACMPL
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_R9
+		prog.To.Type = obj.TYPE_CONST
+		prog.To.Offset = -1
+		builder.AddInstruction(prog)
+
+		divide := builder.NewProg()
+		divide.As = x86.AJNE
+		divide.To.Type = obj.TYPE_BRANCH
+		builder.AddInstruction(divide)
+
+		if op == ops.I32DivS {
+			prog = builder.NewProg()
+			prog.As = x86.ACMPL
+			prog.From.Type = obj.TYPE_REG
+			prog.From.Reg = x86.REG_AX
+			prog.To.Type = obj.TYPE_CONST
+			prog.To.Offset = math.MinInt32
+			builder.AddInstruction(prog)
+			b.emitConditionalReturn(builder, regs, x86.AJEQ, TrapIntegerOverflow)
+
+			prog = builder.NewProg()
+			prog.As = x86.ANEGL
+			prog.To.Type = obj.TYPE_REG
+			prog.To.Reg = x86.REG_AX
+			builder.AddInstruction(prog)
+		} else {
+			prog = builder.NewProg()
+			prog.As = x86.AXORL
+			prog.From.Type = obj.TYPE_REG
+			prog.From.Reg = x86.REG_AX
+			prog.To.Type = obj.TYPE_REG
+			prog.To.Reg = x86.REG_AX
+			builder.AddInstruction(prog)
+		}
+
+		done = builder.NewProg()
+		done.As = obj.AJMP
+		done.To.Type = obj.TYPE_BRANCH
+		builder.AddInstruction(done)
+
+		prog = builder.NewProg()
+		prog.As = x86.ACDQ
+		builder.AddInstruction(prog)
+		divide.Pcond = prog
+
+		prog = builder.NewProg()
+		prog.As = x86.AIDIVL
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_R9
+		builder.AddInstruction(prog)
+	} else {
+		// xorl edx, edx
+		// divl r9d
+		prog = builder.NewProg()
+		prog.As = x86.AXORL
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_DX
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_DX
+		builder.AddInstruction(prog)
+
+		prog = builder.NewProg()
+		prog.As = x86.ADIVL
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_R9
+		builder.AddInstruction(prog)
+	}
+
+	if op == ops.I32RemS || op == ops.I32RemU {
+		// movl eax, edx
+		prog = builder.NewProg()
+		prog.As = x86.AMOVL
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_DX
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_AX
+		builder.AddInstruction(prog)
+	}
+
+	if done != nil {
+		prog = builder.NewProg()
+		prog.As = obj.ANOP
+		builder.AddInstruction(prog)
+		done.Pcond = prog
+	}
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+}
+
+// divUMagic returns the multiplier m and shift s such that, for every
+// 64-bit x, x/c is computed by
+//    t := hi64(x*m)
+//    q := (t + (x-t)>>1) >> s
+// following Granlund & Montgomery, "Division by Invariant Integers
+// using Multiplication", figure 4.1. c must not be zero or a power of two.
+func divUMagic(c uint64) (m uint64, s uint) {
+	l := uint(64 - bits.LeadingZeros64(c-1))
+	// m = floor(2^64 * (2^l - c) / c) + 1; 2^l - c fits in 64 bits as
+	// l <= 64, wrapping when l is 64.
+	q, _ := bits.Div64((uint64(1)<<l)-c, 0, c)
+	return q + 1, l - 1
+}
+
+// emitConstDivU emits the unsigned division of the top of the stack by
+// the constant c, without a DIVQ. Powers of two become a shift, and
+// other divisors a multiplication by a magic number. It returns false,
+// emitting nothing, if c is zero, leaving the caller to emit the
+// trapping division.
+func (b *AMD64Backend) emitConstDivU(builder Assembler, regs *dirtyRegs, c uint64) bool {
+	if c == 0 {
+		return false
+	}
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+
+	if c&(c-1) == 0 {
+		if shift := bits.TrailingZeros64(c); shift > 0 {
+			b.emitShiftRight(builder, x86.REG_AX, int64(shift))
+		}
+		b.emitWasmStackPush(builder, regs, x86.REG_AX)
+		return true
+	}
+
+	m, s := divUMagic(c)
+
+	// movq r8, rax
+	// movq rdx, $m
+	// mulq rdx        ; rdx = hi64(x*m)
+	// movq rax, r8
+	// subq rax, rdx
+	// shrq rax, 1
+	// addq rax, rdx
+	// shrq rax, $s
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_R8
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = int64(m)
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_DX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMULQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_DX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_R8
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.ASUBQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_DX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	b.emitShiftRight(builder, x86.REG_AX, 1)
+
+	prog = builder.NewProg()
+	prog.As = x86.AADDQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_DX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	if s > 0 {
+		b.emitShiftRight(builder, x86.REG_AX, int64(s))
+	}
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+	return true
+}
+
+// emitConstMul emits the multiplication of the top of the stack by the
+// constant c. Powers of two become a shift, and 3, 5 & 9 a single LEAQ.
+// Other constants are moved into R9 for an IMULQ.
+func (b *AMD64Backend) emitConstMul(builder Assembler, regs *dirtyRegs, c uint64) {
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+
+	switch {
+	case c != 0 && c&(c-1) == 0:
+		if shift := bits.TrailingZeros64(c); shift > 0 {
+			prog := builder.NewProg()
+			prog.As = x86.ASHLQ
+			prog.From.Type = obj.TYPE_CONST
+			prog.From.Offset = int64(shift)
+			prog.To.Type = obj.TYPE_REG
+			prog.To.Reg = x86.REG_AX
+			builder.AddInstruction(prog)
+		}
+	case c == 3 || c == 5 || c == 9:
+		// leaq rax, [rax + rax*(c-1)]
+		prog := builder.NewProg()
+		prog.As = x86.ALEAQ
+		prog.From.Type = obj.TYPE_MEM
+		prog.From.Reg = x86.REG_AX
+		prog.From.Index = x86.REG_AX
+		prog.From.Scale = int16(c - 1)
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_AX
+		builder.AddInstruction(prog)
+	default:
+		prog := builder.NewProg()
+		prog.As = x86.AMOVQ
+		prog.From.Type = obj.TYPE_CONST
+		prog.From.Offset = int64(c)
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_R9
+		builder.AddInstruction(prog)
+
+		prog = builder.NewProg()
+		prog.As = x86.AIMULQ
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_R9
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_AX
+		builder.AddInstruction(prog)
+	}
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+}
+
+// emitShl emits an i64.shl. The count is taken in CL, which the processor
+// masks to 6 bits, matching the modulo 64 semantics of the wasm operator.
+func (b *AMD64Backend) emitShl(builder Assembler, regs *dirtyRegs) {
+	b.emitWasmStackLoad(builder, regs, x86.REG_CX)
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+
+	prog := builder.NewProg()
+	prog.As = x86.ASHLQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_CX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+}
+
+// emitConstShl emits an i64.shl of the value on the top of the stack by
+// the constant c, as an immediate. c is masked to 6 bits, as the wasm
+// operator takes the count modulo 64.
+func (b *AMD64Backend) emitConstShl(builder Assembler, regs *dirtyRegs, c uint64) {
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+	if shift := c & 63; shift > 0 {
+		prog := builder.NewProg()
+		prog.As = x86.ASHLQ
+		prog.From.Type = obj.TYPE_CONST
+		prog.From.Offset = int64(shift)
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_AX
+		builder.AddInstruction(prog)
+	}
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+}
+
+// emitShiftRight emits a logical right shift of reg by a constant.
+func (b *AMD64Backend) emitShiftRight(builder Assembler, reg int16, shift int64) {
+	prog := builder.NewProg()
+	prog.As = x86.ASHRQ
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = shift
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = reg
+	builder.AddInstruction(prog)
+}
+
+// emitBinaryFloat emits a binary float op. Operands are moved from the
+// stack into XMM registers with MOVQ, which preserves their bits exactly.
+func (b *AMD64Backend) emitBinaryFloat(builder Assembler, regs *dirtyRegs, op byte) error {
+	b.emitWasmStackLoad(builder, regs, x86.REG_X1)
+	b.emitWasmStackLoad(builder, regs, x86.REG_X0)
+
+	prog := builder.NewProg()
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_X1
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X0
+	switch op {
+	case ops.F32Add:
+		prog.As = x86.AADDSS
+	case ops.F64Add:
+		prog.As = x86.AADDSD
+	case ops.F32Mul:
+		prog.As = x86.AMULSS
+	case ops.F64Mul:
+		prog.As = x86.AMULSD
+	default:
+		return fmt.Errorf("cannot handle op: %x", op)
+	}
+	builder.AddInstruction(prog)
+
+	b.emitWasmStackPush(builder, regs, x86.REG_X0)
+	return nil
+}
+
+// hasFMA is true if the CPU supports FMA3, which is required for
+// VFMADD231SD. Without it, f64.mul & f64.add are always emitted separately.
+var hasFMA = cpu.X86.HasFMA
+
+// emitFusedMulAdd emits an f64.mul followed by an f64.add of the product
+// as one fused multiply-add, which only rounds the final result.
+func (b *AMD64Backend) emitFusedMulAdd(builder Assembler, regs *dirtyRegs) {
+	// vfmadd231sd xmm2, xmm0, xmm1
+	b.emitWasmStackLoad(builder, regs, x86.REG_X1)
+	b.emitWasmStackLoad(builder, regs, x86.REG_X0)
+	b.emitWasmStackLoad(builder, regs, x86.REG_X2)
+
+	prog := builder.NewProg()
+	prog.As = x86.AVFMADD231SD
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_X1
+	prog.SetFrom3(obj.Addr{Type: obj.TYPE_REG, Reg: x86.REG_X0})
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X2
+	builder.AddInstruction(prog)
+
+	b.emitWasmStackPush(builder, regs, x86.REG_X2)
+}
+
+// emitConvertUnsigned emits f32.convert_u or f64.convert_u of an i32 or
+// i64. CVTSQ2SD & CVTSQ2SS convert signed 64-bit integers, so an i32 is
+// zero-extended first. An i64 with the high bit set is halved, keeping
+// the low bit so the result still rounds correctly, then converted and
+// doubled.
+func (b *AMD64Backend) emitConvertUnsigned(builder Assembler, regs *dirtyRegs, op byte) {
+	convert, add := x86.ACVTSQ2SD, x86.AADDSD
+	if op == ops.F32ConvertUI32 || op == ops.F32ConvertUI64 {
+		convert, add = x86.ACVTSQ2SS, x86.AADDSS
+	}
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+
+	// CVTSQ2SS only writes the low 32 bits of xmm0, and the stack slot
+	// of an f32 must have its upper bits clear.
+	// xorps xmm0, xmm0
+	prog := builder.NewProg()
+	prog.As = x86.AXORPS
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_X0
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X0
+	builder.AddInstruction(prog)
+
+	if op == ops.F32ConvertUI32 || op == ops.F64ConvertUI32 {
+		// movl     eax, eax
+		// cvtsq2sd xmm0, rax
+		prog = builder.NewProg()
+		prog.As = x86.AMOVL
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_AX
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_AX
+		builder.AddInstruction(prog)
+
+		prog = builder.NewProg()
+		prog.As = convert
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_AX
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_X0
+		builder.AddInstruction(prog)
+
+		b.emitWasmStackPush(builder, regs, x86.REG_X0)
+		return
+	}
+
+	//   testq    rax, rax
+	//   js       high
+	//   cvtsq2sd xmm0, rax
+	//   jmp      done
+	// high:
+	//   movq     rcx, rax
+	//   shrq     rcx, 1
+	//   andq     rax, 1
+	//   orq      rcx, rax
+	//   cvtsq2sd xmm0, rcx
+	//   addsd    xmm0, xmm0
+	// done:
+	prog = builder.NewProg()
+	prog.As = x86.ATESTQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	toHigh := builder.NewProg()
+	toHigh.As = x86.AJMI
+	toHigh.To.Type = obj.TYPE_BRANCH
+	builder.AddInstruction(toHigh)
+
+	prog = builder.NewProg()
+	prog.As = convert
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X0
+	builder.AddInstruction(prog)
+
+	toDone := builder.NewProg()
+	toDone.As = obj.AJMP
+	toDone.To.Type = obj.TYPE_BRANCH
+	builder.AddInstruction(toDone)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_CX
+	builder.AddInstruction(prog)
+	toHigh.Pcond = prog
+
+	prog = builder.NewProg()
+	prog.As = x86.ASHRQ
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = 1
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_CX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.AANDQ
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = 1
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.AORQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_CX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = convert
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_CX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X0
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = add
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_X0
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X0
+	builder.AddInstruction(prog)
+
+	done := builder.NewProg()
+	done.As = obj.ANOP
+	builder.AddInstruction(done)
+	toDone.Pcond = done
+
+	b.emitWasmStackPush(builder, regs, x86.REG_X0)
+}
+
+// hasSSE41 is true if the CPU supports SSE4.1, which is required for
+// ROUNDSD. Without it, the rounding ops are left to the interpreter.
+var hasSSE41 = cpu.X86.HasSSE41
+
+// roundingModes are the ROUNDSD immediates of the rounding ops. f64.nearest
+// rounds half to even, as the default rounding mode does.
+var roundingModes = map[byte]int64{
+	ops.F64Nearest: 0,
+	ops.F64Floor:   1,
+	ops.F64Ceil:    2,
+	ops.F64Trunc:   3,
+}
+
+// emitFloatRound emits f64.ceil, f64.floor, f64.trunc or f64.nearest.
+func (b *AMD64Backend) emitFloatRound(builder Assembler, regs *dirtyRegs, op byte) {
+	// roundsd x0, x0, $(mode)
+	b.emitWasmStackLoad(builder, regs, x86.REG_X0)
+
+	prog := builder.NewProg()
+	prog.As = x86.AROUNDSD
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = roundingModes[op]
+	prog.SetFrom3(obj.Addr{Type: obj.TYPE_REG, Reg: x86.REG_X0})
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X0
+	builder.AddInstruction(prog)
+
+	b.emitWasmStackPush(builder, regs, x86.REG_X0)
+}
+
+// floatSignMask returns the mask of the sign bit of a float of the type
+// op operates on, and the bitwise and & or instructions for that type.
+func floatSignMask(op byte) (uint64, obj.As, obj.As) {
+	if op == ops.F32Abs || op == ops.F32Copysign {
+		return 1 << 31, x86.AANDPS, x86.AORPS
+	}
+	return 1 << 63, x86.AANDPD, x86.AORPD
+}
+
+// emitFloatMask moves mask into the XMM register reg, and emits inst
+// with reg as its source and dst as its destination. The mask goes
+// through RAX, which keeps the code position independent.
+func (b *AMD64Backend) emitFloatMask(builder Assembler, inst obj.As, mask uint64, reg, dst int16) {
+	// movq rax, $(mask)
+	// movq reg, rax
+	// inst dst, reg
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = int64(mask)
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = reg
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = inst
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = reg
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = dst
+	builder.AddInstruction(prog)
+}
+
+// emitFloatAbs emits f32.abs or f64.abs, clearing the sign bit. Masks
+// cover the whole stack slot, so the upper bits of an f32 are cleared
+// along with it.
+func (b *AMD64Backend) emitFloatAbs(builder Assembler, regs *dirtyRegs, op byte) {
+	sign, and, _ := floatSignMask(op)
+	b.emitWasmStackLoad(builder, regs, x86.REG_X0)
+	b.emitFloatMask(builder, and, sign-1, x86.REG_X1, x86.REG_X0)
+	b.emitWasmStackPush(builder, regs, x86.REG_X0)
+}
+
+// emitFloatCopysign emits f32.copysign or f64.copysign, combining the
+// magnitude of the first operand with the sign of the second.
+func (b *AMD64Backend) emitFloatCopysign(builder Assembler, regs *dirtyRegs, op byte) {
+	// x0 &= magnitude
+	// x1 &= sign
+	// x0 |= x1
+	sign, and, or := floatSignMask(op)
+	b.emitWasmStackLoad(builder, regs, x86.REG_X1)
+	b.emitWasmStackLoad(builder, regs, x86.REG_X0)
+	b.emitFloatMask(builder, and, sign-1, x86.REG_X2, x86.REG_X0)
+	b.emitFloatMask(builder, and, sign, x86.REG_X2, x86.REG_X1)
+
+	prog := builder.NewProg()
+	prog.As = or
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_X1
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_X0
+	builder.AddInstruction(prog)
+
+	b.emitWasmStackPush(builder, regs, x86.REG_X0)
+}
+
+func (b *AMD64Backend) emitBinaryI32(builder Assembler, regs *dirtyRegs, op byte) error {
+	// Shifts & rotates take their count in CL. The processor masks
+	// the count of 32-bit shifts & rotates to 5 bits, which matches
+	// the modulo 32 semantics of the wasm operators.
+	var operand int16 = x86.REG_R9
+	switch op {
+	case ops.I32Shl, ops.I32ShrS, ops.I32ShrU, ops.I32Rotl, ops.I32Rotr:
+		operand = x86.REG_CX
+	}
+	b.emitWasmStackLoad(builder, regs, operand)
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+
+	prog := builder.NewProg()
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = operand
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	switch op {
+	case ops.I32Add:
+		prog.As = x86.AADDL
+	case ops.I32Mul:
+		prog.As = x86.AIMULL
+	case ops.I32Shl:
+		prog.As = x86.ASHLL
+	case ops.I32ShrS:
+		prog.As = x86.ASARL
+	case ops.I32ShrU:
+		prog.As = x86.ASHRL
+	case ops.I32Rotl:
+		prog.As = x86.AROLL
+	case ops.I32Rotr:
+		prog.As = x86.ARORL
+	default:
+		return fmt.Errorf("cannot handle op: %x", op)
+	}
+	builder.AddInstruction(prog)
+
+	// Writing the 32-bit form of a register zeroes the upper 32 bits,
+	// so the result is zero-extended into the stack slot like the
+	// interpreter expects.
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+	return nil
+}
+
+// memoryAccessWidth returns the number of bytes accessed by a load
+// or store, and the move instruction which performs the access.
+func memoryAccessWidth(op byte) (int64, obj.As, error) {
+	switch op {
+	case ops.I32Load, ops.I32Store:
+		return 4, x86.AMOVL, nil
+	case ops.I64Load, ops.I64Store:
+		return 8, x86.AMOVQ, nil
+	}
+	return 0, obj.AXXX, fmt.Errorf("cannot handle op: %x", op)
+}
+
+// emitEffectiveAddress computes the effective address of a memory access
+// from the i32 address in RAX and the static offset, as RAX plus the
+// returned displacement. The address is computed in 64 bits, so the sum
+// can never wrap, as the spec requires. A jump to the postamble is
+// emitted, trapping if the access of width bytes is outside the current
+// bounds of linear memory.
+func (b *AMD64Backend) emitEffectiveAddress(builder Assembler, regs *dirtyRegs, offset uint64, width int64) int64 {
+	// movl rax, eax (zero-extend the i32 address)
+	// movl rdx, $(offset)   (if offset doesn't fit the displacement)
+	// addq rax, rdx
+	// leaq rcx, [rax + disp + width]
+	// cmpq rcx, [rsi+8]
+	// ja   <trap>
+	prog := builder.NewProg()
+	prog.As = x86.AMOVL
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	// Displacements are sign-extended 32 bit values.
+	var disp int64
+	if offset+uint64(width) <= math.MaxInt32 {
+		disp = int64(offset)
+	} else {
+		prog = builder.NewProg()
+		prog.As = x86.AMOVL
+		prog.From.Type = obj.TYPE_CONST
+		prog.From.Offset = int64(uint32(offset))
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_DX
+		builder.AddInstruction(prog)
+
+		prog = builder.NewProg()
+		prog.As = x86.AADDQ
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = x86.REG_DX
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = x86.REG_AX
+		builder.AddInstruction(prog)
+	}
+
+	prog = builder.NewProg()
+	prog.As = x86.ALEAQ
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = x86.REG_AX
+	prog.From.Offset = disp + width
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_CX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.ACMPQ
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_CX
+	prog.To.Type = obj.TYPE_MEM
+	prog.To.Reg = regMemoryHeader
+	prog.To.Offset = 8
+	builder.AddInstruction(prog)
+	b.emitConditionalReturn(builder, regs, x86.AJHI, TrapOutOfBoundsMemory)
+	return disp
+}
+
+// emitLoad emits a load from linear memory, addressed by the i32 on the
+// top of the stack plus the static offset. The loaded value replaces the
+// address on the stack.
+func (b *AMD64Backend) emitLoad(builder Assembler, regs *dirtyRegs, op byte, offset uint64) error {
+	width, mov, err := memoryAccessWidth(op)
+	if err != nil {
+		return err
+	}
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+	disp := b.emitEffectiveAddress(builder, regs, offset, width)
+
+	// movq rdx, [rsi]
+	// mov  rax, [rdx + rax + disp]
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = regMemoryHeader
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_DX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = mov
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = x86.REG_DX
+	prog.From.Index = x86.REG_AX
+	prog.From.Scale = 1
+	prog.From.Offset = disp
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+	return nil
+}
+
+// emitStore emits a store of the value on the top of the stack to linear
+// memory, addressed by the i32 below it plus the static offset. Both
+// operands are popped from the stack.
+func (b *AMD64Backend) emitStore(builder Assembler, regs *dirtyRegs, op byte, offset uint64) error {
+	width, mov, err := memoryAccessWidth(op)
+	if err != nil {
+		return err
+	}
+	b.emitWasmStackLoad(builder, regs, x86.REG_R9)
+	b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+	disp := b.emitEffectiveAddress(builder, regs, offset, width)
+
+	// movq rdx, [rsi]
+	// mov  [rdx + rax + disp], r9
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = regMemoryHeader
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_DX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = mov
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_R9
+	prog.To.Type = obj.TYPE_MEM
+	prog.To.Reg = x86.REG_DX
+	prog.To.Index = x86.REG_AX
+	prog.To.Scale = 1
+	prog.To.Offset = disp
+	builder.AddInstruction(prog)
+	return nil
+}
+
+// emitConstAddrLoad emits a load from the constant i32 address addr plus
+// the static offset, without pushing the address to the stack. The
+// bounds of the access are computed at compile time, leaving a single
+// comparison against the current length of linear memory. It returns
+// false, emitting nothing, if the address cannot be encoded as a
+// displacement.
+func (b *AMD64Backend) emitConstAddrLoad(builder Assembler, regs *dirtyRegs, op byte, addr, offset uint64) bool {
+	width, mov, err := memoryAccessWidth(op)
+	if err != nil {
+		return false
+	}
+	ea := uint64(uint32(addr)) + offset
+	if ea+uint64(width) > math.MaxInt32 {
+		return false
+	}
+
+	// mov rax, [rdx + ea]
+	b.emitConstAddrBase(builder, regs, ea, width)
+	prog := builder.NewProg()
+	prog.As = mov
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = x86.REG_DX
+	prog.From.Offset = int64(ea)
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+	return true
+}
+
+// emitConstAddrBase emits the bounds check of an access of width bytes at
+// the constant effective address ea, trapping if it is out of bounds, and
+// loads the base address of linear memory into RDX.
+func (b *AMD64Backend) emitConstAddrBase(builder Assembler, regs *dirtyRegs, ea uint64, width int64) {
+	// cmpq [rsi+8], $(ea+width)
+	// jb   <trap>
+	// movq rdx, [rsi]
+	prog := builder.NewProg()
+	prog.As = x86.ACMPQ
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = regMemoryHeader
+	prog.From.Offset = 8
+	prog.To.Type = obj.TYPE_CONST
+	prog.To.Offset = int64(ea) + width
+	builder.AddInstruction(prog)
+	b.emitConditionalReturn(builder, regs, x86.AJCS, TrapOutOfBoundsMemory)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = regMemoryHeader
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_DX
+	builder.AddInstruction(prog)
+}
+
+// emitConstAddrRMW emits the addition of a constant to a value in linear
+// memory, for the sequence in insts:
+//   i32.const addr; i32.const addr; load offset; const c; add; store offset
+// which increments a counter at a constant address. A single bounds check
+// covers both the load & the store, and the stack is not touched. It
+// returns false, emitting nothing, if insts is not such a sequence or the
+// address cannot be encoded as a displacement.
+func (b *AMD64Backend) emitConstAddrRMW(builder Assembler, regs *dirtyRegs, code []byte, insts []InstructionMetadata) (bool, error) {
+	var constOp, addOp, storeOp byte
+	switch insts[2].Op {
+	case ops.I32Load:
+		constOp, addOp, storeOp = ops.I32Const, ops.I32Add, ops.I32Store
+	case ops.I64Load:
+		constOp, addOp, storeOp = ops.I64Const, ops.I64Add, ops.I64Store
+	default:
+		return false, nil
+	}
+	if insts[1].Op != ops.I32Const || insts[3].Op != constOp || insts[4].Op != addOp || insts[5].Op != storeOp {
+		return false, nil
+	}
+
+	var imm [5]uint64 // store address, load address, load offset, c, store offset
+	for n, inst := range []InstructionMetadata{insts[0], insts[1], insts[2], insts[3], insts[5]} {
+		v, err := b.readIntImmediate(code, inst)
+		if err != nil {
+			return false, err
+		}
+		imm[n] = v
+	}
+	ea := uint64(uint32(imm[1])) + imm[2]
+	if uint64(uint32(imm[0]))+imm[4] != ea {
+		return false, nil
+	}
+	width, mov, err := memoryAccessWidth(insts[2].Op)
+	if err != nil {
+		return false, err
+	}
+	if ea+uint64(width) > math.MaxInt32 {
+		return false, nil
+	}
+
+	// mov  rax, [rdx + ea]
+	// addq rax, $(c)
+	// mov  [rdx + ea], rax
+	b.flushHeld(builder, regs)
+	b.emitConstAddrBase(builder, regs, ea, width)
+	prog := builder.NewProg()
+	prog.As = mov
+	prog.From.Type = obj.TYPE_MEM
+	prog.From.Reg = x86.REG_DX
+	prog.From.Offset = int64(ea)
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	// Only the low 32 bits of the sum are stored for an i32, so adding
+	// in 64 bits wraps like i32.add.
+	b.emitAddConst(builder, x86.REG_AX, imm[3])
+
+	prog = builder.NewProg()
+	prog.As = mov
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	prog.To.Type = obj.TYPE_MEM
+	prog.To.Reg = x86.REG_DX
+	prog.To.Offset = int64(ea)
+	builder.AddInstruction(prog)
+	return true, nil
+}
+
+func (b *AMD64Backend) emitPushI64(builder Assembler, regs *dirtyRegs, c uint64) {
+	b.emitMoveConst(builder, x86.REG_AX, c)
+	b.emitWasmStackPush(builder, regs, x86.REG_AX)
+}
+
+// emitMoveConst moves the constant c into reg. The assembler picks the
+// shortest encoding of the move: constants in [-2^31, 2^31) use the 7-byte
+// sign-extending MOVQ $imm32, other constants below 2^32 the 5-byte
+// zero-extending MOVL, and only the rest the 10-byte MOVQ $imm64.
+func (b *AMD64Backend) emitMoveConst(builder Assembler, reg int16, c uint64) {
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = int64(c)
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = reg
+	builder.AddInstruction(prog)
+}
+
+// emitPreamble loads the address of the stack slice, locals & linear
+// memory into R10, R11 and RSI respectively. The pointers are passed
+// as the first three arguments of the Go register-based calling
+// convention of Go 1.17 and later, which places them in RAX, RBX and
+// RCX. The fourth, in RDI, points to the invocation counter of the
+// block.
+func (b *AMD64Backend) emitPreamble(builder Assembler, regs *dirtyRegs) {
+	if b.breakpoints {
+		// The one byte form of INT 3, which debuggers expect.
+		prog := builder.NewProg()
+		prog.As = x86.ABYTE
+		prog.From.Type = obj.TYPE_CONST
+		prog.From.Offset = 0xcc
+		builder.AddInstruction(prog)
+	}
+	if b.profiling {
+		// incq [rdi]
+		prog := builder.NewProg()
+		prog.As = x86.AINCQ
+		prog.To.Type = obj.TYPE_MEM
+		prog.To.Reg = x86.REG_DI
+		builder.AddInstruction(prog)
+	}
+
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = regStackHeader
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_AX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = regLocalsHeader
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_BX
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = regMemoryHeader
+	prog.From.Type = obj.TYPE_REG
+	prog.From.Reg = x86.REG_CX
+	builder.AddInstruction(prog)
+}
+
+// emitConditionalReturn emits a jump to the postamble, taken if the
+// condition cond (a conditional jump such as x86.AJEQ) holds for the
+// current flags, or unconditionally if cond is obj.AJMP. The native code
+// unit returns status if the jump is taken. All early exits share the
+// single postamble emitted by emitPostamble.
+func (b *AMD64Backend) emitConditionalReturn(builder Assembler, regs *dirtyRegs, cond obj.As, status NativeExit) {
+	// The postamble writes back R13 when it is dirty, so it must hold
+	// the stack length on every path into the postamble. MOVQ does not
+	// modify flags, so it is safe to load between the comparison and
+	// the jump.
+	if !regs.R13 {
+		prog := builder.NewProg()
+		prog.As = x86.AMOVQ
+		prog.To.Type = obj.TYPE_REG
+		prog.To.Reg = regStackLen
+		prog.From.Type = obj.TYPE_MEM
+		prog.From.Reg = regStackHeader
+		prog.From.Offset = 8
+		builder.AddInstruction(prog)
+		regs.R13 = true
+	}
+
+	prog := builder.NewProg()
+	prog.As = x86.AMOVQ
+	prog.To.Type = obj.TYPE_REG
+	prog.To.Reg = regExitStatus
+	prog.From.Type = obj.TYPE_CONST
+	prog.From.Offset = int64(status)
+	builder.AddInstruction(prog)
+
+	prog = builder.NewProg()
+	prog.As = cond
+	prog.To.Type = obj.TYPE_BRANCH
+	builder.AddInstruction(prog)
+	regs.exits = append(regs.exits, prog)
+}
+
+// emitPostamble writes back the stack length and returns the NativeExit
+// value in RAX. Running to the end of the emitted code returns
+// ExitNormal, while jumps emitted by emitConditionalReturn enter the
+// postamble with their status in R15.
+//
+// Values held in registers are flushed first, deepest first, so every
+// value the candidate leaves is in the stack slice in push order, however
+// many there are.
+//
+// The stack length written back is the one left by the pushes & pops of
+// the candidate alone, even where it ends at the end of a block. Compile
+// removes structured control flow, and the values a block leaves behind
+// are discarded by explicit instructions the interpreter runs after the
+// candidate, so the resume point expects no other height.
+func (b *AMD64Backend) emitPostamble(builder Assembler, regs *dirtyRegs) {
+	b.flushHeld(builder, regs)
+
+	// movq rax, $0 (no early exits)
+	// -- or --
+	// movq r15, $0
+	// exit:
+	// movq rax, r15
+	status := builder.NewProg()
+	status.As = x86.AMOVQ
+	status.To.Type = obj.TYPE_REG
+	status.To.Reg = x86.REG_AX
+	status.From.Type = obj.TYPE_CONST
+	status.From.Offset = int64(ExitNormal)
+	if len(regs.exits) > 0 {
+		status.To.Reg = regExitStatus
+		builder.AddInstruction(status)
+
+		status = builder.NewProg()
+		status.As = x86.AMOVQ
+		status.To.Type = obj.TYPE_REG
+		status.To.Reg = x86.REG_AX
+		status.From.Type = obj.TYPE_REG
+		status.From.Reg = regExitStatus
+	}
+	builder.AddInstruction(status)
+
+	// movq [r10+8], r13
+	if regs.R13 {
+		prog := builder.NewProg()
+		prog.As = x86.AMOVQ
+		prog.From.Type = obj.TYPE_REG
+		prog.From.Reg = regStackLen
+		prog.To.Type = obj.TYPE_MEM
+		prog.To.Reg = regStackHeader
+		prog.To.Offset = 8
+		builder.AddInstruction(prog)
+	}
+
+	ret := builder.NewProg()
+	ret.As = obj.ARET
 	builder.AddInstruction(ret)
+
+	for _, exit := range regs.exits {
+		exit.Pcond = status
+	}
+	regs.exits = nil
 }
@@ -2,16 +2,23 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !appengine amd64
+// +build !appengine,amd64,go1.17
 
 package compile
 
 import (
+	"bytes"
 	"encoding/binary"
+	"math"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 	"unsafe"
 
+	"github.com/go-interpreter/wagon/disasm"
+	"github.com/go-interpreter/wagon/wasm"
+	"github.com/go-interpreter/wagon/wasm/leb128"
 	ops "github.com/go-interpreter/wagon/wasm/operators"
 	asm "github.com/twitchyliquid64/golang-asm"
 	"github.com/twitchyliquid64/golang-asm/obj"
@@ -57,7 +64,7 @@ func TestAMD64StackPush(t *testing.T) {
 
 	fakeStack := make([]uint64, 0, 5)
 	fakeLocals := make([]uint64, 0, 0)
-	nativeBlock.Invoke(&fakeStack, &fakeLocals)
+	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil)
 
 	if got, want := len(fakeStack), 2; got != want {
 		t.Errorf("fakeStack.Len = %d, want %d", got, want)
@@ -70,6 +77,41 @@ func TestAMD64StackPush(t *testing.T) {
 	}
 }
 
+func TestAMD64PushI64Encoding(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	for _, tc := range []struct {
+		c    uint64
+		want []byte
+	}{
+		{^uint64(4), []byte{0x48, 0xc7, 0xc0, 0xfb, 0xff, 0xff, 0xff}},                // movq rax, $-5 (sign-extended imm32)
+		{1 << 40, []byte{0x48, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00}}, // movabs rax, $(1 << 40)
+	} {
+		builder, err := asm.NewBuilder("amd64", 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &AMD64Backend{}
+		b.emitMoveConst(builder, x86.REG_AX, tc.c)
+		if got := builder.Assemble(); !bytes.Equal(got, tc.want) {
+			t.Errorf("emitMoveConst(%#x) = % x, want % x", tc.c, got, tc.want)
+		}
+
+		allocator := &MMapAllocator{}
+		defer allocator.Close()
+		unit := emitAndAllocate(t, allocator, b, func(builder *asm.Builder, regs *dirtyRegs) {
+			b.emitPushI64(builder, regs, tc.c)
+		})
+		fakeStack := make([]uint64, 0, 1)
+		fakeLocals := []uint64{}
+		unit.Invoke(&fakeStack, &fakeLocals, nil)
+		if len(fakeStack) != 1 || fakeStack[0] != tc.c {
+			t.Errorf("emitPushI64(%#x): stack = %#x, want [%#x]", tc.c, fakeStack, tc.c)
+		}
+	}
+}
+
 func TestAMD64StackPop(t *testing.T) {
 	if runtime.GOOS != "linux" {
 		t.SkipNow()
@@ -97,7 +139,7 @@ func TestAMD64StackPop(t *testing.T) {
 	fakeStack := make([]uint64, 2, 5)
 	fakeStack[1] = 1337
 	fakeLocals := make([]uint64, 0, 0)
-	nativeBlock.Invoke(&fakeStack, &fakeLocals)
+	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil)
 
 	if got, want := len(fakeStack), 1; got != want {
 		t.Errorf("fakeStack.Len = %d, want %d", got, want)
@@ -120,9 +162,9 @@ func TestAMD64LocalsGet(t *testing.T) {
 	b := &AMD64Backend{}
 	regs := &dirtyRegs{}
 	b.emitPreamble(builder, regs)
-	b.emitWasmLocalsLoad(builder, regs, x86.REG_AX, 0)
+	b.emitWasmLocalsLoad(builder, regs, x86.REG_AX, x86.AMOVQ, 0)
 	b.emitWasmStackPush(builder, regs, x86.REG_AX)
-	b.emitWasmLocalsLoad(builder, regs, x86.REG_AX, 1)
+	b.emitWasmLocalsLoad(builder, regs, x86.REG_AX, x86.AMOVQ, 1)
 	b.emitWasmStackPush(builder, regs, x86.REG_AX)
 	b.emitBinaryI64(builder, regs, ops.I64Add)
 	b.emitPostamble(builder, regs)
@@ -137,7 +179,7 @@ func TestAMD64LocalsGet(t *testing.T) {
 	fakeLocals := make([]uint64, 2, 2)
 	fakeLocals[0] = 1335
 	fakeLocals[1] = 2
-	nativeBlock.Invoke(&fakeStack, &fakeLocals)
+	nativeBlock.Invoke(&fakeStack, &fakeLocals, nil)
 
 	if got, want := len(fakeStack), 1; got != want {
 		t.Errorf("fakeStack.Len = %d, want %d", got, want)
@@ -147,6 +189,88 @@ func TestAMD64LocalsGet(t *testing.T) {
 	}
 }
 
+func TestAMD64LocalsGetFloat(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	testCases := []struct {
+		Name   string
+		Type   wasm.ValueType
+		Add    byte
+		Locals []uint64
+		Result uint64
+	}{
+		{
+			Name:   "f64",
+			Type:   wasm.ValueTypeF64,
+			Add:    ops.F64Add,
+			Locals: []uint64{math.Float64bits(1.5), math.Float64bits(-0.25)},
+			Result: math.Float64bits(1.25),
+		},
+		{
+			Name:   "f64 NaN payload",
+			Type:   wasm.ValueTypeF64,
+			Add:    ops.F64Add,
+			Locals: []uint64{0x7ff8000000000123, math.Float64bits(1)},
+			Result: 0x7ff8000000000123,
+		},
+		{
+			Name:   "f32",
+			Type:   wasm.ValueTypeF32,
+			Add:    ops.F32Add,
+			Locals: []uint64{uint64(math.Float32bits(1.5)), uint64(math.Float32bits(2.25))},
+			Result: uint64(math.Float32bits(3.75)),
+		},
+	}
+
+	allocator := &MMapAllocator{}
+	b := &AMD64Backend{}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			addInst, _ := ops.New(tc.Add)
+			code, meta := Compile([]disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: addInst},
+			})
+			meta.LocalTypes = []wasm.ValueType{tc.Type, tc.Type}
+			candidates, err := b.Scanner().ScanFunc(code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(candidates) != 1 {
+				t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+			}
+
+			insts, err := b.BuildInstructions(candidates[0], code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, inst := range insts {
+				if strings.Contains(inst, "(CX), AX") {
+					t.Errorf("float local loaded through a general purpose register: %q", inst)
+				}
+			}
+
+			out, err := b.Build(candidates[0], code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nativeBlock, err := allocator.AllocateExec(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fakeStack := make([]uint64, 0, 5)
+			fakeLocals := tc.Locals
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil)
+			if len(fakeStack) != 1 || fakeStack[0] != tc.Result {
+				t.Errorf("fakeStack = %#x, want [%#x]", fakeStack, tc.Result)
+			}
+		})
+	}
+}
+
 func TestAMD64OperationsI64(t *testing.T) {
 	if runtime.GOOS != "linux" {
 		t.SkipNow()
@@ -207,11 +331,6 @@ func TestAMD64OperationsI64(t *testing.T) {
 			b.emitPostamble(builder, regs)
 			out := builder.Assemble()
 
-			// cmd := exec.Command("ndisasm", "-b64", "-")
-			// cmd.Stdin = bytes.NewReader(out)
-			// cmd.Stdout = os.Stdout
-			// cmd.Run()
-
 			nativeBlock, err := allocator.AllocateExec(out)
 			if err != nil {
 				t.Fatal(err)
@@ -219,7 +338,7 @@ func TestAMD64OperationsI64(t *testing.T) {
 
 			fakeStack := make([]uint64, 0, 5)
 			fakeLocals := make([]uint64, 0, 0)
-			nativeBlock.Invoke(&fakeStack, &fakeLocals)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil)
 
 			if got, want := len(fakeStack), 1; got != want {
 				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
@@ -231,25 +350,2084 @@ func TestAMD64OperationsI64(t *testing.T) {
 	}
 }
 
-// TestSliceMemoryLayoutAMD64 tests assumptions about the memory layout
-// of slices have not changed. These are not specified in the Go
-// spec.
-// Specifically, we expect the Go compiler lays out slice headers
-// like this:
-//    0000: pointer to first element
-//    0008: uint64 length of the slice
-//    0010: uint64 capacity of the slice.
-//
-// This test should fail if this ever changes. In that case, stack handling
-// instructions that are emitted (emitWasmStackLoad/emitWasmStackPush) will
-// need to be revised to match the new memory layout.
-func TestSliceMemoryLayoutAMD64(t *testing.T) {
-	slice := make([]uint64, 2, 5)
-	mem := (*[24]byte)(unsafe.Pointer(&slice))
-	if got, want := binary.LittleEndian.Uint64(mem[8:16]), uint64(2); got != want {
-		t.Errorf("Got len = %d, want %d", got, want)
+func TestAMD64OperationsI32(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
 	}
-	if got, want := binary.LittleEndian.Uint64(mem[16:24]), uint64(5); got != want {
-		t.Errorf("Got cap = %d, want %d", got, want)
+	testCases := []struct {
+		Name   string
+		Op     byte
+		Args   []uint64
+		Result uint64
+	}{
+		{
+			Name:   "multiply",
+			Op:     ops.I32Mul,
+			Args:   []uint64{11, 5},
+			Result: 55,
+		},
+		{
+			Name:   "multiply wrap",
+			Op:     ops.I32Mul,
+			Args:   []uint64{0xFFFFFFFF, 0xFFFFFFFF},
+			Result: 1,
+		},
+		{
+			Name:   "multiply ignores upper bits",
+			Op:     ops.I32Mul,
+			Args:   []uint64{0x100000003, 0xFF00000005},
+			Result: 15,
+		},
+		{
+			Name:   "shift left",
+			Op:     ops.I32Shl,
+			Args:   []uint64{0x80000001, 4},
+			Result: 0x10,
+		},
+		{
+			Name:   "shift left by 32",
+			Op:     ops.I32Shl,
+			Args:   []uint64{0x80000001, 32},
+			Result: 0x80000001,
+		},
+		{
+			Name:   "shift left by 33",
+			Op:     ops.I32Shl,
+			Args:   []uint64{0x80000001, 33},
+			Result: 2,
+		},
+		{
+			Name:   "shift right signed",
+			Op:     ops.I32ShrS,
+			Args:   []uint64{0x80000000, 4},
+			Result: 0xF8000000,
+		},
+		{
+			Name:   "shift right signed by 36",
+			Op:     ops.I32ShrS,
+			Args:   []uint64{0x80000000, 36},
+			Result: 0xF8000000,
+		},
+		{
+			Name:   "shift right unsigned",
+			Op:     ops.I32ShrU,
+			Args:   []uint64{0x80000000, 4},
+			Result: 0x08000000,
+		},
+		{
+			Name:   "shift right unsigned by 63",
+			Op:     ops.I32ShrU,
+			Args:   []uint64{0x80000000, 63},
+			Result: 1,
+		},
+		{
+			Name:   "rotate left",
+			Op:     ops.I32Rotl,
+			Args:   []uint64{0x80000001, 1},
+			Result: 3,
+		},
+		{
+			Name:   "rotate left by 33",
+			Op:     ops.I32Rotl,
+			Args:   []uint64{0x80000001, 33},
+			Result: 3,
+		},
+		{
+			Name:   "rotate right",
+			Op:     ops.I32Rotr,
+			Args:   []uint64{3, 1},
+			Result: 0x80000001,
+		},
+		{
+			Name:   "rotate right by 64",
+			Op:     ops.I32Rotr,
+			Args:   []uint64{3, 64},
+			Result: 3,
+		},
+	}
+
+	allocator := &MMapAllocator{}
+	b := &AMD64Backend{}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			nativeBlock := emitAndAllocate(t, allocator, b, func(builder *asm.Builder, regs *dirtyRegs) {
+				for _, arg := range tc.Args {
+					b.emitPushI64(builder, regs, arg)
+				}
+				if err := b.emitBinaryI32(builder, regs, tc.Op); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			fakeStack := make([]uint64, 0, 5)
+			fakeLocals := make([]uint64, 0, 0)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil)
+
+			if got, want := len(fakeStack), 1; got != want {
+				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
+			}
+			if got, want := fakeStack[0], tc.Result; got != want {
+				t.Errorf("fakeStack[0] = %#x, want %#x", got, want)
+			}
+		})
+	}
+}
+
+func TestAMD64ConstDivU(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	allocator := &MMapAllocator{}
+	b := &AMD64Backend{}
+
+	// build emits x/c, where x is locals[0]. If constant is set, the
+	// division is strength-reduced, otherwise it uses DIVQ.
+	build := func(c uint64, constant bool) NativeCodeUnit {
+		return emitAndAllocate(t, allocator, b, func(builder *asm.Builder, regs *dirtyRegs) {
+			b.emitWasmLocalsLoad(builder, regs, x86.REG_AX, x86.AMOVQ, 0)
+			b.emitWasmStackPush(builder, regs, x86.REG_AX)
+			if constant {
+				if !b.emitConstDivU(builder, regs, c) {
+					t.Fatalf("emitConstDivU(%d) = false, want true", c)
+				}
+			} else {
+				b.emitPushI64(builder, regs, c)
+				b.emitDivU(builder, regs)
+			}
+		})
+	}
+
+	xs := []uint64{0, 1, 7, 8, 9, 10, 99, 100, 1 << 32, math.MaxUint32, 1<<63 - 1, 1 << 63, math.MaxUint64 - 1, math.MaxUint64}
+	for _, c := range []uint64{8, 10, 1, 3, 7, 1 << 63, 1<<63 + 1, math.MaxUint64} {
+		strength, divq := build(c, true), build(c, false)
+		for _, x := range xs {
+			var got, want uint64
+			for _, r := range []struct {
+				unit NativeCodeUnit
+				out  *uint64
+			}{{strength, &got}, {divq, &want}} {
+				stack := make([]uint64, 0, 2)
+				locals := []uint64{x}
+				if exit := r.unit.Invoke(&stack, &locals, nil); exit != ExitNormal || len(stack) != 1 {
+					t.Fatalf("%d/%d: exit = %d, stack = %v", x, c, exit, stack)
+				}
+				*r.out = stack[0]
+			}
+			if got != want || got != x/c {
+				t.Errorf("%d/%d = %d, DIVQ = %d, want %d", x, c, got, want, x/c)
+			}
+		}
+	}
+
+	if b.emitConstDivU(nil, nil, 0) {
+		t.Error("emitConstDivU(0) = true, want false")
+	}
+	stack := make([]uint64, 0, 2)
+	locals := []uint64{5}
+	if got, want := build(0, false).Invoke(&stack, &locals, nil), TrapIntegerDivideByZero; got != want {
+		t.Errorf("5/0: exit = %d, want %d", got, want)
+	}
+}
+
+func TestAMD64ConstShl(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+	b := &AMD64Backend{}
+
+	// build emits x<<c, where x is locals[0]. If constant is set, the
+	// count is an immediate, otherwise it is taken in CL.
+	build := func(c uint64, constant bool) NativeCodeUnit {
+		return emitAndAllocate(t, allocator, b, func(builder *asm.Builder, regs *dirtyRegs) {
+			b.emitWasmLocalsLoad(builder, regs, x86.REG_AX, x86.AMOVQ, 0)
+			b.emitWasmStackPush(builder, regs, x86.REG_AX)
+			if constant {
+				b.emitConstShl(builder, regs, c)
+			} else {
+				b.emitPushI64(builder, regs, c)
+				b.emitShl(builder, regs)
+			}
+		})
+	}
+
+	xs := []uint64{0, 1, 0x123456789abcdef, 1 << 63, math.MaxUint64}
+	for _, c := range []uint64{0, 1, 4, 63, 64, 70, math.MaxUint64} {
+		immediate, cl := build(c, true), build(c, false)
+		for _, x := range xs {
+			var got, want uint64
+			for _, r := range []struct {
+				unit NativeCodeUnit
+				out  *uint64
+			}{{immediate, &got}, {cl, &want}} {
+				stack := make([]uint64, 0, 2)
+				locals := []uint64{x}
+				if exit := r.unit.Invoke(&stack, &locals, nil); exit != ExitNormal || len(stack) != 1 {
+					t.Fatalf("%#x<<%d: exit = %d, stack = %v", x, c, exit, stack)
+				}
+				*r.out = stack[0]
+			}
+			if got != want || got != x<<(c%64) {
+				t.Errorf("%#x<<%d = %#x, SHLQ CL = %#x, want %#x", x, c, got, want, x<<(c%64))
+			}
+		}
+	}
+}
+
+// TestAMD64I32UpperBitsCleared checks every supported op producing an i32
+// leaves the upper 32 bits of its stack slot zero, by adding the slot to an
+// i64. Operands have their upper bits set, which the interpreter never
+// stores but native code must ignore, so an op which only writes the low
+// half of a register, or forgets to zero-extend, leaks them into the sum.
+func TestAMD64I32UpperBitsCleared(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	i64Const, _ := ops.New(ops.I64Const)
+	i64Add, _ := ops.New(ops.I64Add)
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+
+	b := &AMD64Backend{}
+	var tested int
+	for _, op := range b.SupportedOpcodes() {
+		effect, ok := b.instStackEffect(nil, &BytecodeMetadata{}, InstructionMetadata{Op: op})
+		if !ok || effect.pushes != 1 || effect.typ != wasm.ValueTypeI32 {
+			continue
+		}
+		inst, err := ops.New(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		operand := uint64(0xfffffffffffffffb) // -5, sign-extended
+		var immediates []interface{}
+		switch op {
+		case ops.I32Const:
+			immediates = []interface{}{int32(-5)}
+		case ops.I32Load:
+			immediates = []interface{}{uint32(2), uint32(0)}
+			operand = 0
+		case ops.I32ReinterpretF32:
+			// The upper bits of an f32 slot are always clear.
+			operand = uint64(math.Float32bits(-5))
+		}
+		instrs := make([]disasm.Instr, 0, effect.pops+4)
+		for i := 0; i < effect.pops; i++ {
+			instrs = append(instrs, disasm.Instr{Op: getLocalInst, Immediates: []interface{}{uint32(i)}})
+		}
+		instrs = append(instrs,
+			disasm.Instr{Op: inst, Immediates: immediates},
+			disasm.Instr{Op: i64Const, Immediates: []interface{}{int64(0)}},
+			disasm.Instr{Op: i64Add})
+		code, meta := Compile(instrs)
+
+		out, err := b.Build(CompilationCandidate{EndInstruction: len(instrs) - 1}, code, meta)
+		if err != nil {
+			t.Errorf("%s: %v", inst.Name, err)
+			continue
+		}
+		unit, err := allocator.AllocateExec(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stack := make([]uint64, 0, effect.pops+2)
+		locals := []uint64{operand, operand}
+		memory := []byte{0xff, 0xff, 0xff, 0xff}
+		if exit := unit.Invoke(&stack, &locals, &memory); exit != ExitNormal {
+			t.Errorf("%s: exit = %v, want %v", inst.Name, exit, ExitNormal)
+			continue
+		}
+		if len(stack) != 1 || stack[0]>>32 != 0 {
+			t.Errorf("%s: stack = %#x, want the upper 32 bits clear", inst.Name, stack)
+		}
+		tested++
+	}
+	if tested < 10 {
+		t.Errorf("only %d i32 ops tested", tested)
+	}
+}
+
+func TestAMD64DivI32(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	// Locals hold i32 values sign-extended, as the interpreter pushes
+	// them, which the division must ignore.
+	minInt32 := uint64(0xffffffff80000000)
+	minusOne := ^uint64(0)
+	for _, tc := range []struct {
+		op   byte
+		a, b uint64
+		want uint64
+		exit NativeExit
+	}{
+		{op: ops.I32DivS, a: 7, b: 2, want: 3},
+		{op: ops.I32DivS, a: 7, b: 0xfffffffe, want: 0xfffffffd}, // 7 / -2
+		{op: ops.I32DivS, a: minInt32, b: 2, want: 0xc0000000},
+		{op: ops.I32DivS, a: 5, b: minusOne, want: 0xfffffffb},
+		{op: ops.I32DivS, a: minInt32, b: minusOne, exit: TrapIntegerOverflow},
+		{op: ops.I32DivS, a: 1, b: 0, exit: TrapIntegerDivideByZero},
+		{op: ops.I32DivU, a: minInt32, b: 2, want: 0x40000000},
+		{op: ops.I32DivU, a: minInt32, b: minusOne, want: 0},
+		{op: ops.I32DivU, a: 1, b: 0, exit: TrapIntegerDivideByZero},
+		{op: ops.I32RemS, a: 0xfffffff9, b: 2, want: 0xffffffff}, // -7 % 2
+		{op: ops.I32RemS, a: minInt32, b: minusOne, want: 0},
+		{op: ops.I32RemS, a: 5, b: minusOne, want: 0},
+		{op: ops.I32RemS, a: 1, b: 0, exit: TrapIntegerDivideByZero},
+		{op: ops.I32RemU, a: 0xfffffff9, b: 2, want: 1},
+		{op: ops.I32RemU, a: 1, b: 0, exit: TrapIntegerDivideByZero},
+	} {
+		op, _ := ops.New(tc.op)
+		code, meta := Compile([]disasm.Instr{
+			{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+			{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+			{Op: op},
+		})
+		stack, exit, err := RunCandidate(&AMD64Backend{}, CompilationCandidate{EndInstruction: 2}, code, meta, make([]uint64, 0, 2), []uint64{tc.a, tc.b})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exit != tc.exit {
+			t.Errorf("%s(%#x, %#x): exit = %d, want %d", op.Name, tc.a, tc.b, exit, tc.exit)
+			continue
+		}
+		// The upper half of the result must be cleared.
+		if exit == ExitNormal && (len(stack) != 1 || stack[0] != tc.want) {
+			t.Errorf("%s(%#x, %#x): stack = %#x, want [%#x]", op.Name, tc.a, tc.b, stack, tc.want)
+		}
+	}
+}
+
+func TestAMD64DropFirst(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	dropInst, _ := ops.New(ops.Drop)
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := Compile([]disasm.Instr{
+		{Op: dropInst},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: addInst},
+	})
+	candidate := CompilationCandidate{EndInstruction: 2}
+
+	// The drop must load the stack length, as nothing has before it.
+	b := &AMD64Backend{}
+	insts, err := b.BuildInstructions(candidate, code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(insts, "\n"), "MOVQ 8(R10), R13\nDECQ R13") {
+		t.Errorf("drop does not load the stack length:\n%s", strings.Join(insts, "\n"))
+	}
+
+	// The interpreter pushed 9 & 5, so dropping the 5 leaves 9 + 40.
+	stack := append(make([]uint64, 0, 3), 9, 5)
+	stack, exit, err := RunCandidate(b, candidate, code, meta, stack, []uint64{40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit != ExitNormal {
+		t.Errorf("exit = %v, want %v", exit, ExitNormal)
+	}
+	if len(stack) != 1 || stack[0] != 49 {
+		t.Errorf("stack = %v, want [49]", stack)
+	}
+}
+
+func TestAMD64GuardStack(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	allocator := &MMapAllocator{}
+	b := &AMD64Backend{}
+	b.SetGuardStack(true)
+	unit := emitAndAllocate(t, allocator, b, func(builder *asm.Builder, regs *dirtyRegs) {
+		b.emitPushI64(builder, regs, 1)
+		b.emitPushI64(builder, regs, 2)
+		b.emitPushI64(builder, regs, 3)
+	})
+
+	for _, tc := range []struct {
+		cap  int
+		exit NativeExit
+		len  int
+	}{
+		{cap: 1, exit: TrapStackOverflow, len: 1},
+		{cap: 2, exit: TrapStackOverflow, len: 2},
+		{cap: 3, exit: ExitNormal, len: 3},
+	} {
+		backing := []uint64{0xdeadbeef, 0xdeadbeef, 0xdeadbeef, 0xdeadbeef}
+		stack := backing[:0:tc.cap]
+		var locals []uint64
+		if got := unit.Invoke(&stack, &locals, nil); got != tc.exit {
+			t.Errorf("cap %d: exit = %d, want %d", tc.cap, got, tc.exit)
+		}
+		if got := len(stack); got != tc.len {
+			t.Errorf("cap %d: len(stack) = %d, want %d", tc.cap, got, tc.len)
+		}
+		for i := tc.cap; i < len(backing); i++ {
+			if backing[i] != 0xdeadbeef {
+				t.Errorf("cap %d: value %d past the end of the stack = %#x, want 0xdeadbeef", tc.cap, i, backing[i])
+			}
+		}
+	}
+}
+
+func TestAMD64GuardLocals(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	setLocalInst, _ := ops.New(ops.SetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: addInst},
+		{Op: setLocalInst, Immediates: []interface{}{uint32(2)}},
+	})
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+	b := &AMD64Backend{}
+	b.SetGuardLocals(true)
+	out, err := b.Build(CompilationCandidate{EndInstruction: 3}, code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit, err := allocator.AllocateExec(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		len  int
+		exit NativeExit
+	}{
+		{len: 0, exit: TrapLocalOutOfRange}, // get_local 0
+		{len: 2, exit: TrapLocalOutOfRange}, // set_local 2
+		{len: 3, exit: ExitNormal},
+	} {
+		backing := []uint64{5, 0xdeadbeef, 0xdeadbeef}
+		locals := backing[:tc.len]
+		stack := make([]uint64, 0, 1)
+		if got := unit.Invoke(&stack, &locals, nil); got != tc.exit {
+			t.Errorf("len %d: exit = %d, want %d", tc.len, got, tc.exit)
+		}
+		want := uint64(0xdeadbeef)
+		if tc.exit == ExitNormal {
+			want = 6
+		}
+		if got := backing[2]; got != want {
+			t.Errorf("len %d: backing[2] = %#x, want %#x", tc.len, got, want)
+		}
+	}
+}
+
+// TestAMD64LocalsBaseReloaded checks every access to a local loads the base
+// of the locals from their sliceHeader, so native code follows locals
+// which are reallocated while the header stays in place.
+func TestAMD64LocalsBaseReloaded(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	setLocalInst, _ := ops.New(ops.SetLocal)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: addInst},
+		{Op: setLocalInst, Immediates: []interface{}{uint32(2)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(2)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: addInst},
+	})
+	candidate := CompilationCandidate{EndInstruction: 6}
+	b := &AMD64Backend{}
+
+	insts, err := b.BuildInstructions(candidate, code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loads int
+	for _, inst := range insts {
+		if strings.HasPrefix(inst, "MOVQ") && strings.Contains(inst, "(R11)") {
+			loads++
+		}
+	}
+	if loads != 5 {
+		t.Errorf("%d loads of the locals base, want 1 for each of the 5 accesses:\n%s", loads, strings.Join(insts, "\n"))
+	}
+
+	out, err := b.Build(candidate, code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+	unit, err := allocator.AllocateExec(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locals := []uint64{1, 2, 0}
+	old := locals
+	stack := make([]uint64, 0, 2)
+	if exit := unit.Invoke(&stack, &locals, nil); exit != ExitNormal {
+		t.Fatalf("exit = %v, want %v", exit, ExitNormal)
+	}
+	// Reallocate the locals behind the same sliceHeader.
+	locals = append([]uint64(nil), 10, 20, 0)
+	stack = stack[:0]
+	if exit := unit.Invoke(&stack, &locals, nil); exit != ExitNormal {
+		t.Fatalf("exit = %v, want %v", exit, ExitNormal)
+	}
+	if len(stack) != 1 || stack[0] != 40 {
+		t.Errorf("stack = %v, want [40]", stack)
+	}
+	if locals[2] != 30 || old[2] != 3 {
+		t.Errorf("locals[2] = %d & old[2] = %d, want 30 & 3", locals[2], old[2])
+	}
+}
+
+func TestAMD64FusedMulAdd(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	mulInst, _ := ops.New(ops.F64Mul)
+	addInst, _ := ops.New(ops.F64Add)
+	// c + a*b
+	code, meta := Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(2)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: mulInst},
+		{Op: addInst},
+	})
+	candidate := CompilationCandidate{EndInstruction: 4}
+
+	// (1+2^-30) * (1-2^-30) is exactly 1-2^-60, which rounds to 1 before
+	// the addition. A fused multiply-add keeps the low bits of the product.
+	a, b, c := 1+math.Ldexp(1, -30), 1-math.Ldexp(1, -30), -1.0
+	separate := float64(a*b) + c
+	if separate != 0 {
+		t.Fatalf("separate = %v, want 0", separate)
+	}
+	fused := math.FMA(a, b, c)
+	if fused != -math.Ldexp(1, -60) {
+		t.Fatalf("fused = %v, want -2^-60", fused)
+	}
+
+	for _, enabled := range []bool{false, true} {
+		backend := &AMD64Backend{}
+		backend.SetFusedMulAdd(enabled)
+		insts, err := backend.BuildInstructions(candidate, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantFused := enabled && hasFMA
+		var gotFused bool
+		for _, inst := range insts {
+			if strings.HasPrefix(inst, "VFMADD231SD") {
+				gotFused = true
+			}
+		}
+		if gotFused != wantFused {
+			t.Errorf("enabled = %v: VFMADD231SD emitted = %v, want %v:\n%s", enabled, gotFused, wantFused, strings.Join(insts, "\n"))
+		}
+
+		locals := []uint64{math.Float64bits(a), math.Float64bits(b), math.Float64bits(c)}
+		stack, exit, err := RunCandidate(backend, candidate, code, meta, make([]uint64, 0, 3), locals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exit != ExitNormal {
+			t.Fatalf("enabled = %v: exit = %v, want %v", enabled, exit, ExitNormal)
+		}
+		want := separate
+		if wantFused {
+			want = fused
+		}
+		if len(stack) != 1 || math.Float64frombits(stack[0]) != want {
+			t.Errorf("enabled = %v: stack = %v, want [%v]", enabled, stack, want)
+		}
+	}
+}
+
+func TestAMD64Breakpoints(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: addInst},
+	})
+	candidate := CompilationCandidate{EndInstruction: 2}
+
+	for _, enabled := range []bool{false, true} {
+		b := &AMD64Backend{}
+		b.SetBreakpoints(enabled)
+		out, err := b.Build(candidate, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := out[0] == 0xcc; got != enabled {
+			t.Errorf("breakpoints %v: first byte = %#x", enabled, out[0])
+		}
+	}
+}
+
+func TestAMD64Profiling(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: addInst},
+	})
+	candidate := CompilationCandidate{EndInstruction: 2}
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+
+	const n = 7
+	for _, enabled := range []bool{false, true} {
+		b := &AMD64Backend{}
+		b.SetProfiling(enabled)
+		out, err := b.Build(candidate, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unit, err := allocator.AllocateExec(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			stack := make([]uint64, 0, 2)
+			locals := []uint64{}
+			if exit := unit.Invoke(&stack, &locals, nil); exit != ExitNormal || len(stack) != 1 || stack[0] != 3 {
+				t.Fatalf("profiling %v: exit = %d, stack = %v", enabled, exit, stack)
+			}
+		}
+		var want uint64
+		if enabled {
+			want = n
+		}
+		if got := unit.(CountedCodeUnit).Invocations(); got != want {
+			t.Errorf("profiling %v: Invocations() = %d, want %d", enabled, got, want)
+		}
+	}
+}
+
+func TestAMD64RegAlloc(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	addInst, _ := ops.New(ops.I64Add)
+	subInst, _ := ops.New(ops.I64Sub)
+	mulInst, _ := ops.New(ops.I64Mul)
+	get := func(i uint32) disasm.Instr {
+		return disasm.Instr{Op: getLocalInst, Immediates: []interface{}{i}}
+	}
+	add, sub, mul := disasm.Instr{Op: addInst}, disasm.Instr{Op: subInst}, disasm.Instr{Op: mulInst}
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+
+	tcs := []struct {
+		Name   string
+		Instrs []disasm.Instr
+		Want   func(l []uint64) uint64
+	}{
+		{
+			Name:   "chain",
+			Instrs: []disasm.Instr{get(0), get(1), add, get(2), add, get(3), add, get(4), add},
+			Want:   func(l []uint64) uint64 { return l[0] + l[1] + l[2] + l[3] + l[4] },
+		},
+		{
+			// Five values are live before the first add, which is
+			// more than can be held in registers.
+			Name:   "nested",
+			Instrs: []disasm.Instr{get(0), get(1), get(2), get(3), get(4), sub, mul, add, sub},
+			Want:   func(l []uint64) uint64 { return l[0] - (l[1] + l[2]*(l[3]-l[4])) },
+		},
+	}
+	for _, tc := range tcs {
+		code, meta := Compile(tc.Instrs)
+		candidate := CompilationCandidate{EndInstruction: len(tc.Instrs) - 1}
+		var sizes [2]int
+		for i, noRegAlloc := range []bool{true, false} {
+			b := &AMD64Backend{noRegAlloc: noRegAlloc}
+			out, err := b.Build(candidate, code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[i] = len(out)
+			unit, err := allocator.AllocateExec(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			locals := []uint64{100, 20, 7, 5, 1 << 40}
+			stack := make([]uint64, 0, len(tc.Instrs))
+			if exit := unit.Invoke(&stack, &locals, nil); exit != ExitNormal {
+				t.Fatalf("%s (noRegAlloc = %v): exit = %d", tc.Name, noRegAlloc, exit)
+			}
+			if want := tc.Want(locals); len(stack) != 1 || stack[0] != want {
+				t.Errorf("%s (noRegAlloc = %v): stack = %v, want [%d]", tc.Name, noRegAlloc, stack, want)
+			}
+		}
+		if naive, allocated := sizes[0], sizes[1]; allocated >= naive {
+			t.Errorf("%s: %d bytes with registers held, want fewer than %d bytes without", tc.Name, allocated, naive)
+		}
+	}
+}
+
+func TestAMD64WrapI64(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	allocator := &MMapAllocator{}
+	b := &AMD64Backend{}
+	unit := emitAndAllocate(t, allocator, b, func(builder *asm.Builder, regs *dirtyRegs) {
+		b.emitPushI64(builder, regs, 0x1000000ff)
+		b.emitLow32(builder, regs)
+	})
+
+	stack := make([]uint64, 0, 1)
+	var locals []uint64
+	unit.Invoke(&stack, &locals, nil)
+	if len(stack) != 1 {
+		t.Fatalf("len(stack) = %d, want 1", len(stack))
+	}
+	if got, want := stack[0], uint64(0xff); got != want {
+		t.Errorf("i32.wrap_i64(0x1000000ff) = %#x, want %#x", got, want)
+	}
+}
+
+func TestAMD64ConditionalReturn(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	allocator := &MMapAllocator{}
+
+	// exitIfLocalZero emits an early exit, taken if locals[i] == 0.
+	exitIfLocalZero := func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs, i uint64) {
+		b.emitWasmLocalsLoad(builder, regs, x86.REG_AX, x86.AMOVQ, i)
+		cmp := builder.NewProg()
+		cmp.As = x86.ACMPQ
+		cmp.From.Type = obj.TYPE_REG
+		cmp.From.Reg = x86.REG_AX
+		cmp.To.Type = obj.TYPE_CONST
+		cmp.To.Offset = 0
+		builder.AddInstruction(cmp)
+		b.emitConditionalReturn(builder, regs, x86.AJEQ, ExitNormal)
+	}
+
+	b := &AMD64Backend{}
+	nativeBlock := emitAndAllocate(t, allocator, b, func(builder *asm.Builder, regs *dirtyRegs) {
+		exitIfLocalZero(b, builder, regs, 0)
+		b.emitPushI64(builder, regs, 1)
+		exitIfLocalZero(b, builder, regs, 1)
+		b.emitPushI64(builder, regs, 2)
+		exitIfLocalZero(b, builder, regs, 2)
+		b.emitPushI64(builder, regs, 3)
+	})
+
+	for _, tc := range []struct {
+		locals []uint64
+		stack  []uint64
+	}{
+		{[]uint64{0, 1, 1}, []uint64{}},
+		{[]uint64{1, 0, 1}, []uint64{1}},
+		{[]uint64{1, 1, 0}, []uint64{1, 2}},
+		{[]uint64{1, 1, 1}, []uint64{1, 2, 3}},
+	} {
+		fakeStack := make([]uint64, 0, 5)
+		fakeLocals := tc.locals
+		nativeBlock.Invoke(&fakeStack, &fakeLocals, nil)
+
+		if got, want := len(fakeStack), len(tc.stack); got != want {
+			t.Errorf("locals = %v: fakeStack.Len = %d, want %d", tc.locals, got, want)
+			continue
+		}
+		for i := range tc.stack {
+			if fakeStack[i] != tc.stack[i] {
+				t.Errorf("locals = %v: fakeStack[%d] = %d, want %d", tc.locals, i, fakeStack[i], tc.stack[i])
+			}
+		}
+	}
+}
+
+func TestAMD64WideI64Const(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	testCases := []struct {
+		Name    string
+		Val     uint64
+		LEBSize int
+	}{
+		{"9-byte", 1 << 56, 9},
+		{"10-byte", 1 << 62, 10},
+		{"max int64", 1<<63 - 1, 10},
+		{"min int64", 1 << 63, 10},
+		{"near max uint64", 0xBFFFFFFFFFFFFFFF, 10},
+	}
+
+	constInst, _ := ops.New(ops.I64Const)
+	orInst, _ := ops.New(ops.I64Or)
+	allocator := &MMapAllocator{}
+	b := &AMD64Backend{}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if got := len(leb128.AppendSleb128(nil, int64(tc.Val))); got != tc.LEBSize {
+				t.Fatalf("LEB128 size = %d, want %d", got, tc.LEBSize)
+			}
+			wasm, err := disasm.Assemble([]disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int64(tc.Val)}},
+				{Op: constInst, Immediates: []interface{}{int64(0)}},
+				{Op: orInst},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			instrs, err := disasm.Disassemble(wasm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, meta := Compile(instrs)
+			candidates, err := b.Scanner().ScanFunc(code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(candidates) != 1 {
+				t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+			}
+			out, err := b.Build(candidates[0], code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nativeBlock, err := allocator.AllocateExec(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fakeStack := make([]uint64, 0, 5)
+			fakeLocals := make([]uint64, 0, 0)
+			nativeBlock.Invoke(&fakeStack, &fakeLocals, nil)
+
+			if got, want := len(fakeStack), 1; got != want {
+				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
+			}
+			if got, want := fakeStack[0], tc.Val; got != want {
+				t.Errorf("fakeStack[0] = %#x, want %#x", got, want)
+			}
+		})
+	}
+}
+
+func TestAMD64MemoryOps(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	constInst, _ := ops.New(ops.I32Const)
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	i32LoadInst, _ := ops.New(ops.I32Load)
+	i64LoadInst, _ := ops.New(ops.I64Load)
+	i64StoreInst, _ := ops.New(ops.I64Store)
+
+	testCases := []struct {
+		Name       string
+		Code       []disasm.Instr
+		Locals     []uint64
+		MemSize    int
+		Exit       NativeExit
+		Stack      []uint64
+		StoredAt   int
+		StoredWant uint64
+	}{
+		{
+			Name: "constant address",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: constInst, Immediates: []interface{}{int32(8)}},
+				{Op: i64LoadInst, Immediates: []interface{}{uint32(3), uint32(4)}},
+			},
+			MemSize: 20,
+			Stack:   []uint64{1, 0x14131211100f0e0d},
+		},
+		{
+			Name: "constant address out of bounds",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: constInst, Immediates: []interface{}{int32(8)}},
+				{Op: i64LoadInst, Immediates: []interface{}{uint32(3), uint32(4)}},
+			},
+			MemSize: 19,
+			Exit:    TrapOutOfBoundsMemory,
+		},
+		{
+			Name: "negative constant address",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: constInst, Immediates: []interface{}{int32(-4)}},
+				{Op: i32LoadInst, Immediates: []interface{}{uint32(2), uint32(8)}},
+			},
+			MemSize: 20,
+			Exit:    TrapOutOfBoundsMemory,
+		},
+		{
+			Name: "dynamic address",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: i32LoadInst, Immediates: []interface{}{uint32(2), uint32(1)}},
+			},
+			Locals:  []uint64{0xffffffff00000002},
+			MemSize: 20,
+			Stack:   []uint64{1, 0x07060504},
+		},
+		{
+			Name: "dynamic address offset overflow",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: i32LoadInst, Immediates: []interface{}{uint32(2), uint32(4)}},
+			},
+			Locals:  []uint64{0xfffffffe},
+			MemSize: 20,
+			Exit:    TrapOutOfBoundsMemory,
+		},
+		{
+			Name: "dynamic address large offset wraps 32 bits",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: i64LoadInst, Immediates: []interface{}{uint32(3), uint32(0xfffffff8)}},
+			},
+			Locals:  []uint64{0x10},
+			MemSize: 20,
+			Exit:    TrapOutOfBoundsMemory,
+		},
+		{
+			Name: "dynamic address displacement wraps 32 bits",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: i64LoadInst, Immediates: []interface{}{uint32(3), uint32(0x10)}},
+			},
+			Locals:  []uint64{0xfffffff8},
+			MemSize: 20,
+			Exit:    TrapOutOfBoundsMemory,
+		},
+		{
+			Name: "dynamic address offset at displacement limit",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: i64LoadInst, Immediates: []interface{}{uint32(3), uint32(0x7ffffff7)}},
+			},
+			Locals:  []uint64{0x80000009},
+			MemSize: 20,
+			Exit:    TrapOutOfBoundsMemory,
+		},
+		{
+			Name: "store",
+			Code: []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: i64StoreInst, Immediates: []interface{}{uint32(3), uint32(2)}},
+			},
+			Locals:     []uint64{4, 0x1122334455667788},
+			MemSize:    14,
+			StoredAt:   6,
+			StoredWant: 0x1122334455667788,
+		},
+		{
+			Name: "store out of bounds",
+			Code: []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: i64StoreInst, Immediates: []interface{}{uint32(3), uint32(2)}},
+			},
+			Locals:  []uint64{5, 0x1122334455667788},
+			MemSize: 14,
+			Exit:    TrapOutOfBoundsMemory,
+		},
+		{
+			Name: "store large offset wraps 32 bits",
+			Code: []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: i64StoreInst, Immediates: []interface{}{uint32(3), uint32(0xfffffffc)}},
+			},
+			Locals:  []uint64{6, 0x1122334455667788},
+			MemSize: 14,
+			Exit:    TrapOutOfBoundsMemory,
+		},
+	}
+
+	allocator := &MMapAllocator{}
+	b := &AMD64Backend{}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			code, meta := Compile(tc.Code)
+			candidates, err := b.Scanner().ScanFunc(code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(candidates) != 1 {
+				t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+			}
+			out, err := b.Build(candidates[0], code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nativeBlock, err := allocator.AllocateExec(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fakeStack := make([]uint64, 0, 5)
+			fakeLocals := tc.Locals
+			fakeMemory := make([]byte, tc.MemSize)
+			for i := range fakeMemory {
+				fakeMemory[i] = byte(i + 1)
+			}
+			if tc.StoredWant != 0 {
+				fakeMemory = make([]byte, tc.MemSize)
+			}
+			exit := nativeBlock.Invoke(&fakeStack, &fakeLocals, &fakeMemory)
+			if exit != tc.Exit {
+				t.Fatalf("Invoke() = %v, want %v", exit, tc.Exit)
+			}
+			if exit != ExitNormal {
+				return
+			}
+
+			if got, want := len(fakeStack), len(tc.Stack); got != want {
+				t.Fatalf("fakeStack.Len = %d, want %d", got, want)
+			}
+			for i := range tc.Stack {
+				if fakeStack[i] != tc.Stack[i] {
+					t.Errorf("fakeStack[%d] = %#x, want %#x", i, fakeStack[i], tc.Stack[i])
+				}
+			}
+			if tc.StoredWant != 0 {
+				if got := binary.LittleEndian.Uint64(fakeMemory[tc.StoredAt:]); got != tc.StoredWant {
+					t.Errorf("stored value = %#x, want %#x", got, tc.StoredWant)
+				}
+			}
+		})
+	}
+}
+
+// TestAMD64MemoryGrown checks bounds checks compare against the length
+// of linear memory when the code is invoked, not when it was compiled.
+func TestAMD64MemoryGrown(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	constInst, _ := ops.New(ops.I32Const)
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	loadInst, _ := ops.New(ops.I32Load)
+
+	testCases := []struct {
+		Name string
+		Code []disasm.Instr
+	}{
+		{
+			Name: "constant address",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: constInst, Immediates: []interface{}{int32(16)}},
+				{Op: loadInst, Immediates: []interface{}{uint32(2), uint32(4)}},
+			},
+		},
+		{
+			Name: "dynamic address",
+			Code: []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: loadInst, Immediates: []interface{}{uint32(2), uint32(4)}},
+			},
+		},
+	}
+
+	allocator := &MMapAllocator{}
+	b := &AMD64Backend{}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			code, meta := Compile(tc.Code)
+			candidates, err := b.Scanner().ScanFunc(code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(candidates) != 1 {
+				t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+			}
+			out, err := b.Build(candidates[0], code, meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nativeBlock, err := allocator.AllocateExec(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fakeStack := make([]uint64, 0, 5)
+			fakeLocals := []uint64{16}
+			fakeMemory := make([]byte, 20)
+			if exit := nativeBlock.Invoke(&fakeStack, &fakeLocals, &fakeMemory); exit != TrapOutOfBoundsMemory {
+				t.Fatalf("Invoke() before growing = %v, want %v", exit, TrapOutOfBoundsMemory)
+			}
+
+			fakeStack = fakeStack[:0]
+			fakeMemory = append(fakeMemory, make([]byte, 4)...)
+			binary.LittleEndian.PutUint32(fakeMemory[20:], 0xdeadbeef)
+			if exit := nativeBlock.Invoke(&fakeStack, &fakeLocals, &fakeMemory); exit != ExitNormal {
+				t.Fatalf("Invoke() after growing = %v, want %v", exit, ExitNormal)
+			}
+			if len(fakeStack) != 2 || fakeStack[1] != 0xdeadbeef {
+				t.Errorf("fakeStack = %#x, want [0x1 0xdeadbeef]", fakeStack)
+			}
+		})
+	}
+}
+
+func TestAMD64ConstAddrLoadFolded(t *testing.T) {
+	constInst, _ := ops.New(ops.I32Const)
+	loadInst, _ := ops.New(ops.I32Load)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int32(1)}},
+		{Op: constInst, Immediates: []interface{}{int32(16)}},
+		{Op: loadInst, Immediates: []interface{}{uint32(2), uint32(4)}},
+	})
+
+	b := &AMD64Backend{}
+	candidates, err := b.Scanner().ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	rec := &recordingAssembler{}
+	b.NewAssembler = func() (Assembler, error) {
+		builder, err := asm.NewBuilder("amd64", 128)
+		rec.Builder = builder
+		return rec, err
+	}
+	if _, err := b.Build(candidates[0], code, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	var accesses, bounds int
+	for _, p := range rec.progs {
+		if p.From.Type == obj.TYPE_MEM && p.From.Reg == x86.REG_DX {
+			accesses++
+			if p.From.Index != x86.REG_NONE || p.From.Offset != 20 {
+				t.Errorf("memory access = %v, want displacement 20 without index", p)
+			}
+		}
+		if p.As == x86.ACMPQ {
+			bounds++
+			if p.To.Type != obj.TYPE_CONST || p.To.Offset != 24 {
+				t.Errorf("bounds check = %v, want comparison against 24", p)
+			}
+		}
+		if p.As == x86.AMOVQ && p.From.Type == obj.TYPE_MEM && p.From.Reg == x86.REG_R12 {
+			t.Errorf("unexpected stack load %v: constant address should not be pushed", p)
+		}
+	}
+	if accesses != 1 || bounds != 1 {
+		t.Errorf("got %d memory accesses and %d bounds checks, want 1 of each", accesses, bounds)
+	}
+}
+
+func TestAMD64ConstAddrRMW(t *testing.T) {
+	i32Const, _ := ops.New(ops.I32Const)
+	loadInst, _ := ops.New(ops.I32Load)
+	addInst, _ := ops.New(ops.I32Add)
+	storeInst, _ := ops.New(ops.I32Store)
+	code, meta := Compile([]disasm.Instr{
+		{Op: i32Const, Immediates: []interface{}{int32(16)}},
+		{Op: i32Const, Immediates: []interface{}{int32(16)}},
+		{Op: loadInst, Immediates: []interface{}{uint32(2), uint32(4)}},
+		{Op: i32Const, Immediates: []interface{}{int32(1)}},
+		{Op: addInst},
+		{Op: storeInst, Immediates: []interface{}{uint32(2), uint32(4)}},
+	})
+
+	b := &AMD64Backend{}
+	candidates, err := b.Scanner().ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	rec := &recordingAssembler{}
+	b.NewAssembler = func() (Assembler, error) {
+		builder, err := asm.NewBuilder("amd64", 128)
+		rec.Builder = builder
+		return rec, err
+	}
+	if _, err := b.Build(candidates[0], code, meta); err != nil {
+		t.Fatal(err)
+	}
+
+	var loads, stores, bounds int
+	for _, p := range rec.progs {
+		if p.From.Type == obj.TYPE_MEM && p.From.Reg == x86.REG_DX && p.From.Offset == 20 {
+			loads++
+		}
+		if p.To.Type == obj.TYPE_MEM && p.To.Reg == x86.REG_DX && p.To.Offset == 20 {
+			stores++
+		}
+		if p.As == x86.ACMPQ {
+			bounds++
+		}
+		if (p.From.Type == obj.TYPE_MEM && p.From.Reg == x86.REG_R12) || (p.To.Type == obj.TYPE_MEM && p.To.Reg == x86.REG_R12) {
+			t.Errorf("unexpected stack access %v", p)
+		}
+	}
+	if loads != 1 || stores != 1 || bounds != 1 {
+		t.Errorf("got %d loads, %d stores and %d bounds checks, want 1 of each", loads, stores, bounds)
+	}
+}
+
+func TestAMD64FusedCompareBranch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	ltInst, _ := ops.New(ops.I64LtS)
+	brIfInst, _ := ops.New(ops.BrIf)
+	code, meta := Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: ltInst},
+		{Op: brIfInst, Immediates: []interface{}{uint32(0)}},
+	})
+	// Point the branch somewhere recognisable.
+	binary.LittleEndian.PutUint64(code[meta.Instructions[3].Start+1:], 1234)
+
+	b := &AMD64Backend{}
+	candidates, err := b.Scanner().ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	rec := &recordingAssembler{}
+	b.NewAssembler = func() (Assembler, error) {
+		builder, err := asm.NewBuilder("amd64", 128)
+		rec.Builder = builder
+		return rec, err
+	}
+	out, err := b.Build(candidates[0], code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The comparison should branch on the flags, without materializing
+	// & testing the boolean.
+	var jumps int
+	for _, p := range rec.progs {
+		switch p.As {
+		case x86.ASETLT, x86.AMOVBQZX, x86.ATESTL:
+			t.Errorf("unexpected %v in fused comparison", p)
+		case x86.AJLT:
+			jumps++
+		}
+	}
+	if jumps != 1 {
+		t.Errorf("got %d JLT instructions, want 1", jumps)
+	}
+
+	allocator := &MMapAllocator{}
+	nativeBlock, err := allocator.AllocateExec(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		locals []uint64
+		exit   NativeExit
+	}{
+		{[]uint64{1, 2}, BranchExit(1234)},
+		{[]uint64{2, 2}, ExitNormal},
+		{[]uint64{^uint64(0), 0}, BranchExit(1234)},
+		{[]uint64{0, ^uint64(0)}, ExitNormal},
+	} {
+		fakeStack := make([]uint64, 0, 5)
+		fakeLocals := tc.locals
+		if got := nativeBlock.Invoke(&fakeStack, &fakeLocals, nil); got != tc.exit {
+			t.Errorf("locals = %v: Invoke() = %#x, want %#x", tc.locals, got, tc.exit)
+		}
+		if len(fakeStack) != 0 {
+			t.Errorf("locals = %v: fakeStack = %v, want []", tc.locals, fakeStack)
+		}
+	}
+}
+
+// recordingAssembler is an Assembler which records each instruction
+// before passing it on to golang-asm.
+type recordingAssembler struct {
+	*asm.Builder
+	progs []*obj.Prog
+}
+
+func (a *recordingAssembler) AddInstruction(p *obj.Prog) {
+	a.progs = append(a.progs, p)
+	a.Builder.AddInstruction(p)
+}
+
+// TestAMD64BuildThroughAssembler checks Build routes every instruction
+// through the Assembler from NewAssembler, and that doing so does not
+// change the code built.
+func TestAMD64BuildThroughAssembler(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	mulInst, _ := ops.New(ops.I64Mul)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+		{Op: addInst},
+		{Op: constInst, Immediates: []interface{}{int64(5)}},
+		{Op: mulInst},
+	})
+
+	b := &AMD64Backend{}
+	candidates, err := b.Scanner().ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	want, err := b.Build(candidates[0], code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &recordingAssembler{}
+	b.NewAssembler = func() (Assembler, error) {
+		builder, err := asm.NewBuilder("amd64", 128)
+		rec.Builder = builder
+		return rec, err
+	}
+	got, err := b.Build(candidates[0], code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Build() through recordingAssembler = %x, want %x", got, want)
+	}
+	if len(rec.progs) == 0 {
+		t.Error("recordingAssembler was not used")
+	}
+}
+
+// emitAndInspect emits the preamble, the instructions produced by emit and
+// the postamble into a new builder. It returns the dirtyRegs state
+// after emit has run, along with the emitted instructions in order.
+func emitAndInspect(t *testing.T, emit func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs)) (dirtyRegs, []*obj.Prog) {
+	t.Helper()
+	builder, err := asm.NewBuilder("amd64", 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &AMD64Backend{}
+	regs := &dirtyRegs{}
+	b.emitPreamble(builder, regs)
+	emit(b, builder, regs)
+	final := *regs
+	b.emitPostamble(builder, regs)
+
+	var progs []*obj.Prog
+	for p := builder.Root(); p != nil; p = p.Link {
+		progs = append(progs, p)
+	}
+	return final, progs
+}
+
+func TestAMD64DirtyRegsFlush(t *testing.T) {
+	regs, progs := emitAndInspect(t, func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+		b.emitPushI64(builder, regs, 1234)
+	})
+	if !regs.R13 {
+		t.Fatal("regs.R13 = false after push, want true")
+	}
+	if len(progs) < 2 {
+		t.Fatalf("len(progs) = %d, want >= 2", len(progs))
+	}
+	wb := progs[len(progs)-2]
+	if wb.As != x86.AMOVQ || wb.From.Type != obj.TYPE_REG || wb.From.Reg != x86.REG_R13 ||
+		wb.To.Type != obj.TYPE_MEM || wb.To.Reg != x86.REG_R10 || wb.To.Offset != 8 {
+		t.Errorf("progs[%d] = %v, want MOVQ R13, 8(R10)", len(progs)-2, wb)
+	}
+	if ret := progs[len(progs)-1]; ret.As != obj.ARET {
+		t.Errorf("progs[%d] = %v, want RET", len(progs)-1, ret)
+	}
+
+	// Nothing touched the stack, so there should be nothing to flush.
+	regs, progs = emitAndInspect(t, func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {})
+	if regs.R13 {
+		t.Error("regs.R13 = true without stack access, want false")
+	}
+	for i, p := range progs {
+		if p.To.Type == obj.TYPE_MEM && p.To.Reg == x86.REG_R10 {
+			t.Errorf("progs[%d] = %v, want no writes to the stack sliceHeader", i, p)
+		}
+	}
+}
+
+// TestAMD64PostambleStackLength checks each emit helper which pushes or
+// pops values marks R13 dirty, so the postamble writes the new length of
+// the stack back to its sliceHeader.
+// emitAndAllocate emits the preamble, the instructions produced by emit
+// and the postamble into a new builder, and places the assembled code in
+// executable memory from allocator.
+func emitAndAllocate(t *testing.T, allocator *MMapAllocator, b *AMD64Backend, emit func(builder *asm.Builder, regs *dirtyRegs)) NativeCodeUnit {
+	t.Helper()
+	builder, err := asm.NewBuilder("amd64", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs := &dirtyRegs{}
+	b.emitPreamble(builder, regs)
+	emit(builder, regs)
+	b.emitPostamble(builder, regs)
+	unit, err := allocator.AllocateExec(builder.Assemble())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unit
+}
+
+func TestAMD64PostambleStackLength(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	tcs := []struct {
+		Name  string
+		Emit  func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs)
+		Delta int
+	}{
+		{"emitWasmStackPush", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitWasmStackPush(builder, regs, x86.REG_AX)
+		}, 1},
+		{"emitWasmStackLoad", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+		}, -1},
+		{"emitPushI64", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitPushI64(builder, regs, 1)
+		}, 1},
+		{"holdReg", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitMoveConst(builder, x86.REG_DX, 1)
+			b.holdReg(builder, regs, x86.REG_DX)
+		}, 1},
+		{"emitBinaryI64", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitBinaryI64(builder, regs, ops.I64Add)
+		}, -1},
+		{"emitBinaryI32", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitBinaryI32(builder, regs, ops.I32Mul)
+		}, -1},
+		{"emitCompare", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitCompare(builder, regs, ops.I64LtU)
+			b.emitSetCondition(builder, regs, ops.I64LtU)
+		}, -1},
+		{"emitLow32", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitLow32(builder, regs)
+		}, 0},
+		{"emitDivU", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitDivU(builder, regs)
+		}, -1},
+		{"emitConstDivU", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitConstDivU(builder, regs, 7)
+		}, 0},
+		{"emitConstMul", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitConstMul(builder, regs, 3)
+		}, 0},
+		{"emitBinaryFloat", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitBinaryFloat(builder, regs, ops.F64Add)
+		}, -1},
+		{"emitFusedMulAdd", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitFusedMulAdd(builder, regs)
+		}, -2},
+		{"emitFloatAbs", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitFloatAbs(builder, regs, ops.F64Abs)
+		}, 0},
+		{"emitFloatCopysign", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitFloatCopysign(builder, regs, ops.F64Copysign)
+		}, -1},
+		{"emitLoad", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitLoad(builder, regs, ops.I64Load, 0)
+		}, 0},
+		{"emitStore", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitStore(builder, regs, ops.I64Store, 0)
+		}, -2},
+		{"emitConstAddrLoad", func(b *AMD64Backend, builder *asm.Builder, regs *dirtyRegs) {
+			b.emitConstAddrLoad(builder, regs, ops.I64Load, 8, 0)
+		}, 1},
+	}
+
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			b := &AMD64Backend{}
+			unit := emitAndAllocate(t, allocator, b, func(builder *asm.Builder, regs *dirtyRegs) {
+				tc.Emit(b, builder, regs)
+			})
+			// Small values, so they are in-bounds addresses & non-zero
+			// divisors.
+			fakeStack := append(make([]uint64, 0, 8), 4, 3, 2, 1)
+			fakeLocals := []uint64{}
+			fakeMemory := make([]byte, 64)
+			if exit := unit.Invoke(&fakeStack, &fakeLocals, &fakeMemory); exit != ExitNormal {
+				t.Fatalf("exit = %v, want %v", exit, ExitNormal)
+			}
+			if got, want := len(fakeStack), 4+tc.Delta; got != want {
+				t.Errorf("len(fakeStack) = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestSliceMemoryLayoutAMD64 tests assumptions about the memory layout
+// of slices have not changed. These are not specified in the Go
+// spec.
+// Specifically, we expect the Go compiler lays out slice headers
+// like this:
+//    0000: pointer to first element
+//    0008: uint64 length of the slice
+//    0010: uint64 capacity of the slice.
+//
+// This test should fail if this ever changes. In that case, stack handling
+// instructions that are emitted (emitWasmStackLoad/emitWasmStackPush) will
+// need to be revised to match the new memory layout.
+func TestSliceMemoryLayoutAMD64(t *testing.T) {
+	slice := make([]uint64, 2, 5)
+	mem := (*[24]byte)(unsafe.Pointer(&slice))
+	if got, want := binary.LittleEndian.Uint64(mem[8:16]), uint64(2); got != want {
+		t.Errorf("Got len = %d, want %d", got, want)
+	}
+	if got, want := binary.LittleEndian.Uint64(mem[16:24]), uint64(5); got != want {
+		t.Errorf("Got cap = %d, want %d", got, want)
+	}
+}
+
+func TestRunCandidate(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: addInst},
+	})
+
+	stack, exit, err := RunCandidate(&AMD64Backend{}, CompilationCandidate{EndInstruction: 2}, code, meta, make([]uint64, 0, 5), []uint64{40, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit != ExitNormal {
+		t.Errorf("exit = %v, want %v", exit, ExitNormal)
+	}
+	if got, want := stack, []uint64{42}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("stack = %v, want %v", got, want)
+	}
+}
+
+func TestAMD64EmitSizeBudget(t *testing.T) {
+	// The bytes each op may emit, through the full path of loading its
+	// operands from & pushing its result to the stack. They leave room
+	// for small changes, but not for a refactor doubling the code size.
+	budgets := []struct {
+		op     byte
+		imm    []interface{}
+		budget int
+	}{
+		{ops.I64Const, []interface{}{int64(5)}, 36},
+		{ops.GetLocal, []interface{}{uint32(0)}, 48},
+		{ops.SetLocal, []interface{}{uint32(0)}, 44},
+		{ops.Drop, nil, 16},
+		{ops.I64Add, nil, 64},
+		{ops.I64Sub, nil, 64},
+		{ops.I64Mul, nil, 64},
+		{ops.I64Shl, nil, 64},
+		{ops.I64DivU, nil, 88},
+		{ops.I32Add, nil, 64},
+		{ops.I32DivS, nil, 112},
+		{ops.I32RemS, nil, 100},
+		{ops.I64Eq, nil, 72},
+		{ops.I32LtS, nil, 72},
+		{ops.I32WrapI64, nil, 48},
+		{ops.F64Add, nil, 72},
+		{ops.F64Copysign, nil, 120},
+		{ops.I64Load, []interface{}{uint32(3), uint32(0)}, 80},
+		{ops.I64Store, []interface{}{uint32(3), uint32(0)}, 80},
+		{ops.Select, nil, 88},
+		{ops.Return, nil, 24},
+	}
+
+	b := &AMD64Backend{}
+	// size returns the bytes emitted for a candidate of inst alone.
+	size := func(inst disasm.Instr) int {
+		code, meta := Compile([]disasm.Instr{inst})
+		candidate := CompilationCandidate{End: meta.Instructions[0].Size}
+		out, err := b.Build(candidate, code, meta)
+		if err != nil {
+			t.Fatalf("Build(%s) failed: %v", inst.Op.Name, err)
+		}
+		return len(out)
+	}
+	// The preamble & postamble, which every candidate has.
+	nopInst, _ := ops.New(ops.Nop)
+	base := size(disasm.Instr{Op: nopInst})
+
+	for _, tc := range budgets {
+		inst, err := ops.New(tc.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := size(disasm.Instr{Op: inst, Immediates: tc.imm}) - base; got > tc.budget {
+			t.Errorf("%s emitted %d bytes, want at most %d", inst.Name, got, tc.budget)
+		}
+	}
+}
+
+func TestAMD64I32LocalZeroExtended(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	setLocalInst, _ := ops.New(ops.SetLocal)
+	addInst, _ := ops.New(ops.I32Add)
+	// local 1 = local 0; local 0 + local 0, both through held registers
+	// & the stack.
+	code, meta := Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: setLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: addInst},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+	})
+	meta.LocalTypes = []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}
+	last := meta.Instructions[len(meta.Instructions)-1]
+	candidate := CompilationCandidate{End: last.Start + last.Size, EndInstruction: len(meta.Instructions) - 1}
+
+	// A producer left garbage above the i32 in local 0.
+	locals := []uint64{0xdeadbeef00000005, 0}
+	stack, exit, err := RunCandidate(&AMD64Backend{}, candidate, code, meta, make([]uint64, 0, 4), locals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit != ExitNormal {
+		t.Fatalf("exit = %d, want %d", exit, ExitNormal)
+	}
+	if len(stack) != 2 || stack[0] != 10 || stack[1] != 5 {
+		t.Errorf("stack = %#x, want [0xa 0x5]", stack)
+	}
+	if got, want := locals[1], uint64(5); got != want {
+		t.Errorf("locals[1] = %#x, want %#x", got, want)
+	}
+}
+
+func TestAMD64StackBalanceCheck(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+	b := &AMD64Backend{}
+
+	// build pushes two values and pops one, a net delta of one, but
+	// checks for a delta of want.
+	build := func(want int) NativeCodeUnit {
+		return emitAndAllocate(t, allocator, b, func(builder *asm.Builder, regs *dirtyRegs) {
+			b.emitPushI64(builder, regs, 1)
+			b.emitPushI64(builder, regs, 2)
+			b.emitWasmStackLoad(builder, regs, x86.REG_AX)
+			b.emitStackBalanceCheck(builder, regs, want)
+		})
+	}
+	for _, tc := range []struct {
+		want int
+		exit NativeExit
+	}{
+		{1, ExitNormal},
+		{0, TrapStackImbalance},
+		{2, TrapStackImbalance},
+		{-1, TrapStackImbalance},
+	} {
+		stack := make([]uint64, 3, 8)
+		if exit := build(tc.want).Invoke(&stack, nil, nil); exit != tc.exit {
+			t.Errorf("delta %d: exit = %d, want %d", tc.want, exit, tc.exit)
+		}
+		// The stack is written back either way, for debugging.
+		if len(stack) != 4 {
+			t.Errorf("delta %d: len(stack) = %d, want 4", tc.want, len(stack))
+		}
+	}
+
+	// Candidates built with the check run as before.
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	setLocalInst, _ := ops.New(ops.SetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	selectInst, _ := ops.New(ops.Select)
+	code, meta := Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: addInst},
+		{Op: setLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(5)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: selectInst},
+	})
+	last := meta.Instructions[len(meta.Instructions)-1]
+	candidate := CompilationCandidate{End: last.Start + last.Size, EndInstruction: len(meta.Instructions) - 1}
+	checked := &AMD64Backend{}
+	checked.SetStackBalance(true)
+	insts, err := checked.BuildInstructions(candidate, code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchecked, err := b.BuildInstructions(candidate, code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) <= len(unchecked) {
+		t.Errorf("no check emitted: %q", insts)
+	}
+	stack, exit, err := RunCandidate(checked, candidate, code, meta, make([]uint64, 0, 4), []uint64{2, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit != ExitNormal || len(stack) != 1 || stack[0] != 5 {
+		t.Errorf("exit = %d, stack = %v, want %d & [5]", exit, stack, ExitNormal)
+	}
+}
+
+func TestAMD64IncDec(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	subInst, _ := ops.New(ops.I64Sub)
+	mulInst, _ := ops.New(ops.I64Mul)
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+
+	for _, tc := range []struct {
+		name   string
+		instrs []disasm.Instr
+		want   obj.As
+		fn     func(x, y uint64) uint64
+	}{
+		{
+			name: "local + 1",
+			instrs: []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: constInst, Immediates: []interface{}{int64(1)}},
+				{Op: addInst},
+			},
+			want: x86.AINCQ,
+			fn:   func(x, y uint64) uint64 { return x + 1 },
+		},
+		{
+			name: "local + -1",
+			instrs: []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: constInst, Immediates: []interface{}{int64(-1)}},
+				{Op: addInst},
+			},
+			want: x86.ADECQ,
+			fn:   func(x, y uint64) uint64 { return x - 1 },
+		},
+		{
+			name: "x*y + 1",
+			instrs: []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: mulInst},
+				{Op: constInst, Immediates: []interface{}{int64(1)}},
+				{Op: addInst},
+			},
+			want: x86.AINCQ,
+			fn:   func(x, y uint64) uint64 { return x*y + 1 },
+		},
+		{
+			name: "x*y - 1",
+			instrs: []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: mulInst},
+				{Op: constInst, Immediates: []interface{}{int64(1)}},
+				{Op: subInst},
+			},
+			want: x86.ADECQ,
+			fn:   func(x, y uint64) uint64 { return x*y - 1 },
+		},
+	} {
+		code, meta := Compile(tc.instrs)
+		rec := &recordingAssembler{}
+		b := &AMD64Backend{NewAssembler: func() (Assembler, error) {
+			builder, err := asm.NewBuilder("amd64", 128)
+			rec.Builder = builder
+			return rec, err
+		}}
+		out, err := b.Build(CompilationCandidate{EndInstruction: len(tc.instrs) - 1}, code, meta)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		var found bool
+		for _, p := range rec.progs {
+			switch p.As {
+			case tc.want:
+				found = true
+			case x86.AADDQ, x86.ASUBQ:
+				t.Errorf("%s: unexpected %v", tc.name, p)
+			}
+		}
+		if !found {
+			t.Errorf("%s: no %v emitted", tc.name, tc.want)
+		}
+
+		unit, err := allocator.AllocateExec(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, x := range []uint64{0, 1, 7, 1<<63 - 1, math.MaxUint64} {
+			stack := make([]uint64, 0, 3)
+			locals := []uint64{x, 3}
+			if exit := unit.Invoke(&stack, &locals, nil); exit != ExitNormal || len(stack) != 1 {
+				t.Fatalf("%s: exit = %v, stack = %v", tc.name, exit, stack)
+			}
+			if want := tc.fn(x, 3); stack[0] != want {
+				t.Errorf("%s: x = %#x: got %#x, want %#x", tc.name, x, stack[0], want)
+			}
+		}
+	}
+}
+
+// TestAMD64ManyLocals scales each of 20 locals in place, then sums them
+// with every local on the stack at once, far more values than fit in
+// amd64HeldRegs.
+func TestAMD64ManyLocals(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	const n = 20
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	setLocalInst, _ := ops.New(ops.SetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	mulInst, _ := ops.New(ops.I64Mul)
+
+	var instrs []disasm.Instr
+	for i := 0; i < n; i++ {
+		instrs = append(instrs,
+			disasm.Instr{Op: getLocalInst, Immediates: []interface{}{uint32(i)}},
+			disasm.Instr{Op: constInst, Immediates: []interface{}{int64(i + 2)}},
+			disasm.Instr{Op: mulInst},
+			disasm.Instr{Op: setLocalInst, Immediates: []interface{}{uint32(i)}})
+	}
+	for i := 0; i < n; i++ {
+		instrs = append(instrs, disasm.Instr{Op: getLocalInst, Immediates: []interface{}{uint32(i)}})
+	}
+	for i := 1; i < n; i++ {
+		instrs = append(instrs, disasm.Instr{Op: addInst})
+	}
+	code, meta := Compile(instrs)
+
+	b := &AMD64Backend{}
+	candidates, err := b.Scanner().ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 || candidates[0].EndInstruction != len(instrs)-1 {
+		t.Fatalf("candidates = %+v, want one covering all %d instructions", candidates, len(instrs))
+	}
+	out, err := b.Build(candidates[0], code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+	unit, err := allocator.AllocateExec(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locals := make([]uint64, n)
+	var want uint64
+	for i := range locals {
+		locals[i] = uint64(i*i + 1)
+		want += locals[i] * uint64(i+2)
+	}
+	stack := make([]uint64, 0, n)
+	if exit := unit.Invoke(&stack, &locals, nil); exit != ExitNormal {
+		t.Fatalf("exit = %v, want %v", exit, ExitNormal)
+	}
+	if len(stack) != 1 || stack[0] != want {
+		t.Errorf("stack = %v, want [%d]", stack, want)
+	}
+	for i, v := range locals {
+		if want := uint64(i*i+1) * uint64(i+2); v != want {
+			t.Errorf("locals[%d] = %d, want %d", i, v, want)
+		}
+	}
+}
+
+// TestAMD64LeavesSeveralValues checks candidates which leave more than
+// one value are written back in push order, above the values they found
+// on the stack, whether those values were held in registers or spilled.
+func TestAMD64LeavesSeveralValues(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+
+	for n := 2; n <= 4; n++ {
+		// local[i] + i+1, for each i < n.
+		var instrs []disasm.Instr
+		for i := 0; i < n; i++ {
+			instrs = append(instrs,
+				disasm.Instr{Op: getLocalInst, Immediates: []interface{}{uint32(i)}},
+				disasm.Instr{Op: constInst, Immediates: []interface{}{int64(i + 1)}},
+				disasm.Instr{Op: addInst})
+		}
+		code, meta := Compile(instrs)
+		b := &AMD64Backend{}
+		out, err := b.Build(CompilationCandidate{EndInstruction: len(instrs) - 1}, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unit, err := allocator.AllocateExec(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stack := make([]uint64, 1, n+1)
+		stack[0] = 99
+		locals := []uint64{10, 20, 30, 40}
+		if exit := unit.Invoke(&stack, &locals, nil); exit != ExitNormal {
+			t.Fatalf("n = %d: exit = %v, want %v", n, exit, ExitNormal)
+		}
+		want := []uint64{99}
+		for i := 0; i < n; i++ {
+			want = append(want, locals[i]+uint64(i+1))
+		}
+		if !reflect.DeepEqual(stack, want) {
+			t.Errorf("n = %d: stack = %v, want %v", n, stack, want)
+		}
+	}
+}
+
+func TestAMD64AbsLocal(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	subInst, _ := ops.New(ops.I64Sub)
+	ltInst, _ := ops.New(ops.I64LtS)
+	selectInst, _ := ops.New(ops.Select)
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+
+	// abs builds select(0 - a, b, c < 0), which is abs(x) if a, b & c
+	// are all local x.
+	abs := func(a, b, c uint32) []disasm.Instr {
+		return []disasm.Instr{
+			{Op: constInst, Immediates: []interface{}{int64(0)}},
+			{Op: getLocalInst, Immediates: []interface{}{a}},
+			{Op: subInst},
+			{Op: getLocalInst, Immediates: []interface{}{b}},
+			{Op: getLocalInst, Immediates: []interface{}{c}},
+			{Op: constInst, Immediates: []interface{}{int64(0)}},
+			{Op: ltInst},
+			{Op: selectInst},
+		}
+	}
+	for _, tc := range []struct {
+		a, b, c uint32
+		folded  bool
+	}{
+		{0, 0, 0, true},
+		{1, 1, 1, true},
+		{0, 1, 0, false},
+		{0, 0, 1, false},
+	} {
+		instrs := abs(tc.a, tc.b, tc.c)
+		code, meta := Compile(instrs)
+		rec := &recordingAssembler{}
+		b := &AMD64Backend{NewAssembler: func() (Assembler, error) {
+			builder, err := asm.NewBuilder("amd64", 128)
+			rec.Builder = builder
+			return rec, err
+		}}
+		out, err := b.Build(CompilationCandidate{EndInstruction: len(instrs) - 1}, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sar, branches int
+		for _, p := range rec.progs {
+			switch p.As {
+			case x86.ASARQ:
+				sar++
+			case x86.ACMPQ, x86.ACMOVQLT, x86.ACMOVQNE, x86.AJNE, x86.AJEQ:
+				branches++
+			}
+		}
+		if folded := sar == 1 && branches == 0; folded != tc.folded {
+			t.Errorf("select(0 - local%d, local%d, local%d < 0): folded = %v, want %v", tc.a, tc.b, tc.c, folded, tc.folded)
+		}
+
+		unit, err := allocator.AllocateExec(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, x := range []int64{0, 1, -1, 5, -5, math.MaxInt64, math.MinInt64} {
+			locals := []uint64{uint64(x), uint64(-x)}
+			stack := make([]uint64, 0, 3)
+			if exit := unit.Invoke(&stack, &locals, nil); exit != ExitNormal || len(stack) != 1 {
+				t.Fatalf("exit = %v, stack = %v", exit, stack)
+			}
+			want := locals[tc.b]
+			if int64(locals[tc.c]) < 0 {
+				want = -locals[tc.a]
+			}
+			if stack[0] != want {
+				t.Errorf("select(0 - local%d, local%d, local%d < 0) with locals %d: got %d, want %d",
+					tc.a, tc.b, tc.c, []int64{x, -x}, int64(stack[0]), int64(want))
+			}
+		}
 	}
 }
@@ -0,0 +1,91 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compile
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-interpreter/wagon/disasm"
+	ops "github.com/go-interpreter/wagon/wasm/operators"
+)
+
+// minimalInstr returns an instance of the opcode o with placeholder
+// immediates. Opcodes with immediates must be listed here before a backend
+// can advertise them.
+func minimalInstr(o ops.Op) disasm.Instr {
+	instr := disasm.Instr{Op: o}
+	switch o.Code {
+	case ops.I32Const:
+		instr.Immediates = []interface{}{int32(1)}
+	case ops.I64Const:
+		instr.Immediates = []interface{}{int64(1)}
+	case ops.GetLocal, ops.SetLocal, ops.BrIf, ops.TeeLocal, ops.GetGlobal, ops.SetGlobal:
+		instr.Immediates = []interface{}{uint32(0)}
+	case ops.I32Load, ops.I64Load, ops.F32Load, ops.F64Load, ops.I32Load8s, ops.I32Load8u, ops.I32Load16s, ops.I32Load16u, ops.I64Load8s, ops.I64Load8u, ops.I64Load16s, ops.I64Load16u, ops.I64Load32s, ops.I64Load32u, ops.I32Store, ops.I64Store, ops.F32Store, ops.F64Store, ops.I32Store8, ops.I32Store16, ops.I64Store8, ops.I64Store16, ops.I64Store32:
+		instr.Immediates = []interface{}{uint32(0), uint32(4)}
+	}
+	return instr
+}
+
+// TestBackendCapabilities checks every opcode advertised by each backend
+// can be built on its own. Run with -v to print the capability matrix.
+func TestBackendCapabilities(t *testing.T) {
+	backends := []struct {
+		Name    string
+		Backend interface {
+			SupportedOpcodes() []byte
+			Build(candidate CompilationCandidate, code []byte, meta *BytecodeMetadata) ([]byte, error)
+		}
+	}{
+		{"amd64", &AMD64Backend{}},
+	}
+
+	for _, be := range backends {
+		supported := map[byte]bool{}
+		for _, op := range be.Backend.SupportedOpcodes() {
+			supported[op] = true
+		}
+
+		var matrix strings.Builder
+		for op := 0; op <= 0xff; op++ {
+			o, err := ops.New(byte(op))
+			if err != nil {
+				continue
+			}
+			status := "-"
+			if supported[byte(op)] {
+				status = "supported"
+				code, meta := Compile([]disasm.Instr{minimalInstr(o)})
+				candidate := CompilationCandidate{
+					End: meta.Instructions[0].Start + meta.Instructions[0].Size,
+				}
+				if _, err := be.Backend.Build(candidate, code, meta); err != nil {
+					t.Errorf("%s: Build(%s) failed: %v", be.Name, o.Name, err)
+				}
+			}
+			fmt.Fprintf(&matrix, "%-20s %s\n", o.Name, status)
+		}
+		t.Logf("%s capabilities:\n%s", be.Name, matrix.String())
+	}
+}
+
+func TestAMD64RoundingRequiresSSE41(t *testing.T) {
+	defer func(v bool) { hasSSE41 = v }(hasSSE41)
+
+	for _, sse41 := range []bool{false, true} {
+		hasSSE41 = sse41
+		supported := map[byte]bool{}
+		for _, op := range (&AMD64Backend{}).SupportedOpcodes() {
+			supported[op] = true
+		}
+		for op := range roundingModes {
+			if supported[op] != sse41 {
+				t.Errorf("hasSSE41 = %v: supported[%#x] = %v, want %v", sse41, op, supported[op], sse41)
+			}
+		}
+	}
+}
@@ -43,6 +43,7 @@ import (
 	"encoding/binary"
 
 	"github.com/go-interpreter/wagon/disasm"
+	"github.com/go-interpreter/wagon/wasm"
 	ops "github.com/go-interpreter/wagon/wasm/operators"
 )
 
@@ -146,6 +147,19 @@ type BytecodeMetadata struct {
 	// avoid generating native code which has an inbound
 	// jump target somewhere deep inside.
 	InboundTargets map[int64]bool
+
+	// LocalTypes are the types of the function's parameters followed by
+	// its locals, by local index. Compile doesn't know them, so they are
+	// set by the caller. Locals missing from LocalTypes are integers.
+	LocalTypes []wasm.ValueType
+}
+
+// LocalType returns the declared type of the local at index.
+func (m *BytecodeMetadata) LocalType(index uint64) wasm.ValueType {
+	if index < uint64(len(m.LocalTypes)) {
+		return m.LocalTypes[index]
+	}
+	return wasm.ValueTypeI64
 }
 
 // Compile rewrites WebAssembly bytecode from its disassembly.
@@ -164,8 +178,8 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 	emitMetadata := func(op byte, index, size int) {
 		metadata = append(metadata, InstructionMetadata{
 			Op:    op,
-			Start: index,
-			Size:  size,
+			Start: int64(index),
+			Size:  int64(size),
 		})
 	}
 
@@ -211,7 +225,7 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 			continue
 		case ops.Else:
 			ifInstr := disassembly[instr.Block.ElseIfIndex] // the corresponding `if` instruction for this else
-			if ifInstr.NewStack != nil && ifInstr.NewStack.StackTopDiff != 0 {
+			if discardsValues(ifInstr.NewStack) {
 				// add code for jumping out of a taken if branch
 				op := OpDiscard
 				if ifInstr.NewStack.PreserveTop {
@@ -240,7 +254,7 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 			depth := curBlockDepth
 			block := blocks[depth]
 
-			if instr.NewStack.StackTopDiff != 0 {
+			if discardsValues(instr.NewStack) {
 				// when exiting a block, discard elements to
 				// restore stack height.
 				op := OpDiscard
@@ -276,7 +290,7 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 			curBlockDepth--
 			continue
 		case ops.Br:
-			if instr.NewStack != nil && instr.NewStack.StackTopDiff != 0 {
+			if discardsValues(instr.NewStack) {
 				op := OpDiscard
 				if instr.NewStack.PreserveTop {
 					op = OpDiscardPreserveTop
@@ -371,6 +385,16 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 
 	for _, table := range branchTables {
 		table.patchedAddrs = nil
+		// br_table jumps to its targets without a patched offset, so
+		// they are recorded here.
+		for _, target := range table.Targets {
+			if !target.Return {
+				inboundTargets[target.Addr] = true
+			}
+		}
+		if !table.DefaultTarget.Return {
+			inboundTargets[table.DefaultTarget.Addr] = true
+		}
 	}
 	return buffer.Bytes(), &BytecodeMetadata{
 		BranchTables:   branchTables,
@@ -379,6 +403,19 @@ func Compile(disassembly []disasm.Instr) ([]byte, *BytecodeMetadata) {
 	}
 }
 
+// discardsValues reports whether unwinding the stack as described by
+// stack removes any values. Discarding a single value while preserving
+// the top leaves the stack unchanged, which is the case at the end of a
+// block leaving exactly its result: no discard operator is emitted, so
+// the end remains a purely structural marker, and straight-line code
+// across it is not split.
+func discardsValues(stack *disasm.StackInfo) bool {
+	if stack == nil || stack.StackTopDiff == 0 {
+		return false
+	}
+	return !(stack.PreserveTop && stack.StackTopDiff == 1)
+}
+
 // replace the address starting at start with addr
 func patchOffset(code []byte, start int64, addr int64, inboundTargets map[int64]bool) *bytes.Buffer {
 	inboundTargets[addr] = true
@@ -0,0 +1,39 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compile
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestSliceMemoryLayout tests assumptions about the memory layout
+// of slices have not changed, on every architecture. Native backends
+// read & write slice headers directly, expecting them to be laid out
+// as three pointer-sized words:
+//    0: pointer to first element
+//    1: length of the slice
+//    2: capacity of the slice.
+//
+// This test should fail if this ever changes. In that case, the stack and
+// locals handling instructions of every backend will need to be revised to
+// match the new memory layout.
+func TestSliceMemoryLayout(t *testing.T) {
+	if got, want := unsafe.Sizeof([]uint64{}), 3*unsafe.Sizeof(uintptr(0)); got != want {
+		t.Fatalf("Sizeof(slice) = %d, want %d", got, want)
+	}
+
+	slice := make([]uint64, 2, 5)
+	header := (*[3]uintptr)(unsafe.Pointer(&slice))
+	if got, want := header[0], uintptr(unsafe.Pointer(&slice[0])); got != want {
+		t.Errorf("Got data = %#x, want %#x", got, want)
+	}
+	if got, want := header[1], uintptr(2); got != want {
+		t.Errorf("Got len = %d, want %d", got, want)
+	}
+	if got, want := header[2], uintptr(5); got != want {
+		t.Errorf("Got cap = %d, want %d", got, want)
+	}
+}
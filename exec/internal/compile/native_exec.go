@@ -2,18 +2,37 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !appengine
+// +build !appengine,!js
 
 package compile
 
 import "unsafe"
 
 type asmBlock struct {
-	mem unsafe.Pointer
+	mem  unsafe.Pointer
+	size int
+	// incremented by the native code on each invocation, if it was
+	// built with AMD64Backend.SetProfiling.
+	invocations uint64
 }
 
-func (b *asmBlock) Invoke(stack, locals *[]uint64) {
+var (
+	_ NativeCodeRegion = (*asmBlock)(nil)
+	_ CountedCodeUnit  = (*asmBlock)(nil)
+)
+
+// Region implements NativeCodeRegion.
+func (b *asmBlock) Region() (uintptr, int) {
+	return *(*uintptr)(b.mem), b.size
+}
+
+// Invocations implements CountedCodeUnit.
+func (b *asmBlock) Invocations() uint64 {
+	return b.invocations
+}
+
+func (b *asmBlock) Invoke(stack, locals *[]uint64, memory *[]byte) NativeExit {
 	f := (uintptr)(unsafe.Pointer(&b.mem))
-	fp := **(**func(unsafe.Pointer, unsafe.Pointer))(unsafe.Pointer(&f))
-	fp(unsafe.Pointer(stack), unsafe.Pointer(locals))
+	fp := **(**func(unsafe.Pointer, unsafe.Pointer, unsafe.Pointer, unsafe.Pointer) uint64)(unsafe.Pointer(&f))
+	return NativeExit(fp(unsafe.Pointer(stack), unsafe.Pointer(locals), unsafe.Pointer(memory), unsafe.Pointer(&b.invocations)))
 }
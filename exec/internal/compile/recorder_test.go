@@ -0,0 +1,404 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compile
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-interpreter/wagon/disasm"
+	"github.com/go-interpreter/wagon/wasm"
+	ops "github.com/go-interpreter/wagon/wasm/operators"
+	"github.com/twitchyliquid64/golang-asm/obj"
+	"github.com/twitchyliquid64/golang-asm/obj/x86"
+)
+
+func TestRecorderPushI64(t *testing.T) {
+	r, err := NewRecorder("amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &AMD64Backend{}
+	regs := &dirtyRegs{}
+	b.emitPushI64(r, regs, 1234)
+	b.emitPushI64(r, regs, 5678)
+
+	want := []string{
+		"MOVQ $1234, AX",
+		"MOVQ 8(R10), R13",
+		"MOVQ (R10), R12",
+		"LEAQ (R12)(R13*8), R12",
+		"MOVQ AX, (R12)",
+		"INCQ R13",
+		"MOVQ $5678, AX",
+		"MOVQ (R10), R12",
+		"LEAQ (R12)(R13*8), R12",
+		"MOVQ AX, (R12)",
+		"INCQ R13",
+	}
+	if got := r.Instructions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Instructions() = %q, want %q", got, want)
+	}
+	if out := r.Assemble(); out != nil {
+		t.Errorf("Assemble() = %x, want nil", out)
+	}
+}
+
+func TestAMD64BuildInstructions(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+		{Op: addInst},
+	})
+
+	b := &AMD64Backend{}
+	candidates, err := b.Scanner().ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	got, err := b.BuildInstructions(candidates[0], code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRecorder("amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs := &dirtyRegs{}
+	b.emitPreamble(r, regs)
+	// The sum is computed at compile time.
+	reg := b.holdTarget(regs)
+	b.emitMoveConst(r, reg, 7)
+	b.holdReg(r, regs, reg)
+	b.emitPostamble(r, regs)
+	if want := r.Instructions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildInstructions() = %q, want %q", got, want)
+	}
+}
+
+func TestAMD64EffectiveAddressDisplacement(t *testing.T) {
+	tcs := []struct {
+		Offset uint64
+		Disp   int64
+		Lea    string
+	}{
+		{Offset: 0, Disp: 0, Lea: "LEAQ 8(AX), CX"},
+		{Offset: 0x7ffffff7, Disp: 0x7ffffff7, Lea: "LEAQ 2147483647(AX), CX"},
+		{Offset: 0x7ffffff8, Disp: 0, Lea: "LEAQ 8(AX), CX"},
+		{Offset: 0xfffffff8, Disp: 0, Lea: "LEAQ 8(AX), CX"},
+	}
+	for _, tc := range tcs {
+		r, err := NewRecorder("amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &AMD64Backend{}
+		if got := b.emitEffectiveAddress(r, &dirtyRegs{}, tc.Offset, 8); got != tc.Disp {
+			t.Errorf("offset %#x: displacement = %#x, want %#x", tc.Offset, got, tc.Disp)
+		}
+		found := false
+		for _, inst := range r.Instructions() {
+			if inst == tc.Lea {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("offset %#x: %q not in %q", tc.Offset, tc.Lea, r.Instructions())
+		}
+	}
+}
+
+// TestAMD64RegisterAssignment checks the code emitted for every supported
+// opcode only uses registers declared in amd64Scratch or amd64Reserved.
+func TestAMD64RegisterAssignment(t *testing.T) {
+	allowed := map[int16]bool{
+		0:          true,
+		x86.REG_AL: true, // Low byte of RAX.
+	}
+	for _, r := range amd64Scratch {
+		allowed[r] = true
+	}
+	for _, r := range amd64Reserved {
+		if allowed[r] {
+			t.Errorf("%s is both reserved and scratch", obj.Rconv(int(r)))
+		}
+		allowed[r] = true
+	}
+
+	i32Const, _ := ops.New(ops.I32Const)
+	i32Load, _ := ops.New(ops.I32Load)
+	i32LtS, _ := ops.New(ops.I32LtS)
+	brIf, _ := ops.New(ops.BrIf)
+	sequences := [][]disasm.Instr{
+		{minimalInstr(i32Const), minimalInstr(i32Load)},
+		{minimalInstr(i32Const), minimalInstr(i32Const), minimalInstr(i32LtS), minimalInstr(brIf)},
+	}
+	b := &AMD64Backend{}
+	for _, op := range b.SupportedOpcodes() {
+		o, err := ops.New(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sequences = append(sequences, []disasm.Instr{minimalInstr(o)})
+	}
+
+	for _, seq := range sequences {
+		var r *Recorder
+		b.NewAssembler = func() (Assembler, error) {
+			var err error
+			r, err = NewRecorder("amd64")
+			return r, err
+		}
+		code, meta := Compile(seq)
+		last := meta.Instructions[len(meta.Instructions)-1]
+		candidate := CompilationCandidate{End: last.Start + last.Size}
+		if _, err := b.Build(candidate, code, meta); err != nil {
+			t.Fatalf("Build(%s) failed: %v", seq[len(seq)-1].Op.Name, err)
+		}
+		for _, p := range r.Progs {
+			for _, reg := range []int16{p.From.Reg, p.From.Index, p.To.Reg, p.To.Index} {
+				if !allowed[reg] {
+					t.Errorf("%s: %v uses undeclared register %s", seq[len(seq)-1].Op.Name, p, obj.Rconv(int(reg)))
+				}
+			}
+		}
+	}
+}
+
+func TestAMD64AddLocalConst(t *testing.T) {
+	getLocal, _ := ops.New(ops.GetLocal)
+	i64Const, _ := ops.New(ops.I64Const)
+	i64Add, _ := ops.New(ops.I64Add)
+
+	tcs := []struct {
+		C    int64
+		Want []string
+	}{
+		{C: 1, Want: []string{"INCQ DX"}},
+		{C: -1, Want: []string{"DECQ DX"}},
+		{C: 0x7fffffff, Want: []string{"ADDQ $2147483647, DX"}},
+		{C: 0x100000000, Want: []string{"MOVQ $4294967296, R9", "ADDQ R9, DX"}},
+	}
+	for _, tc := range tcs {
+		code, meta := Compile([]disasm.Instr{
+			{Op: getLocal, Immediates: []interface{}{uint32(0)}},
+			{Op: i64Const, Immediates: []interface{}{tc.C}},
+			{Op: i64Add},
+		})
+		b := &AMD64Backend{}
+		insts, err := b.BuildInstructions(CompilationCandidate{EndInstruction: 2}, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(insts, "\n")
+		if !strings.Contains(got, strings.Join(tc.Want, "\n")) {
+			t.Errorf("C = %#x: %q not in\n%s", tc.C, tc.Want, got)
+		}
+		// The local is pushed once, with the constant already added.
+		if n := strings.Count(got, ", (R12)"); n != 1 {
+			t.Errorf("C = %#x: %d pushes, want 1:\n%s", tc.C, n, got)
+		}
+	}
+}
+
+func TestAMD64ConstMul(t *testing.T) {
+	getLocal, _ := ops.New(ops.GetLocal)
+	i64Const, _ := ops.New(ops.I64Const)
+	i64Mul, _ := ops.New(ops.I64Mul)
+
+	tcs := []struct {
+		C    int64
+		Want []string
+	}{
+		{C: 8, Want: []string{"SHLQ $3, AX"}},
+		{C: 5, Want: []string{"LEAQ (AX)(AX*4), AX"}},
+		{C: 3, Want: []string{"LEAQ (AX)(AX*2), AX"}},
+		{C: 7, Want: []string{"MOVQ $7, R9", "IMULQ R9, AX"}},
+	}
+	for _, tc := range tcs {
+		code, meta := Compile([]disasm.Instr{
+			{Op: getLocal, Immediates: []interface{}{uint32(0)}},
+			{Op: i64Const, Immediates: []interface{}{tc.C}},
+			{Op: i64Mul},
+		})
+		b := &AMD64Backend{}
+		insts, err := b.BuildInstructions(CompilationCandidate{EndInstruction: 2}, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(insts, "\n")
+		if !strings.Contains(got, strings.Join(tc.Want, "\n")) {
+			t.Errorf("C = %d: %q not in\n%s", tc.C, tc.Want, got)
+		}
+		// The constant is never pushed, so MULQ is never emitted.
+		if strings.Contains(got, "MULQ R9") && !strings.Contains(got, "IMULQ R9") {
+			t.Errorf("C = %d: MULQ emitted:\n%s", tc.C, got)
+		}
+	}
+}
+
+func TestAMD64SubConstZero(t *testing.T) {
+	getLocal, _ := ops.New(ops.GetLocal)
+	i64Const, _ := ops.New(ops.I64Const)
+	i64Sub, _ := ops.New(ops.I64Sub)
+
+	tcs := []struct {
+		Name    string
+		Instrs  []disasm.Instr
+		Want    string
+		NotWant string
+	}{
+		{
+			Name: "0-x",
+			Instrs: []disasm.Instr{
+				{Op: i64Const, Immediates: []interface{}{int64(0)}},
+				{Op: getLocal, Immediates: []interface{}{uint32(0)}},
+				{Op: i64Sub},
+			},
+			Want:    "NEGQ DX",
+			NotWant: "SUBQ",
+		},
+		{
+			Name: "x-0",
+			Instrs: []disasm.Instr{
+				{Op: getLocal, Immediates: []interface{}{uint32(0)}},
+				{Op: i64Const, Immediates: []interface{}{int64(0)}},
+				{Op: i64Sub},
+			},
+			NotWant: "SUBQ",
+		},
+		{
+			Name: "x-5",
+			Instrs: []disasm.Instr{
+				{Op: getLocal, Immediates: []interface{}{uint32(0)}},
+				{Op: i64Const, Immediates: []interface{}{int64(5)}},
+				{Op: i64Sub},
+			},
+			Want:    "SUBQ R8, DX",
+			NotWant: "NEGQ",
+		},
+	}
+	for _, tc := range tcs {
+		code, meta := Compile(tc.Instrs)
+		b := &AMD64Backend{}
+		insts, err := b.BuildInstructions(CompilationCandidate{EndInstruction: 2}, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(insts, "\n")
+		if tc.Want != "" && !strings.Contains(got, tc.Want) {
+			t.Errorf("%s: %q not in\n%s", tc.Name, tc.Want, got)
+		}
+		if strings.Contains(got, tc.NotWant) {
+			t.Errorf("%s: unexpected %q in\n%s", tc.Name, tc.NotWant, got)
+		}
+	}
+}
+
+func TestAMD64SelectOperandType(t *testing.T) {
+	getLocal, _ := ops.New(ops.GetLocal)
+	i32Const, _ := ops.New(ops.I32Const)
+	selectOp, _ := ops.New(ops.Select)
+
+	tcs := []struct {
+		Name    string
+		Type    wasm.ValueType
+		Want    string
+		NotWant string
+	}{
+		{Name: "i64", Type: wasm.ValueTypeI64, Want: "CMOVQEQ R9, AX", NotWant: "MOVAPS"},
+		{Name: "i32", Type: wasm.ValueTypeI32, Want: "CMOVQEQ R9, AX", NotWant: "MOVAPS"},
+		{Name: "f64", Type: wasm.ValueTypeF64, Want: "MOVAPS X1, X0", NotWant: "CMOV"},
+		{Name: "f32", Type: wasm.ValueTypeF32, Want: "MOVAPS X1, X0", NotWant: "CMOV"},
+	}
+	for _, tc := range tcs {
+		code, meta := Compile([]disasm.Instr{
+			{Op: getLocal, Immediates: []interface{}{uint32(0)}},
+			{Op: getLocal, Immediates: []interface{}{uint32(1)}},
+			{Op: i32Const, Immediates: []interface{}{int32(1)}},
+			{Op: selectOp},
+		})
+		meta.LocalTypes = []wasm.ValueType{tc.Type, tc.Type}
+		b := &AMD64Backend{}
+		insts, err := b.BuildInstructions(CompilationCandidate{EndInstruction: 3}, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(insts, "\n")
+		if !strings.Contains(got, tc.Want) {
+			t.Errorf("%s: %q not in\n%s", tc.Name, tc.Want, got)
+		}
+		if strings.Contains(got, tc.NotWant) {
+			t.Errorf("%s: unexpected %q in\n%s", tc.Name, tc.NotWant, got)
+		}
+	}
+}
+
+func TestAMD64FoldConstants(t *testing.T) {
+	i64Const, _ := ops.New(ops.I64Const)
+	getLocal, _ := ops.New(ops.GetLocal)
+	setLocal, _ := ops.New(ops.SetLocal)
+	i64Mul, _ := ops.New(ops.I64Mul)
+
+	tcs := []struct {
+		Name    string
+		Instrs  []disasm.Instr
+		Want    []string
+		NotWant []string
+	}{
+		{
+			Name: "propagated",
+			Instrs: []disasm.Instr{
+				{Op: i64Const, Immediates: []interface{}{int64(5)}},
+				{Op: setLocal, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocal, Immediates: []interface{}{uint32(0)}},
+				{Op: i64Const, Immediates: []interface{}{int64(3)}},
+				{Op: i64Mul},
+			},
+			// The local is still written, and the product pushed.
+			Want:    []string{"MOVQ $5, DX", "MOVQ DX, (CX)(BX*8)", "MOVQ $15, DX"},
+			NotWant: []string{"IMULQ", "LEAQ (DX)(DX*2)", "MOVQ (CX), "},
+		},
+		{
+			Name: "overwritten",
+			Instrs: []disasm.Instr{
+				{Op: i64Const, Immediates: []interface{}{int64(5)}},
+				{Op: setLocal, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocal, Immediates: []interface{}{uint32(1)}},
+				{Op: setLocal, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocal, Immediates: []interface{}{uint32(0)}},
+				{Op: i64Const, Immediates: []interface{}{int64(3)}},
+				{Op: i64Mul},
+			},
+			NotWant: []string{"MOVQ $15"},
+		},
+	}
+	for _, tc := range tcs {
+		code, meta := Compile(tc.Instrs)
+		b := &AMD64Backend{}
+		insts, err := b.BuildInstructions(CompilationCandidate{EndInstruction: len(tc.Instrs) - 1}, code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(insts, "\n")
+		for _, want := range tc.Want {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: %q not in\n%s", tc.Name, want, got)
+			}
+		}
+		for _, notWant := range tc.NotWant {
+			if strings.Contains(got, notWant) {
+				t.Errorf("%s: unexpected %q in\n%s", tc.Name, notWant, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !appengine,!js
+
+package compile
+
+// Backend is implemented by types which can build native code for a
+// compilation candidate, such as AMD64Backend.
+type Backend interface {
+	// Build returns the machine code for the candidate.
+	Build(candidate CompilationCandidate, code []byte, meta *BytecodeMetadata) ([]byte, error)
+}
+
+// RunCandidate builds candidate with backend, places the result in
+// executable memory, and invokes it once with the given stack and locals.
+// It is intended for exercising a backend without a VM.
+//
+// The stack must have enough spare capacity for any values the candidate
+// pushes. The candidate sees an empty linear memory, so any memory access
+// traps. The stack as modified by the native code is returned, along with
+// the reason it stopped executing.
+func RunCandidate(backend Backend, candidate CompilationCandidate, code []byte, meta *BytecodeMetadata, stack, locals []uint64) ([]uint64, NativeExit, error) {
+	out, err := backend.Build(candidate, code, meta)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	allocator := &MMapAllocator{}
+	defer allocator.Close()
+	unit, err := allocator.AllocateExec(out)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var memory []byte
+	exit := unit.Invoke(&stack, &locals, &memory)
+	return stack, exit, nil
+}
@@ -5,27 +5,70 @@
 package compile
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
 	ops "github.com/go-interpreter/wagon/wasm/operators"
 )
 
+// ErrScanDeadline is returned by ScanFuncBefore when the deadline passes
+// before the function has been scanned.
+var ErrScanDeadline = errors.New("compile: scan exceeded its deadline")
+
+// scanDeadlineInterval is the number of instructions scanned between
+// checks of the deadline in ScanFuncBefore, so the clock is not read for
+// every instruction.
+const scanDeadlineInterval = 1024
+
 type scanner struct {
 	supportedOpcodes map[byte]bool
+	// gapOpcodes have no effect, and are compiled to nothing. A single
+	// one between two candidates does not keep them apart, see
+	// mergeAdjacent.
+	gapOpcodes map[byte]bool
+	// costModel decides which candidates are worth emitting. If nil,
+	// DefaultCostModel is used.
+	costModel *CostModel
+	// scanWindow is the number of instructions at the start of each
+	// function which are scanned, or 0 to scan them all.
+	scanWindow int
+}
+
+// SetScanWindow limits scanning to the first n instructions of each
+// function, bounding the cost of scanning huge functions at the expense of
+// leaving the rest of them to the interpreter. A run of supported opcodes
+// crossing the end of the window is cut short there. If n is 0, every
+// instruction is scanned.
+func (s *scanner) SetScanWindow(n int) {
+	s.scanWindow = n
+}
+
+// SetCostModel sets the CostModel which decides whether a run of supported
+// opcodes is worth compiling: only runs estimated to be faster as native
+// code are emitted as candidates.
+func (s *scanner) SetCostModel(m CostModel) {
+	s.costModel = &m
 }
 
 // InstructionMetadata describes a bytecode instruction.
 type InstructionMetadata struct {
-	Op    byte
-	Start int
-	Size  int
+	Op byte
+	// Start is the bytecode index of the opcode, and Size the length of
+	// the opcode and its immediates in bytes.
+	Start int64
+	Size  int64
 }
 
 // CompilationCandidate describes a range of bytecode that can
 // be translated to native code.
 type CompilationCandidate struct {
 	// Bytecode index of the first opcode.
-	Beginning uint
+	Beginning int64
 	// Bytecode index of the last byte in the instruction.
-	End uint
+	End int64
 	// InstructionMeta index of the first instruction.
 	StartInstruction int
 	// InstructionMeta index of the last instruction.
@@ -44,7 +87,7 @@ func (s *CompilationCandidate) reset() {
 
 // Bounds returns the beginning & end index in the bytecode which
 // this candidate would replace.
-func (s *CompilationCandidate) Bounds() (uint, uint) {
+func (s *CompilationCandidate) Bounds() (int64, int64) {
 	return s.Beginning, s.End
 }
 
@@ -56,23 +99,192 @@ type Metrics struct {
 	AllOps     int
 	IntegerOps int
 	FloatOps   int
+
+	// MaxStackGrowth is the largest number of values the sequence
+	// pushes on top of the stack height at its beginning.
+	MaxStackGrowth int
+	stackDelta     int
+}
+
+// add accumulates the metrics of a sequence which directly follows the
+// one m describes.
+func (m *Metrics) add(next Metrics) {
+	m.MemoryReads += next.MemoryReads
+	m.MemoryWrites += next.MemoryWrites
+	m.StackReads += next.StackReads
+	m.StackWrites += next.StackWrites
+	m.AllOps += next.AllOps
+	m.IntegerOps += next.IntegerOps
+	m.FloatOps += next.FloatOps
+	if growth := m.stackDelta + next.MaxStackGrowth; growth > m.MaxStackGrowth {
+		m.MaxStackGrowth = growth
+	}
+	m.stackDelta += next.stackDelta
+}
+
+// CostModel estimates the relative cost of running an instruction sequence
+// in the interpreter & as native code. The interpreter pays to dispatch
+// every instruction & to bounds-check every stack access, while native
+// code keeps most intermediate values in registers but pays a fixed cost
+// to enter the block & leave it again: the preamble loads the stack,
+// locals & memory headers, and the postamble writes the stack length
+// back.
+type CostModel struct {
+	InterpDispatch int // per instruction interpreted.
+	InterpStack    int // per stack read or write in the interpreter.
+	InterpMemory   int // per linear memory read or write in the interpreter.
+	NativeEntry    int // per entry into native code.
+	NativeStack    int // per stack read or write in native code.
+	NativeMemory   int // per linear memory read or write in native code.
+	Arithmetic     int // per integer or float op, in either.
+}
+
+// DefaultCostModel is the CostModel used unless another is set with
+// SetCostModel.
+var DefaultCostModel = CostModel{
+	InterpDispatch: 8,
+	InterpStack:    2,
+	InterpMemory:   4,
+	NativeEntry:    24,
+	NativeStack:    1,
+	NativeMemory:   3,
+	Arithmetic:     1,
+}
+
+// Interpreter estimates the cost of interpreting the sequence m describes.
+func (c CostModel) Interpreter(m Metrics) int {
+	return c.InterpDispatch*m.AllOps + c.InterpStack*int(m.StackReads+m.StackWrites) +
+		c.InterpMemory*int(m.MemoryReads+m.MemoryWrites) + c.Arithmetic*(m.IntegerOps+m.FloatOps)
+}
+
+// Native estimates the cost of running the sequence m describes as native
+// code, including entering & leaving it.
+func (c CostModel) Native(m Metrics) int {
+	return c.NativeEntry + c.NativeStack*int(m.StackReads+m.StackWrites) +
+		c.NativeMemory*int(m.MemoryReads+m.MemoryWrites) + c.Arithmetic*(m.IntegerOps+m.FloatOps)
+}
+
+// Profitable returns true if the sequence m describes is estimated to run
+// faster as native code than in the interpreter.
+func (c CostModel) Profitable(m Metrics) bool {
+	return c.Native(m) < c.Interpreter(m)
+}
+
+// EstimatedSpeedup estimates how many times faster native code runs the
+// sequence m describes than the interpreter does, from the mix of its
+// instructions under DefaultCostModel. Long runs of arithmetic score
+// highest. Short sequences score lower, as the cost of entering native
+// code dominates, and may score below 1.
+func (m Metrics) EstimatedSpeedup() float64 {
+	return float64(DefaultCostModel.Interpreter(m)) / float64(DefaultCostModel.Native(m))
+}
+
+// branchKeepsStack returns false if inst is a conditional branch which
+// discards values from the stack when taken. Native code exits to the
+// interpreter to take a branch, and only supports branches which leave
+// the stack as it is.
+func branchKeepsStack(bytecode []byte, inst InstructionMetadata) bool {
+	if inst.Op != OpJmpNz {
+		return true
+	}
+	// OpJmpNz <addr int64> <preserveTop bool> <discard int64>
+	return binary.LittleEndian.Uint64(bytecode[inst.Start+10:]) == 0
+}
+
+// controlOpcodes transfer control away from the next instruction without
+// exiting native code, or call another function. Native code can contain
+// none of them, whatever opcodes a scanner claims to support.
+var controlOpcodes = map[byte]bool{
+	ops.Call:            true,
+	ops.CallIndirect:    true,
+	ops.BrTable:         true,
+	ops.Unreachable:     true,
+	ops.WagonNativeExec: true,
+	OpJmp:               true,
+	OpJmpZ:              true,
+}
+
+// CheckCandidate returns an error if candidate contains a call or control
+// instruction which native code cannot contain, or a branch target after
+// its first instruction. It guards against scanners which wrongly report
+// such an instruction as supported.
+func CheckCandidate(candidate CompilationCandidate, meta *BytecodeMetadata) error {
+	if candidate.StartInstruction < 0 || candidate.EndInstruction >= len(meta.Instructions) || candidate.StartInstruction > candidate.EndInstruction {
+		return fmt.Errorf("candidate instructions [%d, %d] out of range", candidate.StartInstruction, candidate.EndInstruction)
+	}
+	for i := candidate.StartInstruction; i <= candidate.EndInstruction; i++ {
+		inst := meta.Instructions[i]
+		if controlOpcodes[inst.Op] {
+			return fmt.Errorf("candidate contains call or control opcode 0x%x at %d", inst.Op, inst.Start)
+		}
+		// Branches, such as to the end of a block, must land on
+		// bytecode rather than the unreachable opcodes which pad the
+		// patched candidate. A candidate may end at a target, which is
+		// where the interpreter resumes.
+		if i > candidate.StartInstruction && meta.InboundTargets[inst.Start] {
+			return fmt.Errorf("candidate contains branch target %d", inst.Start)
+		}
+	}
+	return nil
+}
+
+// CheckBounds returns an error unless candidate covers a non-empty range
+// of bytecode of length codeLen.
+func CheckBounds(candidate CompilationCandidate, codeLen int64) error {
+	lower, upper := candidate.Bounds()
+	if lower < 0 || upper <= lower || upper > codeLen {
+		return fmt.Errorf("candidate bounds [%d:%d] out of range for %d bytes of bytecode", lower, upper, codeLen)
+	}
+	return nil
+}
+
+// SupportedOpcodes returns the opcodes which may appear in a candidate, in
+// ascending order.
+func (s *scanner) SupportedOpcodes() []byte {
+	var out []byte
+	for op := 0; op <= 0xff; op++ {
+		if s.supportedOpcodes[byte(op)] || s.gapOpcodes[byte(op)] {
+			out = append(out, byte(op))
+		}
+	}
+	return out
 }
 
 // ScanFunc scans the given function information, emitting selections of
 // bytecode which could be compiled into function code.
+//
+// Dead code, where the stack is polymorphic, never reaches the scanner:
+// Compile drops the instructions the disassembler marks as unreachable.
+// The unreachable, br & br_table instructions preceding a dead region are
+// not supported, so no candidate can span one.
 func (s *scanner) ScanFunc(bytecode []byte, meta *BytecodeMetadata) ([]CompilationCandidate, error) {
+	return s.ScanFuncBefore(bytecode, meta, time.Time{})
+}
+
+// ScanFuncBefore is like ScanFunc, but gives up with ErrScanDeadline once
+// deadline has passed. The deadline is checked every
+// scanDeadlineInterval instructions. A zero deadline means no limit.
+func (s *scanner) ScanFuncBefore(bytecode []byte, meta *BytecodeMetadata, deadline time.Time) ([]CompilationCandidate, error) {
 	var finishedCandidates []CompilationCandidate
 	inProgress := CompilationCandidate{}
 
 	for i, inst := range meta.Instructions {
+		if s.scanWindow > 0 && i >= s.scanWindow {
+			break
+		}
+		if !deadline.IsZero() && i%scanDeadlineInterval == 0 && time.Now().After(deadline) {
+			return nil, ErrScanDeadline
+		}
+		if inst.Start < 0 || inst.Size <= 0 || inst.Start > math.MaxInt64-inst.Size {
+			return nil, fmt.Errorf("invalid metadata for instruction %d: start %d, size %d", i, inst.Start, inst.Size)
+		}
 		// Except for the first instruction, we cant emit a native section
 		// where other parts of code try and call into us halfway. Maybe we
 		// can support that in the future.
-		isInsideBranchTarget := meta.InboundTargets[int64(inst.Start)] && inst.Start > 0
+		isInsideBranchTarget := meta.InboundTargets[inst.Start] && inst.Start > 0
 
-		if !s.supportedOpcodes[inst.Op] || isInsideBranchTarget {
-			// See if the candidate can be emitted.
-			if inProgress.Metrics.AllOps > 2 {
+		if !s.supportedOpcodes[inst.Op] || isInsideBranchTarget || !branchKeepsStack(bytecode, inst) {
+			if inProgress.Metrics.AllOps > 0 {
 				finishedCandidates = append(finishedCandidates, inProgress)
 			}
 			inProgress.reset()
@@ -83,32 +295,142 @@ func (s *scanner) ScanFunc(bytecode []byte, meta *BytecodeMetadata) ([]Compilati
 
 		if inProgress.Metrics.AllOps == 0 {
 			// First instruction of the candidate - setup structure.
-			inProgress.Beginning = uint(inst.Start)
+			inProgress.Beginning = inst.Start
 			inProgress.StartInstruction = i
 		}
 		inProgress.EndInstruction = i
-		inProgress.End = uint(inst.Start) + uint(inst.Size)
+		inProgress.End = inst.Start + inst.Size
 
 		// TODO: Add to this table as backends support more opcodes.
 		switch inst.Op {
-		case ops.I64Const, ops.GetLocal:
+		case ops.I64Const, ops.I32Const, ops.GetLocal:
 			inProgress.Metrics.IntegerOps++
 			inProgress.Metrics.StackWrites++
-		case ops.I64Add, ops.I64Sub, ops.I64Mul, ops.I64And, ops.I64Or:
+			inProgress.Metrics.stackDelta++
+		case ops.I64Add, ops.I64Sub, ops.I64Mul, ops.I64DivU, ops.I64And, ops.I64Or, ops.I64Shl, ops.I32Add, ops.I32Mul,
+			ops.I32DivS, ops.I32DivU, ops.I32RemS, ops.I32RemU,
+			ops.I32Shl, ops.I32ShrS, ops.I32ShrU, ops.I32Rotl, ops.I32Rotr,
+			ops.I64Eq, ops.I64Ne, ops.I64LtS, ops.I64LtU, ops.I64GtS, ops.I64GtU, ops.I64LeS, ops.I64LeU, ops.I64GeS, ops.I64GeU,
+			ops.I32Eq, ops.I32Ne, ops.I32LtS, ops.I32LtU, ops.I32GtS, ops.I32GtU, ops.I32LeS, ops.I32LeU, ops.I32GeS, ops.I32GeU:
 			inProgress.Metrics.IntegerOps++
 			inProgress.Metrics.StackReads += 2
 			inProgress.Metrics.StackWrites++
+			inProgress.Metrics.stackDelta--
+		case ops.I32WrapI64:
+			inProgress.Metrics.IntegerOps++
+			inProgress.Metrics.StackReads++
+			inProgress.Metrics.StackWrites++
+		case ops.I32ReinterpretF32, ops.F32ReinterpretI32:
+			inProgress.Metrics.StackReads++
+			inProgress.Metrics.StackWrites++
+		case ops.F32Abs, ops.F64Abs, ops.F64Ceil, ops.F64Floor, ops.F64Trunc, ops.F64Nearest,
+			ops.F32ConvertUI32, ops.F32ConvertUI64, ops.F64ConvertUI32, ops.F64ConvertUI64:
+			inProgress.Metrics.FloatOps++
+			inProgress.Metrics.StackReads++
+			inProgress.Metrics.StackWrites++
+		case ops.F32Add, ops.F64Add, ops.F32Mul, ops.F64Mul, ops.F32Copysign, ops.F64Copysign:
+			inProgress.Metrics.FloatOps++
+			inProgress.Metrics.StackReads += 2
+			inProgress.Metrics.StackWrites++
+			inProgress.Metrics.stackDelta--
+		case ops.SetLocal:
+			inProgress.Metrics.StackReads++
+			inProgress.Metrics.stackDelta--
+		case ops.Drop:
+			inProgress.Metrics.stackDelta--
+		case ops.Select:
+			inProgress.Metrics.StackReads += 3
+			inProgress.Metrics.StackWrites++
+			inProgress.Metrics.stackDelta -= 2
+		case OpJmpNz:
+			inProgress.Metrics.StackReads++
+			inProgress.Metrics.stackDelta--
+		case ops.I32Load, ops.I64Load:
+			inProgress.Metrics.MemoryReads++
+			inProgress.Metrics.StackReads++
+			inProgress.Metrics.StackWrites++
+		case ops.I32Store, ops.I64Store:
+			inProgress.Metrics.MemoryWrites++
+			inProgress.Metrics.StackReads += 2
+			inProgress.Metrics.stackDelta -= 2
+		case ops.GrowMemory:
+			inProgress.Metrics.MemoryWrites++
+			inProgress.Metrics.StackReads++
+			inProgress.Metrics.StackWrites++
+		}
+		if inProgress.Metrics.stackDelta > inProgress.Metrics.MaxStackGrowth {
+			inProgress.Metrics.MaxStackGrowth = inProgress.Metrics.stackDelta
 		}
 		inProgress.Metrics.AllOps++
+
+		// Nothing after a return is reached, and the VM resumes after
+		// a memory.grow, so both always end the candidate.
+		if endsCandidate(inst.Op) {
+			if inProgress.Metrics.AllOps > 0 {
+				finishedCandidates = append(finishedCandidates, inProgress)
+			}
+			inProgress.reset()
+		}
 	}
 
-	// End of instructions - emit the inProgress candidate if
-	// its at least 3 instructions.
-	if inProgress.Metrics.AllOps > 2 {
+	if inProgress.Metrics.AllOps > 0 {
 		finishedCandidates = append(finishedCandidates, inProgress)
 	}
 
 	//fmt.Printf("Candidates: %+v\n", finishedCandidates)
 	//fmt.Printf("Instructions: %+v\n", meta.Instructions)
-	return finishedCandidates, nil
+	return s.profitable(s.mergeAdjacent(finishedCandidates, meta)), nil
+}
+
+// endsCandidate reports whether native code always exits at op, so it
+// must be the last instruction of a candidate.
+func endsCandidate(op byte) bool {
+	return op == ops.Return || op == ops.GrowMemory
+}
+
+// profitable filters candidates down to those the scanner's cost model
+// estimates are faster as native code. Runs are merged before they are
+// filtered, so runs which are only worth compiling together are kept.
+func (s *scanner) profitable(candidates []CompilationCandidate) []CompilationCandidate {
+	model := DefaultCostModel
+	if s.costModel != nil {
+		model = *s.costModel
+	}
+	out := candidates[:0]
+	for _, c := range candidates {
+		if model.Profitable(c.Metrics) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// mergeAdjacent combines candidates which are only separated by a single
+// gap opcode into one, so they share a native block rather than returning
+// to the interpreter for an instruction which does nothing.
+func (s *scanner) mergeAdjacent(candidates []CompilationCandidate, meta *BytecodeMetadata) []CompilationCandidate {
+	if len(s.gapOpcodes) == 0 || len(candidates) < 2 {
+		return candidates
+	}
+	merged := candidates[:1]
+	for _, next := range candidates[1:] {
+		prev := &merged[len(merged)-1]
+		if next.StartInstruction != prev.EndInstruction+2 {
+			merged = append(merged, next)
+			continue
+		}
+		gap := meta.Instructions[prev.EndInstruction+1]
+		// Neither the gap nor the next candidate may be entered by a
+		// branch, and prev must run to its end.
+		if !s.gapOpcodes[gap.Op] || meta.InboundTargets[gap.Start] || meta.InboundTargets[next.Beginning] ||
+			endsCandidate(meta.Instructions[prev.EndInstruction].Op) {
+			merged = append(merged, next)
+			continue
+		}
+		prev.End = next.End
+		prev.EndInstruction = next.EndInstruction
+		prev.Metrics.add(next.Metrics)
+		prev.Metrics.AllOps++ // the gap instruction.
+	}
+	return merged
 }
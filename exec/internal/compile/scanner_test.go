@@ -0,0 +1,605 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compile
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-interpreter/wagon/disasm"
+	"github.com/go-interpreter/wagon/wasm"
+	ops "github.com/go-interpreter/wagon/wasm/operators"
+)
+
+func TestScannerMaxStackGrowth(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: addInst},
+		{Op: addInst},
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+	})
+
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.I64Const: true, ops.I64Add: true}}
+	candidates, err := s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	if got, want := candidates[0].Metrics.MaxStackGrowth, 3; got != want {
+		t.Errorf("MaxStackGrowth = %d, want %d", got, want)
+	}
+}
+
+func TestScannerEndsAtReturn(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	returnInst, _ := ops.New(ops.Return)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: addInst},
+		{Op: returnInst},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+		{Op: addInst},
+	})
+
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.I64Const: true, ops.I64Add: true, ops.Return: true}}
+	candidates, err := s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("len(candidates) = %d, want 2", len(candidates))
+	}
+	if got, want := candidates[0].EndInstruction, 3; got != want {
+		t.Errorf("candidates[0].EndInstruction = %d, want %d", got, want)
+	}
+	if got, want := candidates[1].StartInstruction, 4; got != want {
+		t.Errorf("candidates[1].StartInstruction = %d, want %d", got, want)
+	}
+}
+
+func TestScannerEndsAtGrowMemory(t *testing.T) {
+	constInst, _ := ops.New(ops.I32Const)
+	addInst, _ := ops.New(ops.I32Add)
+	growInst, _ := ops.New(ops.GrowMemory)
+	nopInst, _ := ops.New(ops.Nop)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int32(1)}},
+		{Op: constInst, Immediates: []interface{}{int32(2)}},
+		{Op: addInst},
+		{Op: growInst, Immediates: []interface{}{uint8(0)}},
+		{Op: nopInst},
+		{Op: constInst, Immediates: []interface{}{int32(3)}},
+		{Op: addInst},
+		{Op: constInst, Immediates: []interface{}{int32(4)}},
+		{Op: addInst},
+	})
+
+	// The VM resumes after the grow, so the nop gap is not merged over.
+	s := &scanner{
+		supportedOpcodes: map[byte]bool{ops.I32Const: true, ops.I32Add: true, ops.GrowMemory: true},
+		gapOpcodes:       map[byte]bool{ops.Nop: true},
+	}
+	candidates, err := s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("len(candidates) = %d, want 2", len(candidates))
+	}
+	if got, want := candidates[0].EndInstruction, 3; got != want {
+		t.Errorf("candidates[0].EndInstruction = %d, want %d", got, want)
+	}
+	if got, want := candidates[0].Metrics.MemoryWrites, uint(1); got != want {
+		t.Errorf("candidates[0].Metrics.MemoryWrites = %d, want %d", got, want)
+	}
+	if got, want := candidates[1].StartInstruction, 5; got != want {
+		t.Errorf("candidates[1].StartInstruction = %d, want %d", got, want)
+	}
+}
+
+func TestScannerSkipsDeadCode(t *testing.T) {
+	blockInst, _ := ops.New(ops.Block)
+	endInst, _ := ops.New(ops.End)
+	unreachableInst, _ := ops.New(ops.Unreachable)
+	dropInst, _ := ops.New(ops.Drop)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	body, err := disasm.Assemble([]disasm.Instr{
+		{Op: blockInst, Immediates: []interface{}{wasm.BlockTypeEmpty}},
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: unreachableInst},
+		// Dead: the stack is polymorphic from here to the end of the block.
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+		{Op: addInst},
+		{Op: addInst},
+		{Op: addInst},
+		{Op: dropInst},
+		{Op: endInst},
+		{Op: constInst, Immediates: []interface{}{int64(5)}},
+		{Op: constInst, Immediates: []interface{}{int64(6)}},
+		{Op: addInst},
+		{Op: dropInst},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := disasm.NewDisassembly(wasm.Function{Sig: &wasm.FunctionSig{}, Body: &wasm.FunctionBody{Code: body}}, &wasm.Module{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, meta := Compile(d.Code)
+
+	unreachableAt := -1
+	for i, inst := range meta.Instructions {
+		if inst.Op == ops.Unreachable {
+			unreachableAt = i
+		}
+	}
+	if unreachableAt < 0 {
+		t.Fatal("unreachable instruction missing from compiled code")
+	}
+
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.I64Const: true, ops.I64Add: true}}
+	candidates, err := s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("len(candidates) = %d, want 2", len(candidates))
+	}
+	for i, c := range candidates {
+		if c.StartInstruction <= unreachableAt && c.EndInstruction >= unreachableAt {
+			t.Errorf("candidates[%d] = [%d, %d] spans unreachable at %d", i, c.StartInstruction, c.EndInstruction, unreachableAt)
+		}
+		if got, want := c.Metrics.AllOps, 3; got != want {
+			t.Errorf("candidates[%d].Metrics.AllOps = %d, want %d", i, got, want)
+		}
+	}
+	if got, want := candidates[1].Metrics.MaxStackGrowth, 2; got != want {
+		t.Errorf("candidates[1].Metrics.MaxStackGrowth = %d, want %d", got, want)
+	}
+}
+
+func TestScannerEndsBeforeCall(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	callInst, _ := ops.New(ops.Call)
+	callIndirectInst, _ := ops.New(ops.CallIndirect)
+
+	for _, call := range []disasm.Instr{
+		{Op: callInst, Immediates: []interface{}{uint32(0)}},
+		{Op: callIndirectInst, Immediates: []interface{}{uint32(0), uint32(0)}},
+	} {
+		code, meta := Compile([]disasm.Instr{
+			{Op: constInst, Immediates: []interface{}{int64(1)}},
+			{Op: constInst, Immediates: []interface{}{int64(2)}},
+			{Op: addInst},
+			call,
+			{Op: constInst, Immediates: []interface{}{int64(3)}},
+			{Op: addInst},
+			{Op: constInst, Immediates: []interface{}{int64(4)}},
+		})
+
+		s := &scanner{supportedOpcodes: map[byte]bool{ops.I64Const: true, ops.I64Add: true}}
+		candidates, err := s.ScanFunc(code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(candidates) != 2 {
+			t.Fatalf("%s: len(candidates) = %d, want 2", call.Op.Name, len(candidates))
+		}
+		if got, want := candidates[0].EndInstruction, 2; got != want {
+			t.Errorf("%s: EndInstruction = %d, want %d", call.Op.Name, got, want)
+		}
+		if got, want := candidates[0].End, meta.Instructions[3].Start; got != want {
+			t.Errorf("%s: End = %d, want %d (the start of the call)", call.Op.Name, got, want)
+		}
+		if got, want := candidates[1].Beginning, meta.Instructions[4].Start; got != want {
+			t.Errorf("%s: Beginning = %d, want %d (the end of the call)", call.Op.Name, got, want)
+		}
+	}
+}
+
+func TestScannerSpansStructuralBlocks(t *testing.T) {
+	blockInst, _ := ops.New(ops.Block)
+	loopInst, _ := ops.New(ops.Loop)
+	endInst, _ := ops.New(ops.End)
+	brIfInst, _ := ops.New(ops.BrIf)
+	dropInst, _ := ops.New(ops.Drop)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+
+	compile := func(instrs []disasm.Instr) ([]byte, *BytecodeMetadata) {
+		body, err := disasm.Assemble(instrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := disasm.NewDisassembly(wasm.Function{Sig: &wasm.FunctionSig{}, Body: &wasm.FunctionBody{Code: body}}, &wasm.Module{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Compile(d.Code)
+	}
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.I64Const: true, ops.I64Add: true, OpJmpNz: true}}
+
+	// Nothing branches to the block or the loop, so their markers are
+	// purely structural and the arithmetic is straight-line.
+	code, meta := compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: blockInst, Immediates: []interface{}{wasm.BlockType(wasm.ValueTypeI64)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: addInst},
+		{Op: loopInst, Immediates: []interface{}{wasm.BlockType(wasm.ValueTypeI64)}},
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+		{Op: endInst},
+		{Op: addInst},
+		{Op: endInst},
+		{Op: addInst},
+		{Op: dropInst},
+	})
+	candidates, err := s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	if got, want := candidates[0].Metrics.AllOps, 7; got != want {
+		t.Errorf("Metrics.AllOps = %d, want %d", got, want)
+	}
+	if got, want := candidates[0].StartInstruction, 0; got != want {
+		t.Errorf("StartInstruction = %d, want %d", got, want)
+	}
+
+	// A branch back to the loop makes its start a branch target, which
+	// must begin a new candidate.
+	code, meta = compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: addInst},
+		{Op: loopInst, Immediates: []interface{}{wasm.BlockTypeEmpty}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+		{Op: addInst},
+		{Op: brIfInst, Immediates: []interface{}{uint32(0)}},
+		{Op: endInst},
+		{Op: constInst, Immediates: []interface{}{int64(5)}},
+		{Op: addInst},
+		{Op: dropInst},
+	})
+	candidates, err = s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("len(candidates) = %d, want 2", len(candidates))
+	}
+	loopStart := meta.Instructions[3].Start
+	for i, c := range candidates {
+		if c.Beginning < loopStart && c.End > loopStart {
+			t.Errorf("candidates[%d] = [%d, %d] spans the loop start at %d", i, c.Beginning, c.End, loopStart)
+		}
+	}
+}
+
+func TestScannerMergesAcrossGap(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	nopInst, _ := ops.New(ops.Nop)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: addInst},
+		{Op: nopInst},
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+		{Op: constInst, Immediates: []interface{}{int64(5)}},
+		{Op: constInst, Immediates: []interface{}{int64(6)}},
+		{Op: addInst},
+		{Op: addInst},
+	})
+
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.I64Const: true, ops.I64Add: true}}
+	candidates, err := s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 2 {
+		t.Fatalf("without gap opcodes, len(candidates) = %d, want 2", len(candidates))
+	}
+
+	s.gapOpcodes = map[byte]bool{ops.Nop: true}
+	candidates, err = s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	c := candidates[0]
+	if c.StartInstruction != 0 || c.EndInstruction != 9 {
+		t.Errorf("instructions = [%d, %d], want [0, 9]", c.StartInstruction, c.EndInstruction)
+	}
+	if want := meta.Instructions[9].Start + meta.Instructions[9].Size; c.Beginning != 0 || c.End != want {
+		t.Errorf("bounds = [%d, %d], want [0, %d]", c.Beginning, c.End, want)
+	}
+	if got, want := c.Metrics.AllOps, 10; got != want {
+		t.Errorf("Metrics.AllOps = %d, want %d", got, want)
+	}
+	// Two values are left after the first candidate, and the second
+	// pushes three more.
+	if got, want := c.Metrics.MaxStackGrowth, 5; got != want {
+		t.Errorf("MaxStackGrowth = %d, want %d", got, want)
+	}
+}
+
+func TestMetricsEstimatedSpeedup(t *testing.T) {
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	addInst, _ := ops.New(ops.I64Add)
+	loadInst, _ := ops.New(ops.I64Load)
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.GetLocal: true, ops.I64Add: true, ops.I64Load: true}}
+	scan := func(instrs []disasm.Instr) Metrics {
+		code, meta := Compile(instrs)
+		candidates, err := s.ScanFunc(code, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(candidates) != 1 {
+			t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+		}
+		return candidates[0].Metrics
+	}
+	// local0 + local1 + local1 + ...
+	arith := func(n int) Metrics {
+		instrs := []disasm.Instr{{Op: getLocalInst, Immediates: []interface{}{uint32(0)}}}
+		for i := 0; i < n; i++ {
+			instrs = append(instrs,
+				disasm.Instr{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				disasm.Instr{Op: addInst})
+		}
+		return scan(instrs)
+	}
+	// A chain of loads, each from the address loaded by the last.
+	loads := func(n int) Metrics {
+		instrs := []disasm.Instr{{Op: getLocalInst, Immediates: []interface{}{uint32(0)}}}
+		for i := 0; i < n; i++ {
+			instrs = append(instrs, disasm.Instr{Op: loadInst, Immediates: []interface{}{uint32(3), uint32(0)}})
+		}
+		return scan(instrs)
+	}
+
+	prev := 0.0
+	for _, n := range []int{1, 2, 4, 8, 16} {
+		got := arith(n).EstimatedSpeedup()
+		if got <= prev {
+			t.Errorf("%d adds: EstimatedSpeedup() = %v, want more than %v for fewer adds", n, got, prev)
+		}
+		prev = got
+	}
+	if got := arith(1).EstimatedSpeedup(); got > 1.5 {
+		t.Errorf("1 add: EstimatedSpeedup() = %v, want entry costs to dominate", got)
+	}
+	// Loads are bounds-checked in native code too, so save less than
+	// arithmetic of the same length.
+	if a, l := arith(8), loads(16); a.AllOps != l.AllOps || l.EstimatedSpeedup() >= a.EstimatedSpeedup() {
+		t.Errorf("%d loads: EstimatedSpeedup() = %v, want less than %v for %d ops of arithmetic", l.AllOps, l.EstimatedSpeedup(), a.EstimatedSpeedup(), a.AllOps)
+	}
+}
+
+func TestScannerCostModel(t *testing.T) {
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	dropInst, _ := ops.New(ops.Drop)
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.GetLocal: true, ops.I64Const: true, ops.I64Add: true, ops.Drop: true}}
+
+	// Three drops save three dispatches, which only pays for entering
+	// native code: the old AllOps > 2 heuristic emitted them, but they
+	// aren't worth it.
+	code, meta := Compile([]disasm.Instr{{Op: dropInst}, {Op: dropInst}, {Op: dropInst}})
+	candidates, err := s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 0 {
+		t.Errorf("3 drops: candidates = %+v, want none", candidates)
+	}
+
+	code, meta = Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: addInst},
+	})
+	candidates, err = s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	m := candidates[0].Metrics
+	if !DefaultCostModel.Profitable(m) {
+		t.Errorf("DefaultCostModel.Profitable(%+v) = false, want true", m)
+	}
+
+	// A costlier entry into native code makes the same run not worth it.
+	model := DefaultCostModel
+	model.NativeEntry = DefaultCostModel.Interpreter(m)
+	s.SetCostModel(model)
+	candidates, err = s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 0 {
+		t.Errorf("with NativeEntry = %d: candidates = %+v, want none", model.NativeEntry, candidates)
+	}
+}
+
+func TestScannerScanWindow(t *testing.T) {
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	clzInst, _ := ops.New(ops.I64Clz)
+	// 1000 runs of get_local 0; i64.const 1; i64.add; i64.add, each ended
+	// by an unsupported i64.clz.
+	var instrs []disasm.Instr
+	for i := 0; i < 1000; i++ {
+		instrs = append(instrs,
+			disasm.Instr{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+			disasm.Instr{Op: constInst, Immediates: []interface{}{int64(1)}},
+			disasm.Instr{Op: addInst},
+			disasm.Instr{Op: addInst},
+			disasm.Instr{Op: clzInst})
+	}
+	code, meta := Compile(instrs)
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.GetLocal: true, ops.I64Const: true, ops.I64Add: true}}
+
+	candidates, err := s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1000 {
+		t.Fatalf("without a window, len(candidates) = %d, want 1000", len(candidates))
+	}
+
+	// The window ends in the middle of the third run.
+	s.SetScanWindow(13)
+	candidates, err = s.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 3 {
+		t.Fatalf("len(candidates) = %d, want 3", len(candidates))
+	}
+	for i, c := range candidates[:2] {
+		if c.StartInstruction != 5*i || c.EndInstruction != 5*i+3 {
+			t.Errorf("candidates[%d] = [%d, %d], want [%d, %d]", i, c.StartInstruction, c.EndInstruction, 5*i, 5*i+3)
+		}
+	}
+	if c := candidates[2]; c.StartInstruction != 10 || c.EndInstruction != 12 {
+		t.Errorf("candidates[2] = [%d, %d], want [10, 12], cut short by the window", c.StartInstruction, c.EndInstruction)
+	}
+}
+
+func TestScannerDeadline(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: addInst},
+	})
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.I64Const: true, ops.I64Add: true}}
+
+	if _, err := s.ScanFuncBefore(code, meta, time.Now().Add(-time.Second)); err != ErrScanDeadline {
+		t.Errorf("ScanFuncBefore(past deadline) error = %v, want %v", err, ErrScanDeadline)
+	}
+	candidates, err := s.ScanFuncBefore(code, meta, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Errorf("ScanFuncBefore(future deadline): len(candidates) = %d, want 1", len(candidates))
+	}
+}
+
+func TestCheckCandidate(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	callInst, _ := ops.New(ops.Call)
+	code, meta := Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: addInst},
+		{Op: callInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: addInst},
+	})
+
+	before := CompilationCandidate{EndInstruction: 2}
+	if err := CheckCandidate(before, meta); err != nil {
+		t.Errorf("CheckCandidate(before the call) = %v, want nil", err)
+	}
+
+	// A candidate spanning the call, as if it came from a scanner which
+	// wrongly supports calls, must be refused by the backend.
+	spanning := CompilationCandidate{EndInstruction: 5}
+	if err := CheckCandidate(spanning, meta); err == nil {
+		t.Error("CheckCandidate(spanning the call) = nil, want an error")
+	}
+	b := &AMD64Backend{}
+	if _, err := b.Build(spanning, code, meta); err == nil {
+		t.Error("Build(spanning the call) succeeded, want an error")
+	}
+
+	if err := CheckCandidate(CompilationCandidate{EndInstruction: 6}, meta); err == nil {
+		t.Error("CheckCandidate(out of range) = nil, want an error")
+	}
+
+	// As if a block ended after the first addition, and was branched to.
+	meta.InboundTargets = map[int64]bool{meta.Instructions[3].Start: true}
+	if err := CheckCandidate(before, meta); err != nil {
+		t.Errorf("CheckCandidate(ending at a branch target) = %v, want nil", err)
+	}
+	meta.InboundTargets = map[int64]bool{meta.Instructions[1].Start: true}
+	if err := CheckCandidate(before, meta); err == nil {
+		t.Error("CheckCandidate(containing a branch target) = nil, want an error")
+	}
+}
+
+func TestScannerLargeOffsets(t *testing.T) {
+	// Offsets beyond 32 bits, as in a function with several gigabytes of
+	// bytecode. The scanner only reads bytecode for OpJmpNz, so no code
+	// is needed.
+	const base = int64(1)<<33 + 7
+	meta := &BytecodeMetadata{
+		Instructions: []InstructionMetadata{
+			{Op: ops.I64Const, Start: base, Size: 9},
+			{Op: ops.I64Const, Start: base + 9, Size: 9},
+			{Op: ops.I64Add, Start: base + 18, Size: 1},
+			{Op: ops.Call, Start: base + 19, Size: 5},
+		},
+	}
+	s := &scanner{supportedOpcodes: map[byte]bool{ops.I64Const: true, ops.I64Add: true}}
+	candidates, err := s.ScanFunc(nil, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 1 {
+		t.Fatalf("len(candidates) = %d, want 1", len(candidates))
+	}
+	if lower, upper := candidates[0].Bounds(); lower != base || upper != base+19 {
+		t.Errorf("Bounds() = [%d:%d], want [%d:%d]", lower, upper, base, base+19)
+	}
+	if err := CheckBounds(candidates[0], base+24); err != nil {
+		t.Errorf("CheckBounds(within the code) = %v, want nil", err)
+	}
+	if err := CheckBounds(candidates[0], base+18); err == nil {
+		t.Error("CheckBounds(past the end of the code) = nil, want an error")
+	}
+	if err := CheckBounds(CompilationCandidate{Beginning: base + 19, End: base}, base+24); err == nil {
+		t.Error("CheckBounds(inverted) = nil, want an error")
+	}
+
+	// An instruction whose end does not fit in an int64 must not wrap
+	// around to a small or negative offset.
+	meta.Instructions[2] = InstructionMetadata{Op: ops.I64Add, Start: math.MaxInt64 - 1, Size: 2}
+	if _, err := s.ScanFunc(nil, meta); err == nil {
+		t.Error("ScanFunc(overflowing instruction) succeeded, want an error")
+	}
+}
@@ -13,15 +13,18 @@ import (
 // when it detects an out of bounds access to the linear memory.
 var ErrOutOfBoundsMemoryAccess = errors.New("exec: out of bounds memory access")
 
+// fetchBaseAddr returns the effective address of a memory access, the sum
+// of the static offset and the i32 address on the top of the stack. The
+// sum is computed in 64 bits, as the spec requires it to never wrap.
 func (vm *VM) fetchBaseAddr() int {
-	return int(vm.fetchUint32() + uint32(vm.popInt32()))
+	return int(uint64(vm.fetchUint32()) + uint64(uint32(vm.popInt32())))
 }
 
 // inBounds returns true when the next vm.fetchBaseAddr() + offset
 // indices are in bounds accesses to the linear memory.
 func (vm *VM) inBounds(offset int) bool {
-	addr := endianess.Uint32(vm.ctx.code[vm.ctx.pc:]) + uint32(vm.ctx.stack[len(vm.ctx.stack)-1])
-	return int(addr)+offset < len(vm.memory)
+	addr := uint64(endianess.Uint32(vm.ctx.code[vm.ctx.pc:])) + uint64(uint32(vm.ctx.stack[len(vm.ctx.stack)-1]))
+	return addr+uint64(offset) < uint64(len(vm.memory))
 }
 
 // curMem returns a slice to the memeory segment pointed to by
@@ -207,6 +210,13 @@ func (vm *VM) currentMemory() {
 
 func (vm *VM) growMemory() {
 	_ = vm.fetchInt8() // reserved (https://github.com/WebAssembly/design/blob/27ac254c854994103c24834a994be16f74f54186/BinaryEncoding.md#memory-related-operators-described-here)
+	vm.growMemoryBy()
+}
+
+// growMemoryBy pops the number of pages to grow linear memory by, and
+// pushes its previous size in pages. It is shared with native code,
+// which exits to the VM to grow memory.
+func (vm *VM) growMemoryBy() {
 	curLen := len(vm.memory) / wasmPageSize
 	n := vm.popInt32()
 	vm.memory = append(vm.memory, make([]byte, n*wasmPageSize)...)
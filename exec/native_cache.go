@@ -0,0 +1,177 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/go-interpreter/wagon/exec/internal/compile"
+)
+
+// nativeCacheVersion is incremented whenever the format of the native
+// cache, or the code emitted by any backend, changes incompatibly.
+const nativeCacheVersion = 2
+
+// ErrNativeCacheMismatch is returned by NewVMWithOptions when the native
+// cache passed with the NativeCache option was written for a different
+// module, architecture or version of wagon, for a CPU with different
+// optional features, or with different settings of NativeStackGuard,
+// NativeStackBalance, NativeLocalsGuard, NativeBreakpoints,
+// NativeProfiling or NativeFusedMulAdd.
+var ErrNativeCacheMismatch = errors.New("exec: native cache does not match the module")
+
+// NativeCache loads the native code written by (*VM).WriteNativeCache
+// from r, instead of scanning & building native code for the module.
+//
+// The code read from r is copied into executable memory and run as it is,
+// so r must only supply a cache the embedder wrote itself with
+// WriteNativeCache, and stored where nothing untrusted can modify it.
+// Never load a cache from untrusted input.
+//
+// This is experimental, and the format of the cache may change between
+// versions of wagon. This option has no effect unless EnableAOT is set,
+// and native compilation is supported for the current architecture.
+func NativeCache(r io.Reader) VMOption {
+	return func(c *config) {
+		c.NativeCache = r
+	}
+}
+
+type nativeCacheFile struct {
+	Version      int
+	Arch, OS     string
+	ModuleHash   [sha256.Size]byte
+	StackGuard   bool
+	StackBalance bool
+	LocalsGuard  bool
+	Breakpoints  bool
+	Profiling    bool
+	FusedMulAdd  bool
+	CPUFeatures  []string
+	Blocks       []nativeCacheBlock
+}
+
+type nativeCacheBlock struct {
+	Func      int
+	Candidate compile.CompilationCandidate
+	Code      []byte
+}
+
+// moduleHash identifies the code of the VM's module, so a native cache is
+// never applied to a module it wasn't written for.
+func (vm *VM) moduleHash() [sha256.Size]byte {
+	h := sha256.New()
+	var buf [8]byte
+	for _, fn := range vm.module.FunctionIndexSpace {
+		if fn.IsHost() {
+			binary.LittleEndian.PutUint64(buf[:], 0)
+			h.Write(buf[:])
+			continue
+		}
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(fn.Body.Code)))
+		h.Write(buf[:])
+		h.Write(fn.Body.Code)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// WriteNativeCache writes the native code compiled for the VM's module to
+// w, so later VMs for the same module can load it with the NativeCache
+// option rather than compiling it again. Compiled code is position
+// independent, so it only needs to be copied into executable memory.
+//
+// This is experimental, and the format of the cache may change between
+// versions of wagon.
+func (vm *VM) WriteNativeCache(w io.Writer) error {
+	file := nativeCacheFile{
+		Version:      nativeCacheVersion,
+		Arch:         runtime.GOARCH,
+		OS:           runtime.GOOS,
+		ModuleHash:   vm.moduleHash(),
+		StackGuard:   vm.opts.NativeStackGuard,
+		StackBalance: vm.opts.NativeStackBalance,
+		LocalsGuard:  vm.opts.NativeLocalsGuard,
+		Breakpoints:  vm.opts.NativeBreakpoints,
+		Profiling:    vm.opts.NativeProfiling,
+		FusedMulAdd:  vm.opts.NativeFusedMulAdd,
+		CPUFeatures:  nativeCPUFeatures(),
+	}
+	for i, f := range vm.funcs {
+		fn, ok := f.(compiledFunction)
+		if !ok {
+			continue
+		}
+		for _, block := range fn.asm {
+			file.Blocks = append(file.Blocks, nativeCacheBlock{
+				Func:      i,
+				Candidate: block.candidate,
+				Code:      block.machineCode,
+			})
+		}
+	}
+	return gob.NewEncoder(w).Encode(&file)
+}
+
+// nativeCPUFeatures returns the optional features of this CPU which native
+// code built for it may use, according to the backend for the current
+// architecture. A cache records them, as its code may fault on a CPU
+// without them.
+func nativeCPUFeatures() []string {
+	if ok, backend := nativeBackend(); ok {
+		if b, ok := backend.Builder.(cpuFeatureBuilder); ok {
+			return b.CPUFeatures()
+		}
+	}
+	return nil
+}
+
+// loadNativeCache installs the native code read from r, in the order it
+// was written so the index of each block is unchanged.
+func (vm *VM) loadNativeCache(r io.Reader) error {
+	var file nativeCacheFile
+	if err := gob.NewDecoder(r).Decode(&file); err != nil {
+		return fmt.Errorf("exec: reading native cache: %v", err)
+	}
+	if file.Version != nativeCacheVersion || file.Arch != runtime.GOARCH || file.OS != runtime.GOOS || file.ModuleHash != vm.moduleHash() || file.StackGuard != vm.opts.NativeStackGuard || file.StackBalance != vm.opts.NativeStackBalance || file.LocalsGuard != vm.opts.NativeLocalsGuard || file.Breakpoints != vm.opts.NativeBreakpoints || file.Profiling != vm.opts.NativeProfiling || file.FusedMulAdd != vm.opts.NativeFusedMulAdd || strings.Join(file.CPUFeatures, ",") != strings.Join(nativeCPUFeatures(), ",") {
+		return ErrNativeCacheMismatch
+	}
+
+	for _, block := range file.Blocks {
+		if block.Func < 0 || block.Func >= len(vm.funcs) {
+			return fmt.Errorf("exec: native cache block for invalid function %d", block.Func)
+		}
+		fn, ok := vm.funcs[block.Func].(compiledFunction)
+		if !ok {
+			return fmt.Errorf("exec: native cache block for host function %d", block.Func)
+		}
+		if allow := vm.opts.NativeCompileFilter; allow != nil && !allow(int64(block.Func)) {
+			continue
+		}
+		lower, upper := block.Candidate.Bounds()
+		if compile.CheckBounds(block.Candidate, int64(len(fn.code))) != nil || upper-lower < minInstBytes {
+			return fmt.Errorf("exec: native cache block has invalid bounds vm.funcs[%d].code[%d:%d]", block.Func, lower, upper)
+		}
+
+		unit, err := vm.nativeBackend.allocator.AllocateExec(block.Code)
+		if err != nil {
+			return err
+		}
+		vm.nativeCodeBytes += len(block.Code)
+		if vm.opts.VerifyNativeCompile && !vm.verifyNativeUnit(fn, block.Candidate, unit) {
+			continue
+		}
+		vm.installNativeBlock(block.Func, block.Candidate, unit, block.Code)
+	}
+	return nil
+}
@@ -5,11 +5,20 @@
 package exec
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
 	"runtime"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/go-interpreter/wagon/exec/internal/compile"
+	"github.com/go-interpreter/wagon/wasm"
 	ops "github.com/go-interpreter/wagon/wasm/operators"
 )
 
@@ -21,50 +30,497 @@ const (
 	// wagon.nativeExec instruction and its parameter.
 	minInstBytes                = 5
 	minArithInstructionSequence = 2
+
+	// number of random states each native block is executed with when
+	// VerifyNativeCompile is enabled.
+	nativeVerifyTrials = 16
+)
+
+// StackGrowthStrategy describes how the stack is grown before entering
+// a native code block, which must never cause the stack to be
+// reallocated while it runs.
+type StackGrowthStrategy uint8
+
+// Valid StackGrowthStrategy values.
+const (
+	// GrowStackExact grows the stack to exactly the capacity required by
+	// a native code block, before the block is entered.
+	GrowStackExact StackGrowthStrategy = iota
+	// GrowStackDoubling grows the stack to at least double its capacity
+	// when a native code block requires more capacity, before the block
+	// is entered.
+	GrowStackDoubling
+	// GrowStackPreReserve reserves a fixed amount of headroom on top of
+	// the maximum depth of each function at VM creation. Should a
+	// native code block still require more capacity, the stack is grown
+	// exactly before the block is entered.
+	GrowStackPreReserve
+)
+
+// NativeStackGrowth sets the strategy used to ensure the stack has
+// enough capacity before entering native code. headroom is the number of
+// values reserved by GrowStackPreReserve, and is otherwise ignored.
+func NativeStackGrowth(strategy StackGrowthStrategy, headroom int) VMOption {
+	return func(c *config) {
+		c.NativeStackGrowth = strategy
+		c.NativeStackHeadroom = headroom
+	}
+}
+
+// VerifyNativeCompile enables a (slow) debug mode, where each native code
+// block is executed alongside the interpreter over a set of random stack &
+// locals states after compilation. Blocks which produce different results
+// are discarded, leaving their instructions to the interpreter.
+func VerifyNativeCompile(v bool) VMOption {
+	return func(c *config) {
+		c.VerifyNativeCompile = v
+	}
+}
+
+// NativeCodeBudget limits the total size of the native code emitted for
+// a module to n bytes. Candidates expected to give the largest speedup
+// are compiled first, with the remainder left to the interpreter once the
+// budget is spent. A budget of zero means no limit.
+func NativeCodeBudget(n int) VMOption {
+	return func(c *config) {
+		c.NativeCodeBudget = n
+	}
+}
+
+// NativeCompileTimeout limits the time spent scanning & building native
+// code for each function to d. Functions which exceed this are left to
+// the interpreter. The deadline is checked while scanning, if the
+// scanner supports it, and between candidates, so a single slow
+// candidate may overrun it. A timeout of zero means no limit.
+func NativeCompileTimeout(d time.Duration) VMOption {
+	return func(c *config) {
+		c.NativeCompileTimeout = d
+	}
+}
+
+// NativeStackGuard enables a debug mode, where native code checks every
+// push against the capacity of the stack. Code which would overflow the
+// stack traps with ErrNativeStackOverflow instead of corrupting memory.
+// The stack is grown before entering native code, so this only guards
+// against bugs in wagon.
+func NativeStackGuard(v bool) VMOption {
+	return func(c *config) {
+		c.NativeStackGuard = v
+	}
+}
+
+// NativeStackBalance enables a debug mode, where native code which
+// runs to its end checks that it pushed & popped the values expected from
+// the instructions it was compiled from. Code whose pushes & pops do not
+// balance traps with ErrNativeStackImbalance instead of leaving the stack
+// at the wrong height. Such code is a bug in wagon.
+func NativeStackBalance(v bool) VMOption {
+	return func(c *config) {
+		c.NativeStackBalance = v
+	}
+}
+
+// NativeLocalsGuard enables a debug mode, where native code checks every
+// access to a local against the number of locals. Code which would access
+// a local out of range traps with ErrNativeLocalOutOfRange instead of
+// corrupting memory. Validation rejects such modules, so this only guards
+// against bugs in wagon.
+func NativeLocalsGuard(v bool) VMOption {
+	return func(c *config) {
+		c.NativeLocalsGuard = v
+	}
+}
+
+// NativeAliasGuard enables a debug mode, where the VM checks that the
+// stack & locals do not share memory before every invocation of native
+// code. Native code assumes writes to one never change the other, so the
+// VM traps with ErrNativeSlicesAlias rather than running it if they do.
+// The VM always allocates them separately, so this only guards against
+// bugs in wagon.
+func NativeAliasGuard(v bool) VMOption {
+	return func(c *config) {
+		c.NativeAliasGuard = v
+	}
+}
+
+// NativeBreakpoints emits a breakpoint instruction (INT3 on amd64) at the
+// start of every native code block, so a debugger stops whenever native
+// code is entered. It is intended for stepping through native code, for
+// example with gdb:
+//
+//    $ gdb --args ./program
+//    (gdb) run
+//    Program received signal SIGTRAP, Trace/breakpoint trap.
+//    (gdb) x/16i $pc
+//
+// Continuing from the breakpoint resumes the block after it. The
+// breakpoint raises SIGTRAP, which crashes the program when no debugger
+// is attached, so this must never be enabled otherwise.
+func NativeBreakpoints(v bool) VMOption {
+	return func(c *config) {
+		c.NativeBreakpoints = v
+	}
+}
+
+// NativeFusedMulAdd lets native code compute an f64.mul immediately
+// followed by an f64.add of the product with a single fused multiply-add
+// instruction, where the CPU supports one (FMA3 on amd64). A fused
+// multiply-add rounds only its final result, so it is both faster and more
+// precise, but its results may differ in the last bit from the separate
+// rounding the WebAssembly specification requires. It is disabled by
+// default, so native code stays bit-exact with the interpreter.
+func NativeFusedMulAdd(v bool) VMOption {
+	return func(c *config) {
+		c.NativeFusedMulAdd = v
+	}
+}
+
+// NativeCostModel sets the CostModel which decides whether a run of
+// supported opcodes is worth compiling into native code: only runs it
+// estimates to be faster as native code than in the interpreter are
+// compiled. Very short runs rarely are, as entering & leaving native code
+// has a fixed cost. It has no effect on scanners set with NativeCompiler.
+func NativeCostModel(m CostModel) VMOption {
+	return func(c *config) {
+		c.NativeCostModel = &m
+	}
+}
+
+// NativeScanWindow limits the search for runs of supported opcodes to the
+// first n instructions of each function, bounding the startup cost of
+// modules with huge functions. The rest of each function is left to the
+// interpreter. If n is 0, the default, whole functions are scanned. It has
+// no effect on scanners set with NativeCompiler.
+func NativeScanWindow(n int) VMOption {
+	return func(c *config) {
+		c.NativeScanWindow = n
+	}
+}
+
+// NativeCompileFilter restricts native compilation to the functions for
+// which allow returns true, leaving the rest to the interpreter. This
+// keeps functions under debugging, or with behaviour the embedder wants
+// to intercept, interpreted. allow is called with the index of each
+// function in the module's function index space, and must be safe for
+// concurrent use with NativeCompileWorkers.
+func NativeCompileFilter(allow func(fnIndex int64) bool) VMOption {
+	return func(c *config) {
+		c.NativeCompileFilter = allow
+	}
+}
+
+// NativeProfiling counts the invocations of every native code block, for
+// (*VM).NativeBlockInvocations. Counting adds an instruction to the
+// entry of each block, so it is off by default.
+func NativeProfiling(v bool) VMOption {
+	return func(c *config) {
+		c.NativeProfiling = v
+	}
+}
+
+// NativeTracing records each native block invoked by ExecCode, in order,
+// along with the bytecode address the interpreter resumed at, for
+// (*VM).NativeTrace. This shows how native & interpreted execution
+// interleave when debugging where a block hands control back. Without
+// it, nothing is recorded.
+func NativeTracing(v bool) VMOption {
+	return func(c *config) {
+		c.NativeTracing = v
+	}
+}
+
+// NativeCompileWorkers scans & builds the native code of up to n functions
+// in parallel, which can shorten the creation of VMs for large modules.
+// Allocating & installing the code remains sequential, so the result is
+// the same as compiling one function at a time. Values of n below 2
+// compile sequentially, which is the default.
+//
+// A scanner or builder set with NativeCompiler must be safe for
+// concurrent use when n is at least 2.
+func NativeCompileWorkers(n int) VMOption {
+	return func(c *config) {
+		c.NativeCompileWorkers = n
+	}
+}
+
+// NativeCompileLazily defers the native compilation of each function to
+// its first call, instead of compiling every function as the VM is
+// created. This shortens the creation of VMs for modules with many
+// functions which are rarely called. Errors from compiling a function are
+// recorded for ExplainNative, and leave the function to the interpreter.
+//
+// This option has no effect if native code is loaded with NativeCache.
+func NativeCompileLazily(v bool) VMOption {
+	return func(c *config) {
+		c.NativeCompileLazily = v
+	}
+}
+
+// ErrNativeStackOverflow is the error value used while trapping the VM
+// when native code built with NativeStackGuard would have overflowed the
+// stack.
+var ErrNativeStackOverflow = errors.New("exec: native code overflowed the stack")
+
+// ErrNativeStackImbalance is the error value used while trapping the VM
+// when native code built with NativeStackBalance left the stack at a
+// length other than expected.
+var ErrNativeStackImbalance = errors.New("exec: native code left the stack unbalanced")
+
+// ErrNativeSlicesAlias is the error value used while trapping the VM when,
+// with NativeAliasGuard, the stack & locals share memory on entry to
+// native code.
+var ErrNativeSlicesAlias = errors.New("exec: native code stack & locals share memory")
+
+// ErrNativeLocalOutOfRange is the error value used while trapping the VM
+// when native code built with NativeLocalsGuard would have accessed a
+// local out of range.
+var ErrNativeLocalOutOfRange = errors.New("exec: native code accessed a local out of range")
+
+// ErrNativeBlockMismatch is the error value used while trapping the VM
+// when a wagon.nativeExec instruction names a native block which was not
+// installed at its position in the bytecode.
+var ErrNativeBlockMismatch = errors.New("exec: wagon.nativeExec does not match its native block")
+
+// NativeHugePages places native code in huge pages, which can reduce
+// iTLB pressure for modules with a lot of native code. Where huge pages
+// are not supported or none are available, normal pages are used.
+func NativeHugePages(v bool) VMOption {
+	return func(c *config) {
+		c.NativeHugePages = v
+	}
+}
+
+// NativePrefault populates the pages holding native code as they are
+// allocated, so the first call into each native block does not stall on
+// page faults.
+func NativePrefault(v bool) VMOption {
+	return func(c *config) {
+		c.NativePrefault = v
+	}
+}
+
+// supportedNativeArchs are the backends built into wagon, and
+// registeredNativeArchs those added with RegisterBackend, which take
+// precedence.
+var (
+	supportedNativeArchs  []nativeArch
+	registeredNativeArchs []nativeArch
+	registeredNativeMu    sync.Mutex
 )
 
-var supportedNativeArchs []nativeArch
+// nativeExecPrologueSize is the size of a wagon.nativeExec instruction,
+// the opcode followed by the uint32 index of its native block.
+const nativeExecPrologueSize = 1 + ops.WagonNativeExecImmediateSize
 
 type nativeArch struct {
 	Arch, OS string
 	make     func(endianness binary.ByteOrder) *nativeCompiler
 }
 
+// NativeCompiler overrides the SequenceScanner and InstructionBuilder used
+// for ahead-of-time compilation, allowing different heuristics for
+// selecting candidates to be tried without modifying wagon. A nil scanner
+// or builder leaves the default for the current architecture in place.
+//
+// This option has no effect unless EnableAOT is set, and native compilation
+// is supported for the current architecture.
+func NativeCompiler(scanner SequenceScanner, builder InstructionBuilder) VMOption {
+	return func(c *config) {
+		c.NativeScanner = scanner
+		c.NativeBuilder = builder
+	}
+}
+
+// CompilationCandidate describes a range of bytecode that can
+// be translated to native code.
+type CompilationCandidate = compile.CompilationCandidate
+
+// BytecodeMetadata describes the instructions & branch targets of
+// compiled bytecode.
+type BytecodeMetadata = compile.BytecodeMetadata
+
+// InstructionMetadata describes a bytecode instruction.
+type InstructionMetadata = compile.InstructionMetadata
+
+// Metrics describes the heuristics of an instruction sequence.
+type Metrics = compile.Metrics
+
+// CostModel estimates the relative cost of running an instruction sequence
+// in the interpreter & as native code, see NativeCostModel.
+type CostModel = compile.CostModel
+
+// DefaultCostModel returns the CostModel native compilation uses unless
+// NativeCostModel is set.
+func DefaultCostModel() CostModel {
+	return compile.DefaultCostModel
+}
+
+// NativeCodeUnit is a block of native code in executable memory, returned
+// by a NativeAllocator.
+type NativeCodeUnit = compile.NativeCodeUnit
+
+// NativeExit is returned by native code, to indicate how execution should
+// continue. The zero value indicates the native code ran to completion.
+type NativeExit = compile.NativeExit
+
+// NativeBackend is a backend for native code generation & execution on an
+// architecture, see RegisterBackend.
+type NativeBackend struct {
+	Scanner   SequenceScanner
+	Builder   InstructionBuilder
+	Allocator NativeAllocator
+}
+
+// ErrBackendRegistered is returned by RegisterBackend if a backend is
+// already registered for the architecture & operating system.
+var ErrBackendRegistered = errors.New("exec: native backend already registered")
+
+// RegisterBackend adds a native backend for the architecture arch (a
+// GOARCH value) & operating system os (a GOOS value), which newBackend
+// returns given the byte order of the VM. A registered backend takes
+// precedence over the one built into wagon, if any, and is used by VMs
+// created with EnableAOT afterwards. Only one backend may be registered
+// for each architecture & operating system.
+func RegisterBackend(arch, os string, newBackend func(endianness binary.ByteOrder) NativeBackend) error {
+	registeredNativeMu.Lock()
+	defer registeredNativeMu.Unlock()
+	for _, c := range registeredNativeArchs {
+		if c.Arch == arch && c.OS == os {
+			return ErrBackendRegistered
+		}
+	}
+	registeredNativeArchs = append(registeredNativeArchs, nativeArch{
+		Arch: arch,
+		OS:   os,
+		make: func(endianness binary.ByteOrder) *nativeCompiler {
+			b := newBackend(endianness)
+			return &nativeCompiler{
+				Scanner:   b.Scanner,
+				Builder:   b.Builder,
+				allocator: b.Allocator,
+			}
+		},
+	})
+	return nil
+}
+
 // nativeCompiler represents a backend for native code generation + execution.
 type nativeCompiler struct {
-	Scanner   sequenceScanner
-	Builder   instructionBuilder
-	allocator pageAllocator
+	Scanner   SequenceScanner
+	Builder   InstructionBuilder
+	allocator NativeAllocator
 }
 
 func (c *nativeCompiler) Close() error {
 	return c.allocator.Close()
 }
 
-// pageAllocator is responsible for the efficient allocation of
+// NativeAllocator is responsible for the efficient allocation of
 // executable, aligned regions of executable memory.
-type pageAllocator interface {
+type NativeAllocator interface {
 	AllocateExec(asm []byte) (compile.NativeCodeUnit, error)
 	Close() error
 }
 
-// sequenceScanner is responsible for detecting runs of supported opcodes
+// stackGuardBuilder is implemented by InstructionBuilders which can check
+// pushes against the capacity of the stack.
+type stackGuardBuilder interface {
+	SetGuardStack(v bool)
+}
+
+// stackBalanceBuilder is implemented by InstructionBuilders which can
+// check the net stack effect of native code.
+type stackBalanceBuilder interface {
+	SetStackBalance(v bool)
+}
+
+// costModelScanner is implemented by SequenceScanners which decide which
+// runs of opcodes to compile with a CostModel.
+type costModelScanner interface {
+	SetCostModel(m CostModel)
+}
+
+// deadlineScanner is implemented by SequenceScanners which can give up
+// on a function once a deadline has passed, returning
+// compile.ErrScanDeadline.
+type deadlineScanner interface {
+	ScanFuncBefore(bytecode []byte, meta *BytecodeMetadata, deadline time.Time) ([]CompilationCandidate, error)
+}
+
+// scanWindowScanner is implemented by SequenceScanners which can limit the
+// number of instructions they scan in each function.
+type scanWindowScanner interface {
+	SetScanWindow(n int)
+}
+
+// localsGuardBuilder is implemented by InstructionBuilders which can check
+// accesses to locals against the number of locals.
+type localsGuardBuilder interface {
+	SetGuardLocals(v bool)
+}
+
+// breakpointBuilder is implemented by InstructionBuilders which can emit
+// a breakpoint at the start of each native block.
+type breakpointBuilder interface {
+	SetBreakpoints(v bool)
+}
+
+// cpuFeatureBuilder is implemented by InstructionBuilders whose code
+// depends on optional features of the CPU it was built on.
+type cpuFeatureBuilder interface {
+	CPUFeatures() []string
+}
+
+// fusedMulAddBuilder is implemented by InstructionBuilders which can fuse
+// a multiplication & an addition into one instruction.
+type fusedMulAddBuilder interface {
+	SetFusedMulAdd(v bool)
+}
+
+// profilingBuilder is implemented by InstructionBuilders which can count
+// the invocations of each native block.
+type profilingBuilder interface {
+	SetProfiling(v bool)
+}
+
+// consumptionAllocator is implemented by NativeAllocators which can report
+// the executable memory taken up by their allocations.
+type consumptionAllocator interface {
+	ConsumedBytes() uint64
+}
+
+// hugePageAllocator is implemented by NativeAllocators which can place
+// code in huge pages.
+type hugePageAllocator interface {
+	SetHugePages(v bool)
+}
+
+// prefaultAllocator is implemented by NativeAllocators which can populate
+// executable pages as they are allocated.
+type prefaultAllocator interface {
+	SetPrefault(v bool)
+}
+
+// SequenceScanner is responsible for detecting runs of supported opcodes
 // that could benefit from compilation into native instructions.
-type sequenceScanner interface {
+type SequenceScanner interface {
 	// ScanFunc returns an ordered, non-overlapping set of
 	// sequences to compile into native code.
-	ScanFunc(bytecode []byte, meta *compile.BytecodeMetadata) ([]compile.CompilationCandidate, error)
+	ScanFunc(bytecode []byte, meta *BytecodeMetadata) ([]CompilationCandidate, error)
 }
 
-// instructionBuilder is responsible for compiling wasm opcodes into
+// InstructionBuilder is responsible for compiling wasm opcodes into
 // native instructions.
-type instructionBuilder interface {
+type InstructionBuilder interface {
 	// Build compiles the specified bytecode into native instructions.
-	Build(candidate compile.CompilationCandidate, code []byte, meta *compile.BytecodeMetadata) ([]byte, error)
+	Build(candidate CompilationCandidate, code []byte, meta *BytecodeMetadata) ([]byte, error)
 }
 
 func nativeBackend() (bool, *nativeCompiler) {
-	for _, c := range supportedNativeArchs {
+	registeredNativeMu.Lock()
+	archs := append(append([]nativeArch(nil), registeredNativeArchs...), supportedNativeArchs...)
+	registeredNativeMu.Unlock()
+	for _, c := range archs {
 		if c.Arch == runtime.GOARCH && c.OS == runtime.GOOS {
 			backend := c.make(endianess)
 			return true, backend
@@ -73,72 +529,755 @@ func nativeBackend() (bool, *nativeCompiler) {
 	return false, nil
 }
 
+// nativeScore estimates the payoff of compiling a candidate with the
+// given metrics. Arithmetic dominates, with the stack traffic kept in
+// registers as a tie-breaker.
+func nativeScore(m compile.Metrics) int {
+	return 4*(m.IntegerOps+m.FloatOps) + int(m.StackReads+m.StackWrites)
+}
+
+// pendingCandidate is a built candidate, awaiting allocation in
+// vm.funcs[fn].
+type pendingCandidate struct {
+	fn        int
+	candidate compile.CompilationCandidate
+	asm       []byte
+}
+
 func (vm *VM) tryNativeCompile() error {
 	if vm.nativeBackend == nil {
 		return nil
 	}
+	if vm.opts.NativeCache != nil {
+		if err := vm.loadNativeCache(vm.opts.NativeCache); err != nil {
+			return err
+		}
+		vm.reserveNativeHeadroom()
+		return nil
+	}
+	if vm.opts.NativeCompileLazily {
+		vm.nativeLazy = make([]bool, len(vm.funcs))
+		return nil
+	}
 
+	pending, err := vm.compileFuncs()
+	if err != nil {
+		return err
+	}
+	vm.installPending(pending)
+	vm.reserveNativeHeadroom()
+	return nil
+}
+
+// compileFuncs runs compileFunc over every function, in parallel across
+// the configured NativeCompileWorkers. The candidates are returned in the
+// order of the functions, as if they were compiled sequentially.
+func (vm *VM) compileFuncs() ([]pendingCandidate, error) {
+	var fns []int
 	for i := range vm.funcs {
-		if _, isGoFunc := vm.funcs[i].(*goFunction); isGoFunc {
+		if _, ok := vm.funcs[i].(compiledFunction); ok {
+			fns = append(fns, i)
+		}
+	}
+
+	built := make([][]pendingCandidate, len(vm.funcs))
+	errs := make([]error, len(vm.funcs))
+	if workers := vm.opts.NativeCompileWorkers; workers > 1 {
+		// Each function is compiled by a single worker, which is the
+		// only one to touch vm.funcs[i], built[i] & errs[i].
+		next := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range next {
+					built[i], errs[i] = vm.compileFunc(i)
+				}
+			}()
+		}
+		for _, i := range fns {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+	} else {
+		for _, i := range fns {
+			if built[i], errs[i] = vm.compileFunc(i); errs[i] != nil {
+				break
+			}
+		}
+	}
+
+	var pending []pendingCandidate
+	for _, i := range fns {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		pending = append(pending, built[i]...)
+	}
+	return pending, nil
+}
+
+// compileFunc scans vm.funcs[i] for candidates, and builds native code for
+// those worth compiling. The code is installed by installPending.
+func (vm *VM) compileFunc(i int) ([]pendingCandidate, error) {
+	if allow := vm.opts.NativeCompileFilter; allow != nil && !allow(int64(i)) {
+		vm.noteNative(i, "excluded by NativeCompileFilter")
+		return nil, nil
+	}
+	fn := vm.funcs[i].(compiledFunction)
+	start := time.Now()
+	var candidates []CompilationCandidate
+	var err error
+	if s, ok := vm.nativeBackend.Scanner.(deadlineScanner); ok && vm.opts.NativeCompileTimeout > 0 {
+		candidates, err = s.ScanFuncBefore(fn.code, fn.codeMeta, start.Add(vm.opts.NativeCompileTimeout))
+	} else {
+		candidates, err = vm.nativeBackend.Scanner.ScanFunc(fn.code, fn.codeMeta)
+	}
+	if err == compile.ErrScanDeadline {
+		vm.noteNative(i, "compilation exceeded the timeout of %v", vm.opts.NativeCompileTimeout)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("AOT scan failed on vm.funcs[%d]: %v", i, err)
+	}
+	if len(candidates) == 0 {
+		vm.noteNative(i, "no supported-opcode runs found")
+	}
+
+	var built []pendingCandidate
+	for _, candidate := range candidates {
+		lower, upper := candidate.Bounds()
+		// Such a candidate comes from a broken scanner, and patching
+		// it would write out of range.
+		if err := compile.CheckBounds(candidate, int64(len(fn.code))); err != nil {
+			return nil, fmt.Errorf("AOT scan of vm.funcs[%d] produced an invalid candidate: %v", i, err)
+		}
+		// Never trust the scanner to leave calls & control flow to the
+		// interpreter.
+		if fn.codeMeta != nil {
+			if err := compile.CheckCandidate(candidate, fn.codeMeta); err != nil {
+				vm.noteNative(i, "candidate [%d:%d]: refused: %v", lower, upper, err)
+				continue
+			}
+		}
+		if reason := candidateSkipReason(candidate); reason != "" {
+			vm.noteNative(i, "candidate [%d:%d]: %s", lower, upper, reason)
 			continue
 		}
+		if vm.nativeCompileExpired(start) {
+			break
+		}
 
+		asm, err := vm.nativeBackend.Builder.Build(candidate, fn.code, fn.codeMeta)
+		if err != nil {
+			return nil, fmt.Errorf("native compilation failed on vm.funcs[%d].code[%d:%d]: %v", i, lower, upper, err)
+		}
+		built = append(built, pendingCandidate{fn: i, candidate: candidate, asm: asm})
+	}
+	// Functions which take too long to compile are left to the
+	// interpreter entirely.
+	if vm.nativeCompileExpired(start) {
+		vm.noteNative(i, "compilation exceeded the timeout of %v", vm.opts.NativeCompileTimeout)
+		return nil, nil
+	}
+	return built, nil
+}
+
+// installPending allocates & installs built candidates, within the
+// NativeCodeBudget.
+func (vm *VM) installPending(pending []pendingCandidate) {
+	// Compile the most profitable candidates first, so they are the ones
+	// which fit if the budget is limited.
+	sort.SliceStable(pending, func(a, b int) bool {
+		return nativeScore(pending[a].candidate.Metrics) > nativeScore(pending[b].candidate.Metrics)
+	})
+
+	var allocErr error
+	for _, p := range pending {
+		i, candidate, asm := p.fn, p.candidate, p.asm
 		fn := vm.funcs[i].(compiledFunction)
-		candidates, err := vm.nativeBackend.Scanner.ScanFunc(fn.code, fn.codeMeta)
+		lower, upper := candidate.Bounds()
+
+		if allocErr != nil {
+			vm.noteNative(i, "candidate [%d:%d]: not allocated: %v", lower, upper, allocErr)
+			continue
+		}
+		if vm.opts.NativeCodeBudget > 0 && vm.nativeCodeBytes+len(asm) > vm.opts.NativeCodeBudget {
+			vm.noteNative(i, "candidate [%d:%d]: %d bytes of native code exceed the remaining budget of %d", lower, upper, len(asm), vm.opts.NativeCodeBudget-vm.nativeCodeBytes)
+			continue
+		}
+		unit, err := vm.nativeBackend.allocator.AllocateExec(asm)
 		if err != nil {
-			return fmt.Errorf("AOT scan failed on vm.funcs[%d]: %v", i, err)
+			// Such as when the process is out of address space. Blocks
+			// which were already compiled are kept, and everything else
+			// is left to the interpreter.
+			allocErr = err
+			vm.noteNative(i, "candidate [%d:%d]: not allocated: %v", lower, upper, allocErr)
+			continue
+		}
+		// The unit stays mapped until the VM is closed, even if it is
+		// rejected below, so it counts against the budget either way.
+		vm.nativeCodeBytes += len(asm)
+		if vm.opts.VerifyNativeCompile && !vm.verifyNativeUnit(fn, candidate, unit) {
+			vm.noteNative(i, "candidate [%d:%d]: native code disagreed with the interpreter", lower, upper)
+			continue
 		}
+		vm.installNativeBlock(i, candidate, unit, asm)
+		vm.noteNative(i, "candidate [%d:%d]: compiled to %d bytes of native code, estimated speedup %.1fx", lower, upper, len(asm), candidate.Metrics.EstimatedSpeedup())
+	}
+}
 
-		for _, candidate := range candidates {
-			if (candidate.Metrics.IntegerOps + candidate.Metrics.FloatOps) < minArithInstructionSequence {
-				continue
-			}
-			lower, upper := candidate.Bounds()
-			if (upper - lower) < minInstBytes {
-				continue
-			}
+// invalidateFunction drops the native code of the function at fnIndex,
+// restoring the bytecode it replaced. Anything which modifies the bytecode
+// of a function must invalidate it first, then may compile it again with
+// recompileFunction. Nothing exported modifies bytecode yet, so neither
+// is exported.
+//
+// The executable memory of the dropped code is only freed when the VM is
+// closed, and still counts towards the NativeCodeBudget. The function
+// must not be executing.
+func (vm *VM) invalidateFunction(fnIndex int64) error {
+	if fnIndex < 0 || int(fnIndex) >= len(vm.funcs) {
+		return fmt.Errorf("exec: no function at index %d", fnIndex)
+	}
+	fn, ok := vm.funcs[fnIndex].(compiledFunction)
+	if !ok {
+		return fmt.Errorf("exec: function %d is a host function", fnIndex)
+	}
+	if len(fn.asm) > 0 && vm.opts.NativeStackGrowth == GrowStackPreReserve {
+		fn.maxDepth -= vm.opts.NativeStackHeadroom
+	}
+	for _, block := range fn.asm {
+		lower, _ := block.candidate.Bounds()
+		copy(fn.code[lower:], block.original)
+	}
+	fn.asm = nil
+	fn.nativeNotes = nil
+	vm.funcs[fnIndex] = fn
+	return nil
+}
 
-			asm, err := vm.nativeBackend.Builder.Build(candidate, fn.code, fn.codeMeta)
-			if err != nil {
-				return fmt.Errorf("native compilation failed on vm.funcs[%d].code[%d:%d]: %v", i, lower, upper, err)
-			}
-			unit, err := vm.nativeBackend.allocator.AllocateExec(asm)
-			if err != nil {
-				return fmt.Errorf("PageAllocator.AllocateExec() failed: %v", err)
+// recompileFunction compiles the function at fnIndex into native code
+// again, after invalidating any native code it has. The bytecode metadata
+// of the function must describe its current bytecode.
+//
+// This has no effect unless EnableAOT is set, and native compilation is
+// supported for the current architecture.
+func (vm *VM) recompileFunction(fnIndex int64) error {
+	if err := vm.invalidateFunction(fnIndex); err != nil {
+		return err
+	}
+	if vm.nativeBackend == nil {
+		return nil
+	}
+	return vm.compileAndInstall(int(fnIndex))
+}
+
+// compileOnFirstCall compiles the function at index into native code on
+// its first call, when NativeCompileLazily is set.
+func (vm *VM) compileOnFirstCall(index int64) {
+	if vm.nativeLazy == nil || vm.nativeLazy[index] {
+		return
+	}
+	vm.nativeLazy[index] = true
+	if _, ok := vm.funcs[index].(compiledFunction); !ok {
+		return
+	}
+	if err := vm.compileAndInstall(int(index)); err != nil {
+		vm.noteNative(int(index), "%v", err)
+	}
+}
+
+// compileAndInstall compiles & installs the native code of a single
+// function, reserving its stack headroom.
+func (vm *VM) compileAndInstall(i int) error {
+	built, err := vm.compileFunc(i)
+	if err != nil {
+		return err
+	}
+	vm.installPending(built)
+	if fn := vm.funcs[i].(compiledFunction); len(fn.asm) > 0 && vm.opts.NativeStackGrowth == GrowStackPreReserve {
+		fn.maxDepth += vm.opts.NativeStackHeadroom
+		vm.funcs[i] = fn
+	}
+	return nil
+}
+
+// candidateSkipReason returns why candidate is not worth compiling, or
+// the empty string if it should be compiled.
+func candidateSkipReason(candidate compile.CompilationCandidate) string {
+	if n := candidate.Metrics.IntegerOps + candidate.Metrics.FloatOps; n < minArithInstructionSequence {
+		return fmt.Sprintf("only %d integer & float ops, below threshold %d", n, minArithInstructionSequence)
+	}
+	if lower, upper := candidate.Bounds(); upper-lower < minInstBytes {
+		return fmt.Sprintf("only %d bytes of bytecode, below minimum %d", upper-lower, minInstBytes)
+	}
+	return ""
+}
+
+// noteNative records a reason for the outcome of native compilation of
+// vm.funcs[i], for ExplainNative.
+func (vm *VM) noteNative(i int, format string, args ...interface{}) {
+	fn := vm.funcs[i].(compiledFunction)
+	fn.nativeNotes = append(fn.nativeNotes, fmt.Sprintf(format, args...))
+	vm.funcs[i] = fn
+}
+
+// ExplainNative returns human-readable reasons why parts of the function
+// at fnIndex were, or were not, compiled into native code. Reasons are
+// recorded as the VM is created, so they reflect the options it was
+// created with. With NativeCompileLazily, they are recorded on the first
+// call to the function instead, and none are returned before it.
+func (vm *VM) ExplainNative(fnIndex int64) []string {
+	if fnIndex < 0 || int(fnIndex) >= len(vm.funcs) {
+		return []string{fmt.Sprintf("no function at index %d", fnIndex)}
+	}
+	fn, ok := vm.funcs[fnIndex].(compiledFunction)
+	if !ok {
+		return []string{"function is a host function"}
+	}
+	if vm.nativeBackend == nil {
+		return []string{"native compilation is not enabled, or not supported on this architecture"}
+	}
+	if vm.opts.NativeCache != nil {
+		return []string{"native code was loaded from a cache"}
+	}
+	return append([]string(nil), fn.nativeNotes...)
+}
+
+// installNativeBlock patches the bytecode of vm.funcs[i] to call into unit,
+// the native code compiled from candidate.
+func (vm *VM) installNativeBlock(i int, candidate compile.CompilationCandidate, unit compile.NativeCodeUnit, asm []byte) {
+	fn := vm.funcs[i].(compiledFunction)
+	lower, upper := candidate.Bounds()
+	fn.asm = append(fn.asm, asmBlock{
+		nativeUnit:  unit,
+		resumePC:    upper,
+		stackGrowth: candidate.Metrics.MaxStackGrowth,
+		candidate:   candidate,
+		machineCode: asm,
+		original:    append([]byte(nil), fn.code[lower:upper]...),
+	})
+
+	// Patch the wasm opcode stream to call into the native section.
+	// The number of bytes touched here must always be equal to
+	// nativeExecPrologueSize and <= minInstructionSequence.
+	fn.code[lower] = ops.WagonNativeExec
+	endianess.PutUint32(fn.code[lower+1:], uint32(len(fn.asm)-1))
+	// make the remainder of the recompiled instructions
+	// unreachable: this should trap the program in the event that
+	// a bug in code offsets & candidate sequence detection results in
+	// a jump to the middle of re-compiled code.
+	// This conservative behaviour is the least likely to result in
+	// bugs becoming security issues.
+	// A block at the tail of the function has nothing after it to jump
+	// into, so its bytecode is left as it was.
+	if !isFunctionTail(fn.code, upper) {
+		for i := lower + nativeExecPrologueSize; i < upper; i++ {
+			fn.code[i] = ops.Unreachable
+		}
+	}
+	vm.funcs[i] = fn
+}
+
+// isFunctionTail reports whether bytecode ending at upper runs to the end
+// of code, allowing for the nop compile.Compile appends to every function.
+func isFunctionTail(code []byte, upper int64) bool {
+	n := int64(len(code))
+	return upper == n || (upper == n-1 && code[upper] == ops.Nop)
+}
+
+// reserveNativeHeadroom adds the headroom of GrowStackPreReserve to the
+// maximum stack depth of every function containing native code.
+func (vm *VM) reserveNativeHeadroom() {
+	if vm.opts.NativeStackGrowth != GrowStackPreReserve {
+		return
+	}
+	for i := range vm.funcs {
+		if fn, ok := vm.funcs[i].(compiledFunction); ok && len(fn.asm) > 0 {
+			fn.maxDepth += vm.opts.NativeStackHeadroom
+			vm.funcs[i] = fn
+		}
+	}
+}
+
+// NativeBlocks returns the candidates compiled into native code for the
+// function at fnIndex, indexed by the immediate of the wagon.nativeExec
+// instruction which replaced each of them. Bounds of each candidate give
+// the range of the function's bytecode a native block corresponds to.
+func (vm *VM) NativeBlocks(fnIndex int64) []CompilationCandidate {
+	if fnIndex < 0 || int(fnIndex) >= len(vm.funcs) {
+		return nil
+	}
+	fn, ok := vm.funcs[fnIndex].(compiledFunction)
+	if !ok {
+		return nil
+	}
+	out := make([]CompilationCandidate, len(fn.asm))
+	for i, block := range fn.asm {
+		out[i] = block.candidate
+	}
+	return out
+}
+
+// NativeMemoryBytes returns the number of bytes of executable memory taken
+// up by native code, including the padding which aligns each native block.
+// It is zero if native compilation is not enabled, or the allocator cannot
+// report its usage. Hosts can check it against a budget, to decide
+// whether to compile further modules natively.
+func (vm *VM) NativeMemoryBytes() uint64 {
+	if vm.nativeBackend == nil {
+		return 0
+	}
+	if a, ok := vm.nativeBackend.allocator.(consumptionAllocator); ok {
+		return a.ConsumedBytes()
+	}
+	return 0
+}
+
+// NativeBlockInvocations returns the number of times each native block of
+// the function at fnIndex was invoked, indexed as for NativeBlocks. Counts
+// are zero unless the VM was created with NativeProfiling.
+func (vm *VM) NativeBlockInvocations(fnIndex int64) []uint64 {
+	if fnIndex < 0 || int(fnIndex) >= len(vm.funcs) {
+		return nil
+	}
+	fn, ok := vm.funcs[fnIndex].(compiledFunction)
+	if !ok {
+		return nil
+	}
+	out := make([]uint64, len(fn.asm))
+	for i, block := range fn.asm {
+		if unit, ok := block.nativeUnit.(compile.CountedCodeUnit); ok {
+			out[i] = unit.Invocations()
+		}
+	}
+	return out
+}
+
+// NativeTraceEntry records one invocation of a native block, see
+// NativeTracing.
+type NativeTraceEntry struct {
+	// Func is the index of the function containing the block.
+	Func int64
+	// Block is the index of the block, as for NativeBlocks.
+	Block int
+	// ResumePC is the bytecode address the interpreter continued at
+	// after the block: the end of the block, a branch target, or the end
+	// of the function on a return.
+	ResumePC int64
+}
+
+// NativeTrace returns the native blocks invoked by the last call to
+// ExecCode, in the order they ran. Blocks which trapped are not
+// recorded. It is empty unless the VM was created with NativeTracing.
+func (vm *VM) NativeTrace() []NativeTraceEntry {
+	return append([]NativeTraceEntry(nil), vm.nativeTrace...)
+}
+
+// NativeFunctionInfo describes where the native code of a function lives,
+// see (*VM).NativeFunctionInfo.
+type NativeFunctionInfo struct {
+	// Func is the index of the function.
+	Func int64
+	// Blocks describes each native block of the function, indexed as for
+	// NativeBlocks.
+	Blocks []NativeBlockInfo
+}
+
+// NativeBlockInfo describes a native block, and the bytecode it replaced.
+type NativeBlockInfo struct {
+	// Start & End are the offsets in the function's bytecode of the
+	// first byte the block replaced, and of the byte after the last.
+	Start, End int64
+	// Address & Size locate the machine code of the block in memory.
+	// Both are zero if the NativeAllocator which allocated the block
+	// cannot report them.
+	Address uintptr
+	Size    int
+	// ResumePC is the bytecode address the interpreter continues at when
+	// the block runs to its end.
+	ResumePC int64
+}
+
+// NativeFunctionInfo returns the layout of the native code compiled for
+// the function at fnIndex. Blocks is empty if the index is out of range,
+// the function is a host function, or nothing in it was compiled. The
+// addresses are valid until the VM is closed, so embedders can use them
+// to symbolize native frames, such as in a perf map.
+func (vm *VM) NativeFunctionInfo(fnIndex int64) NativeFunctionInfo {
+	info := NativeFunctionInfo{Func: fnIndex}
+	if fnIndex < 0 || int(fnIndex) >= len(vm.funcs) {
+		return info
+	}
+	fn, ok := vm.funcs[fnIndex].(compiledFunction)
+	if !ok {
+		return info
+	}
+	info.Blocks = make([]NativeBlockInfo, len(fn.asm))
+	for i, block := range fn.asm {
+		b := &info.Blocks[i]
+		b.Start, b.End = block.candidate.Bounds()
+		b.ResumePC = block.resumePC
+		if r, ok := block.nativeUnit.(compile.NativeCodeRegion); ok {
+			b.Address, b.Size = r.Region()
+		}
+	}
+	return info
+}
+
+// WritePerfMap writes a line to w for each native block of the VM, in the
+// format Linux perf reads from /tmp/perf-<pid>.map to symbolize JIT code:
+// the address & size of the block's machine code in hexadecimal, then a
+// symbol naming the function and the range of bytecode the block replaced,
+// such as "wasm[3]:0x10-0x2a". Blocks whose address is unknown are
+// skipped. The addresses are valid until the VM is closed.
+func (vm *VM) WritePerfMap(w io.Writer) error {
+	for i := range vm.funcs {
+		for _, block := range vm.NativeFunctionInfo(int64(i)).Blocks {
+			if block.Size == 0 {
+				continue
 			}
-			fn.asm = append(fn.asm, asmBlock{
-				nativeUnit: unit,
-				resumePC:   upper,
-			})
-
-			// Patch the wasm opcode stream to call into the native section.
-			// The number of bytes touched here must always be equal to
-			// nativeExecPrologueSize and <= minInstructionSequence.
-			fn.code[lower] = ops.WagonNativeExec
-			endianess.PutUint32(fn.code[lower+1:], uint32(len(fn.asm)-1))
-			// make the remainder of the recompiled instructions
-			// unreachable: this should trap the program in the event that
-			// a bug in code offsets & candidate sequence detection results in
-			// a jump to the middle of re-compiled code.
-			// This conservative behaviour is the least likely to result in
-			// bugs becoming security issues.
-			for i := lower + 5; i < upper-1; i++ {
-				fn.code[i] = ops.Unreachable
+			if _, err := fmt.Fprintf(w, "%x %x wasm[%d]:%#x-%#x\n", block.Address, block.Size, i, block.Start, block.End); err != nil {
+				return err
 			}
 		}
-		vm.funcs[i] = fn
 	}
-
 	return nil
 }
 
+// FunctionMetadata returns a copy of the metadata describing the bytecode
+// of the function at fnIndex, as it was before any native code was
+// installed. The instruction offsets are those used by the bounds of
+// candidates, so they can be matched against NativeBlocks to see which
+// instructions a native block replaced.
+func (vm *VM) FunctionMetadata(fnIndex int64) (*BytecodeMetadata, error) {
+	if fnIndex < 0 || int(fnIndex) >= len(vm.funcs) {
+		return nil, fmt.Errorf("exec: no function at index %d", fnIndex)
+	}
+	fn, ok := vm.funcs[fnIndex].(compiledFunction)
+	if !ok {
+		return nil, fmt.Errorf("exec: function %d is a host function", fnIndex)
+	}
+	meta := *fn.codeMeta
+	meta.Instructions = append([]InstructionMetadata(nil), meta.Instructions...)
+	meta.LocalTypes = append([]wasm.ValueType(nil), meta.LocalTypes...)
+	meta.InboundTargets = make(map[int64]bool, len(fn.codeMeta.InboundTargets))
+	for addr, v := range fn.codeMeta.InboundTargets {
+		meta.InboundTargets[addr] = v
+	}
+	return &meta, nil
+}
+
+// nativeCompileExpired returns true if compilation of a function started at
+// start has exceeded the configured NativeCompileTimeout.
+func (vm *VM) nativeCompileExpired(start time.Time) bool {
+	return vm.opts.NativeCompileTimeout > 0 && time.Since(start) > vm.opts.NativeCompileTimeout
+}
+
+// checkNativeBlock traps unless vm.ctx.asm[asmIndex] was installed at the
+// wagon.nativeExec instruction just fetched, so a corrupt immediate cannot
+// run the wrong native code.
+func (vm *VM) checkNativeBlock(asmIndex uint32) {
+	if int(asmIndex) < len(vm.ctx.asm) {
+		lower, _ := vm.ctx.asm[asmIndex].candidate.Bounds()
+		if lower+nativeExecPrologueSize == vm.ctx.pc {
+			return
+		}
+	}
+	panic(ErrNativeBlockMismatch)
+}
+
 // nativeCodeInvocation calls into one of the assembled code blocks.
-// Assembled code blocks expect the following two pieces of
-// information on the stack:
-// [fp:fp+pointerSize]: sliceHeader for the stack.
-// [fp+pointerSize:fp+pointerSize*2]: sliceHeader for locals variables.
+// Assembled code blocks expect the following four pieces of
+// information as arguments, in the registers of Go 1.17's
+// register-based calling convention:
+// RAX: pointer to the sliceHeader for the stack.
+// RBX: pointer to the sliceHeader for locals variables.
+// RCX: pointer to the sliceHeader for linear memory.
+// RDI: pointer to the invocation counter of the block.
 func (vm *VM) nativeCodeInvocation(asmIndex uint32) {
 	block := vm.ctx.asm[asmIndex]
-	block.nativeUnit.Invoke(&vm.ctx.stack, &vm.ctx.locals)
-	vm.ctx.pc = int64(block.resumePC)
+	if need := len(vm.ctx.stack) + block.stackGrowth; need > cap(vm.ctx.stack) {
+		vm.growStack(need)
+	}
+	if vm.opts.NativeAliasGuard && slicesOverlap(vm.ctx.stack, vm.ctx.locals) {
+		panic(ErrNativeSlicesAlias)
+	}
+	exit := block.nativeUnit.Invoke(&vm.ctx.stack, &vm.ctx.locals, &vm.memory)
+	if target, ok := exit.BranchTarget(); ok {
+		vm.ctx.pc = target
+		return
+	}
+	switch exit {
+	case compile.ExitReturn:
+		// Resuming at the end of the code returns from the function.
+		vm.ctx.pc = int64(len(vm.ctx.code))
+		return
+	case compile.TrapOutOfBoundsMemory:
+		panic(ErrOutOfBoundsMemoryAccess)
+	case compile.TrapIntegerDivideByZero:
+		panic(ErrIntegerDivideByZero)
+	case compile.TrapIntegerOverflow:
+		panic(ErrIntegerOverflow)
+	case compile.TrapStackOverflow:
+		panic(ErrNativeStackOverflow)
+	case compile.TrapStackImbalance:
+		panic(ErrNativeStackImbalance)
+	case compile.TrapLocalOutOfRange:
+		panic(ErrNativeLocalOutOfRange)
+	case compile.ExitGrowMemory:
+		vm.growMemoryBy()
+	}
+	vm.ctx.pc = block.resumePC
+}
+
+// slicesOverlap reports whether the backing arrays of a & b share any
+// element up to their capacities, which native code may write.
+func slicesOverlap(a, b []uint64) bool {
+	if cap(a) == 0 || cap(b) == 0 {
+		return false
+	}
+	const size = 8
+	aStart, bStart := reflect.ValueOf(a).Pointer(), reflect.ValueOf(b).Pointer()
+	return aStart < bStart+uintptr(cap(b))*size && bStart < aStart+uintptr(cap(a))*size
+}
+
+// growStack reallocates the stack to a capacity of at least need,
+// according to the configured StackGrowthStrategy. Native code writes
+// to the stack without bounds checks, so this must happen before
+// entering a native code block.
+func (vm *VM) growStack(need int) {
+	newCap := need
+	if vm.opts.NativeStackGrowth == GrowStackDoubling && 2*cap(vm.ctx.stack) > newCap {
+		newCap = 2 * cap(vm.ctx.stack)
+	}
+	stack := make([]uint64, len(vm.ctx.stack), newCap)
+	copy(stack, vm.ctx.stack)
+	vm.ctx.stack = stack
+}
+
+// verifyNativeUnit executes the given native code unit, and the bytecode
+// of the candidate it was compiled from, over a set of random states. It
+// returns false if the native code diverges from the interpreter.
+func (vm *VM) verifyNativeUnit(fn compiledFunction, candidate compile.CompilationCandidate, unit compile.NativeCodeUnit) bool {
+	prevCtx, prevMemory := vm.ctx, vm.memory
+	defer func() {
+		vm.ctx, vm.memory = prevCtx, prevMemory
+	}()
+
+	lower, upper := candidate.Bounds()
+	rng := rand.New(rand.NewSource(lower))
+	for trial := 0; trial < nativeVerifyTrials; trial++ {
+		// The function never exceeds maxDepth values on the stack, so
+		// this is enough for any values consumed by the candidate.
+		stack := make([]uint64, fn.maxDepth, fn.maxDepth+candidate.Metrics.MaxStackGrowth)
+		locals := make([]uint64, fn.totalLocalVars)
+		for i := range stack {
+			stack[i] = rng.Uint64()
+		}
+		for i := range locals {
+			locals[i] = rng.Uint64()
+			// Native code ignores the upper half of 32-bit locals,
+			// zero-extending them as it loads them. The interpreter
+			// only stores them with the upper half clear (see
+			// pushInt32), so only give them such values.
+			if fn.codeMeta != nil {
+				switch fn.codeMeta.LocalType(uint64(i)) {
+				case wasm.ValueTypeI32, wasm.ValueTypeF32:
+					locals[i] = uint64(uint32(locals[i]))
+				}
+			}
+		}
+
+		nativeStack := append(make([]uint64, 0, cap(stack)), stack...)
+		nativeLocals := append([]uint64(nil), locals...)
+		nativeMemory := prevMemory
+		if candidate.Metrics.MemoryWrites > 0 {
+			nativeMemory = append([]byte(nil), prevMemory...)
+		}
+		exit := unit.Invoke(&nativeStack, &nativeLocals, &nativeMemory)
+
+		vm.ctx = context{
+			stack:  stack,
+			locals: locals,
+			code:   fn.code,
+		}
+		if candidate.Metrics.MemoryWrites > 0 {
+			vm.memory = append([]byte(nil), prevMemory...)
+		}
+		interpExit, err := vm.interpretRange(lower, upper)
+		switch {
+		case err == ErrOutOfBoundsMemoryAccess && exit == compile.TrapOutOfBoundsMemory,
+			err == ErrIntegerDivideByZero && exit == compile.TrapIntegerDivideByZero,
+			err == ErrIntegerOverflow && exit == compile.TrapIntegerOverflow:
+			// Both trapped: the remaining state is unobservable.
+			continue
+		case err != nil || exit != interpExit:
+			return false
+		}
+		if !equalValues(vm.ctx.stack, nativeStack) || !equalValues(vm.ctx.locals, nativeLocals) {
+			return false
+		}
+		if !bytes.Equal(vm.memory, nativeMemory) {
+			return false
+		}
+	}
+	return true
+}
+
+// interpretRange executes the bytecode in vm.ctx.code[lower:upper],
+// returning the value of any panic raised by the interpreter. Execution
+// stops early with compile.ExitReturn if a return is reached, with
+// compile.ExitGrowMemory before a memory.grow, or with a branch exit if a
+// branch is taken.
+func (vm *VM) interpretRange(lower, upper int64) (exit compile.NativeExit, err interface{}) {
+	defer func() {
+		err = recover()
+	}()
+	vm.ctx.pc = lower
+	for vm.ctx.pc < upper {
+		op := vm.ctx.code[vm.ctx.pc]
+		vm.ctx.pc++
+		switch op {
+		case ops.Return:
+			return compile.ExitReturn, nil
+		case ops.GrowMemory:
+			// Stop where native code hands the grow to the VM, as the
+			// operand is arbitrary.
+			return compile.ExitGrowMemory, nil
+		case compile.OpJmpNz:
+			target := vm.fetchInt64()
+			preserveTop := vm.fetchBool()
+			discard := vm.fetchInt64()
+			if vm.popUint32() != 0 {
+				var top uint64
+				if preserveTop {
+					top = vm.ctx.stack[len(vm.ctx.stack)-1]
+				}
+				vm.ctx.stack = vm.ctx.stack[:len(vm.ctx.stack)-int(discard)]
+				if preserveTop {
+					vm.pushUint64(top)
+				}
+				return compile.BranchExit(target), nil
+			}
+		default:
+			vm.funcTable[op]()
+		}
+	}
+	return compile.ExitNormal, nil
+}
+
+func equalValues(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,66 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build appengine
+
+package exec
+
+import (
+	"encoding/binary"
+	"errors"
+	"runtime"
+
+	"github.com/go-interpreter/wagon/exec/internal/compile"
+)
+
+// errNativeUnsupported is returned by the appengine backend, which
+// cannot map executable memory.
+var errNativeUnsupported = errors.New("exec: native code is not supported on appengine")
+
+var (
+	_ SequenceScanner    = noopBackend{}
+	_ InstructionBuilder = noopBackend{}
+	_ NativeAllocator    = noopBackend{}
+)
+
+func init() {
+	supportedNativeArchs = append(supportedNativeArchs, nativeArch{
+		Arch: runtime.GOARCH,
+		OS:   runtime.GOOS,
+		make: makeNoopNativeBackend,
+	})
+}
+
+func makeNoopNativeBackend(endianness binary.ByteOrder) *nativeCompiler {
+	return &nativeCompiler{
+		Builder:   noopBackend{},
+		Scanner:   noopBackend{},
+		allocator: noopBackend{},
+	}
+}
+
+// noopBackend stands in for a native backend under appengine. It never
+// finds candidates, so EnableAOT runs the compilation pipeline without
+// changing the bytecode.
+type noopBackend struct{}
+
+// ScanFunc implements SequenceScanner.
+func (noopBackend) ScanFunc(bytecode []byte, meta *BytecodeMetadata) ([]CompilationCandidate, error) {
+	return nil, nil
+}
+
+// Build implements InstructionBuilder.
+func (noopBackend) Build(candidate CompilationCandidate, code []byte, meta *BytecodeMetadata) ([]byte, error) {
+	return nil, errNativeUnsupported
+}
+
+// AllocateExec implements NativeAllocator.
+func (noopBackend) AllocateExec(asm []byte) (compile.NativeCodeUnit, error) {
+	return nil, errNativeUnsupported
+}
+
+// Close implements NativeAllocator.
+func (noopBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build appengine
+
+package exec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-interpreter/wagon/wasm"
+)
+
+func TestNoopNativeCompile(t *testing.T) {
+	m := wasm.NewModule()
+	m.Start = nil
+	sig := wasm.FunctionSig{
+		Form:        0,
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+	}
+	m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+	m.Function = &wasm.SectionFunctions{Types: []uint32{0}}
+	body := wasm.FunctionBody{
+		Module: m,
+		Code:   []byte{0x20, 0x00, 0x42, 0x03, 0x7e}, // get_local 0; i64.const 3; i64.mul
+	}
+	m.Code = &wasm.SectionCode{Bodies: []wasm.FunctionBody{body}}
+	m.FunctionIndexSpace = []wasm.Function{{Sig: &sig, Body: &body}}
+
+	vm, err := NewVMWithOptions(m, EnableAOT(true), NativeStackGrowth(GrowStackPreReserve, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if vm.nativeBackend == nil {
+		t.Fatal("EnableAOT did not set up the appengine backend")
+	}
+	fn := vm.funcs[0].(compiledFunction)
+	code := append([]byte(nil), fn.code...)
+	maxDepth := fn.maxDepth
+
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() = %v", err)
+	}
+	fn = vm.funcs[0].(compiledFunction)
+	if !bytes.Equal(fn.code, code) {
+		t.Error("tryNativeCompile modified the bytecode")
+	}
+	if len(fn.asm) != 0 || len(vm.NativeBlocks(0)) != 0 {
+		t.Errorf("tryNativeCompile installed native blocks: %v", vm.NativeBlocks(0))
+	}
+	if fn.maxDepth != maxDepth {
+		t.Errorf("maxDepth = %d, want %d", fn.maxDepth, maxDepth)
+	}
+
+	out, err := vm.ExecCode(0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.(uint64), uint64(15); got != want {
+		t.Errorf("result = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build js,wasm
+
+package exec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-interpreter/wagon/wasm"
+)
+
+func TestNativeCompileJS(t *testing.T) {
+	if supported, backend := nativeBackend(); supported || backend != nil {
+		t.Fatalf("nativeBackend() = (%v, %v), want (false, nil)", supported, backend)
+	}
+
+	m := wasm.NewModule()
+	m.Start = nil
+	sig := wasm.FunctionSig{
+		Form:        0,
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+	}
+	m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+	m.Function = &wasm.SectionFunctions{Types: []uint32{0}}
+	body := wasm.FunctionBody{
+		Module: m,
+		Code:   []byte{0x20, 0x00, 0x42, 0x03, 0x7e}, // get_local 0; i64.const 3; i64.mul
+	}
+	m.Code = &wasm.SectionCode{Bodies: []wasm.FunctionBody{body}}
+	m.FunctionIndexSpace = []wasm.Function{{Sig: &sig, Body: &body}}
+
+	vm, err := NewVMWithOptions(m, EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if vm.nativeBackend != nil {
+		t.Fatal("EnableAOT set up a native backend under js/wasm")
+	}
+	code := append([]byte(nil), vm.funcs[0].(compiledFunction).code...)
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() = %v", err)
+	}
+	if !bytes.Equal(vm.funcs[0].(compiledFunction).code, code) {
+		t.Error("tryNativeCompile modified the bytecode")
+	}
+
+	out, err := vm.ExecCode(0, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.(uint64), uint64(15); got != want {
+		t.Errorf("result = %d, want %d", got, want)
+	}
+}
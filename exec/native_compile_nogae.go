@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !appengine
+// +build !appengine,!js,go1.17
 
 package exec
 
@@ -12,6 +12,27 @@ import (
 	"github.com/go-interpreter/wagon/exec/internal/compile"
 )
 
+var (
+	_ SequenceScanner      = (&compile.AMD64Backend{}).Scanner()
+	_ costModelScanner     = (&compile.AMD64Backend{}).Scanner()
+	_ scanWindowScanner    = (&compile.AMD64Backend{}).Scanner()
+	_ deadlineScanner      = (&compile.AMD64Backend{}).Scanner()
+	_ InstructionBuilder   = (*compile.AMD64Backend)(nil)
+	_ stackGuardBuilder    = (*compile.AMD64Backend)(nil)
+	_ stackBalanceBuilder  = (*compile.AMD64Backend)(nil)
+	_ localsGuardBuilder   = (*compile.AMD64Backend)(nil)
+	_ breakpointBuilder    = (*compile.AMD64Backend)(nil)
+	_ profilingBuilder     = (*compile.AMD64Backend)(nil)
+	_ fusedMulAddBuilder   = (*compile.AMD64Backend)(nil)
+	_ cpuFeatureBuilder    = (*compile.AMD64Backend)(nil)
+	_ hugePageAllocator    = (*compile.MMapAllocator)(nil)
+	_ consumptionAllocator = (*compile.MMapAllocator)(nil)
+	_ prefaultAllocator    = (*compile.MMapAllocator)(nil)
+)
+
+// The AMD64 backend takes the arguments of a native call in registers,
+// as passed by the register-based calling convention of Go 1.17 and
+// later, so it is only registered when built with those versions.
 func init() {
 	supportedNativeArchs = append(supportedNativeArchs, nativeArch{
 		Arch: "amd64",
@@ -2,18 +2,29 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !appengine
+// +build !appengine,!js,go1.17
 
 package exec
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-interpreter/wagon/disasm"
 	"github.com/go-interpreter/wagon/exec/internal/compile"
+	"github.com/go-interpreter/wagon/wasm"
 	ops "github.com/go-interpreter/wagon/wasm/operators"
+	"golang.org/x/sys/cpu"
 )
 
 func fakeNativeCompiler(t *testing.T) *nativeCompiler {
@@ -33,22 +44,89 @@ func (s *mockSequenceScanner) ScanFunc(bc []byte, meta *compile.BytecodeMetadata
 	return s.emit, nil
 }
 
-type mockPageAllocator struct{}
+type mockPageAllocator struct {
+	unit compile.NativeCodeUnit
+}
 
 func (a *mockPageAllocator) AllocateExec(asm []byte) (compile.NativeCodeUnit, error) {
-	return nil, nil
+	return a.unit, nil
 }
 
 func (a *mockPageAllocator) Close() error {
 	return nil
 }
 
+// limitedPageAllocator wraps a NativeAllocator, failing all allocations
+// once remaining allocations have succeeded.
+type limitedPageAllocator struct {
+	NativeAllocator
+	remaining int
+}
+
+func (a *limitedPageAllocator) AllocateExec(asm []byte) (compile.NativeCodeUnit, error) {
+	if a.remaining == 0 {
+		return nil, errors.New("cannot allocate memory")
+	}
+	a.remaining--
+	return a.NativeAllocator.AllocateExec(asm)
+}
+
+// mockNativeUnit pushes a number of values when invoked, recording whether
+// doing so caused the stack to be reallocated.
+type mockNativeUnit struct {
+	push    int
+	realloc bool
+}
+
+func (u *mockNativeUnit) Invoke(stack, locals *[]uint64, memory *[]byte) compile.NativeExit {
+	before := cap(*stack)
+	for i := 0; i < u.push; i++ {
+		*stack = append(*stack, uint64(i))
+	}
+	if cap(*stack) != before {
+		u.realloc = true
+	}
+	return compile.ExitNormal
+}
+
 type mockInstructionBuilder struct{}
 
 func (b *mockInstructionBuilder) Build(candidate compile.CompilationCandidate, code []byte, meta *compile.BytecodeMetadata) ([]byte, error) {
 	return []byte{byte(candidate.Beginning), byte(candidate.End)}, nil
 }
 
+func TestRegisterBackend(t *testing.T) {
+	defer func(archs []nativeArch) { registeredNativeArchs = archs }(registeredNativeArchs)
+
+	scanner := &mockSequenceScanner{}
+	var gotEndianness binary.ByteOrder
+	newBackend := func(endianness binary.ByteOrder) NativeBackend {
+		gotEndianness = endianness
+		return NativeBackend{
+			Scanner:   scanner,
+			Builder:   &mockInstructionBuilder{},
+			Allocator: &mockPageAllocator{},
+		}
+	}
+	if err := RegisterBackend(runtime.GOARCH, runtime.GOOS, newBackend); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterBackend(runtime.GOARCH, runtime.GOOS, newBackend); err != ErrBackendRegistered {
+		t.Errorf("second RegisterBackend() error = %v, want %v", err, ErrBackendRegistered)
+	}
+
+	supported, backend := nativeBackend()
+	if !supported {
+		t.Fatal("nativeBackend() unsupported after RegisterBackend")
+	}
+	if backend.Scanner != scanner {
+		t.Errorf("nativeBackend().Scanner = %v, want the registered scanner", backend.Scanner)
+	}
+	if gotEndianness != endianess {
+		t.Errorf("backend made with byte order %v, want %v", gotEndianness, endianess)
+	}
+}
+
 func TestNativeAsmStructureSetup(t *testing.T) {
 	nc := fakeNativeCompiler(t)
 
@@ -119,6 +197,14 @@ func TestNativeAsmStructureSetup(t *testing.T) {
 			t.Errorf("fn.code[%d] = %v, want ops.Unreachable", i, fn.code[i])
 		}
 	}
+
+	want := []string{
+		"candidate [0:7]: only 1 integer & float ops, below threshold 2",
+		"candidate [7:15]: compiled to 2 bytes of native code, estimated speedup 0.1x",
+	}
+	if got := vm.ExplainNative(0); !reflect.DeepEqual(got, want) {
+		t.Errorf("ExplainNative(0) = %q, want %q", got, want)
+	}
 }
 
 func TestBasicAMD64(t *testing.T) {
@@ -152,6 +238,7 @@ func TestBasicAMD64(t *testing.T) {
 	_, be := nativeBackend()
 	vm.nativeBackend = be
 	originalLen := len(code)
+	original := append([]byte(nil), code...)
 	if err := vm.tryNativeCompile(); err != nil {
 		t.Fatalf("tryNativeCompile() failed: %v", err)
 	}
@@ -165,22 +252,3290 @@ func TestBasicAMD64(t *testing.T) {
 	}
 
 	// The function bytecode should have been modified to call wagon.nativeExec,
-	// with the index of the block (0) following, and remaining bytes set to the
-	// unreachable opcode.
+	// with the index of the block (0) following. The block is the tail of
+	// the function, so the remaining bytes are left as they were.
 	if want := ops.WagonNativeExec; fn.code[0] != want {
 		t.Errorf("fn.code[0] = %v, want %v", fn.code[0], want)
 	}
 	if want := []byte{0, 0, 0, 0}; !bytes.Equal(fn.code[1:5], want) {
 		t.Errorf("fn.code[1:5] = %v, want %v", fn.code[1:5], want)
 	}
-	for i := 6; i < 15; i++ {
-		if fn.code[i] != ops.Unreachable {
-			t.Errorf("fn.code[%d] = %v, want ops.Unreachable", i, fn.code[i])
+	if !bytes.Equal(fn.code[5:], original[5:]) {
+		t.Errorf("fn.code[5:] = %v, want %v", fn.code[5:], original[5:])
+	}
+
+	fn.call(vm, 0)
+	if len(vm.ctx.stack) != 1 || vm.ctx.stack[0] != 120 {
+		t.Errorf("stack = %+v, want [120]", vm.ctx.stack)
+	}
+}
+
+func TestNativeStackGrowth(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Strategy StackGrowthStrategy
+		Headroom int
+		WantCap  int
+	}{
+		{"exact", GrowStackExact, 0, 6},
+		{"doubling", GrowStackDoubling, 0, 8},
+		{"pre-reserve", GrowStackPreReserve, 8, 12},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			nc := fakeNativeCompiler(t)
+			constInst, _ := ops.New(ops.I32Const)
+			wasm, err := disasm.Assemble([]disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int32(1)}},
+				{Op: constInst, Immediates: []interface{}{int32(2)}},
+				{Op: constInst, Immediates: []interface{}{int32(3)}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			vm := &VM{
+				funcs: []function{
+					compiledFunction{
+						code:     wasm,
+						maxDepth: 4,
+					},
+				},
+				nativeBackend: nc,
+				opts: config{
+					NativeStackGrowth:   tc.Strategy,
+					NativeStackHeadroom: tc.Headroom,
+				},
+			}
+			vm.newFuncTable()
+			nc.Scanner.(*mockSequenceScanner).emit = []compile.CompilationCandidate{
+				{Beginning: 0, End: int64(len(wasm)), EndInstruction: 2, Metrics: compile.Metrics{IntegerOps: 3, MaxStackGrowth: 4}},
+			}
+			if err := vm.tryNativeCompile(); err != nil {
+				t.Fatalf("tryNativeCompile() failed: %v", err)
+			}
+
+			fn := vm.funcs[0].(compiledFunction)
+			if got, want := fn.asm[0].stackGrowth, 4; got != want {
+				t.Errorf("fn.asm[0].stackGrowth = %d, want %d", got, want)
+			}
+			unit := &mockNativeUnit{push: fn.asm[0].stackGrowth}
+			fn.asm[0].nativeUnit = unit
+
+			vm.ctx.stack = make([]uint64, 2, fn.maxDepth)
+			vm.ctx.stack[0], vm.ctx.stack[1] = 7, 9
+			vm.ctx.asm = fn.asm
+			vm.nativeCodeInvocation(0)
+
+			if unit.realloc {
+				t.Error("stack was reallocated during Invoke")
+			}
+			if got, want := cap(vm.ctx.stack), tc.WantCap; got != want {
+				t.Errorf("cap(stack) = %d, want %d", got, want)
+			}
+			if got, want := len(vm.ctx.stack), 6; got != want {
+				t.Fatalf("len(stack) = %d, want %d", got, want)
+			}
+			if vm.ctx.stack[0] != 7 || vm.ctx.stack[1] != 9 {
+				t.Errorf("stack[:2] = %v, want [7 9]", vm.ctx.stack[:2])
+			}
+		})
+	}
+}
+
+// mockAddUnit pushes the i32.add of the first two locals, or
+// incorrectly adds one extra if buggy is set.
+type mockAddUnit struct {
+	buggy bool
+}
+
+func (u *mockAddUnit) Invoke(stack, locals *[]uint64, memory *[]byte) compile.NativeExit {
+	v := uint64(uint32((*locals)[0] + (*locals)[1]))
+	if u.buggy {
+		v++
+	}
+	*stack = append(*stack, v)
+	return compile.ExitNormal
+}
+
+func TestVerifyNativeCompile(t *testing.T) {
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	addInst, _ := ops.New(ops.I32Add)
+	wasm, err := disasm.Assemble([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: addInst},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Compile re-encodes the immediates, as the interpreter expects.
+	instrs, err := disasm.Disassemble(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, meta := compile.Compile(instrs)
+
+	for _, buggy := range []bool{false, true} {
+		nc := fakeNativeCompiler(t)
+		nc.allocator.(*mockPageAllocator).unit = &mockAddUnit{buggy: buggy}
+		nc.Scanner.(*mockSequenceScanner).emit = []compile.CompilationCandidate{
+			{Beginning: 0, End: int64(len(code) - 1), EndInstruction: 2, Metrics: compile.Metrics{IntegerOps: 3, MaxStackGrowth: 2}},
+		}
+		vm := &VM{
+			funcs: []function{
+				compiledFunction{
+					code:           append([]byte(nil), code...),
+					codeMeta:       meta,
+					maxDepth:       2,
+					totalLocalVars: 2,
+				},
+			},
+			nativeBackend: nc,
+			opts:          config{VerifyNativeCompile: true},
+		}
+		vm.newFuncTable()
+		if err := vm.tryNativeCompile(); err != nil {
+			t.Fatalf("tryNativeCompile() failed: %v", err)
+		}
+
+		fn := vm.funcs[0].(compiledFunction)
+		if buggy {
+			if len(fn.asm) != 0 {
+				t.Errorf("buggy: len(fn.asm) = %d, want 0", len(fn.asm))
+			}
+			if !bytes.Equal(fn.code, code) {
+				t.Errorf("buggy: fn.code = %v, want %v", fn.code, code)
+			}
+		} else if len(fn.asm) != 1 {
+			t.Errorf("len(fn.asm) = %d, want 1", len(fn.asm))
+		}
+		// A rejected unit stays mapped, so it is still counted.
+		if got, want := vm.nativeCodeBytes, 2; got != want {
+			t.Errorf("buggy=%v: nativeCodeBytes = %d, want %d", buggy, got, want)
+		}
+	}
+}
+
+// mockTrapUnit returns the given exit status without touching any state.
+type mockTrapUnit struct {
+	exit compile.NativeExit
+}
+
+func (u *mockTrapUnit) Invoke(stack, locals *[]uint64, memory *[]byte) compile.NativeExit {
+	return u.exit
+}
+
+func TestNativeCodeInvocationTrap(t *testing.T) {
+	vm := &VM{}
+	vm.ctx.asm = []asmBlock{
+		{nativeUnit: &mockTrapUnit{exit: compile.TrapOutOfBoundsMemory}, resumePC: 12},
+	}
+
+	defer func() {
+		if r := recover(); r != ErrOutOfBoundsMemoryAccess {
+			t.Errorf("recover() = %v, want %v", r, ErrOutOfBoundsMemoryAccess)
+		}
+		if vm.ctx.pc == 12 {
+			t.Error("execution resumed after the native code trapped")
+		}
+	}()
+	vm.nativeCodeInvocation(0)
+}
+
+func TestNativeBlockMismatch(t *testing.T) {
+	nc := fakeNativeCompiler(t)
+	nc.allocator.(*mockPageAllocator).unit = &mockNativeUnit{push: 1}
+	constInst, _ := ops.New(ops.I32Const)
+	var instrs []disasm.Instr
+	for i := 0; i < 6; i++ {
+		instrs = append(instrs, disasm.Instr{Op: constInst, Immediates: []interface{}{int32(i)}})
+	}
+	code, meta := compile.Compile(instrs)
+	vm := &VM{
+		funcs:         []function{compiledFunction{code: code, maxDepth: 6}},
+		nativeBackend: nc,
+	}
+	vm.newFuncTable()
+	second := meta.Instructions[3].Start
+	nc.Scanner.(*mockSequenceScanner).emit = []compile.CompilationCandidate{
+		{Beginning: 0, End: second, EndInstruction: 2, Metrics: compile.Metrics{IntegerOps: 2, MaxStackGrowth: 1}},
+		{Beginning: second, End: int64(len(code)), StartInstruction: 3, EndInstruction: 5, Metrics: compile.Metrics{IntegerOps: 2, MaxStackGrowth: 1}},
+	}
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+	fn := vm.funcs[0].(compiledFunction)
+	if got, want := len(fn.asm), 2; got != want {
+		t.Fatalf("len(fn.asm) = %d, want %d", got, want)
+	}
+
+	for _, asmIndex := range []uint32{0, 2} {
+		t.Run(fmt.Sprint(asmIndex), func(t *testing.T) {
+			// Corrupt the second wagon.nativeExec to invoke another block.
+			endianess.PutUint32(fn.code[second+1:], asmIndex)
+			vm.ctx = context{
+				stack: make([]uint64, 0, fn.maxDepth),
+				code:  fn.code,
+				asm:   fn.asm,
+			}
+			defer func() {
+				if r := recover(); r != ErrNativeBlockMismatch {
+					t.Errorf("recover() = %v, want %v", r, ErrNativeBlockMismatch)
+				}
+				// Only the first block ran.
+				if got, want := len(vm.ctx.stack), 1; got != want {
+					t.Errorf("len(stack) = %d, want %d", got, want)
+				}
+			}()
+			vm.execCode(fn)
+		})
+	}
+}
+
+func TestNativeAllocFailure(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	constInst, _ := ops.New(ops.I32Const)
+	addInst, _ := ops.New(ops.I64Add)
+
+	var funcs []function
+	for i := 0; i < 3; i++ {
+		code, meta := compile.Compile([]disasm.Instr{
+			{Op: constInst, Immediates: []interface{}{int32(100)}},
+			{Op: constInst, Immediates: []interface{}{int32(16)}},
+			{Op: constInst, Immediates: []interface{}{int32(4)}},
+			{Op: addInst},
+			{Op: addInst},
+		})
+		funcs = append(funcs, compiledFunction{
+			returns:      true,
+			maxDepth:     6,
+			code:         code,
+			branchTables: meta.BranchTables,
+			codeMeta:     meta,
+		})
+	}
+	vm := &VM{funcs: funcs}
+	vm.newFuncTable()
+
+	_, be := nativeBackend()
+	be.allocator = &limitedPageAllocator{NativeAllocator: be.allocator, remaining: 1}
+	vm.nativeBackend = be
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+
+	for i, want := range []int{1, 0, 0} {
+		fn := vm.funcs[i].(compiledFunction)
+		if got := len(fn.asm); got != want {
+			t.Errorf("len(vm.funcs[%d].asm) = %d, want %d", i, got, want)
+		}
+		vm.ctx.stack = nil
+		fn.call(vm, 0)
+		if len(vm.ctx.stack) != 1 || vm.ctx.stack[0] != 120 {
+			t.Errorf("vm.funcs[%d]: stack = %+v, want [120]", i, vm.ctx.stack)
 		}
 	}
+}
+
+// recordingBuilder records each candidate it is asked to build.
+type recordingBuilder struct {
+	mockInstructionBuilder
+	built []CompilationCandidate
+}
+
+func (b *recordingBuilder) Build(candidate CompilationCandidate, code []byte, meta *BytecodeMetadata) ([]byte, error) {
+	b.built = append(b.built, candidate)
+	return b.mockInstructionBuilder.Build(candidate, code, meta)
+}
+
+func TestNativeCompilerOption(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	f, err := os.Open("testdata/add-ex.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	module, err := wasm.ReadModule(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// get_local 0; get_local 1; i32.add
+	candidate := CompilationCandidate{Beginning: 0, End: 11, EndInstruction: 2, Metrics: Metrics{IntegerOps: 3}}
+	scanner := &mockSequenceScanner{emit: []CompilationCandidate{candidate}}
+	builder := &recordingBuilder{}
+	vm, err := NewVMWithOptions(module, EnableAOT(true), NativeCompiler(scanner, builder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+
+	if len(builder.built) != 1 || builder.built[0] != candidate {
+		t.Fatalf("built = %+v, want [%+v]", builder.built, candidate)
+	}
+	fn := vm.funcs[0].(compiledFunction)
+	if got, want := len(fn.asm), 1; got != want {
+		t.Fatalf("len(fn.asm) = %d, want %d", got, want)
+	}
+	if got, want := fn.asm[0].resumePC, int64(11); got != want {
+		t.Errorf("fn.asm[0].resumePC = %d, want %d", got, want)
+	}
+
+	// The mock builder does not emit real code, so substitute a unit
+	// which behaves like the candidate.
+	fn.asm[0].nativeUnit = &mockAddUnit{}
+	out, err := vm.ExecCode(0, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.(uint32), uint32(7); got != want {
+		t.Errorf("iadd(3, 4) = %d, want %d", got, want)
+	}
+}
+
+func TestNativeCodeBudget(t *testing.T) {
+	constInst, _ := ops.New(ops.I32Const)
+	var instrs []disasm.Instr
+	for i := 0; i < 9; i++ {
+		instrs = append(instrs, disasm.Instr{Op: constInst, Immediates: []interface{}{int32(i)}})
+	}
+	code, meta := compile.Compile(instrs)
+
+	nc := fakeNativeCompiler(t)
+	nc.Scanner.(*mockSequenceScanner).emit = []compile.CompilationCandidate{
+		{Beginning: 0, End: 15, EndInstruction: 2, Metrics: compile.Metrics{IntegerOps: 3}},
+		{Beginning: 15, End: 30, StartInstruction: 3, EndInstruction: 5, Metrics: compile.Metrics{IntegerOps: 3, StackWrites: 3}},
+		{Beginning: 30, End: 45, StartInstruction: 6, EndInstruction: 8, Metrics: compile.Metrics{IntegerOps: 2}},
+	}
+	vm := &VM{
+		funcs: []function{
+			compiledFunction{
+				code:     code,
+				codeMeta: meta,
+			},
+		},
+		nativeBackend: nc,
+		// mockInstructionBuilder emits two bytes per candidate.
+		opts: config{NativeCodeBudget: 3},
+	}
+	vm.newFuncTable()
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+
+	fn := vm.funcs[0].(compiledFunction)
+	if got, want := len(fn.asm), 1; got != want {
+		t.Fatalf("len(fn.asm) = %d, want %d", got, want)
+	}
+	if got, want := fn.asm[0].resumePC, int64(30); got != want {
+		t.Errorf("fn.asm[0].resumePC = %d, want %d", got, want)
+	}
+	if fn.code[0] == ops.WagonNativeExec || fn.code[30] == ops.WagonNativeExec {
+		t.Error("lower scoring candidates were compiled over budget")
+	}
+	if fn.code[15] != ops.WagonNativeExec {
+		t.Errorf("fn.code[15] = %v, want %v", fn.code[15], ops.WagonNativeExec)
+	}
+}
+
+func TestNativeCompileReturn(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	returnInst, _ := ops.New(ops.Return)
+
+	code, meta := compile.Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(100)}},
+		{Op: constInst, Immediates: []interface{}{int64(20)}},
+		{Op: addInst},
+		{Op: returnInst},
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: addInst},
+	})
+	vm := &VM{
+		funcs: []function{
+			compiledFunction{
+				returns:      true,
+				maxDepth:     3,
+				code:         code,
+				branchTables: meta.BranchTables,
+				codeMeta:     meta,
+			},
+		},
+		opts: config{VerifyNativeCompile: true},
+	}
+	vm.newFuncTable()
+
+	_, be := nativeBackend()
+	vm.nativeBackend = be
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+
+	fn := vm.funcs[0].(compiledFunction)
+	if got, want := len(fn.asm), 1; got != want {
+		t.Fatalf("len(fn.asm) = %d, want %d", got, want)
+	}
+	// The candidate ends at the return.
+	if got, want := fn.asm[0].resumePC, meta.Instructions[3].Start+1; got != want {
+		t.Errorf("fn.asm[0].resumePC = %d, want %d", got, want)
+	}
 
 	fn.call(vm, 0)
 	if len(vm.ctx.stack) != 1 || vm.ctx.stack[0] != 120 {
 		t.Errorf("stack = %+v, want [120]", vm.ctx.stack)
 	}
 }
+
+func TestNativeCompileFusedBranch(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	loopInst, _ := ops.New(ops.Loop)
+	endInst, _ := ops.New(ops.End)
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	setLocalInst, _ := ops.New(ops.SetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	ltInst, _ := ops.New(ops.I64LtS)
+	brIfInst, _ := ops.New(ops.BrIf)
+
+	// Counts locals[0] up to locals[1], one at a time.
+	body, err := disasm.Assemble([]disasm.Instr{
+		{Op: loopInst, Immediates: []interface{}{wasm.BlockTypeEmpty}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: addInst},
+		{Op: setLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: ltInst},
+		{Op: brIfInst, Immediates: []interface{}{uint32(0)}},
+		{Op: endInst},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &wasm.FunctionSig{
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+	}
+	disassembly, err := disasm.NewDisassembly(wasm.Function{Sig: sig, Body: &wasm.FunctionBody{Code: body}}, &wasm.Module{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, meta := compile.Compile(disassembly.Code)
+	vm := &VM{
+		funcs: []function{
+			compiledFunction{
+				returns:        true,
+				args:           2,
+				totalLocalVars: 2,
+				maxDepth:       3,
+				code:           code,
+				branchTables:   meta.BranchTables,
+				codeMeta:       meta,
+			},
+		},
+		opts: config{VerifyNativeCompile: true},
+	}
+	vm.newFuncTable()
+
+	_, be := nativeBackend()
+	vm.nativeBackend = be
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+	// The whole loop body, including the set_local, is one block.
+	fn := vm.funcs[0].(compiledFunction)
+	if got, want := len(fn.asm), 1; got != want {
+		t.Fatalf("len(fn.asm) = %d, want %d", got, want)
+	}
+
+	for _, tc := range []struct{ from, to, want int64 }{
+		{0, 10, 10},
+		{-5, 3, 3},
+		{7, 2, 8},
+	} {
+		vm.ctx.stack = []uint64{uint64(tc.from), uint64(tc.to)}
+		fn.call(vm, 0)
+		if len(vm.ctx.stack) != 1 || int64(vm.ctx.stack[0]) != tc.want {
+			t.Errorf("count(%d, %d): stack = %+v, want [%d]", tc.from, tc.to, vm.ctx.stack, tc.want)
+		}
+	}
+}
+
+// slowInstructionBuilder sleeps for delay before every build.
+type slowInstructionBuilder struct {
+	mockInstructionBuilder
+	delay time.Duration
+}
+
+func (b *slowInstructionBuilder) Build(candidate compile.CompilationCandidate, code []byte, meta *compile.BytecodeMetadata) ([]byte, error) {
+	time.Sleep(b.delay)
+	return b.mockInstructionBuilder.Build(candidate, code, meta)
+}
+
+func TestNativeCompileTimeout(t *testing.T) {
+	constInst, _ := ops.New(ops.I32Const)
+	addInst, _ := ops.New(ops.I32Add)
+	code, meta := compile.Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int32(3)}},
+		{Op: constInst, Immediates: []interface{}{int32(4)}},
+		{Op: addInst},
+	})
+	original := append([]byte(nil), code...)
+
+	nc := fakeNativeCompiler(t)
+	nc.Builder = &slowInstructionBuilder{delay: 20 * time.Millisecond}
+	nc.Scanner.(*mockSequenceScanner).emit = []compile.CompilationCandidate{
+		{Beginning: 0, End: int64(len(code)), EndInstruction: 2, Metrics: compile.Metrics{IntegerOps: 3}},
+	}
+	vm := &VM{
+		funcs: []function{
+			compiledFunction{
+				returns:  true,
+				maxDepth: 2,
+				code:     code,
+				codeMeta: meta,
+			},
+		},
+		nativeBackend: nc,
+		opts:          config{NativeCompileTimeout: time.Millisecond},
+	}
+	vm.newFuncTable()
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+
+	fn := vm.funcs[0].(compiledFunction)
+	if len(fn.asm) != 0 {
+		t.Errorf("len(fn.asm) = %d, want 0", len(fn.asm))
+	}
+	if !bytes.Equal(fn.code, original) {
+		t.Errorf("fn.code = %v, want %v", fn.code, original)
+	}
+	fn.call(vm, 0)
+	if len(vm.ctx.stack) != 1 || vm.ctx.stack[0] != 7 {
+		t.Errorf("stack = %+v, want [7]", vm.ctx.stack)
+	}
+}
+
+// deadlineSequenceScanner records the deadline it is given, and gives up
+// as if it had passed.
+type deadlineSequenceScanner struct {
+	mockSequenceScanner
+	deadline time.Time
+}
+
+func (s *deadlineSequenceScanner) ScanFuncBefore(bc []byte, meta *compile.BytecodeMetadata, deadline time.Time) ([]compile.CompilationCandidate, error) {
+	s.deadline = deadline
+	return nil, compile.ErrScanDeadline
+}
+
+func TestNativeCompileTimeoutWhileScanning(t *testing.T) {
+	constInst, _ := ops.New(ops.I32Const)
+	code, meta := compile.Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int32(3)}},
+	})
+	nc := fakeNativeCompiler(t)
+	scanner := &deadlineSequenceScanner{}
+	nc.Scanner = scanner
+	vm := &VM{
+		funcs: []function{
+			compiledFunction{
+				returns:  true,
+				maxDepth: 1,
+				code:     code,
+				codeMeta: meta,
+			},
+		},
+		nativeBackend: nc,
+		opts:          config{NativeCompileTimeout: time.Minute},
+	}
+	vm.newFuncTable()
+	before := time.Now()
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+	if scanner.deadline.Before(before.Add(time.Minute)) || scanner.deadline.After(time.Now().Add(time.Minute)) {
+		t.Errorf("deadline = %v, want a minute after compilation started at %v", scanner.deadline, before)
+	}
+	if notes := vm.ExplainNative(0); len(notes) != 1 || !strings.Contains(notes[0], "timeout") {
+		t.Errorf("ExplainNative(0) = %q, want the timeout", notes)
+	}
+}
+
+func TestNativeCompileCandidatePastEnd(t *testing.T) {
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	code, meta := compile.Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+		{Op: addInst},
+	})
+	original := append([]byte(nil), code...)
+
+	for _, c := range []compile.CompilationCandidate{
+		{Beginning: 0, End: int64(len(code)) + 10, EndInstruction: 2, Metrics: compile.Metrics{IntegerOps: 3}},
+		{Beginning: int64(len(code)), End: 0, EndInstruction: 2, Metrics: compile.Metrics{IntegerOps: 3}},
+	} {
+		nc := fakeNativeCompiler(t)
+		nc.Scanner.(*mockSequenceScanner).emit = []compile.CompilationCandidate{c}
+		vm := &VM{
+			funcs: []function{
+				compiledFunction{
+					returns:  true,
+					maxDepth: 2,
+					code:     code,
+					codeMeta: meta,
+				},
+			},
+			nativeBackend: nc,
+		}
+		vm.newFuncTable()
+		err := vm.tryNativeCompile()
+		if err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("tryNativeCompile() with bounds [%d:%d] = %v, want an out of range error", c.Beginning, c.End, err)
+		}
+		if fn := vm.funcs[0].(compiledFunction); !bytes.Equal(fn.code, original) || len(fn.asm) != 0 {
+			t.Errorf("bounds [%d:%d]: the bytecode was patched", c.Beginning, c.End)
+		}
+	}
+}
+
+func TestNativeBlocks(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	clzInst, _ := ops.New(ops.I64Clz)
+	code, meta := compile.Compile([]disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(1)}},
+		{Op: constInst, Immediates: []interface{}{int64(2)}},
+		{Op: addInst},
+		{Op: clzInst},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: constInst, Immediates: []interface{}{int64(4)}},
+		{Op: constInst, Immediates: []interface{}{int64(5)}},
+		{Op: addInst},
+		{Op: addInst},
+	})
+	_, be := nativeBackend()
+	want, err := be.Scanner.ScanFunc(code, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want) != 2 {
+		t.Fatalf("len(candidates) = %d, want 2", len(want))
+	}
+
+	vm := &VM{
+		funcs: []function{
+			compiledFunction{
+				returns:  true,
+				maxDepth: 4,
+				code:     code,
+				codeMeta: meta,
+			},
+		},
+		nativeBackend: be,
+	}
+	vm.newFuncTable()
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+
+	blocks := vm.NativeBlocks(0)
+	if len(blocks) != len(want) {
+		t.Fatalf("len(NativeBlocks(0)) = %d, want %d", len(blocks), len(want))
+	}
+	for i, block := range blocks {
+		// Locate the candidate from the block index patched into the code.
+		lower, upper := block.Bounds()
+		if got := vm.funcs[0].(compiledFunction).code[lower]; got != ops.WagonNativeExec {
+			t.Errorf("code[%d] = %#x, want wagon.nativeExec", lower, got)
+		}
+		if got := endianess.Uint32(vm.funcs[0].(compiledFunction).code[lower+1:]); got != uint32(i) {
+			t.Errorf("code[%d:] block index = %d, want %d", lower+1, got, i)
+		}
+		var found bool
+		for _, c := range want {
+			if l, u := c.Bounds(); l == lower && u == upper {
+				found = true
+				if c.Metrics != block.Metrics {
+					t.Errorf("NativeBlocks(0)[%d].Metrics = %+v, want %+v", i, block.Metrics, c.Metrics)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("NativeBlocks(0)[%d] bounds [%d, %d) were not emitted by the scanner", i, lower, upper)
+		}
+	}
+	if got := vm.NativeBlocks(1); got != nil {
+		t.Errorf("NativeBlocks(1) = %v, want nil", got)
+	}
+}
+
+func TestNativeCompileWholeFunction(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	mulInst, _ := ops.New(ops.I64Mul)
+	code, meta := compile.Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: mulInst},
+	})
+	original := append([]byte(nil), code...)
+	vm := &VM{
+		funcs: []function{
+			compiledFunction{
+				returns:        true,
+				args:           1,
+				totalLocalVars: 1,
+				maxDepth:       2,
+				code:           code,
+				codeMeta:       meta,
+			},
+		},
+	}
+	vm.newFuncTable()
+	_, be := nativeBackend()
+	vm.nativeBackend = be
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+
+	fn := vm.funcs[0].(compiledFunction)
+	if got, want := len(fn.asm), 1; got != want {
+		t.Fatalf("len(fn.asm) = %d, want %d", got, want)
+	}
+	// The block replaces every instruction, up to the nop Compile appends
+	// to the end of the function.
+	last := meta.Instructions[len(meta.Instructions)-1]
+	if got, want := fn.asm[0].resumePC, last.Start+last.Size; got != want {
+		t.Errorf("fn.asm[0].resumePC = %d, want %d", got, want)
+	}
+	// Nothing follows the block, so its bytecode is not filled with
+	// unreachable.
+	if got, want := fn.code[5:fn.asm[0].resumePC], original[5:fn.asm[0].resumePC]; !bytes.Equal(got, want) {
+		t.Errorf("fn.code[5:%d] = %#x, want %#x", fn.asm[0].resumePC, got, want)
+	}
+	if got, want := fn.code[len(fn.code)-1], ops.Nop; got != want {
+		t.Errorf("fn.code[%d] = %#x, want ops.Nop", len(fn.code)-1, got)
+	}
+
+	for _, arg := range []uint64{0, 7, 1 << 62} {
+		vm.ctx.stack = []uint64{arg}
+		fn.call(vm, 0)
+		if len(vm.ctx.stack) != 1 || vm.ctx.stack[0] != arg*3 {
+			t.Errorf("f(%d): stack = %+v, want [%d]", arg, vm.ctx.stack, arg*3)
+		}
+	}
+}
+
+func TestNativeCompileFillsBeforeTail(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	mulInst, _ := ops.New(ops.I64Mul)
+	clzInst, _ := ops.New(ops.I64Clz)
+	addInst, _ := ops.New(ops.I64Add)
+	// clz(x*3) + x*3, where the unsupported i64.clz splits the two blocks.
+	code, meta := compile.Compile([]disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: mulInst},
+		{Op: clzInst},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: mulInst},
+		{Op: addInst},
+	})
+	original := append([]byte(nil), code...)
+	vm := &VM{
+		funcs: []function{
+			compiledFunction{
+				returns:        true,
+				args:           1,
+				totalLocalVars: 1,
+				maxDepth:       3,
+				code:           code,
+				codeMeta:       meta,
+			},
+		},
+	}
+	vm.newFuncTable()
+	_, be := nativeBackend()
+	vm.nativeBackend = be
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+
+	fn := vm.funcs[0].(compiledFunction)
+	if got, want := len(fn.asm), 2; got != want {
+		t.Fatalf("len(fn.asm) = %d, want %d", got, want)
+	}
+	// The first block is followed by the i64.clz, so is filled, while the
+	// second runs to the end of the function. Blocks are not installed in
+	// bytecode order.
+	first, tail := fn.asm[0].candidate, fn.asm[1].candidate
+	if first.Beginning > tail.Beginning {
+		first, tail = tail, first
+	}
+	lower, upper := first.Bounds()
+	for i := lower + nativeExecPrologueSize; i < upper; i++ {
+		if fn.code[i] != ops.Unreachable {
+			t.Errorf("fn.code[%d] = %#x, want ops.Unreachable", i, fn.code[i])
+		}
+	}
+	lower, _ = tail.Bounds()
+	if got, want := fn.code[lower+nativeExecPrologueSize:], original[lower+nativeExecPrologueSize:]; !bytes.Equal(got, want) {
+		t.Errorf("fn.code[%d:] = %#x, want %#x", lower+nativeExecPrologueSize, got, want)
+	}
+
+	vm.ctx.stack = []uint64{7}
+	fn.call(vm, 0)
+	if want := uint64(59 + 21); len(vm.ctx.stack) != 1 || vm.ctx.stack[0] != want {
+		t.Errorf("stack = %+v, want [%d]", vm.ctx.stack, want)
+	}
+}
+
+// nativeCacheModule returns a module with a single function, computing
+// (i64.mul (get_local 0) (i64.const 3)).
+func nativeCacheModule() *wasm.Module {
+	m := wasm.NewModule()
+	m.Start = nil
+	sig := wasm.FunctionSig{
+		Form:        0,
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+	}
+	m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+	m.Function = &wasm.SectionFunctions{Types: []uint32{0}}
+	body := wasm.FunctionBody{
+		Module: m,
+		Code:   []byte{0x20, 0x00, 0x42, 0x03, 0x7e},
+	}
+	m.Code = &wasm.SectionCode{Bodies: []wasm.FunctionBody{body}}
+	m.FunctionIndexSpace = []wasm.Function{{Sig: &sig, Body: &body}}
+	return m
+}
+
+// multiFuncModule builds a module of functions of type (i64) -> i64, one
+// for each body.
+func multiFuncModule(bodies ...[]byte) *wasm.Module {
+	m := nativeCacheModule()
+	sig := m.Types.Entries[0]
+	m.Function.Types = make([]uint32, len(bodies))
+	m.Code.Bodies = make([]wasm.FunctionBody, len(bodies))
+	m.FunctionIndexSpace = make([]wasm.Function, len(bodies))
+	for i, code := range bodies {
+		m.Code.Bodies[i] = wasm.FunctionBody{Module: m, Code: code}
+		m.FunctionIndexSpace[i] = wasm.Function{Sig: &sig, Body: &m.Code.Bodies[i]}
+	}
+	return m
+}
+
+func TestNativeCache(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if got, want := len(vm.NativeBlocks(0)), 1; got != want {
+		t.Fatalf("len(NativeBlocks(0)) = %d, want %d", got, want)
+	}
+	var cache bytes.Buffer
+	if err := vm.WriteNativeCache(&cache); err != nil {
+		t.Fatal(err)
+	}
+
+	// The loaded VM must never scan or build.
+	scanner := &mockSequenceScanner{}
+	builder := &recordingBuilder{}
+	loaded, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true), NativeCompiler(scanner, builder), NativeCache(&cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.Close()
+	if len(builder.built) != 0 {
+		t.Errorf("built = %+v, want none", builder.built)
+	}
+	got, want := loaded.funcs[0].(compiledFunction).asm, vm.funcs[0].(compiledFunction).asm
+	if len(got) != 1 || got[0].resumePC != want[0].resumePC || got[0].stackGrowth != want[0].stackGrowth {
+		t.Errorf("loaded blocks = %+v, want %+v", got, want)
+	}
+	if got, want := loaded.funcs[0].(compiledFunction).code, vm.funcs[0].(compiledFunction).code; !bytes.Equal(got, want) {
+		t.Errorf("loaded code = %x, want %x", got, want)
+	}
+
+	for _, arg := range []uint64{0, 7, 1 << 62} {
+		want, err := vm.ExecCode(0, arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := loaded.ExecCode(0, arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want || got.(uint64) != arg*3 {
+			t.Errorf("f(%d) = %v, want %v", arg, got, want)
+		}
+	}
+}
+
+func TestNativeCacheMismatch(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	var cache bytes.Buffer
+	if err := vm.WriteNativeCache(&cache); err != nil {
+		t.Fatal(err)
+	}
+
+	other := nativeCacheModule()
+	other.FunctionIndexSpace[0].Body.Code[3] = 0x04 // i64.const 4
+	if _, err := NewVMWithOptions(other, EnableAOT(true), NativeCache(&cache)); err != ErrNativeCacheMismatch {
+		t.Errorf("NewVMWithOptions() error = %v, want %v", err, ErrNativeCacheMismatch)
+	}
+}
+
+// TestNativeCacheCPUFeatures checks a cache written on a CPU with other
+// optional features is rejected, rather than installing code which may
+// fault.
+func TestNativeCacheCPUFeatures(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	var cache bytes.Buffer
+	if err := vm.WriteNativeCache(&cache); err != nil {
+		t.Fatal(err)
+	}
+	var file nativeCacheFile
+	if err := gob.NewDecoder(&cache).Decode(&file); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := file.CPUFeatures, nativeCPUFeatures(); !reflect.DeepEqual(got, want) {
+		t.Errorf("CPUFeatures = %q, want %q", got, want)
+	}
+
+	for _, features := range [][]string{
+		append(append([]string(nil), file.CPUFeatures...), "avx512"),
+		nil,
+	} {
+		if features == nil && len(file.CPUFeatures) == 0 {
+			continue
+		}
+		file.CPUFeatures = features
+		var other bytes.Buffer
+		if err := gob.NewEncoder(&other).Encode(&file); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true), NativeCache(&other)); err != ErrNativeCacheMismatch {
+			t.Errorf("features %q: NewVMWithOptions() error = %v, want %v", features, err, ErrNativeCacheMismatch)
+		}
+	}
+}
+
+func TestNativeCompileAfterDroppedCall(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	m := wasm.NewModule()
+	m.Start = nil
+	sig := wasm.FunctionSig{
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+	}
+	m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+	m.Function = &wasm.SectionFunctions{Types: []uint32{0, 0}}
+	bodies := []wasm.FunctionBody{
+		// get_local 0; get_local 0; call 1; drop; i64.const 3; i64.mul
+		{Module: m, Code: []byte{0x20, 0x00, 0x20, 0x00, 0x10, 0x01, 0x1a, 0x42, 0x03, 0x7e}},
+		// get_local 0; i64.const 1; i64.add
+		{Module: m, Code: []byte{0x20, 0x00, 0x42, 0x01, 0x7c}},
+	}
+	m.Code = &wasm.SectionCode{Bodies: bodies}
+	m.FunctionIndexSpace = []wasm.Function{
+		{Sig: &sig, Body: &bodies[0]},
+		{Sig: &sig, Body: &bodies[1]},
+	}
+
+	vm, err := NewVMWithOptions(m, EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+
+	// The block after the call begins with the drop of its result.
+	blocks := vm.NativeBlocks(0)
+	if len(blocks) != 1 {
+		t.Fatalf("len(NativeBlocks(0)) = %d, want 1: %q", len(blocks), vm.ExplainNative(0))
+	}
+	fn := vm.funcs[0].(compiledFunction)
+	if got, want := fn.codeMeta.Instructions[blocks[0].StartInstruction].Op, ops.Drop; got != want {
+		t.Errorf("block begins with op %#x, want drop (%#x)", got, want)
+	}
+
+	for _, arg := range []uint64{0, 5, 1 << 40} {
+		out, err := vm.ExecCode(0, arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.(uint64), arg*3; got != want {
+			t.Errorf("f(%d) = %d, want %d", arg, got, want)
+		}
+	}
+}
+
+func TestNativeCompileBeforeCall(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	m := wasm.NewModule()
+	m.Start = nil
+	sig := wasm.FunctionSig{
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+	}
+	m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+	m.Function = &wasm.SectionFunctions{Types: []uint32{0, 0}}
+	bodies := []wasm.FunctionBody{
+		// get_local 0; i64.const 3; i64.mul; call 1
+		{Module: m, Code: []byte{0x20, 0x00, 0x42, 0x03, 0x7e, 0x10, 0x01}},
+		// get_local 0; i64.const 1; i64.add
+		{Module: m, Code: []byte{0x20, 0x00, 0x42, 0x01, 0x7c}},
+	}
+	m.Code = &wasm.SectionCode{Bodies: bodies}
+	m.FunctionIndexSpace = []wasm.Function{
+		{Sig: &sig, Body: &bodies[0]},
+		{Sig: &sig, Body: &bodies[1]},
+	}
+
+	vm, err := NewVMWithOptions(m, EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+
+	blocks := vm.NativeBlocks(0)
+	if len(blocks) != 1 {
+		t.Fatalf("len(NativeBlocks(0)) = %d, want 1", len(blocks))
+	}
+	fn := vm.funcs[0].(compiledFunction)
+	_, upper := blocks[0].Bounds()
+	if got, want := fn.code[upper], ops.Call; got != want {
+		t.Errorf("fn.code[%d] = %#x, want the call (%#x) left to the interpreter", upper, got, want)
+	}
+
+	for _, arg := range []uint64{0, 5, 1 << 40} {
+		out, err := vm.ExecCode(0, arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.(uint64), arg*3+1; got != want {
+			t.Errorf("f(%d) = %d, want %d", arg, got, want)
+		}
+	}
+}
+
+func TestExplainNative(t *testing.T) {
+	vm := &VM{
+		funcs: []function{
+			goFunction{},
+			compiledFunction{},
+		},
+	}
+	if got, want := vm.ExplainNative(0), []string{"function is a host function"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ExplainNative(0) = %q, want %q", got, want)
+	}
+	if got, want := vm.ExplainNative(2), []string{"no function at index 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ExplainNative(2) = %q, want %q", got, want)
+	}
+	if got := vm.ExplainNative(1); len(got) != 1 || !strings.Contains(got[0], "not enabled") {
+		t.Errorf("ExplainNative(1) = %q, want native compilation reported as not enabled", got)
+	}
+
+	vm.nativeBackend = fakeNativeCompiler(t)
+	if err := vm.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+	if got, want := vm.ExplainNative(1), []string{"no supported-opcode runs found"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ExplainNative(1) = %q, want %q", got, want)
+	}
+}
+
+func TestNativeFloatSignOps(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	negZero := math.Float64bits(math.Copysign(0, -1))
+	testCases := []struct {
+		Name string
+		Op   byte
+		Type wasm.ValueType
+		Args [2]uint64
+	}{
+		{"f64.copysign(3, -1)", ops.F64Copysign, wasm.ValueTypeF64, [2]uint64{math.Float64bits(3), math.Float64bits(-1)}},
+		{"f64.copysign(-3, 0)", ops.F64Copysign, wasm.ValueTypeF64, [2]uint64{math.Float64bits(-3), 0}},
+		{"f64.copysign(2, -0)", ops.F64Copysign, wasm.ValueTypeF64, [2]uint64{math.Float64bits(2), negZero}},
+		{"f64.copysign(-0, 1)", ops.F64Copysign, wasm.ValueTypeF64, [2]uint64{negZero, math.Float64bits(1)}},
+		{"f64.copysign(NaN, -1)", ops.F64Copysign, wasm.ValueTypeF64, [2]uint64{0x7ff0000000000001, math.Float64bits(-1)}},
+		{"f32.copysign(3, -1)", ops.F32Copysign, wasm.ValueTypeF32, [2]uint64{uint64(math.Float32bits(3)), uint64(math.Float32bits(-1))}},
+		{"f32.copysign(2, -0)", ops.F32Copysign, wasm.ValueTypeF32, [2]uint64{uint64(math.Float32bits(2)), 0x80000000}},
+		{"f32.copysign(NaN, -0)", ops.F32Copysign, wasm.ValueTypeF32, [2]uint64{0x7f800001, 0x80000000}},
+		{"f64.abs(-0)", ops.F64Abs, wasm.ValueTypeF64, [2]uint64{0, negZero}},
+		{"f64.abs(-NaN)", ops.F64Abs, wasm.ValueTypeF64, [2]uint64{0, 0xfff0000000000001}},
+		{"f32.abs(-3)", ops.F32Abs, wasm.ValueTypeF32, [2]uint64{0, uint64(math.Float32bits(-3))}},
+		{"f32.abs(-NaN)", ops.F32Abs, wasm.ValueTypeF32, [2]uint64{0, 0xff800001}},
+	}
+
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			op, _ := ops.New(tc.Op)
+			checkNativeAgainstInterpreter(t, []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: op},
+			}, tc.Type, tc.Args)
+		})
+	}
+}
+
+// checkNativeAgainstInterpreter compiles instrs as the body of a function
+// of two locals of type typ, and checks calling it with args leaves the
+// same stack whether it is compiled into native code or interpreted. It
+// returns the stack left by the native code.
+func checkNativeAgainstInterpreter(t *testing.T, instrs []disasm.Instr, typ wasm.ValueType, args [2]uint64) []uint64 {
+	t.Helper()
+	newVM := func() *VM {
+		code, meta := compile.Compile(instrs)
+		meta.LocalTypes = []wasm.ValueType{typ, typ}
+		vm := &VM{funcs: []function{compiledFunction{
+			returns:        true,
+			args:           2,
+			totalLocalVars: 2,
+			maxDepth:       len(instrs),
+			code:           code,
+			codeMeta:       meta,
+		}}}
+		vm.newFuncTable()
+		vm.ctx.stack = append([]uint64(nil), args[:]...)
+		return vm
+	}
+
+	interp := newVM()
+	interp.funcs[0].call(interp, 0)
+
+	native := newVM()
+	_, native.nativeBackend = nativeBackend()
+	if err := native.tryNativeCompile(); err != nil {
+		t.Fatalf("tryNativeCompile() failed: %v", err)
+	}
+	if len(native.NativeBlocks(0)) != 1 {
+		t.Fatalf("not compiled: %q", native.ExplainNative(0))
+	}
+	native.funcs[0].call(native, 0)
+
+	if got, want := native.ctx.stack, interp.ctx.stack; !reflect.DeepEqual(got, want) {
+		t.Errorf("native stack = %#x, interpreter stack = %#x", got, want)
+	}
+	return native.ctx.stack
+}
+
+func TestNativeConstAddrRMW(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	i32Const, _ := ops.New(ops.I32Const)
+	tcs := []struct {
+		Name                    string
+		Const, Load, Add, Store byte
+		Increment               interface{}
+		MemSize                 int
+		WantTrap                bool
+	}{
+		{Name: "i32", Const: ops.I32Const, Load: ops.I32Load, Add: ops.I32Add, Store: ops.I32Store, Increment: int32(-3), MemSize: 32},
+		{Name: "i64", Const: ops.I64Const, Load: ops.I64Load, Add: ops.I64Add, Store: ops.I64Store, Increment: int64(1 << 40), MemSize: 32},
+		{Name: "out of bounds", Const: ops.I32Const, Load: ops.I32Load, Add: ops.I32Add, Store: ops.I32Store, Increment: int32(1), MemSize: 12, WantTrap: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			constInst, _ := ops.New(tc.Const)
+			loadInst, _ := ops.New(tc.Load)
+			addInst, _ := ops.New(tc.Add)
+			storeInst, _ := ops.New(tc.Store)
+			instrs := []disasm.Instr{
+				{Op: i32Const, Immediates: []interface{}{int32(8)}},
+				{Op: i32Const, Immediates: []interface{}{int32(8)}},
+				{Op: loadInst, Immediates: []interface{}{uint32(2), uint32(4)}},
+				{Op: constInst, Immediates: []interface{}{tc.Increment}},
+				{Op: addInst},
+				{Op: storeInst, Immediates: []interface{}{uint32(2), uint32(4)}},
+			}
+			newVM := func() *VM {
+				code, meta := compile.Compile(instrs)
+				vm := &VM{funcs: []function{compiledFunction{
+					maxDepth: len(instrs),
+					code:     code,
+					codeMeta: meta,
+				}}}
+				vm.newFuncTable()
+				vm.memory = make([]byte, tc.MemSize)
+				for i := range vm.memory {
+					vm.memory[i] = byte(0xf0 + i)
+				}
+				return vm
+			}
+			run := func(vm *VM) (trap interface{}) {
+				defer func() {
+					trap = recover()
+				}()
+				vm.funcs[0].call(vm, 0)
+				return nil
+			}
+
+			interp := newVM()
+			interpTrap := run(interp)
+
+			native := newVM()
+			_, native.nativeBackend = nativeBackend()
+			if err := native.tryNativeCompile(); err != nil {
+				t.Fatalf("tryNativeCompile() failed: %v", err)
+			}
+			if len(native.NativeBlocks(0)) != 1 {
+				t.Fatalf("not compiled: %q", native.ExplainNative(0))
+			}
+			nativeTrap := run(native)
+
+			if nativeTrap != interpTrap {
+				t.Errorf("native trap = %v, interpreter trap = %v", nativeTrap, interpTrap)
+			}
+			if tc.WantTrap && nativeTrap != ErrOutOfBoundsMemoryAccess {
+				t.Errorf("native trap = %v, want %v", nativeTrap, ErrOutOfBoundsMemoryAccess)
+			}
+			if !bytes.Equal(native.memory, interp.memory) {
+				t.Errorf("native memory = %#x, interpreter memory = %#x", native.memory, interp.memory)
+			}
+		})
+	}
+}
+
+func TestNativeSelect(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	i32Const, _ := ops.New(ops.I32Const)
+	selectInst, _ := ops.New(ops.Select)
+	f64Add, _ := ops.New(ops.F64Add)
+	i64Add, _ := ops.New(ops.I64Add)
+
+	for _, cond := range []int32{0, 1, -1} {
+		t.Run(fmt.Sprintf("i64/%d", cond), func(t *testing.T) {
+			// select(a+b, b, cond)
+			stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: i64Add},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: i32Const, Immediates: []interface{}{cond}},
+				{Op: selectInst},
+			}, wasm.ValueTypeI64, [2]uint64{40, 2})
+			want := uint64(2)
+			if cond != 0 {
+				want = 42
+			}
+			if len(stack) != 1 || stack[0] != want {
+				t.Errorf("stack = %v, want [%d]", stack, want)
+			}
+		})
+		t.Run(fmt.Sprintf("f64/%d", cond), func(t *testing.T) {
+			stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: f64Add},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: i32Const, Immediates: []interface{}{cond}},
+				{Op: selectInst},
+			}, wasm.ValueTypeF64, [2]uint64{math.Float64bits(1.5), math.Float64bits(-0.25)})
+			want := -0.25
+			if cond != 0 {
+				want = 1.25
+			}
+			if len(stack) != 1 || math.Float64frombits(stack[0]) != want {
+				t.Errorf("stack = %v, want [%v]", stack, want)
+			}
+		})
+	}
+}
+
+func TestNativeConstantPropagation(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	constInst, _ := ops.New(ops.I64Const)
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	setLocalInst, _ := ops.New(ops.SetLocal)
+	mulInst, _ := ops.New(ops.I64Mul)
+
+	stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(5)}},
+		{Op: setLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: mulInst},
+	}, wasm.ValueTypeI64, [2]uint64{7, 11})
+	if len(stack) != 1 || stack[0] != 15 {
+		t.Errorf("stack = %v, want [15]", stack)
+	}
+
+	// Overwriting the local with an unknown value stops propagation.
+	stack = checkNativeAgainstInterpreter(t, []disasm.Instr{
+		{Op: constInst, Immediates: []interface{}{int64(5)}},
+		{Op: setLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: setLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: mulInst},
+	}, wasm.ValueTypeI64, [2]uint64{7, 11})
+	if len(stack) != 1 || stack[0] != 33 {
+		t.Errorf("stack = %v, want [33]", stack)
+	}
+}
+
+func TestNativeMergeAcrossNop(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	mulInst, _ := ops.New(ops.I64Mul)
+	nopInst, _ := ops.New(ops.Nop)
+
+	// The scanner splits the function at the nop, and the two candidates
+	// are merged into the single native block which
+	// checkNativeAgainstInterpreter requires.
+	stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+		{Op: addInst},
+		{Op: nopInst},
+		{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+		{Op: constInst, Immediates: []interface{}{int64(3)}},
+		{Op: mulInst},
+		{Op: addInst},
+	}, wasm.ValueTypeI64, [2]uint64{7, 11})
+	if len(stack) != 1 || stack[0] != 39 {
+		t.Errorf("stack = %v, want [39]", stack)
+	}
+}
+
+func TestNativeConvertUnsigned(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	values := []uint64{
+		0, 1, 0xffffffff, 0x80000000, 0xdeadbeefffffffff,
+		1<<53 + 1, 0x7fffffffffffffff, 0x8000000000000000,
+		// The low bit decides the rounding of these once halved.
+		0x8000000000000401, 0x8000000000000400, 0x8000008000000001,
+		0xfffffffffffffbff, 0xFFFFFFFFFFFFFFFF,
+	}
+	for _, code := range []byte{ops.F32ConvertUI32, ops.F32ConvertUI64, ops.F64ConvertUI32, ops.F64ConvertUI64} {
+		op, _ := ops.New(code)
+		for _, v := range values {
+			t.Run(fmt.Sprintf("%s(%#x)", op.Name, v), func(t *testing.T) {
+				stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+					{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+					{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+					{Op: op},
+				}, wasm.ValueTypeI64, [2]uint64{v, 0})
+				if code == ops.F64ConvertUI64 && len(stack) == 2 {
+					if got, want := math.Float64frombits(stack[1]), float64(v); got != want {
+						t.Errorf("result = %v, want %v", got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestNativeFloatRounding(t *testing.T) {
+	if runtime.GOARCH != "amd64" || runtime.GOOS != "linux" {
+		t.SkipNow()
+	}
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	b := &compile.AMD64Backend{}
+	var hasRounding bool
+	for _, op := range b.SupportedOpcodes() {
+		hasRounding = hasRounding || op == ops.F64Nearest
+	}
+	if !hasRounding {
+		t.Skip("CPU does not support SSE4.1")
+	}
+
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	values := []float64{2.5, -2.5, 3.5, 0.5, -0.5, 1.25, -1.75, math.Copysign(0, -1), 1 << 53, math.Inf(-1), math.NaN()}
+	for _, code := range []byte{ops.F64Ceil, ops.F64Floor, ops.F64Trunc, ops.F64Nearest} {
+		op, _ := ops.New(code)
+		for _, v := range values {
+			t.Run(fmt.Sprintf("%s(%v)", op.Name, v), func(t *testing.T) {
+				checkNativeAgainstInterpreter(t, []disasm.Instr{
+					{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+					{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+					{Op: op},
+				}, wasm.ValueTypeF64, [2]uint64{0, math.Float64bits(v)})
+			})
+		}
+	}
+}
+
+func TestNativeMatchesInterpreter(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (a + b) * c, over i64 parameters.
+	newModule := func() *wasm.Module {
+		m := wasm.NewModule()
+		m.Start = nil
+		sig := wasm.FunctionSig{
+			ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64, wasm.ValueTypeI64},
+			ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+		}
+		m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+		m.Function = &wasm.SectionFunctions{Types: []uint32{0}}
+		body := wasm.FunctionBody{
+			Module: m,
+			// get_local 0; get_local 1; i64.add; get_local 2; i64.mul
+			Code: []byte{0x20, 0x00, 0x20, 0x01, 0x7c, 0x20, 0x02, 0x7e},
+		}
+		m.Code = &wasm.SectionCode{Bodies: []wasm.FunctionBody{body}}
+		m.FunctionIndexSpace = []wasm.Function{{Sig: &sig, Body: &body}}
+		return m
+	}
+
+	native, err := NewVMWithOptions(newModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer native.Close()
+	if len(native.NativeBlocks(0)) == 0 {
+		t.Fatalf("function was not compiled: %q", native.ExplainNative(0))
+	}
+	interp, err := NewVMWithOptions(newModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := [][3]uint64{
+		{1, 2, 3},
+		{0, 0, 0},
+		{1<<63 - 1, 1, 2},
+		{1 << 63, 1 << 63, 5},
+		{^uint64(0), 7, ^uint64(0)},
+	}
+	for _, a := range args {
+		got, err := native.ExecCode(0, a[0], a[1], a[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := interp.ExecCode(0, a[0], a[1], a[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("(%d + %d) * %d = %v natively, %v interpreted", a[0], a[1], a[2], got, want)
+		}
+	}
+}
+
+func TestNativeMemoryBytes(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	m := wasm.NewModule()
+	m.Start = nil
+	sig := wasm.FunctionSig{
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+	}
+	m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+	m.Function = &wasm.SectionFunctions{Types: []uint32{0, 0, 0}}
+	bodies := []wasm.FunctionBody{
+		// get_local 0; i64.const 1; i64.add
+		{Module: m, Code: []byte{0x20, 0x00, 0x42, 0x01, 0x7c}},
+		// get_local 0; get_local 0; i64.mul
+		{Module: m, Code: []byte{0x20, 0x00, 0x20, 0x00, 0x7e}},
+		// get_local 0; get_local 0; i64.add; get_local 0; i64.mul
+		{Module: m, Code: []byte{0x20, 0x00, 0x20, 0x00, 0x7c, 0x20, 0x00, 0x7e}},
+	}
+	m.Code = &wasm.SectionCode{Bodies: bodies}
+	for i := range bodies {
+		m.FunctionIndexSpace = append(m.FunctionIndexSpace, wasm.Function{Sig: &sig, Body: &bodies[i]})
+	}
+
+	interp, err := NewVMWithOptions(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := interp.NativeMemoryBytes(); got != 0 {
+		t.Errorf("NativeMemoryBytes() = %d without native compilation, want 0", got)
+	}
+
+	vm, err := NewVMWithOptions(m, EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	var blocks, size uint64
+	for i := range bodies {
+		fn := vm.funcs[i].(compiledFunction)
+		if len(fn.asm) == 0 {
+			t.Fatalf("function %d was not compiled: %q", i, vm.ExplainNative(int64(i)))
+		}
+		for _, block := range fn.asm {
+			blocks++
+			size += uint64(len(block.machineCode))
+		}
+	}
+	// Each block is padded to the allocation alignment of 128 bytes.
+	if got := vm.NativeMemoryBytes(); got < size || got >= size+128*blocks {
+		t.Errorf("NativeMemoryBytes() = %d, want %d bytes of code in %d blocks, plus alignment", got, size, blocks)
+	}
+}
+
+func TestNativeHugePages(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// Huge pages are used if the system has any reserved, and normal pages
+	// otherwise. Execution must work either way.
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true), NativeHugePages(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if len(vm.NativeBlocks(0)) != 1 {
+		t.Fatalf("function was not compiled: %q", vm.ExplainNative(0))
+	}
+	out, err := vm.ExecCode(0, uint64(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.(uint64), uint64(21); got != want {
+		t.Errorf("f(7) = %d, want %d", got, want)
+	}
+}
+
+func TestNativePrefault(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true), NativePrefault(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if len(vm.NativeBlocks(0)) != 1 {
+		t.Fatalf("function was not compiled: %q", vm.ExplainNative(0))
+	}
+	out, err := vm.ExecCode(0, uint64(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.(uint64), uint64(21); got != want {
+		t.Errorf("f(7) = %d, want %d", got, want)
+	}
+}
+
+func TestNativeDivideByZero(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// a / b, and a / 10, over i64 parameters.
+	newModule := func() *wasm.Module {
+		m := wasm.NewModule()
+		m.Start = nil
+		sig := wasm.FunctionSig{
+			ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64},
+			ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+		}
+		m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+		m.Function = &wasm.SectionFunctions{Types: []uint32{0, 0}}
+		div := wasm.FunctionBody{
+			Module: m,
+			// get_local 0; get_local 1; i64.div_u
+			Code: []byte{0x20, 0x00, 0x20, 0x01, 0x80},
+		}
+		divConst := wasm.FunctionBody{
+			Module: m,
+			// get_local 0; i64.const 10; i64.div_u
+			Code: []byte{0x20, 0x00, 0x42, 0x0a, 0x80},
+		}
+		m.Code = &wasm.SectionCode{Bodies: []wasm.FunctionBody{div, divConst}}
+		m.FunctionIndexSpace = []wasm.Function{{Sig: &sig, Body: &div}, {Sig: &sig, Body: &divConst}}
+		return m
+	}
+
+	native, err := NewVMWithOptions(newModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer native.Close()
+	native.RecoverPanic = true
+	for i := int64(0); i < 2; i++ {
+		if len(native.NativeBlocks(i)) == 0 {
+			t.Fatalf("function %d was not compiled: %q", i, native.ExplainNative(i))
+		}
+	}
+	interp, err := NewVMWithOptions(newModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp.RecoverPanic = true
+
+	for _, tc := range []struct {
+		fn   int64
+		args [2]uint64
+	}{
+		{0, [2]uint64{100, 7}},
+		{0, [2]uint64{5, 0}},
+		{1, [2]uint64{^uint64(0), 0}},
+		{1, [2]uint64{99, 0}},
+	} {
+		got, gotErr := native.ExecCode(tc.fn, tc.args[0], tc.args[1])
+		want, wantErr := interp.ExecCode(tc.fn, tc.args[0], tc.args[1])
+		if gotErr != wantErr {
+			t.Errorf("function %d%v: error = %v natively, %v interpreted", tc.fn, tc.args, gotErr, wantErr)
+		}
+		if got != want {
+			t.Errorf("function %d%v = %v natively, %v interpreted", tc.fn, tc.args, got, want)
+		}
+	}
+}
+
+func TestNativeDivI32(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// a op b over i32 parameters, for each of i32.div_s, i32.div_u,
+	// i32.rem_s & i32.rem_u.
+	opcodes := []byte{ops.I32DivS, ops.I32DivU, ops.I32RemS, ops.I32RemU}
+	newModule := func() *wasm.Module {
+		m := wasm.NewModule()
+		m.Start = nil
+		sig := wasm.FunctionSig{
+			ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32},
+			ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+		}
+		m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+		m.Function = &wasm.SectionFunctions{}
+		m.Code = &wasm.SectionCode{}
+		for _, op := range opcodes {
+			body := wasm.FunctionBody{
+				Module: m,
+				Code:   []byte{0x20, 0x00, 0x20, 0x01, op},
+			}
+			m.Function.Types = append(m.Function.Types, 0)
+			m.Code.Bodies = append(m.Code.Bodies, body)
+		}
+		for i := range m.Code.Bodies {
+			m.FunctionIndexSpace = append(m.FunctionIndexSpace, wasm.Function{Sig: &sig, Body: &m.Code.Bodies[i]})
+		}
+		return m
+	}
+
+	native, err := NewVMWithOptions(newModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer native.Close()
+	native.RecoverPanic = true
+	for i := range opcodes {
+		if len(native.NativeBlocks(int64(i))) == 0 {
+			t.Fatalf("function %d was not compiled: %q", i, native.ExplainNative(int64(i)))
+		}
+	}
+	interp, err := NewVMWithOptions(newModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	interp.RecoverPanic = true
+
+	minInt32 := uint64(1 << 31)
+	minusOne := uint64(math.MaxUint32)
+	for i := range opcodes {
+		for _, args := range [][2]uint64{{7, 2}, {minInt32, 2}, {minInt32, minusOne}, {5, minusOne}, {1, 0}} {
+			got, gotErr := native.ExecCode(int64(i), args[0], args[1])
+			want, wantErr := interp.ExecCode(int64(i), args[0], args[1])
+			if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+				t.Errorf("function %d%#x: error = %v natively, %v interpreted", i, args, gotErr, wantErr)
+			}
+			if got != want {
+				t.Errorf("function %d%#x = %v natively, %v interpreted", i, args, got, want)
+			}
+		}
+	}
+
+	// math.MinInt32 / -1 overflows.
+	if _, err := native.ExecCode(0, minInt32, minusOne); err != ErrIntegerOverflow {
+		t.Errorf("i32.div_s(math.MinInt32, -1) error = %v, want %v", err, ErrIntegerOverflow)
+	}
+}
+
+func TestNativeStackGuard(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true), NativeStackGuard(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	fn := vm.funcs[0].(compiledFunction)
+	if len(fn.asm) != 1 {
+		t.Fatalf("function was not compiled: %q", vm.ExplainNative(0))
+	}
+
+	// Pretend the stack was not grown before entering the block, which
+	// pushes a value onto a stack with no room for it.
+	block := fn.asm[0]
+	block.stackGrowth = 0
+	backing := []uint64{0xdeadbeef}
+	vm.ctx.asm = []asmBlock{block}
+	vm.ctx.stack = backing[:0:0]
+	vm.ctx.locals = []uint64{7}
+
+	defer func() {
+		if r := recover(); r != ErrNativeStackOverflow {
+			t.Errorf("recover() = %v, want %v", r, ErrNativeStackOverflow)
+		}
+		if got, want := backing[0], uint64(0xdeadbeef); got != want {
+			t.Errorf("value past the end of the stack = %#x, want %#x", got, want)
+		}
+	}()
+	vm.nativeCodeInvocation(0)
+}
+
+func TestNativeLocalsGuard(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true), NativeLocalsGuard(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	fn := vm.funcs[0].(compiledFunction)
+	if len(fn.asm) != 1 {
+		t.Fatalf("function was not compiled: %q", vm.ExplainNative(0))
+	}
+
+	// Pretend the function has no locals, so the block reads its
+	// parameter out of range.
+	vm.ctx.asm = fn.asm
+	vm.ctx.stack = make([]uint64, 0, 4)
+	vm.ctx.locals = []uint64{7}[:0]
+
+	defer func() {
+		if r := recover(); r != ErrNativeLocalOutOfRange {
+			t.Errorf("recover() = %v, want %v", r, ErrNativeLocalOutOfRange)
+		}
+	}()
+	vm.nativeCodeInvocation(0)
+}
+
+func TestNativeFusedMulAdd(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	m := wasm.NewModule()
+	m.Start = nil
+	sig := wasm.FunctionSig{
+		Form:        0,
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeF64, wasm.ValueTypeF64, wasm.ValueTypeF64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeF64},
+	}
+	m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+	m.Function = &wasm.SectionFunctions{Types: []uint32{0}}
+	body := wasm.FunctionBody{
+		Module: m,
+		// c + a*b
+		Code: []byte{0x20, 0x02, 0x20, 0x00, 0x20, 0x01, 0xa2, 0xa0},
+	}
+	m.Code = &wasm.SectionCode{Bodies: []wasm.FunctionBody{body}}
+	m.FunctionIndexSpace = []wasm.Function{{Sig: &sig, Body: &body}}
+
+	// The product rounds to 1 when computed separately, so only a fused
+	// multiply-add sees the -2^-60 left after the addition.
+	a, b, c := 1+math.Ldexp(1, -30), 1-math.Ldexp(1, -30), -1.0
+	args := []uint64{math.Float64bits(a), math.Float64bits(b), math.Float64bits(c)}
+
+	for _, enabled := range []bool{false, true} {
+		vm, err := NewVMWithOptions(m, EnableAOT(true), NativeFusedMulAdd(enabled))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vm.Close()
+		if got, want := len(vm.NativeBlocks(0)), 1; got != want {
+			t.Fatalf("len(NativeBlocks(0)) = %d, want %d: %q", got, want, vm.ExplainNative(0))
+		}
+		got, err := vm.ExecCode(0, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without the option, native code must round the product as the
+		// interpreter does.
+		want := 0.0
+		if enabled && cpu.X86.HasFMA {
+			want = math.FMA(a, b, c)
+		}
+		if got != want {
+			t.Errorf("enabled = %v: ExecCode() = %v, want %v", enabled, got, want)
+		}
+	}
+}
+
+// TestNativeImportedGlobal checks native code consuming the value of an
+// imported global agrees with the interpreter. Imported globals are
+// immutable, and are evaluated into vm.globals alongside the module's own
+// globals, so they are read like any other global.
+func TestNativeImportedGlobal(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	env := []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x06, 0x06, 0x01, 0x7e, 0x00, 0x42, 0x28, 0x0b, // (global i64 (i64.const 40))
+		0x07, 0x05, 0x01, 0x01, 0x67, 0x03, 0x00, // (export "g" (global 0))
+	}
+	main := []byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x06, 0x01, 0x60, 0x01, 0x7e, 0x01, 0x7e, // (type (func (param i64) (result i64)))
+		0x02, 0x0a, 0x01, 0x03, 0x65, 0x6e, 0x76, 0x01, 0x67, 0x03, 0x7e, 0x00, // (import "env" "g" (global i64))
+		0x03, 0x02, 0x01, 0x00,
+		// get_global 0; get_local 0; i64.add; i64.const 2; i64.add
+		0x0a, 0x0c, 0x01, 0x0a, 0x00, 0x23, 0x00, 0x20, 0x00, 0x7c, 0x42, 0x02, 0x7c, 0x0b,
+	}
+	m, err := wasm.ReadModule(bytes.NewReader(main), func(name string) (*wasm.Module, error) {
+		if name != "env" {
+			return nil, fmt.Errorf("unexpected import of module %q", name)
+		}
+		return wasm.ReadModule(bytes.NewReader(env), nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []interface{}
+	for _, aot := range []bool{false, true} {
+		vm, err := NewVMWithOptions(m, EnableAOT(aot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vm.Close()
+		if got, want := vm.globals, []uint64{40}; !reflect.DeepEqual(got, want) {
+			t.Errorf("aot = %v: vm.globals = %v, want %v", aot, got, want)
+		}
+		if n := len(vm.NativeBlocks(0)); aot && n != 1 {
+			t.Fatalf("len(NativeBlocks(0)) = %d, want 1: %q", n, vm.ExplainNative(0))
+		}
+		res, err := vm.ExecCode(0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, res)
+	}
+	if results[0] != uint64(142) || results[1] != results[0] {
+		t.Errorf("interpreter returned %v & native code %v, want 142", results[0], results[1])
+	}
+}
+
+func TestNativeScanWindow(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (x+3)*5, twice, split by the unsupported i64.clz, and added.
+	run := []byte{0x20, 0x00, 0x42, 0x03, 0x7c, 0x42, 0x05, 0x7e}
+	body := append(append(append(append([]byte(nil), run...), 0x79), run...), 0x7c)
+	m := multiFuncModule(body)
+	for _, tc := range []struct {
+		window, blocks int
+	}{
+		{0, 2},
+		{5, 1},
+	} {
+		vm, err := NewVMWithOptions(m, EnableAOT(true), NativeScanWindow(tc.window))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vm.Close()
+		if got := len(vm.NativeBlocks(0)); got != tc.blocks {
+			t.Errorf("window %d: len(NativeBlocks(0)) = %d, want %d: %q", tc.window, got, tc.blocks, vm.ExplainNative(0))
+		}
+		// clz(25) + 25
+		if res, err := vm.ExecCode(0, 2); err != nil {
+			t.Fatal(err)
+		} else if res != uint64(84) {
+			t.Errorf("window %d: ExecCode() = %v, want 84", tc.window, res)
+		}
+	}
+}
+
+func TestNativeCostModel(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if got, want := len(vm.NativeBlocks(0)), 1; got != want {
+		t.Fatalf("len(NativeBlocks(0)) = %d, want %d: %q", got, want, vm.ExplainNative(0))
+	}
+
+	model := DefaultCostModel()
+	model.NativeEntry *= 100
+	vm, err = NewVMWithOptions(nativeCacheModule(), EnableAOT(true), NativeCostModel(model))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if got, want := len(vm.NativeBlocks(0)), 0; got != want {
+		t.Errorf("with NativeEntry = %d: len(NativeBlocks(0)) = %d, want %d", model.NativeEntry, got, want)
+	}
+}
+
+func TestNativeBreakpoints(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// The blocks are never entered: without a debugger attached, the
+	// breakpoint would crash the test.
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true), NativeBreakpoints(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	fn := vm.funcs[0].(compiledFunction)
+	if len(fn.asm) != 1 {
+		t.Fatalf("function was not compiled: %q", vm.ExplainNative(0))
+	}
+	if got, want := fn.asm[0].machineCode[0], byte(0xcc); got != want {
+		t.Errorf("first byte = %#x, want %#x (INT3)", got, want)
+	}
+}
+
+func TestNativeProfiling(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true), NativeProfiling(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if len(vm.NativeBlocks(0)) != 1 {
+		t.Fatalf("function was not compiled: %q", vm.ExplainNative(0))
+	}
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		if _, err := vm.ExecCode(0, uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := vm.NativeBlockInvocations(0), []uint64{n}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NativeBlockInvocations(0) = %v, want %v", got, want)
+	}
+}
+
+func TestRecompileFunction(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	vm, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if len(vm.NativeBlocks(0)) != 1 {
+		t.Fatalf("function was not compiled: %q", vm.ExplainNative(0))
+	}
+	call := func(x uint64) uint64 {
+		t.Helper()
+		out, err := vm.ExecCode(0, x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.(uint64)
+	}
+	if got, want := call(7), uint64(21); got != want {
+		t.Errorf("f(7) = %d, want %d", got, want)
+	}
+
+	fn := vm.funcs[0].(compiledFunction)
+	original := append([]byte(nil), fn.code...)
+	if err := vm.invalidateFunction(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(vm.NativeBlocks(0)); got != 0 {
+		t.Errorf("len(NativeBlocks(0)) = %d after invalidateFunction, want 0", got)
+	}
+	fn = vm.funcs[0].(compiledFunction)
+	if bytes.Equal(fn.code, original) {
+		t.Error("bytecode was not restored by invalidateFunction")
+	}
+	if got, want := call(7), uint64(21); got != want {
+		t.Errorf("f(7) = %d after invalidateFunction, want %d", got, want)
+	}
+
+	// Change the constant from 3 to 5 in place, keeping the metadata valid.
+	var patched bool
+	for _, inst := range fn.codeMeta.Instructions {
+		if inst.Op == ops.I64Const {
+			endianess.PutUint64(fn.code[inst.Start+1:], 5)
+			patched = true
+		}
+	}
+	if !patched {
+		t.Fatal("i64.const missing from the bytecode")
+	}
+	if err := vm.recompileFunction(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(vm.NativeBlocks(0)); got != 1 {
+		t.Fatalf("len(NativeBlocks(0)) = %d after recompileFunction, want 1", got)
+	}
+	if got, want := call(7), uint64(35); got != want {
+		t.Errorf("f(7) = %d after recompileFunction, want %d", got, want)
+	}
+
+	if err := vm.invalidateFunction(1); err == nil {
+		t.Error("invalidateFunction(1) succeeded for a function which does not exist")
+	}
+}
+
+func TestNativeWrapI64(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	wrapInst, _ := ops.New(ops.I32WrapI64)
+	mulInst, _ := ops.New(ops.I32Mul)
+	for _, args := range [][2]uint64{
+		{0x1000000ff, 1},
+		{0xffffffff00000001, 0x100000003},
+		{1 << 32, 7},
+	} {
+		checkNativeAgainstInterpreter(t, []disasm.Instr{
+			{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+			{Op: wrapInst},
+			{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+			{Op: wrapInst},
+			{Op: mulInst},
+		}, wasm.ValueTypeI64, args)
+	}
+}
+
+func TestNativeCompileWorkers(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// Functions computing (x + i) * (i + 3), for i up to 31.
+	newModule := func() *wasm.Module {
+		m := wasm.NewModule()
+		m.Start = nil
+		sig := wasm.FunctionSig{
+			ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+			ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+		}
+		m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+		m.Function = &wasm.SectionFunctions{}
+		m.Code = &wasm.SectionCode{}
+		for i := 0; i < 32; i++ {
+			m.Function.Types = append(m.Function.Types, 0)
+			m.Code.Bodies = append(m.Code.Bodies, wasm.FunctionBody{
+				Module: m,
+				// get_local 0; i64.const i; i64.add; i64.const i+3; i64.mul
+				Code: []byte{0x20, 0x00, 0x42, byte(i), 0x7c, 0x42, byte(i + 3), 0x7e},
+			})
+		}
+		for i := range m.Code.Bodies {
+			m.FunctionIndexSpace = append(m.FunctionIndexSpace, wasm.Function{Sig: &sig, Body: &m.Code.Bodies[i]})
+		}
+		return m
+	}
+
+	sequential, err := NewVMWithOptions(newModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sequential.Close()
+	parallel, err := NewVMWithOptions(newModule(), EnableAOT(true), NativeCompileWorkers(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parallel.Close()
+
+	for i := range sequential.funcs {
+		seq, par := sequential.funcs[i].(compiledFunction), parallel.funcs[i].(compiledFunction)
+		if len(seq.asm) == 0 {
+			t.Fatalf("function %d was not compiled: %q", i, sequential.ExplainNative(int64(i)))
+		}
+		if !bytes.Equal(seq.code, par.code) {
+			t.Errorf("function %d: bytecode differs", i)
+		}
+		if len(seq.asm) != len(par.asm) {
+			t.Fatalf("function %d: %d native blocks in parallel, want %d", i, len(par.asm), len(seq.asm))
+		}
+		for j := range seq.asm {
+			if !bytes.Equal(seq.asm[j].machineCode, par.asm[j].machineCode) {
+				t.Errorf("function %d: native block %d differs", i, j)
+			}
+		}
+		if got, want := parallel.ExplainNative(int64(i)), sequential.ExplainNative(int64(i)); !reflect.DeepEqual(got, want) {
+			t.Errorf("function %d: ExplainNative() = %q in parallel, want %q", i, got, want)
+		}
+
+		out, err := parallel.ExecCode(int64(i), uint64(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.(uint64), uint64((10+i)*(i+3)); got != want {
+			t.Errorf("function %d: f(10) = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestNativeAroundCallIndirect(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	newModule := func() *wasm.Module {
+		m := wasm.NewModule()
+		m.Start = nil
+		sig := wasm.FunctionSig{
+			ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+			ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+		}
+		m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+		m.Function = &wasm.SectionFunctions{Types: []uint32{0, 0}}
+		double := wasm.FunctionBody{
+			Module: m,
+			// get_local 0; i64.const 2; i64.mul
+			Code: []byte{0x20, 0x00, 0x42, 0x02, 0x7e},
+		}
+		body := wasm.FunctionBody{
+			Module: m,
+			// get_local 0; i64.const 3; i64.mul; i64.const 1; i64.add
+			// i32.const 0; call_indirect 0
+			// i64.const 5; i64.add; i64.const 7; i64.mul
+			Code: []byte{
+				0x20, 0x00, 0x42, 0x03, 0x7e, 0x42, 0x01, 0x7c,
+				0x41, 0x00, 0x11, 0x00, 0x00,
+				0x42, 0x05, 0x7c, 0x42, 0x07, 0x7e,
+			},
+		}
+		m.Code = &wasm.SectionCode{Bodies: []wasm.FunctionBody{double, body}}
+		m.FunctionIndexSpace = []wasm.Function{{Sig: &sig, Body: &double}, {Sig: &sig, Body: &body}}
+		m.TableIndexSpace = [][]uint32{{0}}
+		return m
+	}
+
+	vm, err := NewVMWithOptions(newModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	blocks := vm.NativeBlocks(1)
+	if len(blocks) != 2 {
+		t.Fatalf("len(NativeBlocks(1)) = %d, want 2: %q", len(blocks), vm.ExplainNative(1))
+	}
+	fn := vm.funcs[1].(compiledFunction)
+	var call compile.InstructionMetadata
+	for _, inst := range fn.codeMeta.Instructions {
+		if inst.Op == ops.CallIndirect {
+			call = inst
+		}
+	}
+	if _, end := blocks[0].Bounds(); end != call.Start {
+		t.Errorf("first block ends at %d, want %d (the call_indirect)", end, call.Start)
+	}
+	if begin, _ := blocks[1].Bounds(); begin != call.Start+call.Size {
+		t.Errorf("second block begins at %d, want %d (after the call_indirect)", begin, call.Start+call.Size)
+	}
+	if got, want := fn.asm[0].resumePC, call.Start; got != want {
+		t.Errorf("first block resumes at %d, want %d (the call_indirect)", got, want)
+	}
+
+	interp, err := NewVMWithOptions(newModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []uint64{0, 1, 10, 1 << 62} {
+		got, err := vm.ExecCode(1, x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := interp.ExecCode(1, x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want || got != ((x*3+1)*2+5)*7 {
+			t.Errorf("f(%d) = %v natively, %v interpreted, want %d", x, got, want, ((x*3+1)*2+5)*7)
+		}
+	}
+}
+
+func TestNativeReinterpret(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	testCases := []struct {
+		Name    string
+		Type    wasm.ValueType
+		ToInt   byte
+		ToFloat byte
+		Bits    uint64
+	}{
+		{"f64(pi)", wasm.ValueTypeF64, ops.I64ReinterpretF64, ops.F64ReinterpretI64, math.Float64bits(math.Pi)},
+		{"f64(-NaN)", wasm.ValueTypeF64, ops.I64ReinterpretF64, ops.F64ReinterpretI64, 0xfff0000000000123},
+		{"f32(-1.5)", wasm.ValueTypeF32, ops.I32ReinterpretF32, ops.F32ReinterpretI32, uint64(math.Float32bits(-1.5))},
+		{"f32(-NaN)", wasm.ValueTypeF32, ops.I32ReinterpretF32, ops.F32ReinterpretI32, 0xff800123},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			toInt, _ := ops.New(tc.ToInt)
+			toFloat, _ := ops.New(tc.ToFloat)
+			// Reinterpret local 0 from float to int, back, and to int
+			// again.
+			stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+				{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: toInt},
+				{Op: toFloat},
+				{Op: toInt},
+			}, tc.Type, [2]uint64{tc.Bits, 0})
+			if len(stack) != 1 || stack[0] != tc.Bits {
+				t.Errorf("stack = %#x, want [%#x]", stack, tc.Bits)
+			}
+		})
+	}
+}
+
+// spanAllScanner claims the whole of every function can be compiled.
+type spanAllScanner struct{}
+
+func (spanAllScanner) ScanFunc(bc []byte, meta *compile.BytecodeMetadata) ([]compile.CompilationCandidate, error) {
+	last := meta.Instructions[len(meta.Instructions)-1]
+	return []compile.CompilationCandidate{{
+		End:            last.Start + last.Size,
+		EndInstruction: len(meta.Instructions) - 1,
+		Metrics:        compile.Metrics{IntegerOps: len(meta.Instructions)},
+	}}, nil
+}
+
+func TestNativeRefusesCalls(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	m := wasm.NewModule()
+	m.Start = nil
+	sig := wasm.FunctionSig{
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+	}
+	m.Types = &wasm.SectionTypes{Entries: []wasm.FunctionSig{sig}}
+	m.Function = &wasm.SectionFunctions{Types: []uint32{0, 0}}
+	double := wasm.FunctionBody{
+		Module: m,
+		// get_local 0; i64.const 2; i64.mul
+		Code: []byte{0x20, 0x00, 0x42, 0x02, 0x7e},
+	}
+	body := wasm.FunctionBody{
+		Module: m,
+		// get_local 0; i64.const 1; i64.add; call 0; i64.const 3; i64.mul
+		Code: []byte{0x20, 0x00, 0x42, 0x01, 0x7c, 0x10, 0x00, 0x42, 0x03, 0x7e},
+	}
+	m.Code = &wasm.SectionCode{Bodies: []wasm.FunctionBody{double, body}}
+	m.FunctionIndexSpace = []wasm.Function{{Sig: &sig, Body: &double}, {Sig: &sig, Body: &body}}
+
+	vm, err := NewVMWithOptions(m, EnableAOT(true), NativeCompiler(spanAllScanner{}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if got := len(vm.NativeBlocks(1)); got != 0 {
+		t.Fatalf("len(NativeBlocks(1)) = %d, want 0 for a candidate spanning a call", got)
+	}
+	if notes := vm.ExplainNative(1); len(notes) != 1 || !strings.Contains(notes[0], "refused") {
+		t.Errorf("ExplainNative(1) = %q, want the candidate refused", notes)
+	}
+	if got := len(vm.NativeBlocks(0)); got != 1 {
+		t.Errorf("len(NativeBlocks(0)) = %d, want 1", got)
+	}
+
+	out, err := vm.ExecCode(1, uint64(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.(uint64), uint64(30); got != want {
+		t.Errorf("f(4) = %d, want %d", got, want)
+	}
+}
+
+func TestNativeAddLocalConst(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	addInst, _ := ops.New(ops.I64Add)
+	for _, c := range []int64{1, 0x7fffffff, 0x100000000, -1, math.MinInt32, math.MinInt32 - 1} {
+		for _, x := range []uint64{0, 41, 1<<63 - 1, ^uint64(0)} {
+			t.Run(fmt.Sprintf("%#x+%#x", x, c), func(t *testing.T) {
+				stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+					{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+					{Op: constInst, Immediates: []interface{}{c}},
+					{Op: addInst},
+				}, wasm.ValueTypeI64, [2]uint64{x, 0})
+				if want := x + uint64(c); len(stack) != 1 || stack[0] != want {
+					t.Errorf("stack = %#x, want [%#x]", stack, want)
+				}
+			})
+		}
+	}
+}
+
+func TestNativeConstMul(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	mulInst, _ := ops.New(ops.I64Mul)
+	// 8 is a shift, 3, 5 & 9 a LEAQ, and the rest an IMULQ.
+	for _, c := range []int64{8, 1, 1 << 62, math.MinInt64, 5, 3, 9, 7, 0, -1, 0x100000001} {
+		for _, x := range []uint64{0, 41, 1<<63 - 1, ^uint64(0)} {
+			t.Run(fmt.Sprintf("%#x*%#x", x, c), func(t *testing.T) {
+				stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+					{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+					{Op: constInst, Immediates: []interface{}{c}},
+					{Op: mulInst},
+				}, wasm.ValueTypeI64, [2]uint64{x, 0})
+				if want := x * uint64(c); len(stack) != 1 || stack[0] != want {
+					t.Errorf("stack = %#x, want [%#x]", stack, want)
+				}
+			})
+		}
+	}
+}
+
+func TestNativeCompileLazily(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// Functions 0 & 1 multiply their argument by 3, and function 2
+	// calls function 0.
+	m := multiFuncModule(
+		[]byte{0x20, 0x00, 0x42, 0x03, 0x7e},
+		[]byte{0x20, 0x00, 0x42, 0x03, 0x7e},
+		[]byte{0x20, 0x00, 0x10, 0x00},
+	)
+	vm, err := NewVMWithOptions(m, EnableAOT(true), NativeCompileLazily(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	for i := int64(0); i < 3; i++ {
+		if blocks := vm.NativeBlocks(i); len(blocks) != 0 {
+			t.Errorf("function %d was compiled before it was called", i)
+		}
+		if notes := vm.ExplainNative(i); len(notes) != 0 {
+			t.Errorf("ExplainNative(%d) = %q before the first call, want none", i, notes)
+		}
+	}
+
+	for n := 0; n < 2; n++ {
+		out, err := vm.ExecCode(2, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.(uint64), uint64(15); got != want {
+			t.Errorf("call %d: result = %d, want %d", n, got, want)
+		}
+		if got, want := len(vm.NativeBlocks(0)), 1; got != want {
+			t.Errorf("call %d: function 0 has %d native blocks, want %d: %q", n, got, want, vm.ExplainNative(0))
+		}
+		if blocks := vm.NativeBlocks(1); len(blocks) != 0 {
+			t.Errorf("call %d: function 1 was compiled but never called", n)
+		}
+	}
+	// Function 2 was called twice, but scanned once.
+	if got := vm.ExplainNative(2); len(got) != 1 {
+		t.Errorf("ExplainNative(2) = %q, want a single note", got)
+	}
+}
+
+func TestNativeCompareI64(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	orInst, _ := ops.New(ops.I64Or)
+	cmps := []struct {
+		op   byte
+		want func(a, b uint64) bool
+	}{
+		{ops.I64Eq, func(a, b uint64) bool { return a == b }},
+		{ops.I64Ne, func(a, b uint64) bool { return a != b }},
+		{ops.I64LtS, func(a, b uint64) bool { return int64(a) < int64(b) }},
+		{ops.I64LtU, func(a, b uint64) bool { return a < b }},
+		{ops.I64GtS, func(a, b uint64) bool { return int64(a) > int64(b) }},
+		{ops.I64GtU, func(a, b uint64) bool { return a > b }},
+		{ops.I64LeS, func(a, b uint64) bool { return int64(a) <= int64(b) }},
+		{ops.I64LeU, func(a, b uint64) bool { return a <= b }},
+		{ops.I64GeS, func(a, b uint64) bool { return int64(a) >= int64(b) }},
+		{ops.I64GeU, func(a, b uint64) bool { return a >= b }},
+	}
+	// Pairs which compare differently as signed & unsigned values,
+	// and equal values.
+	args := [][2]uint64{
+		{math.MaxUint64, 1},
+		{1, math.MaxUint64},
+		{1 << 63, 1<<63 - 1},
+		{1<<63 - 1, 1 << 63},
+		{1 << 63, 0},
+		{0, 1 << 63},
+		{math.MaxUint64, math.MaxUint64},
+		{1, 1},
+	}
+	for _, cmp := range cmps {
+		cmpInst, _ := ops.New(cmp.op)
+		for _, arg := range args {
+			t.Run(fmt.Sprintf("%#x %s %#x", arg[0], cmpInst.Name, arg[1]), func(t *testing.T) {
+				// The or gives the scanner enough arithmetic to compile.
+				stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+					{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+					{Op: constInst, Immediates: []interface{}{int64(0)}},
+					{Op: orInst},
+					{Op: getLocalInst, Immediates: []interface{}{uint32(1)}},
+					{Op: cmpInst},
+				}, wasm.ValueTypeI64, arg)
+				var want uint64
+				if cmp.want(arg[0], arg[1]) {
+					want = 1
+				}
+				if len(stack) != 1 || stack[0] != want {
+					t.Errorf("stack = %#x, want [%#x]", stack, want)
+				}
+			})
+		}
+	}
+}
+
+func TestNativeBlockEndsAtBlockEnd(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (func (param i64) (result i64)
+	//   (block (result i64)
+	//     (br_if 0 (get_local 0) (i32.wrap/i64 (get_local 0)))
+	//     (i64.mul (i64.add (i64.const 2)) (i64.const 3)))
+	//   (i64.add (i64.const 1)))
+	newModule := func() *wasm.Module {
+		m := nativeCacheModule()
+		code := []byte{
+			0x02, 0x7e, // block (result i64)
+			0x20, 0x00, 0x20, 0x00, 0xa7, 0x0d, 0x00, // get_local 0; get_local 0; i32.wrap/i64; br_if 0
+			0x42, 0x02, 0x7c, 0x42, 0x03, 0x7e, // i64.const 2; i64.add; i64.const 3; i64.mul
+			0x0b,             // end
+			0x42, 0x01, 0x7c, // i64.const 1; i64.add
+		}
+		m.Code.Bodies[0].Code = code
+		m.FunctionIndexSpace[0].Body.Code = code
+		return m
+	}
+	interp, err := NewVMWithOptions(newModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := NewVMWithOptions(newModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+
+	// The br_if targets the end of the block, so the arithmetic before
+	// it is compiled into a block resuming exactly there.
+	meta, err := vm.FunctionMetadata(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.InboundTargets) != 1 {
+		t.Fatalf("InboundTargets = %v, want the end of the block", meta.InboundTargets)
+	}
+	var blockEnd int64
+	for target := range meta.InboundTargets {
+		blockEnd = target
+	}
+	var endsAtBlockEnd bool
+	for _, block := range vm.NativeBlocks(0) {
+		if _, upper := block.Bounds(); int64(upper) == blockEnd {
+			endsAtBlockEnd = true
+		}
+	}
+	if !endsAtBlockEnd {
+		t.Fatalf("no native block ends at %d: %q", blockEnd, vm.ExplainNative(0))
+	}
+
+	for _, x := range []uint64{0, 5, 1 << 32, ^uint64(0)} {
+		want, err := interp.ExecCode(0, x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := vm.ExecCode(0, x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("f(%#x) = %#x, interpreter = %#x", x, got, want)
+		}
+	}
+}
+
+func TestNativeCompileFilter(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	body := []byte{0x20, 0x00, 0x42, 0x03, 0x7e}
+	m := multiFuncModule(body, body)
+	vm, err := NewVMWithOptions(m, EnableAOT(true), NativeCompileFilter(func(fnIndex int64) bool {
+		return fnIndex != 1
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+
+	if got := vm.funcs[0].(compiledFunction).code[0]; got != ops.WagonNativeExec {
+		t.Errorf("function 0 was not patched: %q", vm.ExplainNative(0))
+	}
+	if got, want := vm.funcs[1].(compiledFunction).code[0], ops.GetLocal; got != want {
+		t.Errorf("function 1 starts with opcode %#x, want get_local", got)
+	}
+	if got, want := vm.ExplainNative(1), []string{"excluded by NativeCompileFilter"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ExplainNative(1) = %q, want %q", got, want)
+	}
+	for i := int64(0); i < 2; i++ {
+		out, err := vm.ExecCode(i, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.(uint64), uint64(15); got != want {
+			t.Errorf("function %d returned %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestNativeSubConstZero(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	getLocalInst, _ := ops.New(ops.GetLocal)
+	constInst, _ := ops.New(ops.I64Const)
+	subInst, _ := ops.New(ops.I64Sub)
+	for _, x := range []uint64{0, 1, 41, 1 << 63, ^uint64(0)} {
+		t.Run(fmt.Sprintf("0-%#x", x), func(t *testing.T) {
+			stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+				{Op: constInst, Immediates: []interface{}{int64(0)}},
+				{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+				{Op: subInst},
+			}, wasm.ValueTypeI64, [2]uint64{x, 0})
+			if want := -x; len(stack) != 1 || stack[0] != want {
+				t.Errorf("stack = %#x, want [%#x]", stack, want)
+			}
+		})
+		for _, c := range []int64{0, 5, -1} {
+			t.Run(fmt.Sprintf("%#x-%d", x, c), func(t *testing.T) {
+				stack := checkNativeAgainstInterpreter(t, []disasm.Instr{
+					{Op: getLocalInst, Immediates: []interface{}{uint32(0)}},
+					{Op: constInst, Immediates: []interface{}{c}},
+					{Op: subInst},
+				}, wasm.ValueTypeI64, [2]uint64{x, 0})
+				if want := x - uint64(c); len(stack) != 1 || stack[0] != want {
+					t.Errorf("stack = %#x, want [%#x]", stack, want)
+				}
+			})
+		}
+	}
+}
+
+func TestFunctionMetadata(t *testing.T) {
+	vm, err := NewVMWithOptions(nativeCacheModule())
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := vm.FunctionMetadata(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// get_local 0; i64.const 3; i64.mul, with immediates re-encoded
+	// as fixed-width values.
+	want := []InstructionMetadata{
+		{Op: ops.GetLocal, Start: 0, Size: 5},
+		{Op: ops.I64Const, Start: 5, Size: 9},
+		{Op: ops.I64Mul, Start: 14, Size: 1},
+	}
+	if !reflect.DeepEqual(meta.Instructions, want) {
+		t.Errorf("Instructions = %+v, want %+v", meta.Instructions, want)
+	}
+
+	// Changes to the copy don't affect the VM.
+	meta.Instructions[0].Op = ops.Nop
+	if again, _ := vm.FunctionMetadata(0); again.Instructions[0].Op != ops.GetLocal {
+		t.Error("FunctionMetadata returned the metadata used by the VM, not a copy")
+	}
+
+	if _, err := vm.FunctionMetadata(1); err == nil {
+		t.Error("FunctionMetadata(1) succeeded for a function which does not exist")
+	}
+
+	if supported, _ := nativeBackend(); !supported {
+		return
+	}
+	native, err := NewVMWithOptions(nativeCacheModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer native.Close()
+	blocks := native.NativeBlocks(0)
+	if len(blocks) != 1 {
+		t.Fatalf("function was not compiled: %q", native.ExplainNative(0))
+	}
+	if lower, upper := blocks[0].Bounds(); lower != 0 || upper != 15 {
+		t.Errorf("block bounds = [%d:%d], want the instructions at [0:15]", lower, upper)
+	}
+	if meta, err := native.FunctionMetadata(0); err != nil || !reflect.DeepEqual(meta.Instructions, want) {
+		t.Errorf("FunctionMetadata(0) with native code = %+v, %v; want %+v", meta, err, want)
+	}
+}
+
+func TestNativeGrowMemory(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	m, err := wasm.ReadModule(bytes.NewReader([]byte{
+		0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+		0x01, 0x06, 0x01, 0x60, 0x01, 0x7f, 0x01, 0x7f, // (type (func (param i32) (result i32)))
+		0x03, 0x02, 0x01, 0x00,
+		0x05, 0x03, 0x01, 0x00, 0x01, // (memory 1)
+		0x0a, 0x1c, 0x01, 0x1a, 0x00,
+		0x20, 0x00, 0x41, 0x01, 0x6a, 0x40, 0x00, // memory.grow (get_local 0 + 1)
+		0x41, 0xf0, 0xa2, 0x04, 0x41, 0x07, 0x36, 0x02, 0x00, // i32.store (i32.const 70000) (i32.const 7)
+		0x41, 0xf0, 0xa2, 0x04, 0x28, 0x02, 0x00, 0x6a, // i32.add (i32.load (i32.const 70000))
+		0x0b,
+	}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		aot, verify bool
+		blocks      int
+	}{
+		{false, false, 0},
+		{true, false, 2},
+		{true, true, 2},
+	} {
+		vm, err := NewVMWithOptions(m, EnableAOT(tc.aot), VerifyNativeCompile(tc.verify))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vm.Close()
+		if n := len(vm.NativeBlocks(0)); n != tc.blocks {
+			t.Fatalf("aot = %v, verify = %v: len(NativeBlocks(0)) = %d, want %d: %q", tc.aot, tc.verify, n, tc.blocks, vm.ExplainNative(0))
+		}
+		// The store & load at 70000 are only in bounds once memory has
+		// grown to 3 pages.
+		res, err := vm.ExecCode(0, 1)
+		if err != nil {
+			t.Fatalf("aot = %v, verify = %v: %v", tc.aot, tc.verify, err)
+		}
+		if want := uint32(1 + 7); res != want {
+			t.Errorf("aot = %v, verify = %v: result = %v, want %v", tc.aot, tc.verify, res, want)
+		}
+		if got, want := len(vm.Memory()), 3*wasmPageSize; got != want {
+			t.Errorf("aot = %v, verify = %v: len(Memory()) = %d, want %d", tc.aot, tc.verify, got, want)
+		}
+	}
+}
+
+func TestNativeTracing(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (x+3)*5, twice, split by the unsupported i64.clz, and added.
+	run := []byte{0x20, 0x00, 0x42, 0x03, 0x7c, 0x42, 0x05, 0x7e}
+	body := append(append(append(append([]byte(nil), run...), 0x79), run...), 0x7c)
+	m := multiFuncModule(body)
+
+	vm, err := NewVMWithOptions(m, EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if _, err := vm.ExecCode(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := vm.NativeTrace(); len(got) != 0 {
+		t.Errorf("NativeTrace() = %+v without NativeTracing, want none", got)
+	}
+
+	vm, err = NewVMWithOptions(m, EnableAOT(true), NativeTracing(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	blocks := vm.NativeBlocks(0)
+	if len(blocks) != 2 {
+		t.Fatalf("len(NativeBlocks(0)) = %d, want 2: %q", len(blocks), vm.ExplainNative(0))
+	}
+	// Blocks are not installed in bytecode order.
+	first, second := 0, 1
+	if blocks[first].Beginning > blocks[second].Beginning {
+		first, second = second, first
+	}
+	_, firstEnd := blocks[first].Bounds()
+	_, secondEnd := blocks[second].Bounds()
+	want := []NativeTraceEntry{
+		{Func: 0, Block: first, ResumePC: firstEnd},
+		{Func: 0, Block: second, ResumePC: secondEnd},
+	}
+	// Each call starts a new trace.
+	for call := 0; call < 2; call++ {
+		if res, err := vm.ExecCode(0, 2); err != nil {
+			t.Fatal(err)
+		} else if res != uint64(84) {
+			t.Errorf("ExecCode() = %v, want 84", res)
+		}
+		if got := vm.NativeTrace(); !reflect.DeepEqual(got, want) {
+			t.Errorf("call %d: NativeTrace() = %+v, want %+v", call, got, want)
+		}
+	}
+}
+
+func TestNativeConstShl(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (x << k) + x, where the count k is taken modulo 64.
+	for _, k := range []struct {
+		leb   []byte
+		count uint
+	}{
+		{[]byte{0x04}, 4},
+		{[]byte{0xc6, 0x00}, 70},
+	} {
+		body := append(append([]byte{0x20, 0x00, 0x42}, k.leb...), 0x86, 0x20, 0x00, 0x7c)
+		m := multiFuncModule(body)
+		for _, x := range []uint64{0, 1, 0x123456789abcdef, 1<<63 + 5} {
+			want := x<<(k.count%64) + x
+			for _, aot := range []bool{false, true} {
+				vm, err := NewVMWithOptions(m, EnableAOT(aot))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer vm.Close()
+				if n := len(vm.NativeBlocks(0)); aot && n != 1 {
+					t.Fatalf("len(NativeBlocks(0)) = %d, want 1: %q", n, vm.ExplainNative(0))
+				}
+				res, err := vm.ExecCode(0, x)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res != want {
+					t.Errorf("aot = %v: (%#x << %d) + %#x = %#x, want %#x", aot, x, k.count, x, res, want)
+				}
+			}
+		}
+	}
+}
+
+func TestNativeBlockEndsBeforeBlockResult(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (func (param i64) (result i64)
+	//   (block (result i64)
+	//     (i64.mul (get_local 0) (i64.const 2))
+	//     (br 0 (i64.add (get_local 0) (i64.const 1))))
+	//   (i64.add (i64.const 3)))
+	// Leaving the block discards 2x from beneath the block result.
+	newModule := func() *wasm.Module {
+		m := nativeCacheModule()
+		code := []byte{
+			0x02, 0x7e, // block (result i64)
+			0x20, 0x00, 0x42, 0x02, 0x7e, // get_local 0; i64.const 2; i64.mul
+			0x20, 0x00, 0x42, 0x01, 0x7c, // get_local 0; i64.const 1; i64.add
+			0x0c, 0x00, // br 0
+			0x0b,             // end
+			0x42, 0x03, 0x7c, // i64.const 3; i64.add
+		}
+		m.Code.Bodies[0].Code = code
+		m.FunctionIndexSpace[0].Body.Code = code
+		return m
+	}
+	vm, err := NewVMWithOptions(newModule(), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+
+	// A native block must resume at the discard of 2x, with both values
+	// still on the stack. Compile emits it for the br, while the one for
+	// the end is unreachable.
+	meta, err := vm.FunctionMetadata(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var discard int64 = -1
+	for _, inst := range meta.Instructions {
+		if inst.Op == compile.OpDiscardPreserveTop {
+			discard = inst.Start
+			break
+		}
+	}
+	if discard < 0 {
+		t.Fatalf("no discard in the compiled code: %+v", meta.Instructions)
+	}
+	var resumesAtDiscard bool
+	for _, block := range vm.NativeBlocks(0) {
+		if _, upper := block.Bounds(); upper == discard {
+			resumesAtDiscard = true
+		}
+	}
+	if !resumesAtDiscard {
+		t.Fatalf("no native block ends at %d: %q", discard, vm.ExplainNative(0))
+	}
+
+	fn := vm.funcs[0].(compiledFunction)
+	for _, x := range []uint64{0, 5, 1 << 40} {
+		vm.ctx.stack = []uint64{x}
+		fn.call(vm, 0)
+		if want := x + 4; len(vm.ctx.stack) != 1 || vm.ctx.stack[0] != want {
+			t.Errorf("f(%d): stack = %v, want [%d]", x, vm.ctx.stack, want)
+		}
+	}
+}
+
+func TestNativeCompilePacksMappings(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (x+3)*5, in each of 50 functions.
+	bodies := make([][]byte, 50)
+	for i := range bodies {
+		bodies[i] = []byte{0x20, 0x00, 0x42, 0x03, 0x7c, 0x42, 0x05, 0x7e}
+	}
+	vm, err := NewVMWithOptions(multiFuncModule(bodies...), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	for i := range bodies {
+		if n := len(vm.NativeBlocks(int64(i))); n != 1 {
+			t.Fatalf("len(NativeBlocks(%d)) = %d, want 1: %q", i, n, vm.ExplainNative(int64(i)))
+		}
+	}
+	allocator, ok := vm.nativeBackend.allocator.(*compile.MMapAllocator)
+	if !ok {
+		t.Fatalf("allocator is a %T, want *compile.MMapAllocator", vm.nativeBackend.allocator)
+	}
+	if got := allocator.MappedRegions(); got > 2 {
+		t.Errorf("MappedRegions() = %d for %d native blocks, want at most 2", got, len(bodies))
+	}
+	for i := range bodies {
+		if res, err := vm.ExecCode(int64(i), 4); err != nil {
+			t.Fatal(err)
+		} else if res != uint64(35) {
+			t.Errorf("ExecCode(%d) = %v, want 35", i, res)
+		}
+	}
+}
+
+func TestNativeStackBalance(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (x << 4) + x, compiled with and without the stack balance check.
+	m := multiFuncModule([]byte{0x20, 0x00, 0x42, 0x04, 0x86, 0x20, 0x00, 0x7c})
+	for _, check := range []bool{false, true} {
+		vm, err := NewVMWithOptions(m, EnableAOT(true), NativeStackBalance(check))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vm.Close()
+		if n := len(vm.NativeBlocks(0)); n != 1 {
+			t.Fatalf("len(NativeBlocks(0)) = %d, want 1: %q", n, vm.ExplainNative(0))
+		}
+		res, err := vm.ExecCode(0, uint64(3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != uint64(51) {
+			t.Errorf("check = %v: result = %v, want 51", check, res)
+		}
+	}
+}
+
+func TestNativeCodeInvocationStackImbalance(t *testing.T) {
+	vm := &VM{}
+	vm.ctx.asm = []asmBlock{
+		{nativeUnit: &mockTrapUnit{exit: compile.TrapStackImbalance}, resumePC: 12},
+	}
+
+	defer func() {
+		if r := recover(); r != ErrNativeStackImbalance {
+			t.Errorf("recover() = %v, want %v", r, ErrNativeStackImbalance)
+		}
+	}()
+	vm.nativeCodeInvocation(0)
+}
+
+func TestNativeIncDec(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	for _, tc := range []struct {
+		name string
+		body []byte
+		fn   func(x uint64) uint64
+	}{
+		// x + 1
+		{"inc local", []byte{0x20, 0x00, 0x42, 0x01, 0x7c}, func(x uint64) uint64 { return x + 1 }},
+		// x - 1
+		{"dec local", []byte{0x20, 0x00, 0x42, 0x01, 0x7d}, func(x uint64) uint64 { return x - 1 }},
+		// (x*x + 1) * (x - 1)
+		{"inc and dec", []byte{0x20, 0x00, 0x20, 0x00, 0x7e, 0x42, 0x01, 0x7c, 0x20, 0x00, 0x42, 0x01, 0x7d, 0x7e},
+			func(x uint64) uint64 { return (x*x + 1) * (x - 1) }},
+	} {
+		m := multiFuncModule(tc.body)
+		for _, x := range []uint64{0, 1, 41, 1<<63 - 1, math.MaxUint64} {
+			for _, aot := range []bool{false, true} {
+				vm, err := NewVMWithOptions(m, EnableAOT(aot))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer vm.Close()
+				if n := len(vm.NativeBlocks(0)); aot && n != 1 {
+					t.Fatalf("%s: len(NativeBlocks(0)) = %d, want 1: %q", tc.name, n, vm.ExplainNative(0))
+				}
+				res, err := vm.ExecCode(0, x)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := tc.fn(x); res != want {
+					t.Errorf("%s: aot = %v, x = %#x: result = %#x, want %#x", tc.name, aot, x, res, want)
+				}
+			}
+		}
+	}
+}
+
+func TestNativeFunctionInfo(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (x << 4) + x
+	m := multiFuncModule([]byte{0x20, 0x00, 0x42, 0x04, 0x86, 0x20, 0x00, 0x7c})
+	vm, err := NewVMWithOptions(m, EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+
+	blocks := vm.NativeBlocks(0)
+	if len(blocks) != 1 {
+		t.Fatalf("len(NativeBlocks(0)) = %d, want 1: %q", len(blocks), vm.ExplainNative(0))
+	}
+	info := vm.NativeFunctionInfo(0)
+	if info.Func != 0 || len(info.Blocks) != 1 {
+		t.Fatalf("NativeFunctionInfo(0) = %+v, want one block of function 0", info)
+	}
+	got := info.Blocks[0]
+	if start, end := blocks[0].Bounds(); got.Start != start || got.End != end || got.ResumePC != end {
+		t.Errorf("block = %+v, want bytecode [%d, %d) resuming at %d", got, start, end, end)
+	}
+	if got.Address == 0 {
+		t.Error("block address is zero")
+	}
+	if code := vm.funcs[0].(compiledFunction).asm[0].machineCode; got.Size == 0 || got.Size != len(code) {
+		t.Errorf("block size = %d, want %d", got.Size, len(code))
+	}
+
+	for _, i := range []int64{-1, int64(len(vm.funcs))} {
+		if info := vm.NativeFunctionInfo(i); info.Func != i || len(info.Blocks) != 0 {
+			t.Errorf("NativeFunctionInfo(%d) = %+v, want no blocks", i, info)
+		}
+	}
+}
+
+func TestWritePerfMap(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	shl := []byte{0x20, 0x00, 0x42, 0x04, 0x86, 0x20, 0x00, 0x7c}
+	incDec := []byte{0x20, 0x00, 0x20, 0x00, 0x7e, 0x42, 0x01, 0x7c, 0x20, 0x00, 0x42, 0x01, 0x7d, 0x7e}
+	vm, err := NewVMWithOptions(multiFuncModule(shl, incDec, shl), EnableAOT(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+
+	var want []string
+	for i := range vm.funcs {
+		for _, b := range vm.NativeFunctionInfo(int64(i)).Blocks {
+			want = append(want, fmt.Sprintf("%x %x", b.Address, b.Size))
+		}
+	}
+	if len(want) < 3 {
+		t.Fatalf("only %d native blocks", len(want))
+	}
+
+	var buf bytes.Buffer
+	if err := vm.WritePerfMap(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("WritePerfMap() wrote %d lines, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	symbols := make(map[string]bool)
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Errorf("line %q: want <addr> <size> <symbol>", line)
+			continue
+		}
+		if got := fields[0] + " " + fields[1]; got != want[i] {
+			t.Errorf("line %q: address & size = %q, want %q", line, got, want[i])
+		}
+		if !strings.HasPrefix(fields[2], "wasm[") {
+			t.Errorf("line %q: symbol does not name a wasm function", line)
+		}
+		if symbols[fields[2]] {
+			t.Errorf("line %q: duplicate symbol", line)
+		}
+		symbols[fields[2]] = true
+	}
+}
+
+func TestNativeAbs(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// select(0 - x, x, x < 0)
+	m := multiFuncModule([]byte{0x42, 0x00, 0x20, 0x00, 0x7d, 0x20, 0x00, 0x20, 0x00, 0x42, 0x00, 0x53, 0x1b})
+	for _, x := range []int64{0, 7, -7, math.MaxInt64, math.MinInt64} {
+		var results [2]uint64
+		for i, aot := range []bool{false, true} {
+			vm, err := NewVMWithOptions(m, EnableAOT(aot))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer vm.Close()
+			if n := len(vm.NativeBlocks(0)); aot && n != 1 {
+				t.Fatalf("len(NativeBlocks(0)) = %d, want 1: %q", n, vm.ExplainNative(0))
+			}
+			res, err := vm.ExecCode(0, uint64(x))
+			if err != nil {
+				t.Fatal(err)
+			}
+			results[i] = res.(uint64)
+		}
+		want := uint64(x)
+		if x < 0 {
+			want = -want
+		}
+		if results[0] != want || results[1] != want {
+			t.Errorf("abs(%d): interpreter = %d, native = %d, want %d", x, int64(results[0]), int64(results[1]), int64(want))
+		}
+	}
+}
+
+func TestSlicesOverlap(t *testing.T) {
+	backing := make([]uint64, 16)
+	for _, tc := range []struct {
+		name string
+		a, b []uint64
+		want bool
+	}{
+		{"separate", make([]uint64, 4), make([]uint64, 4), false},
+		{"same", backing[:4], backing[:4], true},
+		{"within capacity", backing[:0:8], backing[4:8], true},
+		{"adjacent", backing[:4:4], backing[4:8], false},
+		{"adjacent, reversed", backing[4:8], backing[:4:4], false},
+		{"empty", backing[:0:0], backing[:4], false},
+	} {
+		if got := slicesOverlap(tc.a, tc.b); got != tc.want {
+			t.Errorf("%s: slicesOverlap() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNativeCodeInvocationAliased(t *testing.T) {
+	backing := make([]uint64, 8)
+	vm := &VM{opts: config{NativeAliasGuard: true}}
+	vm.ctx.stack = backing[:0:4]
+	vm.ctx.locals = backing[2:4]
+	// The unit traps differently if it is invoked at all.
+	vm.ctx.asm = []asmBlock{
+		{nativeUnit: &mockTrapUnit{exit: compile.TrapIntegerOverflow}, resumePC: 12},
+	}
+
+	defer func() {
+		if r := recover(); r != ErrNativeSlicesAlias {
+			t.Errorf("recover() = %v, want %v", r, ErrNativeSlicesAlias)
+		}
+	}()
+	vm.nativeCodeInvocation(0)
+}
+
+func TestNativeAliasGuard(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	// (x << 4) + x
+	m := multiFuncModule([]byte{0x20, 0x00, 0x42, 0x04, 0x86, 0x20, 0x00, 0x7c})
+	vm, err := NewVMWithOptions(m, EnableAOT(true), NativeAliasGuard(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if n := len(vm.NativeBlocks(0)); n != 1 {
+		t.Fatalf("len(NativeBlocks(0)) = %d, want 1: %q", n, vm.ExplainNative(0))
+	}
+	res, err := vm.ExecCode(0, uint64(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != uint64(51) {
+		t.Errorf("result = %v, want 51", res)
+	}
+}
+
+// TestVerifyNativeCompileSignedI32 checks native blocks ending in signed
+// i32 ops, whose results are negative for many of the random states,
+// survive verification: the interpreter must leave the same bits in the
+// stack slot as native code does.
+func TestVerifyNativeCompileSignedI32(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	m := nativeCacheModule()
+	sig := wasm.FunctionSig{
+		ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32},
+		ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+	}
+	m.Types.Entries[0] = sig
+	m.FunctionIndexSpace[0].Sig = &sig
+
+	for _, tc := range []struct {
+		name string
+		op   byte
+		fn   func(x, y int32) int32
+	}{
+		{"i32.shr_s", 0x75, func(x, y int32) int32 { return x >> uint32(y%32) }},
+		{"i32.div_s", 0x6d, func(x, y int32) int32 { return x / y }},
+		{"i32.rem_s", 0x6f, func(x, y int32) int32 { return x % y }},
+	} {
+		// x op y
+		m.FunctionIndexSpace[0].Body.Code = []byte{0x20, 0x00, 0x20, 0x01, tc.op}
+		vm, err := NewVMWithOptions(m, EnableAOT(true), VerifyNativeCompile(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer vm.Close()
+		if n := len(vm.NativeBlocks(0)); n != 1 {
+			t.Errorf("%s: len(NativeBlocks(0)) = %d, want 1: %q", tc.name, n, vm.ExplainNative(0))
+			continue
+		}
+		for _, args := range [][2]int32{{-100, 3}, {-7, 2}, {100, -3}, {-1, 1}} {
+			res, err := vm.ExecCode(0, uint64(uint32(args[0])), uint64(uint32(args[1])))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := uint32(tc.fn(args[0], args[1])); res != want {
+				t.Errorf("%s: %d op %d = %d, want %d", tc.name, args[0], args[1], int32(res.(uint32)), int32(want))
+			}
+		}
+	}
+}
+
+// TestVerifyNativeCompileOverflowTrap checks a block which traps on
+// integer overflow in every state, natively & in the interpreter, is
+// accepted by verification.
+func TestVerifyNativeCompileOverflowTrap(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	m := nativeCacheModule()
+	sig := wasm.FunctionSig{ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32}}
+	m.Types.Entries[0] = sig
+	m.FunctionIndexSpace[0].Sig = &sig
+	// math.MinInt32 / -1
+	m.FunctionIndexSpace[0].Body.Code = []byte{0x41, 0x80, 0x80, 0x80, 0x80, 0x78, 0x41, 0x7f, 0x6d}
+
+	vm, err := NewVMWithOptions(m, EnableAOT(true), VerifyNativeCompile(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vm.Close()
+	if n := len(vm.NativeBlocks(0)); n != 1 {
+		t.Fatalf("len(NativeBlocks(0)) = %d, want 1: %q", n, vm.ExplainNative(0))
+	}
+	vm.RecoverPanic = true
+	if _, err := vm.ExecCode(0); err != ErrIntegerOverflow {
+		t.Errorf("ExecCode() = %v, want %v", err, ErrIntegerOverflow)
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !appengine,!js,go1.17
+
+package exec
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/go-interpreter/wagon/disasm"
+	"github.com/go-interpreter/wagon/exec/internal/compile"
+	"github.com/go-interpreter/wagon/wasm"
+	ops "github.com/go-interpreter/wagon/wasm/operators"
+)
+
+var randomFuncSeed = flag.Int64("native.seed", 1, "seed of the first function generated by TestNativeRandomFuncs")
+
+// randomLocalTypes are the types of the locals of generated functions, one
+// of each value type.
+var randomLocalTypes = []wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI32, wasm.ValueTypeF64, wasm.ValueTypeF32}
+
+// randomOpSigs are the operand & result types of the opcodes without
+// immediates which the generator emits. Opcodes the native backend
+// supports must be added here, or to the special cases of
+// applyRandomInstr, to be exercised.
+var randomOpSigs = map[byte]struct {
+	pops []wasm.ValueType
+	push wasm.ValueType
+}{
+	ops.I64Add:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI64},
+	ops.I64Sub:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI64},
+	ops.I64Mul:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI64},
+	ops.I64And:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI64},
+	ops.I64Or:   {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI64},
+	ops.I64Shl:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI64},
+	ops.I32Add:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32Mul:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32DivS: {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32DivU: {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32RemS: {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32RemU: {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32Shl:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32ShrS: {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32ShrU: {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32Rotl: {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32Rotr: {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I64Eq:   {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I64Ne:   {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I64LtS:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I64LtU:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I64GtS:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I64GtU:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I64LeS:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I64LeU:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I64GeS:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I64GeU:  {[]wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I32Eq:   {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32Ne:   {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32LtS:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32LtU:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32GtS:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32GtU:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32LeS:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32LeU:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32GeS:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+	ops.I32GeU:  {[]wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}, wasm.ValueTypeI32},
+
+	ops.I32WrapI64:        {[]wasm.ValueType{wasm.ValueTypeI64}, wasm.ValueTypeI32},
+	ops.I32ReinterpretF32: {[]wasm.ValueType{wasm.ValueTypeF32}, wasm.ValueTypeI32},
+	ops.I64ReinterpretF64: {[]wasm.ValueType{wasm.ValueTypeF64}, wasm.ValueTypeI64},
+	ops.F32ReinterpretI32: {[]wasm.ValueType{wasm.ValueTypeI32}, wasm.ValueTypeF32},
+	ops.F64ReinterpretI64: {[]wasm.ValueType{wasm.ValueTypeI64}, wasm.ValueTypeF64},
+	ops.F32ConvertUI32:    {[]wasm.ValueType{wasm.ValueTypeI32}, wasm.ValueTypeF32},
+	ops.F32ConvertUI64:    {[]wasm.ValueType{wasm.ValueTypeI64}, wasm.ValueTypeF32},
+	ops.F64ConvertUI32:    {[]wasm.ValueType{wasm.ValueTypeI32}, wasm.ValueTypeF64},
+	ops.F64ConvertUI64:    {[]wasm.ValueType{wasm.ValueTypeI64}, wasm.ValueTypeF64},
+
+	ops.F32Add:      {[]wasm.ValueType{wasm.ValueTypeF32, wasm.ValueTypeF32}, wasm.ValueTypeF32},
+	ops.F64Add:      {[]wasm.ValueType{wasm.ValueTypeF64, wasm.ValueTypeF64}, wasm.ValueTypeF64},
+	ops.F32Mul:      {[]wasm.ValueType{wasm.ValueTypeF32, wasm.ValueTypeF32}, wasm.ValueTypeF32},
+	ops.F64Mul:      {[]wasm.ValueType{wasm.ValueTypeF64, wasm.ValueTypeF64}, wasm.ValueTypeF64},
+	ops.F32Copysign: {[]wasm.ValueType{wasm.ValueTypeF32, wasm.ValueTypeF32}, wasm.ValueTypeF32},
+	ops.F64Copysign: {[]wasm.ValueType{wasm.ValueTypeF64, wasm.ValueTypeF64}, wasm.ValueTypeF64},
+	ops.F32Abs:      {[]wasm.ValueType{wasm.ValueTypeF32}, wasm.ValueTypeF32},
+	ops.F64Abs:      {[]wasm.ValueType{wasm.ValueTypeF64}, wasm.ValueTypeF64},
+	ops.F64Ceil:     {[]wasm.ValueType{wasm.ValueTypeF64}, wasm.ValueTypeF64},
+	ops.F64Floor:    {[]wasm.ValueType{wasm.ValueTypeF64}, wasm.ValueTypeF64},
+	ops.F64Trunc:    {[]wasm.ValueType{wasm.ValueTypeF64}, wasm.ValueTypeF64},
+	ops.F64Nearest:  {[]wasm.ValueType{wasm.ValueTypeF64}, wasm.ValueTypeF64},
+}
+
+// applyRandomInstr returns the types on the stack after instr, or false if
+// instr is not valid with the given stack. prev is the instruction before
+// instr, if any.
+func applyRandomInstr(stack []wasm.ValueType, prev *disasm.Instr, instr disasm.Instr) ([]wasm.ValueType, bool) {
+	stack = append([]wasm.ValueType(nil), stack...)
+	top := func(types ...wasm.ValueType) bool {
+		if len(stack) < len(types) {
+			return false
+		}
+		for i, typ := range types {
+			if stack[len(stack)-len(types)+i] != typ {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch instr.Op.Code {
+	case ops.Nop:
+		return stack, true
+	case ops.Drop:
+		if len(stack) == 0 {
+			return nil, false
+		}
+		return stack[:len(stack)-1], true
+	case ops.I32Const:
+		return append(stack, wasm.ValueTypeI32), true
+	case ops.I64Const:
+		return append(stack, wasm.ValueTypeI64), true
+	case ops.GetLocal:
+		return append(stack, randomLocalTypes[instr.Immediates[0].(uint32)]), true
+	case ops.SetLocal:
+		if !top(randomLocalTypes[instr.Immediates[0].(uint32)]) {
+			return nil, false
+		}
+		return stack[:len(stack)-1], true
+	case ops.Select:
+		if len(stack) < 3 || !top(stack[len(stack)-2], stack[len(stack)-2], wasm.ValueTypeI32) {
+			return nil, false
+		}
+		return stack[:len(stack)-2], true
+	case ops.I64DivU:
+		// Division by zero traps, so only constant, non-zero divisors
+		// are generated.
+		if prev == nil || prev.Op.Code != ops.I64Const || prev.Immediates[0].(int64) == 0 || !top(wasm.ValueTypeI64, wasm.ValueTypeI64) {
+			return nil, false
+		}
+		return append(stack[:len(stack)-2], wasm.ValueTypeI64), true
+	}
+
+	sig, ok := randomOpSigs[instr.Op.Code]
+	if !ok || !top(sig.pops...) {
+		return nil, false
+	}
+	return append(stack[:len(stack)-len(sig.pops)], sig.push), true
+}
+
+// checkRandomFunc returns the types on the stack after instrs, or false if
+// they are not a valid sequence.
+func checkRandomFunc(instrs []disasm.Instr) ([]wasm.ValueType, bool) {
+	var stack []wasm.ValueType
+	for i, instr := range instrs {
+		var prev *disasm.Instr
+		if i > 0 {
+			prev = &instrs[i-1]
+		}
+		var ok bool
+		if stack, ok = applyRandomInstr(stack, prev, instr); !ok {
+			return nil, false
+		}
+	}
+	return stack, true
+}
+
+// randomIntegers are the values constants & integer locals are usually
+// drawn from, to reach the edge cases of arithmetic.
+var randomIntegers = []uint64{0, 1, 2, 3, 31, 32, 63, 64, 0x7fffffff, 0x80000000, 0xffffffff, 1<<63 - 1, 1 << 63, ^uint64(0)}
+
+// randomFloats are the values float locals are usually drawn from.
+var randomFloats = []float64{0, math.Copysign(0, -1), 0.5, -0.5, 1.5, 2.5, -2.5, 1 << 52, 1e300, math.Inf(1), math.Inf(-1)}
+
+func randomInteger(r *rand.Rand) uint64 {
+	if r.Intn(2) == 0 {
+		return randomIntegers[r.Intn(len(randomIntegers))]
+	}
+	return r.Uint64()
+}
+
+func randomFloat(r *rand.Rand) float64 {
+	if r.Intn(2) == 0 {
+		return randomFloats[r.Intn(len(randomFloats))]
+	}
+	return r.NormFloat64() * 1e6
+}
+
+// randomLocals returns random values for locals of randomLocalTypes.
+func randomLocals(r *rand.Rand) []uint64 {
+	return []uint64{
+		randomInteger(r),
+		uint64(uint32(randomInteger(r))),
+		math.Float64bits(randomFloat(r)),
+		uint64(math.Float32bits(float32(randomFloat(r)))),
+	}
+}
+
+// randomFunc returns a valid sequence of up to n instructions, over the
+// given opcodes.
+func randomFunc(r *rand.Rand, supported map[byte]bool, n int) []disasm.Instr {
+	newInstr := func(code byte, immediates ...interface{}) disasm.Instr {
+		op, err := ops.New(code)
+		if err != nil {
+			panic(err)
+		}
+		return disasm.Instr{Op: op, Immediates: immediates}
+	}
+
+	var instrs []disasm.Instr
+	for len(instrs) < n {
+		var choices [][]disasm.Instr
+		add := func(seq ...disasm.Instr) {
+			for _, instr := range seq {
+				if !supported[instr.Op.Code] {
+					return
+				}
+			}
+			choices = append(choices, seq)
+		}
+		add(newInstr(ops.Nop))
+		add(newInstr(ops.I32Const, int32(randomInteger(r))))
+		add(newInstr(ops.I64Const, int64(randomInteger(r))))
+		add(newInstr(ops.Select))
+		add(newInstr(ops.Drop))
+		add(newInstr(ops.I64Const, int64(randomInteger(r)|1)), newInstr(ops.I64DivU))
+		for i := range randomLocalTypes {
+			add(newInstr(ops.GetLocal, uint32(i)))
+			add(newInstr(ops.SetLocal, uint32(i)))
+		}
+		for code := range randomOpSigs {
+			add(newInstr(code))
+		}
+
+		// Keep the valid choices, which fit in the remaining length.
+		var valid [][]disasm.Instr
+		for _, seq := range choices {
+			if len(instrs)+len(seq) > n {
+				continue
+			}
+			if _, ok := checkRandomFunc(append(append([]disasm.Instr(nil), instrs...), seq...)); ok {
+				valid = append(valid, seq)
+			}
+		}
+		if len(valid) == 0 {
+			break
+		}
+		instrs = append(instrs, valid[r.Intn(len(valid))]...)
+	}
+	return instrs
+}
+
+// runRandomFunc executes instrs with the given locals, natively if native
+// is set. It returns the stack & locals after execution, and the number of
+// native blocks the function was compiled to.
+func runRandomFunc(instrs []disasm.Instr, locals []uint64, native bool) (stack, outLocals []uint64, blocks int, err error) {
+	code, meta := compile.Compile(instrs)
+	meta.LocalTypes = randomLocalTypes
+	vm := &VM{funcs: []function{compiledFunction{
+		totalLocalVars: len(randomLocalTypes),
+		maxDepth:       len(instrs),
+		code:           code,
+		codeMeta:       meta,
+	}}}
+	vm.newFuncTable()
+	if native {
+		_, vm.nativeBackend = nativeBackend()
+		// Check the pushes & pops of each block balance, as well as
+		// its results.
+		vm.nativeBackend.Builder.(*compile.AMD64Backend).SetStackBalance(true)
+		if err := vm.tryNativeCompile(); err != nil {
+			return nil, nil, 0, fmt.Errorf("tryNativeCompile() failed: %v", err)
+		}
+		defer vm.Close()
+		blocks = len(vm.NativeBlocks(0))
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	fn := vm.funcs[0].(compiledFunction)
+	vm.ctx = context{
+		stack:  make([]uint64, 0, fn.maxDepth),
+		locals: append([]uint64(nil), locals...),
+		code:   fn.code,
+		asm:    fn.asm,
+	}
+	vm.execCode(fn)
+	return vm.ctx.stack, vm.ctx.locals, blocks, nil
+}
+
+// sameRandomValue reports whether a & b are the same value of type typ.
+// Only the low 32 bits of 32-bit values are significant, and, as in the
+// wasm spec, NaNs need not have the same sign or payload.
+func sameRandomValue(typ wasm.ValueType, a, b uint64) bool {
+	switch typ {
+	case wasm.ValueTypeI32:
+		return uint32(a) == uint32(b)
+	case wasm.ValueTypeF32:
+		fa, fb := math.Float32frombits(uint32(a)), math.Float32frombits(uint32(b))
+		return uint32(a) == uint32(b) || fa != fa && fb != fb
+	case wasm.ValueTypeF64:
+		fa, fb := math.Float64frombits(a), math.Float64frombits(b)
+		return a == b || fa != fa && fb != fb
+	}
+	return a == b
+}
+
+// compareRandomFunc runs instrs natively & in the interpreter, returning a
+// description of the first difference between them, if any. Both must trap
+// with the same error, or neither. It returns the number of native blocks
+// the function was compiled to.
+func compareRandomFunc(instrs []disasm.Instr, locals []uint64) (int, string) {
+	types, ok := checkRandomFunc(instrs)
+	if !ok {
+		panic("compareRandomFunc: invalid instructions")
+	}
+	wantStack, wantLocals, _, wantErr := runRandomFunc(instrs, locals, false)
+	gotStack, gotLocals, blocks, gotErr := runRandomFunc(instrs, locals, true)
+	if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+		return blocks, fmt.Sprintf("native error = %v, interpreter error = %v", gotErr, wantErr)
+	}
+	if wantErr != nil {
+		return blocks, ""
+	}
+
+	if len(gotStack) != len(wantStack) {
+		return blocks, fmt.Sprintf("native stack = %#x, interpreter stack = %#x", gotStack, wantStack)
+	}
+	for i, typ := range types {
+		if !sameRandomValue(typ, gotStack[i], wantStack[i]) {
+			return blocks, fmt.Sprintf("native stack = %#x, interpreter stack = %#x", gotStack, wantStack)
+		}
+	}
+	for i, typ := range randomLocalTypes {
+		if !sameRandomValue(typ, gotLocals[i], wantLocals[i]) {
+			return blocks, fmt.Sprintf("native locals = %#x, interpreter locals = %#x", gotLocals, wantLocals)
+		}
+	}
+	return blocks, ""
+}
+
+// shrinkRandomFunc removes instructions from instrs while the result is
+// valid and still fails with the given locals, returning the minimal
+// sequence found.
+func shrinkRandomFunc(instrs []disasm.Instr, locals []uint64) []disasm.Instr {
+	for shrunk := true; shrunk; {
+		shrunk = false
+		for i := 0; i < len(instrs); i++ {
+			smaller := append(append([]disasm.Instr(nil), instrs[:i]...), instrs[i+1:]...)
+			if _, ok := checkRandomFunc(smaller); !ok {
+				continue
+			}
+			if _, diff := compareRandomFunc(smaller, locals); diff != "" {
+				instrs = smaller
+				shrunk = true
+				i--
+			}
+		}
+	}
+	return instrs
+}
+
+func formatRandomFunc(instrs []disasm.Instr) string {
+	var out []string
+	for _, instr := range instrs {
+		s := instr.Op.Name
+		for _, imm := range instr.Immediates {
+			s += fmt.Sprintf(" %v", imm)
+		}
+		out = append(out, s)
+	}
+	return strings.Join(out, "; ")
+}
+
+// TestNativeRandomFuncs checks native code computes the same stack &
+// locals as the interpreter, for random valid sequences of the opcodes
+// the backend supports. Failures are shrunk to a minimal sequence, and
+// can be reproduced with -native.seed.
+func TestNativeRandomFuncs(t *testing.T) {
+	if supported, _ := nativeBackend(); !supported {
+		t.SkipNow()
+	}
+	supported := map[byte]bool{}
+	for _, op := range (&compile.AMD64Backend{}).SupportedOpcodes() {
+		supported[op] = true
+	}
+	// Flag opcodes the generator cannot emit yet.
+	for op := range supported {
+		switch op {
+		case ops.Nop, ops.Drop, ops.I32Const, ops.I64Const, ops.GetLocal, ops.SetLocal, ops.Select, ops.I64DivU,
+			// Memory is not set up, and there are no branch targets.
+			ops.I32Load, ops.I64Load, ops.I32Store, ops.I64Store, ops.GrowMemory, ops.Return, compile.OpJmpNz:
+			continue
+		}
+		if _, ok := randomOpSigs[op]; !ok {
+			t.Errorf("opcode 0x%x is supported, but not generated", op)
+		}
+	}
+
+	funcs := 500
+	if testing.Short() {
+		funcs = 50
+	}
+	var compiled int
+	for i := 0; i < funcs; i++ {
+		seed := *randomFuncSeed + int64(i)
+		r := rand.New(rand.NewSource(seed))
+		instrs := randomFunc(r, supported, 3+r.Intn(14))
+		for j := 0; j < 3; j++ {
+			locals := randomLocals(r)
+			blocks, diff := compareRandomFunc(instrs, locals)
+			if j == 0 && blocks > 0 {
+				compiled++
+			}
+			if diff == "" {
+				continue
+			}
+			min := shrinkRandomFunc(instrs, locals)
+			_, diff = compareRandomFunc(min, locals)
+			t.Fatalf("-native.seed=%d: locals = %#x\n%s\nshrunk from\n%s\n%s", seed, locals, formatRandomFunc(min), formatRandomFunc(instrs), diff)
+		}
+	}
+	// Most sequences are long enough to be compiled, or the test checks
+	// little.
+	if compiled < funcs/2 {
+		t.Errorf("only %d of %d functions were compiled", compiled, funcs)
+	}
+}
@@ -5,10 +5,19 @@
 package exec
 
 import (
+	"errors"
 	"math"
 	"math/bits"
 )
 
+// ErrIntegerDivideByZero is the error value used while trapping the VM
+// when an integer division or remainder has a divisor of zero.
+var ErrIntegerDivideByZero = errors.New("exec: integer divide by zero")
+
+// ErrIntegerOverflow is the error value used while trapping the VM when a
+// signed integer division overflows, such as math.MinInt32 / -1.
+var ErrIntegerOverflow = errors.New("exec: integer overflow")
+
 // int32 operators
 
 func (vm *VM) i32Clz() {
@@ -34,24 +43,39 @@ func (vm *VM) i32Mul() {
 func (vm *VM) i32DivS() {
 	v2 := vm.popInt32()
 	v1 := vm.popInt32()
+	if v2 == 0 {
+		panic(ErrIntegerDivideByZero)
+	}
+	if v1 == math.MinInt32 && v2 == -1 {
+		panic(ErrIntegerOverflow)
+	}
 	vm.pushInt32(v1 / v2)
 }
 
 func (vm *VM) i32DivU() {
 	v2 := vm.popUint32()
 	v1 := vm.popUint32()
+	if v2 == 0 {
+		panic(ErrIntegerDivideByZero)
+	}
 	vm.pushUint32(v1 / v2)
 }
 
 func (vm *VM) i32RemS() {
 	v2 := vm.popInt32()
 	v1 := vm.popInt32()
+	if v2 == 0 {
+		panic(ErrIntegerDivideByZero)
+	}
 	vm.pushInt32(v1 % v2)
 }
 
 func (vm *VM) i32RemU() {
 	v2 := vm.popUint32()
 	v1 := vm.popUint32()
+	if v2 == 0 {
+		panic(ErrIntegerDivideByZero)
+	}
 	vm.pushUint32(v1 % v2)
 }
 
@@ -76,19 +100,19 @@ func (vm *VM) i32Xor() {
 func (vm *VM) i32Shl() {
 	v2 := vm.popUint32()
 	v1 := vm.popUint32()
-	vm.pushUint32(v1 << v2)
+	vm.pushUint32(v1 << (v2 % 32))
 }
 
 func (vm *VM) i32ShrU() {
 	v2 := vm.popUint32()
 	v1 := vm.popUint32()
-	vm.pushUint32(v1 >> v2)
+	vm.pushUint32(v1 >> (v2 % 32))
 }
 
 func (vm *VM) i32ShrS() {
 	v2 := vm.popUint32()
 	v1 := vm.popInt32()
-	vm.pushInt32(v1 >> v2)
+	vm.pushInt32(v1 >> (v2 % 32))
 }
 
 func (vm *VM) i32Rotl() {
@@ -194,24 +218,39 @@ func (vm *VM) i64Mul() {
 func (vm *VM) i64DivS() {
 	v2 := vm.popInt64()
 	v1 := vm.popInt64()
+	if v2 == 0 {
+		panic(ErrIntegerDivideByZero)
+	}
+	if v1 == math.MinInt64 && v2 == -1 {
+		panic(ErrIntegerOverflow)
+	}
 	vm.pushInt64(v1 / v2)
 }
 
 func (vm *VM) i64DivU() {
 	v2 := vm.popUint64()
 	v1 := vm.popUint64()
+	if v2 == 0 {
+		panic(ErrIntegerDivideByZero)
+	}
 	vm.pushUint64(v1 / v2)
 }
 
 func (vm *VM) i64RemS() {
 	v2 := vm.popInt64()
 	v1 := vm.popInt64()
+	if v2 == 0 {
+		panic(ErrIntegerDivideByZero)
+	}
 	vm.pushInt64(v1 % v2)
 }
 
 func (vm *VM) i64RemU() {
 	v2 := vm.popUint64()
 	v1 := vm.popUint64()
+	if v2 == 0 {
+		panic(ErrIntegerDivideByZero)
+	}
 	vm.pushUint64(v1 % v2)
 }
 
@@ -230,19 +269,19 @@ func (vm *VM) i64Xor() {
 func (vm *VM) i64Shl() {
 	v2 := vm.popUint64()
 	v1 := vm.popUint64()
-	vm.pushUint64(v1 << v2)
+	vm.pushUint64(v1 << (v2 % 64))
 }
 
 func (vm *VM) i64ShrS() {
 	v2 := vm.popUint64()
 	v1 := vm.popInt64()
-	vm.pushInt64(v1 >> v2)
+	vm.pushInt64(v1 >> (v2 % 64))
 }
 
 func (vm *VM) i64ShrU() {
 	v2 := vm.popUint64()
 	v1 := vm.popUint64()
-	vm.pushUint64(v1 >> v2)
+	vm.pushUint64(v1 >> (v2 % 64))
 }
 
 func (vm *VM) i64Rotl() {
@@ -320,7 +359,7 @@ func (vm *VM) i64GeU() {
 // float32 operators
 
 func (vm *VM) f32Abs() {
-	vm.pushFloat32(float32(math.Abs(float64(vm.popFloat32()))))
+	vm.pushUint32(vm.popUint32() &^ (1 << 31))
 }
 
 func (vm *VM) f32Neg() {
@@ -340,8 +379,7 @@ func (vm *VM) f32Trunc() {
 }
 
 func (vm *VM) f32Nearest() {
-	f := vm.popFloat32()
-	vm.pushFloat32(float32(int32(f + float32(math.Copysign(0.5, float64(f))))))
+	vm.pushFloat32(float32(math.RoundToEven(float64(vm.popFloat32()))))
 }
 
 func (vm *VM) f32Sqrt() {
@@ -377,7 +415,9 @@ func (vm *VM) f32Max() {
 }
 
 func (vm *VM) f32Copysign() {
-	vm.pushFloat32(float32(math.Copysign(float64(vm.popFloat32()), float64(vm.popFloat32()))))
+	v2 := vm.popUint32()
+	v1 := vm.popUint32()
+	vm.pushUint32(v1&^(1<<31) | v2&(1<<31))
 }
 
 func (vm *VM) f32Eq() {
@@ -435,8 +475,7 @@ func (vm *VM) f64Trunc() {
 }
 
 func (vm *VM) f64Nearest() {
-	f := vm.popFloat64()
-	vm.pushFloat64(float64(int64(f + math.Copysign(0.5, f))))
+	vm.pushFloat64(math.RoundToEven(vm.popFloat64()))
 }
 
 func (vm *VM) f64Sqrt() {
@@ -472,7 +511,9 @@ func (vm *VM) f64Max() {
 }
 
 func (vm *VM) f64Copysign() {
-	vm.pushFloat64(math.Copysign(vm.popFloat64(), vm.popFloat64()))
+	v2 := vm.popFloat64()
+	v1 := vm.popFloat64()
+	vm.pushFloat64(math.Copysign(v1, v2))
 }
 
 func (vm *VM) f64Eq() {
@@ -0,0 +1,219 @@
+// Copyright 2019 The go-interpreter Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package exec
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/go-interpreter/wagon/wasm"
+)
+
+func TestI32ShiftCountModulo(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Op     func(vm *VM)
+		Args   []uint64
+		Result uint64
+	}{
+		{"shl by 33", (*VM).i32Shl, []uint64{0x80000001, 33}, 2},
+		{"shr_s by 36", (*VM).i32ShrS, []uint64{0x80000000, 36}, 0xF8000000},
+		{"shr_u by 63", (*VM).i32ShrU, []uint64{0x80000000, 63}, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			vm := &VM{}
+			vm.ctx.stack = append(vm.ctx.stack, tc.Args...)
+			tc.Op(vm)
+			if got := vm.popUint32(); uint64(got) != tc.Result {
+				t.Errorf("result = %#x, want %#x", got, tc.Result)
+			}
+		})
+	}
+}
+
+func TestI64ShiftCountModulo(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Op     func(vm *VM)
+		Args   []uint64
+		Result uint64
+	}{
+		{"shl by 4", (*VM).i64Shl, []uint64{3, 4}, 48},
+		{"shl by 70", (*VM).i64Shl, []uint64{3, 70}, 192},
+		{"shr_s by 65", (*VM).i64ShrS, []uint64{1 << 63, 65}, 0xC000000000000000},
+		{"shr_u by 127", (*VM).i64ShrU, []uint64{1 << 63, 127}, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			vm := &VM{}
+			vm.ctx.stack = append(vm.ctx.stack, tc.Args...)
+			tc.Op(vm)
+			if got := vm.popUint64(); got != tc.Result {
+				t.Errorf("result = %#x, want %#x", got, tc.Result)
+			}
+		})
+	}
+}
+
+func TestSignedDivideOverflow(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Op   func(vm *VM)
+		Args []uint64
+	}{
+		{"i32.div_s", (*VM).i32DivS, []uint64{0x80000000, 0xFFFFFFFF}},
+		{"i64.div_s", (*VM).i64DivS, []uint64{1 << 63, math.MaxUint64}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			vm := &VM{}
+			vm.ctx.stack = append(vm.ctx.stack, tc.Args...)
+			defer func() {
+				if r := recover(); r != ErrIntegerOverflow {
+					t.Errorf("recover() = %v, want %v", r, ErrIntegerOverflow)
+				}
+			}()
+			tc.Op(vm)
+		})
+	}
+}
+
+func TestIntegerDivideByZero(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Op   func(vm *VM)
+	}{
+		{"i32.div_s", (*VM).i32DivS},
+		{"i32.div_u", (*VM).i32DivU},
+		{"i32.rem_s", (*VM).i32RemS},
+		{"i32.rem_u", (*VM).i32RemU},
+		{"i64.div_s", (*VM).i64DivS},
+		{"i64.div_u", (*VM).i64DivU},
+		{"i64.rem_s", (*VM).i64RemS},
+		{"i64.rem_u", (*VM).i64RemU},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			vm := &VM{}
+			vm.ctx.stack = append(vm.ctx.stack, 1, 0)
+			defer func() {
+				if r := recover(); r != ErrIntegerDivideByZero {
+					t.Errorf("recover() = %v, want %v", r, ErrIntegerDivideByZero)
+				}
+			}()
+			tc.Op(vm)
+		})
+	}
+}
+
+func TestFloatSignOps(t *testing.T) {
+	negZero := math.Float64bits(math.Copysign(0, -1))
+	testCases := []struct {
+		Name   string
+		Op     func(vm *VM)
+		Args   []uint64
+		Result uint64
+	}{
+		{"f64.copysign(3, -1)", (*VM).f64Copysign, []uint64{math.Float64bits(3), math.Float64bits(-1)}, math.Float64bits(-3)},
+		{"f64.copysign(-3, 1)", (*VM).f64Copysign, []uint64{math.Float64bits(-3), math.Float64bits(1)}, math.Float64bits(3)},
+		{"f64.copysign(1, -0)", (*VM).f64Copysign, []uint64{math.Float64bits(1), negZero}, math.Float64bits(-1)},
+		{"f32.copysign(3, -1)", (*VM).f32Copysign, []uint64{uint64(math.Float32bits(3)), uint64(math.Float32bits(-1))}, uint64(math.Float32bits(-3))},
+		{"f32.copysign(NaN, -0)", (*VM).f32Copysign, []uint64{0x7f800001, 0x80000000}, 0xff800001},
+		{"f32.abs(-NaN)", (*VM).f32Abs, []uint64{0xff800001}, 0x7f800001},
+		{"f64.abs(-0)", (*VM).f64Abs, []uint64{negZero}, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			vm := &VM{}
+			vm.ctx.stack = append(vm.ctx.stack, tc.Args...)
+			tc.Op(vm)
+			if got := vm.popUint64(); got != tc.Result {
+				t.Errorf("result = %#x, want %#x", got, tc.Result)
+			}
+		})
+	}
+}
+
+func TestFloatNearest(t *testing.T) {
+	testCases := []struct {
+		In, Want float64
+	}{
+		{2.5, 2},
+		{-2.5, -2},
+		{3.5, 4},
+		{0.5, 0},
+		{-0.5, math.Copysign(0, -1)},
+		{1 << 62, 1 << 62},
+		{math.Inf(1), math.Inf(1)},
+	}
+	for _, tc := range testCases {
+		vm := &VM{}
+		vm.pushFloat64(tc.In)
+		vm.f64Nearest()
+		if got := vm.popUint64(); got != math.Float64bits(tc.Want) {
+			t.Errorf("f64.nearest(%v) = %v, want %v", tc.In, math.Float64frombits(got), tc.Want)
+		}
+
+		vm.pushFloat32(float32(tc.In))
+		vm.f32Nearest()
+		if got := vm.popUint32(); got != math.Float32bits(float32(tc.Want)) {
+			t.Errorf("f32.nearest(%v) = %v, want %v", tc.In, math.Float32frombits(got), tc.Want)
+		}
+	}
+}
+
+// TestI32ZeroExtended checks every path which stores an i32 in a stack
+// slot or global leaves the upper half of it clear.
+func TestI32ZeroExtended(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Op     func(vm *VM)
+		Args   []uint64
+		Result uint64
+	}{
+		{"push -1", func(vm *VM) { vm.pushInt32(-1) }, nil, 0xFFFFFFFF},
+		{"shr_s", (*VM).i32ShrS, []uint64{0x80000000, 1}, 0xC0000000},
+		{"div_s", (*VM).i32DivS, []uint64{0xFFFFFFFA, 2}, 0xFFFFFFFD},
+		{"rem_s", (*VM).i32RemS, []uint64{0xFFFFFFF9, 2}, 0xFFFFFFFF},
+		{"host function", func(vm *VM) {
+			f := func(proc *Process) int32 { return -2 }
+			goFunction{val: reflect.ValueOf(f), typ: reflect.TypeOf(f)}.call(vm, 0)
+		}, nil, 0xFFFFFFFE},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			vm := &VM{}
+			vm.ctx.stack = append(vm.ctx.stack, tc.Args...)
+			tc.Op(vm)
+			if got := vm.popUint64(); got != tc.Result {
+				t.Errorf("stack slot = %#x, want %#x", got, tc.Result)
+			}
+		})
+	}
+
+	t.Run("global", func(t *testing.T) {
+		m := wasm.NewModule()
+		m.Start = nil
+		m.GlobalIndexSpace = []wasm.GlobalEntry{{
+			Type: wasm.GlobalVar{Type: wasm.ValueTypeI32},
+			Init: []byte{0x41, 0x7f, 0x0b}, // i32.const -1; end
+		}}
+		vm, err := NewVM(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := vm.globals[0], uint64(0xFFFFFFFF); got != want {
+			t.Errorf("global = %#x, want %#x", got, want)
+		}
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"time"
 
 	"github.com/go-interpreter/wagon/disasm"
 	"github.com/go-interpreter/wagon/exec/internal/compile"
@@ -73,6 +74,16 @@ type VM struct {
 	abort bool // Flag for host functions to terminate execution
 
 	nativeBackend *nativeCompiler
+	// bytes of native code allocated, counted against NativeCodeBudget
+	// whether or not it was installed.
+	nativeCodeBytes int
+	// whether each function has been compiled on its first call, see
+	// NativeCompileLazily. Nil unless compilation is lazy.
+	nativeLazy []bool
+	// native blocks invoked by the last call to ExecCode, see
+	// NativeTracing.
+	nativeTrace []NativeTraceEntry
+	opts        config
 }
 
 // As per the WebAssembly spec: https://github.com/WebAssembly/design/blob/27ac254c854994103c24834a994be16f74f54186/Semantics.md#linear-memory
@@ -81,7 +92,30 @@ const wasmPageSize = 65536 // (64 KB)
 var endianess = binary.LittleEndian
 
 type config struct {
-	EnableAOT bool
+	EnableAOT            bool
+	NativeStackGrowth    StackGrowthStrategy
+	NativeStackHeadroom  int
+	VerifyNativeCompile  bool
+	NativeCodeBudget     int
+	NativeCompileTimeout time.Duration
+	NativeScanner        SequenceScanner
+	NativeBuilder        InstructionBuilder
+	NativeCache          io.Reader
+	NativeHugePages      bool
+	NativePrefault       bool
+	NativeStackGuard     bool
+	NativeStackBalance   bool
+	NativeLocalsGuard    bool
+	NativeAliasGuard     bool
+	NativeBreakpoints    bool
+	NativeProfiling      bool
+	NativeTracing        bool
+	NativeFusedMulAdd    bool
+	NativeCostModel      *CostModel
+	NativeScanWindow     int
+	NativeCompileFilter  func(fnIndex int64) bool
+	NativeCompileWorkers int
+	NativeCompileLazily  bool
 }
 
 // VMOptions describes a customization that can be applied to the VM.
@@ -146,6 +180,15 @@ func NewVMWithOptions(module *wasm.Module, opts ...VMOption) (*VM, error) {
 			totalLocalVars += int(entry.Count)
 		}
 		code, meta := compile.Compile(disassembly.Code)
+		if options.EnableAOT {
+			// Native code loads float locals into float registers.
+			meta.LocalTypes = append([]wasm.ValueType(nil), fn.Sig.ParamTypes...)
+			for _, entry := range fn.Body.Locals {
+				for j := uint32(0); j < entry.Count; j++ {
+					meta.LocalTypes = append(meta.LocalTypes, entry.Type)
+				}
+			}
+		}
 		vm.funcs[i] = compiledFunction{
 			codeMeta:       meta,
 			code:           code,
@@ -164,7 +207,7 @@ func NewVMWithOptions(module *wasm.Module, opts ...VMOption) (*VM, error) {
 		}
 		switch v := val.(type) {
 		case int32:
-			vm.globals[i] = uint64(v)
+			vm.globals[i] = uint64(uint32(v))
 		case int64:
 			vm.globals[i] = uint64(v)
 		case float32:
@@ -174,9 +217,46 @@ func NewVMWithOptions(module *wasm.Module, opts ...VMOption) (*VM, error) {
 		}
 	}
 
+	vm.opts = options
 	if options.EnableAOT {
 		supportedBackend, backend := nativeBackend()
 		if supportedBackend {
+			if s, ok := backend.Scanner.(costModelScanner); ok && options.NativeCostModel != nil {
+				s.SetCostModel(*options.NativeCostModel)
+			}
+			if s, ok := backend.Scanner.(scanWindowScanner); ok {
+				s.SetScanWindow(options.NativeScanWindow)
+			}
+			if options.NativeScanner != nil {
+				backend.Scanner = options.NativeScanner
+			}
+			if options.NativeBuilder != nil {
+				backend.Builder = options.NativeBuilder
+			}
+			if b, ok := backend.Builder.(stackGuardBuilder); ok {
+				b.SetGuardStack(options.NativeStackGuard)
+			}
+			if b, ok := backend.Builder.(stackBalanceBuilder); ok {
+				b.SetStackBalance(options.NativeStackBalance)
+			}
+			if b, ok := backend.Builder.(localsGuardBuilder); ok {
+				b.SetGuardLocals(options.NativeLocalsGuard)
+			}
+			if b, ok := backend.Builder.(breakpointBuilder); ok {
+				b.SetBreakpoints(options.NativeBreakpoints)
+			}
+			if b, ok := backend.Builder.(profilingBuilder); ok {
+				b.SetProfiling(options.NativeProfiling)
+			}
+			if b, ok := backend.Builder.(fusedMulAddBuilder); ok {
+				b.SetFusedMulAdd(options.NativeFusedMulAdd)
+			}
+			if a, ok := backend.allocator.(hugePageAllocator); ok {
+				a.SetHugePages(options.NativeHugePages)
+			}
+			if a, ok := backend.allocator.(prefaultAllocator); ok {
+				a.SetPrefault(options.NativePrefault)
+			}
 			vm.nativeBackend = backend
 			if err := vm.tryNativeCompile(); err != nil {
 				return nil, err
@@ -293,8 +373,11 @@ func (vm *VM) pushUint32(i uint32) {
 	vm.pushUint64(uint64(i))
 }
 
+// pushInt32 pushes i zero-extended, like every other i32 in a stack slot
+// or local, so the upper half of the slot is always clear. Native code
+// relies on the same representation.
 func (vm *VM) pushInt32(i int32) {
-	vm.pushUint64(uint64(i))
+	vm.pushUint64(uint64(uint32(i)))
 }
 
 func (vm *VM) pushFloat32(f float32) {
@@ -325,6 +408,7 @@ func (vm *VM) ExecCode(fnIndex int64, args ...uint64) (rtrn interface{}, err err
 	if len(vm.module.GetFunction(int(fnIndex)).Sig.ParamTypes) != len(args) {
 		return nil, ErrInvalidArgumentCount
 	}
+	vm.compileOnFirstCall(fnIndex)
 	compiled, ok := vm.funcs[fnIndex].(compiledFunction)
 	if !ok {
 		panic(fmt.Sprintf("exec: function at index %d is not a compiled function", fnIndex))
@@ -337,6 +421,7 @@ func (vm *VM) ExecCode(fnIndex int64, args ...uint64) (rtrn interface{}, err err
 	vm.ctx.code = compiled.code
 	vm.ctx.asm = compiled.asm
 	vm.ctx.curFunc = fnIndex
+	vm.nativeTrace = vm.nativeTrace[:0]
 
 	for i, arg := range args {
 		vm.ctx.locals[i] = arg
@@ -436,7 +521,11 @@ outer:
 
 		case ops.WagonNativeExec:
 			i := vm.fetchUint32()
+			vm.checkNativeBlock(i)
 			vm.nativeCodeInvocation(i)
+			if vm.opts.NativeTracing {
+				vm.nativeTrace = append(vm.nativeTrace, NativeTraceEntry{Func: vm.ctx.curFunc, Block: int(i), ResumePC: vm.ctx.pc})
+			}
 		default:
 			vm.funcTable[op]()
 		}
@@ -110,3 +110,18 @@ func TestWriteOffset(t *testing.T) {
 		t.Fatal("Writing at offset didn't work")
 	}
 }
+
+func TestLoadOffsetNoWrap(t *testing.T) {
+	// An address of 0x10 with an offset of 0xfffffff8 would wrap
+	// around to 8 in 32 bits, which is in bounds. It must trap instead.
+	vm := &VM{memory: make([]byte, 16)}
+	vm.ctx.code = []byte{0xf8, 0xff, 0xff, 0xff}
+	vm.ctx.stack = []uint64{0x10}
+
+	defer func() {
+		if r := recover(); r != ErrOutOfBoundsMemoryAccess {
+			t.Fatalf("recover() = %v, want %v", r, ErrOutOfBoundsMemoryAccess)
+		}
+	}()
+	vm.i64Load()
+}
@@ -28,3 +28,19 @@ func TestNew(t *testing.T) {
 		t.Fatalf("0xff: operator %v is valid (should be invalid)", op2)
 	}
 }
+
+func TestNewInternal(t *testing.T) {
+	if _, err := New(WagonNativeExec); err == nil {
+		t.Fatalf("%#x: expected error from New for internal opcode", WagonNativeExec)
+	}
+	op, err := NewInternal(WagonNativeExec)
+	if err != nil {
+		t.Fatalf("unexpected error from NewInternal: %v", err)
+	}
+	if op.Name != "wagon.nativeExec" || len(op.Args) != 0 {
+		t.Fatalf("%#x: unexpected Op %v", WagonNativeExec, op)
+	}
+	if _, err := NewInternal(Unreachable); err == nil {
+		t.Fatalf("0x00: expected error from NewInternal for non-internal opcode")
+	}
+}
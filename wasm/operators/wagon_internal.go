@@ -4,8 +4,6 @@
 
 package operators
 
-import "github.com/go-interpreter/wagon/wasm"
-
 // These opcodes implement optimizations in wagon execution, and are invalid
 // opcodes for any uses other than internal use. Expect them to change at any
 // time.
@@ -16,5 +14,22 @@ var (
 		WagonNativeExec: true,
 	}
 
-	WagonNativeExec = newOp(0xfe, "wagon.nativeExec", []wasm.ValueType{wasm.ValueTypeI64}, noReturn)
+	// WagonNativeExec takes no operands from the stack: the index of the
+	// native block it enters is a fixed-width immediate.
+	WagonNativeExec = newOp(0xfe, "wagon.nativeExec", nil, noReturn)
 )
+
+// WagonNativeExecImmediateSize is the size in bytes of the immediate of a
+// wagon.nativeExec instruction, the little-endian uint32 index of its
+// native block.
+const WagonNativeExecImmediateSize = 4
+
+// NewInternal returns the operator associated with one of wagon's internal
+// opcodes, which New rejects.
+func NewInternal(code byte) (Op, error) {
+	var op Op
+	if !internalOpcodes[code] {
+		return op, InvalidOpcodeError(code)
+	}
+	return ops[code], nil
+}